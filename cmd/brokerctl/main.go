@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/akkeris/s3-broker/pkg/broker"
+)
+
+// brokerctl talks to the admin api of a running broker, the broker is found with --url (or
+// BROKER_URL) and a bearer token for brokers using --authenticate-k8s-token can be given with
+// --token (or BROKER_TOKEN).
+var options struct {
+	Url   string
+	Token string
+	Json  bool
+}
+
+const usage = `Usage: brokerctl [--url <broker url>] [--token <token>] [--json] <command> [arguments]
+
+Commands:
+  instances [--status <status>] [--plan <plan id>]   List instances and unclaimed preprovisioned buckets
+  tasks <instance id> [--limit <count>]               List the recent tasks of an instance
+  failed [--limit <count>]                            List the most recent failed tasks
+  requeue <task id> [<task id> ...]                   Requeue failed tasks
+  pools                                               Show the health of each preprovisioned pool
+  pool <plan id> <count>                              Set the number of buckets preprovisioned for a plan
+  resync <instance id>                                Refresh an instance's status from its provider
+`
+
+func main() {
+	flag.StringVar(&options.Url, "url", os.Getenv("BROKER_URL"), "The url of the broker (e.g., https://s3-broker.example.com), you can also set BROKER_URL environment var.")
+	flag.StringVar(&options.Token, "token", os.Getenv("BROKER_TOKEN"), "A bearer token to send to the broker, you can also set BROKER_TOKEN environment var.")
+	flag.BoolVar(&options.Json, "json", false, "Print the broker's json responses rather than tables.")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if options.Url == "" {
+		options.Url = "http://localhost:8443"
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "brokerctl: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(command string, args []string) error {
+	switch command {
+	case "instances":
+		set := flag.NewFlagSet("instances", flag.ExitOnError)
+		status := set.String("status", "", "Only list instances with this status.")
+		plan := set.String("plan", "", "Only list instances on this plan.")
+		set.Parse(args)
+		var response struct {
+			Instances []broker.InstanceSummary `json:"instances"`
+		}
+		query := url.Values{}
+		if *status != "" {
+			query.Set("status", *status)
+		}
+		if *plan != "" {
+			query.Set("plan", *plan)
+		}
+		if err := request("GET", "/v2/admin/instances?"+query.Encode(), nil, &response); err != nil {
+			return err
+		}
+		if options.Json {
+			return printJson(response)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tPLAN\tSTATUS\tCLAIMED\tREGION\tALIAS\tCREATED")
+		for _, instance := range response.Instances {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t%s\t%s\n", instance.Id, instance.Name, instance.PlanId, instance.Status, instance.Claimed, instance.Region, instance.Alias, instance.Created.Format(time.RFC3339))
+		}
+		return w.Flush()
+	case "tasks", "failed":
+		set := flag.NewFlagSet(command, flag.ExitOnError)
+		limit := set.Int("limit", 25, "The most tasks to list.")
+		set.Parse(args)
+		path := "/v2/admin/tasks?status=failed&limit=" + strconv.Itoa(*limit)
+		if command == "tasks" {
+			if set.NArg() != 1 {
+				return errors.New("tasks needs an instance id")
+			}
+			path = "/v2/admin/instances/" + url.PathEscape(set.Arg(0)) + "/tasks?limit=" + strconv.Itoa(*limit)
+		}
+		var response struct {
+			Tasks []broker.Task `json:"tasks"`
+		}
+		if err := request("GET", path, nil, &response); err != nil {
+			return err
+		}
+		if options.Json {
+			return printJson(response)
+		}
+		return printTasks(response.Tasks)
+	case "requeue":
+		if len(args) == 0 {
+			return errors.New("requeue needs at least one task id")
+		}
+		for _, taskId := range args {
+			if err := request("POST", "/v2/admin/tasks/"+url.PathEscape(taskId)+"/requeue", nil, nil); err != nil {
+				return errors.New("unable to requeue " + taskId + ": " + err.Error())
+			}
+			fmt.Println("Requeued " + taskId)
+		}
+		return nil
+	case "pools":
+		var pools []broker.PoolHealth
+		if err := request("GET", "/v2/admin/pools", nil, &pools); err != nil {
+			return err
+		}
+		if options.Json {
+			return printJson(pools)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PLAN\tTARGET\tAVAILABLE\tPROVISIONING\tFAILED (DAY)\tTO PROVISION\tLAST FAILURE")
+		for _, pool := range pools {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%s\n", pool.PlanId, pool.Target, pool.Available, pool.Provisioning, pool.Failed, pool.ToProvision, pool.LastFailure)
+		}
+		return w.Flush()
+	case "pool":
+		if len(args) != 2 {
+			return errors.New("pool needs a plan id and a count")
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			return errors.New("the count must be zero or more")
+		}
+		if err = request("PUT", "/v2/admin/preprovision/"+url.PathEscape(args[0]), map[string]int{"preprovision": count}, nil); err != nil {
+			return err
+		}
+		fmt.Printf("The preprovision count of %s was set to %d\n", args[0], count)
+		return nil
+	case "resync":
+		if len(args) != 1 {
+			return errors.New("resync needs an instance id")
+		}
+		var response struct {
+			Task string `json:"task"`
+		}
+		if err := request("POST", "/v2/admin/instances/"+url.PathEscape(args[0])+"/resync", nil, &response); err != nil {
+			return err
+		}
+		fmt.Println("Scheduled resync task " + response.Task)
+		return nil
+	}
+	flag.Usage()
+	return errors.New("unknown command " + command)
+}
+
+func printTasks(tasks []broker.Task) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tACTION\tINSTANCE\tSTATUS\tRETRIES\tSTARTED\tFINISHED\tRESULT")
+	for _, task := range tasks {
+		started, finished := "", ""
+		if task.Started != nil {
+			started = task.Started.Format(time.RFC3339)
+		}
+		if task.Finished != nil {
+			finished = task.Finished.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", task.Id, task.Action, task.ResourceId, task.Status, task.Retries, started, finished, task.Result)
+	}
+	return w.Flush()
+}
+
+func printJson(obj interface{}) error {
+	data, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// Sends a request to the admin api, errors returned by the broker (its error description) are
+// returned as errors. The response is decoded into out when it's not nil.
+func request(method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, options.Url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Broker-API-Version", "2.14")
+	if options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+options.Token)
+	}
+	client := &http.Client{Timeout: time.Second * 30}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var failure struct {
+			Error       string `json:"error"`
+			Description string `json:"description"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&failure); err != nil || failure.Description == "" {
+			return errors.New("the broker responded with " + resp.Status)
+		}
+		return errors.New(failure.Description + " (" + failure.Error + ")")
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -103,6 +103,7 @@ func runWithContext(ctx context.Context) error {
 	reg := prom.NewRegistry()
 	osbMetrics := metrics.New()
 	reg.MustRegister(osbMetrics)
+	reg.MustRegister(broker.NewTaskMetricsCollector(businessLogic))
 
 	api, err := rest.NewAPISurface(businessLogic, osbMetrics)
 	if err != nil {
@@ -110,9 +111,16 @@ func runWithContext(ctx context.Context) error {
 	}
 
 	s := server.New(api, reg)
+	s.Router.Use(broker.RequestIdMiddleware)
+	s.Router.Use(broker.PredecessorBindingMiddleware)
+	s.Router.Use(broker.OIDCMiddleware)
 
 	businessLogic.RouteActions(s.Router)
 	broker.CrudeOSBIHacks(s.Router, businessLogic)
+	broker.AdminRoutes(s.Router, businessLogic)
+	broker.DashboardRoutes(s.Router, businessLogic)
+	broker.AdminDashboardRoutes(s.Router, businessLogic)
+	broker.OIDCRoutes(s.Router)
 
 	if options.AuthenticateK8SToken {
 		// get k8s client
@@ -176,7 +184,7 @@ func getKubernetesClient(kubeConfigPath string) (clientset.Interface, error) {
 }
 
 func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
-	term := make(chan os.Signal)
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
 	for {
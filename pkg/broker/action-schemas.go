@@ -0,0 +1,862 @@
+package broker
+
+// OpenAPI 3 operation objects describing each of the actions registered in NewBusinessLogic, these
+// are returned from the actions schema endpoint and listed in the catalog so that platforms can
+// render forms for them.
+
+const errorResponseSchema string = `{
+  "type": "object",
+  "properties": {
+    "error": { "type": "string" },
+    "description": { "type": "string" }
+  }
+}`
+
+const taskResponseSchema string = `{
+  "type": "object",
+  "properties": {
+    "task": { "type": "string", "description": "The id of the task that will perform the action." },
+    "status": { "type": "string", "enum": [ "pending" ] }
+  }
+}`
+
+const lifecycleSchema string = `{
+  "type": "object",
+  "properties": {
+    "rules": {
+      "type": "array",
+      "description": "The S3 lifecycle rules, an empty list removes the lifecycle configuration.",
+      "items": {
+        "type": "object",
+        "required": [ "ID", "Status" ],
+        "properties": {
+          "ID": { "type": "string" },
+          "Status": { "type": "string", "enum": [ "Enabled", "Disabled" ] },
+          "Filter": { "type": "object" },
+          "Expiration": { "type": "object" },
+          "Transitions": { "type": "array", "items": { "type": "object" } },
+          "NoncurrentVersionExpiration": { "type": "object" },
+          "NoncurrentVersionTransitions": { "type": "array", "items": { "type": "object" } },
+          "AbortIncompleteMultipartUpload": { "type": "object" }
+        }
+      }
+    }
+  }
+}`
+
+var rotateCredentialsActionSchema string = `{
+  "summary": "Rotate credentials",
+  "description": "Creates a new access key for the bucket and removes the previous one.",
+  "responses": {
+    "200": {
+      "description": "The new credentials.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "ARN": { "type": "string" },
+              "UserName": { "type": "string" },
+              "AccessKeyId": { "type": "string" },
+              "SecretAccessKey": { "type": "string" }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var aliasActionSchema string = `{
+  "summary": "Set alias",
+  "description": "Sets a human readable alias for the bucket, it's returned in the credentials of bindings as S3_BUCKET_ALIAS. An empty alias removes it.",
+  "requestBody": {
+    "required": true,
+    "content": {
+      "application/json": {
+        "schema": {
+          "type": "object",
+          "required": [ "alias" ],
+          "properties": {
+            "alias": { "type": "string", "maxLength": 63, "pattern": "^([A-Za-z0-9][A-Za-z0-9 ._-]*)?$" }
+          }
+        }
+      }
+    }
+  },
+  "responses": {
+    "200": {
+      "description": "The alias was set.",
+      "content": { "application/json": { "schema": { "type": "object", "properties": { "alias": { "type": "string" } } } } }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The alias was invalid.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var rotationsActionSchema string = `{
+  "summary": "Get credential rotations",
+  "description": "Returns the credential rotations of the bucket (the access keys replaced and who rotated them), most recent first.",
+  "responses": {
+    "200": {
+      "description": "The credential rotations.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "rotations": {
+                "type": "array",
+                "items": {
+                  "type": "object",
+                  "properties": {
+                    "old_access_key_id": { "type": "string" },
+                    "new_access_key_id": { "type": "string" },
+                    "actor": { "type": "string", "description": "The originating identity of the request that rotated the credentials." },
+                    "request_id": { "type": "string" },
+                    "created": { "type": "string", "format": "date-time" }
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var accessKeysActionSchema string = `{
+  "summary": "Get access keys",
+  "description": "Returns the access keys of the bucket's user with when (and with which service) each was last used and the bindings given it, so dormant credentials can be found.",
+  "responses": {
+    "200": {
+      "description": "The access keys.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "access_keys": {
+                "type": "array",
+                "items": {
+                  "type": "object",
+                  "properties": {
+                    "access_key_id": { "type": "string" },
+                    "status": { "type": "string", "enum": ["Active", "Inactive"] },
+                    "created": { "type": "string", "format": "date-time" },
+                    "last_used": { "type": "string", "format": "date-time", "description": "Left out if the key has never been used." },
+                    "last_used_service": { "type": "string" },
+                    "last_used_region": { "type": "string" },
+                    "instance_key": { "type": "boolean", "description": "Whether this is the instance's own key rather than one kept by a rotated binding." },
+                    "bindings": { "type": "array", "items": { "type": "string" } },
+                    "reactivated": { "type": "string", "format": "date-time", "description": "When the key was last reactivated after being deactivated for being unused." },
+                    "idle_days": { "type": "integer", "description": "The days since the key was last used, created or reactivated." }
+                  }
+                }
+              },
+              "dormant_days": { "type": "integer", "description": "Keys idle for this many days are reported as dormant by the access key audit." }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var reactivateAccessKeyActionSchema string = `{
+  "summary": "Reactivate an access key",
+  "description": "Reactivates an access key that was deactivated for being unused. The key is not deactivated again until it has gone unused for the plan's days since it was reactivated.",
+  "responses": {
+    "200": {
+      "description": "The reactivated access key.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "access_key_id": { "type": "string" },
+              "status": { "type": "string", "enum": ["Active", "Inactive"] },
+              "created": { "type": "string", "format": "date-time" },
+              "last_used": { "type": "string", "format": "date-time" },
+              "instance_key": { "type": "boolean" },
+              "bindings": { "type": "array", "items": { "type": "string" } },
+              "reactivated": { "type": "string", "format": "date-time" },
+              "idle_days": { "type": "integer" }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance or access key was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var purgeActionSchema string = `{
+  "summary": "Purge bucket contents",
+  "description": "Removes every object (and object version) from the bucket. This cannot be undone.",
+  "parameters": [
+    {
+      "name": "confirm",
+      "in": "query",
+      "required": true,
+      "description": "The name of the bucket, required to confirm the purge.",
+      "schema": { "type": "string" }
+    }
+  ],
+  "responses": {
+    "200": { "description": "The purge was scheduled.", "content": { "application/json": { "schema": ` + taskResponseSchema + ` } } },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The confirmation did not match the bucket name.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var policiesActionSchema string = `{
+  "summary": "Get policies",
+  "description": "Returns the bucket policy and the policy attached to the bucket's user.",
+  "responses": {
+    "200": {
+      "description": "The effective policies.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "bucket_policy": { "type": "object" },
+              "user_policy": { "type": "object" }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var temporaryCredentialsActionSchema string = `{
+  "summary": "Issue temporary credentials",
+  "description": "Issues short lived credentials scoped to the bucket.",
+  "parameters": [
+    {
+      "name": "read_only",
+      "in": "query",
+      "required": false,
+      "description": "Set to true to only allow reading and listing objects.",
+      "schema": { "type": "boolean", "default": false }
+    },
+    {
+      "name": "prefix",
+      "in": "query",
+      "required": false,
+      "description": "Limits the credentials to keys starting with this prefix.",
+      "schema": { "type": "string" }
+    },
+    {
+      "name": "duration",
+      "in": "query",
+      "required": false,
+      "description": "How long (in seconds) the credentials are valid for.",
+      "schema": { "type": "integer", "minimum": 900, "maximum": 43200, "default": 3600 }
+    }
+  ],
+  "responses": {
+    "200": {
+      "description": "The temporary credentials.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "S3_ACCESS_KEY": { "type": "string" },
+              "S3_SECRET_KEY": { "type": "string" },
+              "S3_SESSION_TOKEN": { "type": "string" },
+              "S3_BUCKET": { "type": "string" },
+              "expiration": { "type": "string", "format": "date-time" },
+              "prefix": { "type": "string" },
+              "read_only": { "type": "boolean" }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The duration was invalid.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var getLifecycleActionSchema string = `{
+  "summary": "Get lifecycle rules",
+  "description": "Returns the lifecycle rules configured on the bucket.",
+  "responses": {
+    "200": { "description": "The lifecycle rules.", "content": { "application/json": { "schema": ` + lifecycleSchema + ` } } },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var setLifecycleActionSchema string = `{
+  "summary": "Replace lifecycle rules",
+  "description": "Replaces the lifecycle rules configured on the bucket.",
+  "requestBody": {
+    "required": true,
+    "content": { "application/json": { "schema": ` + lifecycleSchema + ` } }
+  },
+  "responses": {
+    "200": { "description": "The lifecycle rules that were applied.", "content": { "application/json": { "schema": ` + lifecycleSchema + ` } } },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The lifecycle rules were invalid.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var backupActionSchema string = `{
+  "summary": "Backup bucket",
+  "description": "Copies the current contents of the bucket to the archive bucket.",
+  "responses": {
+    "200": {
+      "description": "The backup was scheduled.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "backup": { "type": "string", "description": "The id of the backup, this is used to restore it." },
+              "task": { "type": "string" },
+              "status": { "type": "string", "enum": [ "pending" ] }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var backupsActionSchema string = `{
+  "summary": "Get backups",
+  "description": "Lists the on-demand backups of the bucket in the archive bucket, newest first. Available backups can be restored by their id.",
+  "responses": {
+    "200": {
+      "description": "The backups.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "backups": {
+                "type": "array",
+                "items": {
+                  "type": "object",
+                  "properties": {
+                    "id": { "type": "string" },
+                    "instance_id": { "type": "string" },
+                    "name": { "type": "string" },
+                    "kind": { "type": "string", "enum": [ "on-demand", "deprovision" ] },
+                    "status": { "type": "string", "enum": [ "pending", "available", "failed" ] },
+                    "objects": { "type": "integer" },
+                    "bytes": { "type": "integer" },
+                    "created": { "type": "string", "format": "date-time" },
+                    "finished": { "type": "string", "format": "date-time" }
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var restorePointsActionSchema string = `{
+  "summary": "Get restore points",
+  "description": "Lists the backups taken automatically by the backup plan of the instance, on-demand backups are not included.",
+  "responses": {
+    "200": {
+      "description": "The restore points.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "restore_points": {
+                "type": "array",
+                "items": {
+                  "type": "object",
+                  "properties": {
+                    "id": { "type": "string", "description": "The id of the restore point, this is used to restore it." },
+                    "created": { "type": "string", "format": "date-time" },
+                    "status": { "type": "string" },
+                    "bytes": { "type": "integer" }
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var restoreActionSchema string = `{
+  "summary": "Restore bucket",
+  "description": "Restores the bucket from an on-demand backup or a restore point. Objects in the backup overwrite the current objects, objects created since the backup are kept.",
+  "parameters": [
+    {
+      "name": "backup",
+      "in": "query",
+      "required": true,
+      "description": "The id of the on-demand backup (from the backups action) or restore point.",
+      "schema": { "type": "string" }
+    }
+  ],
+  "responses": {
+    "200": { "description": "The restore was scheduled.", "content": { "application/json": { "schema": ` + taskResponseSchema + ` } } },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The backup was not specified, is not of this instance or is not available.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var usageActionSchema string = `{
+  "summary": "Get usage",
+  "description": "Returns the recorded storage and request usage of the bucket, most recent first.",
+  "responses": {
+    "200": {
+      "description": "The recorded usage.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "usage": {
+                "type": "array",
+                "items": {
+                  "type": "object",
+                  "properties": {
+                    "resource": { "type": "string" },
+                    "start": { "type": "string", "format": "date-time" },
+                    "end": { "type": "string", "format": "date-time" },
+                    "bytes": { "type": "integer", "description": "The bytes stored at the end of the period." },
+                    "objects": { "type": "integer", "description": "The objects stored at the end of the period." },
+                    "requests": { "type": "integer", "description": "The requests made during the period." }
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var storageQuotaActionSchema string = `{
+  "summary": "Get storage quota",
+  "description": "Returns the storage quota of the plan and the size of the bucket when it was last metered. Buckets over their quota are exceeded, on plans that enforce their quota writes are blocked once the bucket is well over it.",
+  "responses": {
+    "200": {
+      "description": "The storage quota.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "storage_quota": {
+                "type": "object",
+                "properties": {
+                  "instance_id": { "type": "string" },
+                  "quota_bytes": { "type": "integer", "description": "The plan's quota, 0 if it has none." },
+                  "bytes": { "type": "integer", "description": "The bytes stored when the bucket was last metered." },
+                  "status": { "type": "string", "enum": [ "ok", "exceeded", "blocked" ] },
+                  "updated": { "type": "string", "format": "date-time" }
+                }
+              },
+              "enforced": { "type": "boolean" }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var alertSchema string = `{
+  "type": "object",
+  "properties": {
+    "id": { "type": "string" },
+    "instance_id": { "type": "string" },
+    "metric": { "type": "string", "enum": [ "bytes", "objects", "requests" ] },
+    "threshold": { "type": "integer" },
+    "webhook": { "type": "string" },
+    "triggered": { "type": "string", "format": "date-time", "description": "When the webhook was last sent, this is cleared once the usage is back under the threshold." },
+    "created": { "type": "string", "format": "date-time" }
+  }
+}`
+
+var addAlertActionSchema string = `{
+  "summary": "Add alert",
+  "description": "Adds a threshold on the bytes or objects stored in the bucket or its requests per metering period. When the metered usage goes over the threshold the webhook is sent a json body with a state of alert and a description, signed with the secret (by default a base64 hmac-sha256 in the x-osb-signature header).",
+  "requestBody": {
+    "required": true,
+    "content": {
+      "application/json": {
+        "schema": {
+          "type": "object",
+          "required": [ "metric", "threshold", "webhook", "secret" ],
+          "properties": {
+            "metric": { "type": "string", "enum": [ "bytes", "objects", "requests" ] },
+            "threshold": { "type": "integer", "minimum": 1 },
+            "webhook": { "type": "string" },
+            "secret": { "type": "string" }
+          }
+        }
+      }
+    }
+  },
+  "responses": {
+    "200": { "description": "The alert that was added.", "content": { "application/json": { "schema": ` + alertSchema + ` } } },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The alert was invalid.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var alertsActionSchema string = `{
+  "summary": "Get alerts",
+  "description": "Lists the alerts of the bucket.",
+  "responses": {
+    "200": {
+      "description": "The alerts.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "alerts": { "type": "array", "items": ` + alertSchema + ` }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var removeAlertActionSchema string = `{
+  "summary": "Remove alert",
+  "description": "Removes an alert of the bucket by its id.",
+  "responses": {
+    "200": {
+      "description": "The alert was removed.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "alert": { "type": "string" },
+              "status": { "type": "string", "enum": [ "removed" ] }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance or alert was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var freezeActionSchema string = `{
+  "summary": "Freeze",
+  "description": "Makes the bucket read only by denying its user any change to objects, e.g., during incident response or a data migration. With the bucket_policy query parameter set to true the bucket policy denies changes to anyone as well. Frozen instances can't be deprovisioned.",
+  "parameters": [
+    { "name": "bucket_policy", "in": "query", "required": false, "schema": { "type": "boolean" } }
+  ],
+  "responses": {
+    "200": {
+      "description": "The bucket was frozen.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "status": { "type": "string", "enum": [ "frozen" ] },
+              "bucket_policy": { "type": "boolean" }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The instance is being changed.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var unfreezeActionSchema string = `{
+  "summary": "Unfreeze",
+  "description": "Allows changes to the bucket's objects again, removing the statements added to the user's and bucket's policies by freeze.",
+  "responses": {
+    "200": {
+      "description": "The bucket was unfrozen.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "status": { "type": "string", "enum": [ "unfrozen" ] },
+              "bucket_policy": { "type": "boolean" }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The instance is being changed.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var policyVersionSchema string = `{
+  "type": "object",
+  "properties": {
+    "id": { "type": "string" },
+    "instance_id": { "type": "string" },
+    "policy": { "type": "string", "description": "The bucket policy document, empty if the bucket had no policy." },
+    "reason": { "type": "string" },
+    "created": { "type": "string", "format": "date-time" }
+  }
+}`
+
+var policyHistoryActionSchema string = `{
+  "summary": "Get bucket policy history",
+  "description": "Lists every bucket policy the broker has applied to the bucket, newest (the current policy) first.",
+  "responses": {
+    "200": {
+      "description": "The policy versions.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "versions": { "type": "array", "items": ` + policyVersionSchema + ` }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var rollbackPolicyActionSchema string = `{
+  "summary": "Roll back bucket policy",
+  "description": "Applies a previous version of the bucket policy by its id, the current policy is kept in the history.",
+  "responses": {
+    "200": {
+      "description": "The policy was rolled back.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "version": { "type": "string" },
+              "status": { "type": "string", "enum": [ "rolled back" ] }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance or policy version was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The instance is being changed.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var costActionSchema string = `{
+  "summary": "Estimate monthly cost",
+  "description": "Estimates the monthly cost (in US cents) of the bucket from its plan and the most recently measured storage.",
+  "responses": {
+    "200": {
+      "description": "The cost estimate.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "plan_cents": { "type": "integer" },
+              "storage_cents": { "type": "integer" },
+              "total_cents": { "type": "integer" },
+              "bytes": { "type": "integer" },
+              "measured_at": { "type": "string", "format": "date-time" }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var scanActionSchema string = `{
+  "summary": "Scan for sensitive data",
+  "description": "Starts a Macie classification job that scans the objects in the bucket for sensitive data, the results are available from the findings action once it completes.",
+  "responses": {
+    "200": {
+      "description": "The scan was started.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "job_id": { "type": "string" },
+              "created": { "type": "string", "format": "date-time" }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var findingsActionSchema string = `{
+  "summary": "Get sensitive data findings",
+  "description": "Summarizes the sensitive data found in the bucket by scans, counted by severity and by finding type.",
+  "responses": {
+    "200": {
+      "description": "The findings summary.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "total": { "type": "integer" },
+              "by_severity": { "type": "object", "additionalProperties": { "type": "integer" } },
+              "by_type": { "type": "object", "additionalProperties": { "type": "integer" } }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var transferOwnershipActionSchema string = `{
+  "summary": "Transfer object ownership",
+  "description": "Starts an S3 Batch Operations job that copies every object in the bucket onto itself so the broker's account owns it, for buckets that were adopted or that other accounts uploaded objects to. The progress is returned by the ownership action.",
+  "responses": {
+    "200": { "description": "The transfer was scheduled (or one already was).", "content": { "application/json": { "schema": ` + taskResponseSchema + ` } } },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var applyLegalHoldActionSchema string = `{
+  "summary": "Apply legal hold",
+  "description": "Starts an S3 Batch Operations job that places a legal hold on every object under the prefix (or in the whole bucket), objects with a legal hold can't be deleted or overwritten until it's removed. Only available on plans with object lock, the progress is returned by the legal_hold action and the hold is recorded in the instance's event history.",
+  "parameters": [
+    { "name": "prefix", "in": "query", "required": false, "schema": { "type": "string" } }
+  ],
+  "responses": {
+    "200": { "description": "The legal hold was scheduled.", "content": { "application/json": { "schema": ` + taskResponseSchema + ` } } },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The plan has no object lock or another legal hold is being set.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var removeLegalHoldActionSchema string = `{
+  "summary": "Remove legal hold",
+  "description": "Starts an S3 Batch Operations job that removes the legal hold from every object under the prefix (or in the whole bucket).",
+  "parameters": [
+    { "name": "prefix", "in": "query", "required": false, "schema": { "type": "string" } }
+  ],
+  "responses": {
+    "200": { "description": "The removal was scheduled.", "content": { "application/json": { "schema": ` + taskResponseSchema + ` } } },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The plan has no object lock or another legal hold is being set.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var legalHoldActionSchema string = `{
+  "summary": "Get legal hold job",
+  "description": "Returns the progress of the batch job of the last legal hold applied or removed. Until the job is started the task is returned instead.",
+  "responses": {
+    "200": { "description": "The batch job (or the task that starts it).", "content": { "application/json": { "schema": ` + batchJobSchema + ` } } },
+    "404": { "description": "The instance was not found or no legal hold was set.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var batchJobSchema string = `{
+  "type": "object",
+  "properties": {
+    "job_id": { "type": "string" },
+    "created": { "type": "string", "format": "date-time" },
+    "status": { "type": "string" },
+    "objects": { "type": "integer" },
+    "succeeded": { "type": "integer" },
+    "failed": { "type": "integer" },
+    "task": { "type": "string" },
+    "result": { "type": "string" }
+  }
+}`
+
+var ownershipActionSchema string = `{
+  "summary": "Get object ownership transfer",
+  "description": "Returns the progress of the last ownership transfer. Until its batch job is started the task is returned instead.",
+  "responses": {
+    "200": { "description": "The batch job (or the task that starts it).", "content": { "application/json": { "schema": ` + batchJobSchema + ` } } },
+    "404": { "description": "The instance was not found or no transfer was scheduled.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
+
+var replicationActionSchema string = `{
+  "summary": "Get replication health",
+  "description": "Returns the replication rules of the bucket and the last hour of their replication metrics (latency, pending and failed operations), to verify the disaster recovery copy is current. Metrics are only reported for rules with replication metrics enabled.",
+  "parameters": [
+    {
+      "name": "max_latency",
+      "in": "query",
+      "required": false,
+      "description": "The replication latency (in seconds) above which the replication isn't healthy.",
+      "schema": { "type": "number", "default": 900 }
+    }
+  ],
+  "responses": {
+    "200": {
+      "description": "The replication health.",
+      "content": {
+        "application/json": {
+          "schema": {
+            "type": "object",
+            "properties": {
+              "enabled": { "type": "boolean" },
+              "healthy": { "type": "boolean" },
+              "max_latency_seconds": { "type": "number" },
+              "rules": {
+                "type": "array",
+                "items": {
+                  "type": "object",
+                  "properties": {
+                    "rule_id": { "type": "string" },
+                    "status": { "type": "string", "enum": [ "Enabled", "Disabled" ] },
+                    "prefix": { "type": "string" },
+                    "destination": { "type": "string" },
+                    "metrics_enabled": { "type": "boolean" },
+                    "latency_seconds": { "type": "number" },
+                    "pending_operations": { "type": "integer" },
+                    "pending_bytes": { "type": "integer" },
+                    "failed_operations": { "type": "integer", "description": "Operations that failed to replicate in the last hour." },
+                    "updated": { "type": "string", "format": "date-time" }
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "404": { "description": "The instance was not found.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } },
+    "422": { "description": "The bucket is not replicated or max_latency is invalid.", "content": { "application/json": { "schema": ` + errorResponseSchema + ` } } }
+  }
+}`
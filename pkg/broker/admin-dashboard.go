@@ -0,0 +1,235 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The operator dashboard is only served when ADMIN_DASHBOARD_PASSWORD is set, it's reached at /admin
+// with the user admin and this password (basic auth). When OIDC is enabled (see GetOIDCEnabled) users
+// log in with the issuer instead and no password is needed.
+func GetAdminDashboardPassword() string {
+	return os.Getenv("ADMIN_DASHBOARD_PASSWORD")
+}
+
+// Forms on the dashboard carry a token derived from the password (or the OIDC client secret), so other
+// sites can't submit them with the browser's saved credentials.
+func adminDashboardFormToken() string {
+	secret := GetAdminDashboardPassword()
+	if GetOIDCEnabled() {
+		secret = os.Getenv("OIDC_CLIENT_SECRET")
+	}
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte("admin-dashboard"))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func adminDashboardAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	password := GetAdminDashboardPassword()
+	if password == "" && !GetOIDCEnabled() {
+		http.NotFound(w, r)
+		return false
+	}
+	user, given, ok := r.BasicAuth()
+	if !GetOIDCEnabled() && (!ok || user != "admin" || subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="s3-broker"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if r.Method == "POST" && !hmac.Equal([]byte(r.PostFormValue("token")), []byte(adminDashboardFormToken())) {
+		http.Error(w, "The form has expired, reload the page.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+type adminDashboardPlan struct {
+	Id            string
+	Name          string
+	Service       string
+	Organizations string
+	Problems      []string
+	Pool          *PoolHealth
+}
+
+type adminDashboardPage struct {
+	Token   string
+	Plans   []adminDashboardPlan
+	Tasks   []Task
+	Message string
+	Error   string
+}
+
+var adminDashboardTemplate = template.Must(template.New("admin").Parse(`<!doctype html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>s3-broker</title>
+  <style>
+    body { font-family: sans-serif; margin: 2em; color: #222; }
+    table { border-collapse: collapse; margin-bottom: 1.5em; }
+    td, th { padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; text-align: left; vertical-align: top; }
+    .done { background: #e6f4ea; padding: 0.5em; }
+    .error, .problem { background: #fce8e6; padding: 0.5em; }
+    .low { color: #b3261e; font-weight: bold; }
+    input[type=number] { width: 5em; }
+  </style>
+</head>
+<body>
+  <h1>s3-broker</h1>
+  {{if .Message}}<p class="done">{{.Message}}</p>{{end}}
+  {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+  <h2>Plans and preprovisioned pools</h2>
+  <table>
+    <tr><th>Plan</th><th>Available</th><th>Provisioning</th><th>Failed (last day)</th><th>Preprovision</th><th>Organizations</th></tr>
+    {{range .Plans}}<tr>
+      <td>{{.Service}}:{{.Name}}<br><small>{{.Id}}</small>{{range .Problems}}<div class="problem">{{.}}</div>{{end}}</td>
+      {{if .Pool}}<td{{if lt .Pool.Available .Pool.Target}} class="low"{{end}}>{{.Pool.Available}} of {{.Pool.Target}}</td><td>{{.Pool.Provisioning}}</td><td>{{.Pool.Failed}}{{if .Pool.LastFailure}}<br><small>{{.Pool.LastFailure}}</small>{{end}}</td>{{else}}<td></td><td></td><td></td>{{end}}
+      <td><form method="post" action="/admin/pools/{{.Id}}"><input type="hidden" name="token" value="{{$.Token}}"><input type="number" min="0" name="preprovision" value="{{if .Pool}}{{.Pool.Target}}{{else}}0{{end}}"> <button type="submit">Set</button></form></td>
+      <td><form method="post" action="/admin/plans/{{.Id}}/organizations"><input type="hidden" name="token" value="{{$.Token}}"><input type="text" name="organizations" value="{{.Organizations}}" placeholder="everyone"> <button type="submit">Set</button></form></td>
+    </tr>{{end}}
+  </table>
+  <h2>Failed tasks</h2>
+  <table>
+    <tr><th>Task</th><th>Action</th><th>Instance</th><th>Retries</th><th>Finished</th><th>Result</th><th></th></tr>
+    {{range .Tasks}}<tr><td><small>{{.Id}}</small></td><td>{{.Action}}</td><td>{{.ResourceId}}</td><td>{{.Retries}}</td><td>{{if .Finished}}{{.Finished.Format "2006-01-02 15:04"}}{{end}}</td><td>{{.Result}}</td>
+      <td><form method="post" action="/admin/tasks/{{.Id}}/requeue"><input type="hidden" name="token" value="{{$.Token}}"><button type="submit">Requeue</button></form></td></tr>{{else}}<tr><td colspan="7">No failed tasks.</td></tr>{{end}}
+  </table>
+</body>
+</html>
+`))
+
+// Changes made from the dashboard redirect back to it with a message (or error) to show, so reloading
+// the page doesn't make the change again.
+func adminDashboardRedirect(w http.ResponseWriter, r *http.Request, kind string, message string) {
+	http.Redirect(w, r, "/admin?"+kind+"="+url.QueryEscape(message), http.StatusSeeOther)
+}
+
+func (b *BusinessLogic) renderAdminDashboard(w http.ResponseWriter, message string, failure string) {
+	page := adminDashboardPage{Token: adminDashboardFormToken(), Plans: make([]adminDashboardPlan, 0), Message: message, Error: failure}
+	services, err := b.storage.GetServices()
+	if err != nil {
+		glog.Errorf("Unable to get the services for the admin dashboard: %s\n", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	pools, err := b.storage.GetPoolHealth()
+	if err != nil {
+		glog.Errorf("Unable to get the pool health for the admin dashboard: %s\n", err.Error())
+	}
+	organizations, err := b.storage.GetPlanOrganizations()
+	if err != nil {
+		glog.Errorf("Unable to get the plan organizations for the admin dashboard: %s\n", err.Error())
+	}
+	validations, err := b.ValidatePlans()
+	if err != nil {
+		glog.Errorf("Unable to validate the plans for the admin dashboard: %s\n", err.Error())
+	}
+	for _, service := range services {
+		for _, plan := range service.Plans {
+			row := adminDashboardPlan{Id: plan.ID, Name: plan.Name, Service: service.Name, Organizations: strings.Join(organizations[plan.ID], ", ")}
+			for i := range pools {
+				if pools[i].PlanId == plan.ID {
+					row.Pool = &pools[i]
+				}
+			}
+			for _, validation := range validations {
+				if validation.PlanId == plan.ID {
+					row.Problems = validation.Problems
+				}
+			}
+			page.Plans = append(page.Plans, row)
+		}
+	}
+	if page.Tasks, err = b.storage.GetTasksByStatus("failed", 50); err != nil {
+		glog.Errorf("Unable to get the failed tasks for the admin dashboard: %s\n", err.Error())
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err = adminDashboardTemplate.Execute(w, page); err != nil {
+		glog.Errorf("Unable to render the admin dashboard: %s\n", err.Error())
+	}
+}
+
+// Serves the operator dashboard (see GetAdminDashboardPassword), it lists the preprovisioned pools,
+// plans and failed tasks and makes the same changes as the admin api.
+func AdminDashboardRoutes(router *mux.Router, b *BusinessLogic) {
+	router.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		if !adminDashboardAuthorized(w, r) {
+			return
+		}
+		b.renderAdminDashboard(w, r.URL.Query().Get("message"), r.URL.Query().Get("error"))
+	}).Methods("GET")
+
+	router.HandleFunc("/admin/pools/{plan_id}", func(w http.ResponseWriter, r *http.Request) {
+		if !adminDashboardAuthorized(w, r) {
+			return
+		}
+		planId := mux.Vars(r)["plan_id"]
+		count, err := strconv.Atoi(r.PostFormValue("preprovision"))
+		if err != nil || count < 0 {
+			adminDashboardRedirect(w, r, "error", "The preprovision count must be zero or more.")
+			return
+		}
+		if err = b.storage.SetPreprovision(planId, count); err != nil && err.Error() == "Not found" {
+			adminDashboardRedirect(w, r, "error", "The plan was not found.")
+			return
+		} else if err != nil {
+			glog.Errorf("Unable to set the preprovision count of plan %s: %s\n", planId, err.Error())
+			adminDashboardRedirect(w, r, "error", "Unable to set the preprovision count of the plan.")
+			return
+		}
+		glog.Infof("The preprovision count of plan %s was set to %d from the admin dashboard (request: %s)\n", planId, count, r.Header.Get("x-request-id"))
+		adminDashboardRedirect(w, r, "message", "The preprovision count of "+planId+" was set to "+strconv.Itoa(count)+".")
+	}).Methods("POST")
+
+	router.HandleFunc("/admin/plans/{plan_id}/organizations", func(w http.ResponseWriter, r *http.Request) {
+		if !adminDashboardAuthorized(w, r) {
+			return
+		}
+		planId := mux.Vars(r)["plan_id"]
+		organizations := make([]string, 0)
+		for _, organization := range strings.Split(r.PostFormValue("organizations"), ",") {
+			if strings.TrimSpace(organization) != "" {
+				organizations = append(organizations, strings.TrimSpace(organization))
+			}
+		}
+		if err := b.storage.SetPlanOrganizations(planId, organizations); err != nil && err.Error() == "Not found" {
+			adminDashboardRedirect(w, r, "error", "The plan was not found.")
+			return
+		} else if err != nil {
+			glog.Errorf("Unable to set the organizations of plan %s: %s\n", planId, err.Error())
+			adminDashboardRedirect(w, r, "error", "Unable to set the organizations of the plan.")
+			return
+		}
+		glog.Infof("The organizations of plan %s were set to %v from the admin dashboard (request: %s)\n", planId, organizations, r.Header.Get("x-request-id"))
+		adminDashboardRedirect(w, r, "message", "The organizations of "+planId+" were updated.")
+	}).Methods("POST")
+
+	router.HandleFunc("/admin/tasks/{task_id}/requeue", func(w http.ResponseWriter, r *http.Request) {
+		if !adminDashboardAuthorized(w, r) {
+			return
+		}
+		taskId := mux.Vars(r)["task_id"]
+		if err := b.storage.RequeueTask(taskId); err != nil && err.Error() == "Not found" {
+			adminDashboardRedirect(w, r, "error", "The task was not found or has not failed.")
+			return
+		} else if err != nil {
+			glog.Errorf("Unable to requeue task %s: %s\n", taskId, err.Error())
+			adminDashboardRedirect(w, r, "error", "Unable to requeue the task.")
+			return
+		}
+		glog.Infof("Task %s was requeued from the admin dashboard (request: %s)\n", taskId, r.Header.Get("x-request-id"))
+		adminDashboardRedirect(w, r, "message", "Task "+taskId+" was requeued.")
+	}).Methods("POST")
+}
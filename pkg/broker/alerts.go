@@ -0,0 +1,66 @@
+package broker
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"strconv"
+)
+
+const (
+	AlertBytes    = "bytes"
+	AlertObjects  = "objects"
+	AlertRequests = "requests"
+)
+
+func IsAlertMetric(metric string) bool {
+	return metric == AlertBytes || metric == AlertObjects || metric == AlertRequests
+}
+
+func (alert *Alert) value(usage *Usage) int64 {
+	switch alert.Metric {
+	case AlertBytes:
+		return usage.Bytes
+	case AlertObjects:
+		return usage.Objects
+	case AlertRequests:
+		return usage.Requests
+	}
+	return 0
+}
+
+// Compares the metered usage of the instance with its alerts, the webhook of an alert is sent (with
+// up to 5 attempts) when the usage goes over its threshold. An alert is sent once until the usage
+// is back under its threshold.
+func CheckAlerts(storage Storage, Instance *Instance, usage *Usage) error {
+	alerts, err := storage.GetAlerts(Instance.Id)
+	if err != nil {
+		return err
+	}
+	for _, alert := range alerts {
+		value := alert.value(usage)
+		if value < alert.Threshold {
+			if alert.Triggered != nil {
+				if err = storage.SetAlertTriggered(alert.Id, false); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if alert.Triggered != nil {
+			continue
+		}
+		description := "The " + alert.Metric + " of " + Instance.Name + " (" + strconv.FormatInt(value, 10) + ") exceeded the alert threshold of " + strconv.FormatInt(alert.Threshold, 10) + "."
+		metadata, err := json.Marshal(WebhookTaskMetadata{Url: alert.Webhook, Secret: alert.Secret, MaxAttempts: 5, Description: description})
+		if err != nil {
+			return err
+		}
+		if _, err = storage.AddTask(Instance.Id, NotifyAlertWebhookTask, string(metadata), ""); err != nil {
+			return err
+		}
+		if err = storage.SetAlertTriggered(alert.Id, true); err != nil {
+			return err
+		}
+		glog.Infof("%s\n", description)
+	}
+	return nil
+}
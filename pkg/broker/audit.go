@@ -0,0 +1,310 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/golang/glog"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Access keys older than ACCESS_KEY_MAX_AGE_DAYS (90 by default) are reported as stale.
+func GetAccessKeyMaxAgeDays() int64 {
+	days, err := strconv.ParseInt(os.Getenv("ACCESS_KEY_MAX_AGE_DAYS"), 10, 64)
+	if err != nil || days < 1 {
+		return 90
+	}
+	return days
+}
+
+// ACCESS_KEY_AUTO_ROTATE is the most rotations an audit schedules (for the oldest keys first), by
+// default (0) stale keys are only reported.
+func GetAccessKeyAutoRotate() int {
+	rotations, err := strconv.Atoi(os.Getenv("ACCESS_KEY_AUTO_ROTATE"))
+	if err != nil || rotations < 0 {
+		return 0
+	}
+	return rotations
+}
+
+// Active access keys not used in ACCESS_KEY_DORMANT_DAYS (30 by default) are reported as dormant.
+func GetAccessKeyDormantDays() int64 {
+	days, err := strconv.ParseInt(os.Getenv("ACCESS_KEY_DORMANT_DAYS"), 10, 64)
+	if err != nil || days < 1 {
+		return 30
+	}
+	return days
+}
+
+// Active access keys not used in this many days are deactivated by the audit, plans may set their
+// own number of days with the disable-unused-keys-days attribute, otherwise ACCESS_KEY_DISABLE_DAYS
+// is used. 0 (the default) never deactivates keys.
+func GetAccessKeyDisableDays(plan *ProviderPlan) (int64, error) {
+	days, err := strconv.ParseInt(os.Getenv("ACCESS_KEY_DISABLE_DAYS"), 10, 64)
+	if err != nil || days < 0 {
+		days = 0
+	}
+	return planAttributeNumber(plan, "disable-unused-keys-days", days, "a number of days")
+}
+
+func ValidateAccessKeyAttributes(plan *ProviderPlan) []string {
+	problems := make([]string, 0)
+	if _, err := GetAccessKeyDisableDays(plan); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// The audit is run once every ACCESS_KEY_AUDIT_INTERVAL (e.g., 12h), this defaults to a day.
+func GetAccessKeyAuditInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("ACCESS_KEY_AUDIT_INTERVAL"))
+	if err != nil || interval < time.Hour {
+		return time.Hour * 24
+	}
+	return interval
+}
+
+// StaleAccessKey is an access key older than the maximum age, InstanceKey is false for the key
+// kept by the predecessor of a rotated binding (which is removed when the predecessor is unbound).
+type StaleAccessKey struct {
+	InstanceId   string `json:"instance_id"`
+	Name         string `json:"name"`
+	AccessKeyId  string `json:"access_key_id"`
+	InstanceKey  bool   `json:"instance_key"`
+	AgeDays      int64  `json:"age_days"`
+	RotationTask string `json:"rotation_task,omitempty"`
+}
+
+// DormantAccessKey is an active access key that hasn't been used (or was never used) in the
+// dormant days, with the bindings given it.
+type DormantAccessKey struct {
+	InstanceId  string     `json:"instance_id"`
+	Name        string     `json:"name"`
+	AccessKeyId string     `json:"access_key_id"`
+	InstanceKey bool       `json:"instance_key"`
+	Bindings    []string   `json:"bindings"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+	IdleDays    int64      `json:"idle_days"`
+	Deactivated bool       `json:"deactivated"`
+}
+
+type AccessKeyAudit struct {
+	MaxAgeDays  int64              `json:"max_age_days"`
+	DormantDays int64              `json:"dormant_days"`
+	Instances   int                `json:"instances"`
+	Keys        int                `json:"keys"`
+	Failed      int                `json:"failed"`
+	OldestDays  int64              `json:"oldest_days"`
+	Rotations   int                `json:"rotations_scheduled"`
+	Deactivated int                `json:"deactivated"`
+	Stale       []StaleAccessKey   `json:"stale"`
+	Dormant     []DormantAccessKey `json:"dormant"`
+	Created     time.Time          `json:"created"`
+}
+
+// AccessKeyUsage is an access key of an instance with when it was last used and the bindings that
+// were given it, InstanceKey is true for the instance's own key.
+type AccessKeyUsage struct {
+	AccessKey
+	InstanceKey bool       `json:"instance_key"`
+	Bindings    []string   `json:"bindings"`
+	Reactivated *time.Time `json:"reactivated,omitempty"`
+	IdleDays    int64      `json:"idle_days"`
+}
+
+// Gets the access keys of the instance's user with their last use and the bindings using each.
+func GetAccessKeyUsage(storage Storage, provider Provider, Instance *Instance) ([]AccessKeyUsage, error) {
+	keys, err := provider.GetAccessKeys(Instance)
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := storage.GetAccessKeyBindings(Instance.Id)
+	if err != nil {
+		return nil, err
+	}
+	reactivations, err := storage.GetKeyReactivations(Instance.Id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	usages := make([]AccessKeyUsage, 0)
+	for _, key := range keys {
+		bound := bindings[key.AccessKeyId]
+		if bound == nil {
+			bound = make([]string, 0)
+		}
+		var reactivated *time.Time
+		if when, ok := reactivations[key.AccessKeyId]; ok {
+			reactivated = &when
+		}
+		usages = append(usages, AccessKeyUsage{
+			AccessKey:   key,
+			InstanceKey: key.AccessKeyId == Instance.Username,
+			Bindings:    bound,
+			Reactivated: reactivated,
+			IdleDays:    key.IdleDays(now, reactivated),
+		})
+	}
+	return usages, nil
+}
+
+// Deactivates an access key that hasn't been used in the given days, the deactivation is recorded
+// in the instance's events, published and sent to the owner's webhook. The key can be reactivated
+// with the reactivate_access_key action.
+func DeactivateAccessKey(storage Storage, provider Provider, Instance *Instance, AccessKeyId string, IdleDays int64) error {
+	if err := provider.SetAccessKeyStatus(Instance, AccessKeyId, false); err != nil {
+		return err
+	}
+	metadata, err := json.Marshal(map[string]interface{}{"access_key_id": AccessKeyId, "idle_days": IdleDays})
+	if err != nil {
+		glog.Errorf("Unable to marshal the deactivation of %s: %s\n", AccessKeyId, err.Error())
+	}
+	description := "The access key " + AccessKeyId + " was deactivated after " + strconv.FormatInt(IdleDays, 10) + " days without use."
+	if err = storage.AddEvent(Instance.Id, "access-key-deactivated", description, string(metadata)); err != nil {
+		glog.Errorf("Unable to record the deactivation of %s for %s: %s\n", AccessKeyId, Instance.Name, err.Error())
+	}
+	if err = ScheduleOwnerWebhook(storage, Instance, "access-key-deactivated", description+" It can be reactivated with the reactivate_access_key action."); err != nil {
+		glog.Errorf("Unable to schedule the webhook about the deactivation of %s for %s: %s\n", AccessKeyId, Instance.Name, err.Error())
+	}
+	PublishEvent(AccessKeyDeactivatedEvent, Instance, "", "")
+	return nil
+}
+
+// Checks the age and last use of the access keys of every available instance (including the keys
+// of rotated bindings), deactivates the keys unused for longer than their plan allows (see
+// GetAccessKeyDisableDays) and schedules up to autoRotate rotations of the oldest stale instance
+// keys. Instances with a second key (a binding rotation in progress) are not rotated as IAM only
+// allows two keys.
+func RunAccessKeyAudit(namePrefix string, storage Storage, maxAgeDays int64, dormantDays int64, autoRotate int) (*AccessKeyAudit, error) {
+	ids, err := storage.GetAvailableInstanceIds()
+	if err != nil {
+		return nil, err
+	}
+	audit := &AccessKeyAudit{MaxAgeDays: maxAgeDays, DormantDays: dormantDays, Stale: make([]StaleAccessKey, 0), Dormant: make([]DormantAccessKey, 0), Created: time.Now().UTC()}
+	rotatable := make(map[string]bool)
+	for _, id := range ids {
+		Instance, err := GetInstanceById(namePrefix, storage, id)
+		if err != nil {
+			glog.Errorf("Unable to get instance %s for the access key audit: %s\n", id, err.Error())
+			audit.Failed++
+			continue
+		}
+		provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+		if err != nil {
+			glog.Errorf("Unable to audit %s, cannot find provider (GetProviderByPlan failed): %s\n", id, err.Error())
+			audit.Failed++
+			continue
+		}
+		keys, err := GetAccessKeyUsage(storage, provider, Instance)
+		if err != nil {
+			glog.Errorf("Unable to get the access keys of %s: %s\n", Instance.Name, err.Error())
+			audit.Failed++
+			continue
+		}
+		disableDays, err := GetAccessKeyDisableDays(Instance.Plan)
+		if err != nil {
+			glog.Errorf("Unable to get the days unused keys of %s are kept: %s\n", Instance.Name, err.Error())
+			disableDays = 0
+		}
+		audit.Instances++
+		rotatable[id] = len(keys) == 1
+		for _, key := range keys {
+			audit.Keys++
+			age := int64(audit.Created.Sub(key.Created).Hours() / 24)
+			if age > audit.OldestDays {
+				audit.OldestDays = age
+			}
+			if age >= maxAgeDays {
+				audit.Stale = append(audit.Stale, StaleAccessKey{
+					InstanceId:  id,
+					Name:        Instance.Name,
+					AccessKeyId: key.AccessKeyId,
+					InstanceKey: key.AccessKeyId == Instance.Username,
+					AgeDays:     age,
+				})
+			}
+			if key.Status != "Active" {
+				continue
+			}
+			deactivated := false
+			if disableDays > 0 && key.IdleDays >= disableDays {
+				if err = DeactivateAccessKey(storage, provider, Instance, key.AccessKeyId, key.IdleDays); err != nil {
+					glog.Errorf("Unable to deactivate the unused access key %s of %s: %s\n", key.AccessKeyId, Instance.Name, err.Error())
+				} else {
+					deactivated = true
+					audit.Deactivated++
+				}
+			}
+			if deactivated || key.IdleDays >= dormantDays {
+				audit.Dormant = append(audit.Dormant, DormantAccessKey{
+					InstanceId:  id,
+					Name:        Instance.Name,
+					AccessKeyId: key.AccessKeyId,
+					InstanceKey: key.InstanceKey,
+					Bindings:    key.Bindings,
+					LastUsed:    key.LastUsed,
+					IdleDays:    key.IdleDays,
+					Deactivated: deactivated,
+				})
+			}
+		}
+	}
+	sort.Slice(audit.Stale, func(i, j int) bool { return audit.Stale[i].AgeDays > audit.Stale[j].AgeDays })
+	sort.Slice(audit.Dormant, func(i, j int) bool { return audit.Dormant[i].IdleDays > audit.Dormant[j].IdleDays })
+
+	for i, key := range audit.Stale {
+		if audit.Rotations >= autoRotate {
+			break
+		}
+		if !key.InstanceKey || !rotatable[key.InstanceId] {
+			continue
+		}
+		if task, err := storage.GetLastTask(key.InstanceId, RotateCredentialsTask); err == nil && (task.Status == "pending" || task.Status == "started") {
+			continue
+		}
+		taskId, err := storage.AddTask(key.InstanceId, RotateCredentialsTask, "", "")
+		if err != nil {
+			glog.Errorf("Unable to schedule the rotation of the access key of %s: %s\n", key.Name, err.Error())
+			continue
+		}
+		audit.Stale[i].RotationTask = taskId
+		audit.Rotations++
+	}
+
+	glog.Infof("Audited %d access keys of %d instances (%d failed), %d are older than %d days (the oldest is %d days old), %d haven't been used in %d days, %d were deactivated and %d rotations were scheduled.\n", audit.Keys, audit.Instances, audit.Failed, len(audit.Stale), maxAgeDays, audit.OldestDays, len(audit.Dormant), dormantDays, audit.Deactivated, audit.Rotations)
+	if len(audit.Stale) > 0 {
+		SendNotification("access-key-audit", "Stale access keys", strconv.Itoa(len(audit.Stale))+" of "+strconv.Itoa(audit.Keys)+" access keys are older than "+strconv.FormatInt(maxAgeDays, 10)+" days (the oldest is "+strconv.FormatInt(audit.OldestDays, 10)+" days old), "+strconv.Itoa(audit.Rotations)+" rotations were scheduled.")
+	}
+	if len(audit.Dormant) > 0 {
+		SendNotification("access-key-dormant", "Dormant access keys", strconv.Itoa(len(audit.Dormant))+" of "+strconv.Itoa(audit.Keys)+" access keys haven't been used in "+strconv.FormatInt(dormantDays, 10)+" days, "+strconv.Itoa(audit.Deactivated)+" were deactivated.")
+	}
+	if err = storage.AddAccessKeyAudit(audit); err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+// The last audit is recorded in the database, so with multiple workers only one of them (usually)
+// runs each audit.
+func TickTocAccessKeyAudit(ctx context.Context, namePrefix string, storage Storage) {
+	interval := GetAccessKeyAuditInterval()
+	next_check := time.NewTicker(time.Minute * 15)
+	defer next_check.Stop()
+	for {
+		last, err := storage.GetLastAccessKeyAudit()
+		if err != nil && err.Error() != "Not found" {
+			glog.Errorf("Unable to get the last access key audit: %s\n", err.Error())
+		} else if err != nil || time.Since(last.Created) >= interval {
+			if _, err = RunAccessKeyAudit(namePrefix, storage, GetAccessKeyMaxAgeDays(), GetAccessKeyDormantDays(), GetAccessKeyAutoRotate()); err != nil {
+				glog.Errorf("Unable to audit access keys: %s\n", err.Error())
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-next_check.C:
+		}
+	}
+}
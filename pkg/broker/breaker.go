@@ -0,0 +1,143 @@
+package broker
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/golang/glog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker stops new provisions from calling a provider that is failing repeatedly, so
+// requests fail fast instead of each waiting (under the broker's lock) for AWS to time out. After
+// threshold consecutive failures it opens, once the cooldown passes one request is let through
+// (half-open) and its result closes or reopens the breaker.
+type CircuitBreaker struct {
+	sync.Mutex
+	name      string
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	opened    int64
+	rejected  int64
+}
+
+type BreakerStatus struct {
+	State    string     `json:"state"`
+	Failures int        `json:"consecutive_failures"`
+	Opened   int64      `json:"times_opened"`
+	Rejected int64      `json:"requests_rejected"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// The breaker opens after PROVIDER_BREAKER_THRESHOLD (5 by default) consecutive failures and
+// allows a trial request after PROVIDER_BREAKER_COOLDOWN (e.g., 1m, 30s by default).
+func NewCircuitBreaker(name string) *CircuitBreaker {
+	threshold, err := strconv.Atoi(os.Getenv("PROVIDER_BREAKER_THRESHOLD"))
+	if err != nil || threshold < 1 {
+		threshold = 5
+	}
+	cooldown, err := time.ParseDuration(os.Getenv("PROVIDER_BREAKER_COOLDOWN"))
+	if err != nil || cooldown < time.Second {
+		cooldown = time.Second * 30
+	}
+	return &CircuitBreaker{name: name, threshold: threshold, cooldown: cooldown, state: BreakerClosed}
+}
+
+var breakers = struct {
+	sync.Mutex
+	breakers map[Providers]*CircuitBreaker
+}{breakers: make(map[Providers]*CircuitBreaker)}
+
+func GetCircuitBreaker(provider Providers) *CircuitBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	if breaker, ok := breakers.breakers[provider]; ok {
+		return breaker
+	}
+	breaker := NewCircuitBreaker(string(provider))
+	breakers.breakers[provider] = breaker
+	return breaker
+}
+
+// Returns an error ("Provider unavailable") when the request should not be sent to the provider.
+func (cb *CircuitBreaker) Allow() error {
+	cb.Lock()
+	defer cb.Unlock()
+	if cb.state == BreakerOpen && time.Since(cb.openedAt) >= cb.cooldown {
+		glog.Infof("The circuit breaker of the %s provider is half-open, trying a request.\n", cb.name)
+		cb.state = BreakerHalfOpen
+		cb.trial = false
+	}
+	if cb.state == BreakerClosed || (cb.state == BreakerHalfOpen && !cb.trial) {
+		if cb.state == BreakerHalfOpen {
+			cb.trial = true
+		}
+		return nil
+	}
+	cb.rejected++
+	return errors.New("Provider unavailable")
+}
+
+// Records the result of a request let through by Allow. Only failures of the provider itself (5xx
+// responses, throttling or connection errors) count, a request the provider refused is a success.
+func (cb *CircuitBreaker) Record(err error) {
+	cb.Lock()
+	defer cb.Unlock()
+	if !isProviderFailure(err) {
+		if cb.state != BreakerClosed {
+			glog.Infof("The circuit breaker of the %s provider is closed.\n", cb.name)
+		}
+		cb.state = BreakerClosed
+		cb.failures = 0
+		cb.trial = false
+		return
+	}
+	cb.failures++
+	if cb.state == BreakerHalfOpen || (cb.state == BreakerClosed && cb.failures >= cb.threshold) {
+		glog.Errorf("The circuit breaker of the %s provider is open after %d failures: %s\n", cb.name, cb.failures, err.Error())
+		SendNotification("breaker-"+cb.name, "Provider unavailable", "The "+cb.name+" provider failed "+strconv.Itoa(cb.failures)+" times in a row, new provisions are rejected until it recovers: "+err.Error())
+		cb.state = BreakerOpen
+		cb.openedAt = time.Now()
+		cb.trial = false
+		cb.opened++
+	}
+}
+
+func (cb *CircuitBreaker) Status() BreakerStatus {
+	cb.Lock()
+	defer cb.Unlock()
+	status := BreakerStatus{State: cb.state, Failures: cb.failures, Opened: cb.opened, Rejected: cb.rejected}
+	if cb.state != BreakerClosed {
+		openedAt := cb.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+func isProviderFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		return rerr.StatusCode() >= 500 || rerr.StatusCode() == 429
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "RequestError", "RequestTimeout", "RequestCanceled", "ServiceUnavailable", "InternalError", "Throttling", "ThrottlingException", "SlowDown", "RequestLimitExceeded", "TooManyRequestsException":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// InstanceCache is a concurrency safe least recently used cache of instances where each entry
+// expires after a fixed ttl. Copies are stored and returned so callers may modify the instances.
+type InstanceCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type instanceCacheEntry struct {
+	key      string
+	instance Instance
+	expires  time.Time
+}
+
+func NewInstanceCache(size int, ttl time.Duration) *InstanceCache {
+	return &InstanceCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *InstanceCache) Get(key string) (*Instance, bool) {
+	c.Lock()
+	defer c.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*instanceCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	instance := entry.instance
+	return &instance, true
+}
+
+func (c *InstanceCache) Put(key string, instance *Instance) {
+	c.Lock()
+	defer c.Unlock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*instanceCacheEntry)
+		entry.instance = *instance
+		entry.expires = time.Now().Add(c.ttl)
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&instanceCacheEntry{
+		key:      key,
+		instance: *instance,
+		expires:  time.Now().Add(c.ttl),
+	})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*instanceCacheEntry).key)
+	}
+}
+
+func (c *InstanceCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
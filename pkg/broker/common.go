@@ -1,23 +1,25 @@
 package broker
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	uuid "github.com/nu7hatch/gouuid"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
 	"sync"
 	"strings"
 	"strconv"
-	"text/template"
 	"time"
 )
 
@@ -70,7 +72,10 @@ func falsePtr() *bool {
 func HttpWrite(w http.ResponseWriter, status int, obj interface{}) {
 	data, err := json.Marshal(obj)
 	if err != nil {
+		glog.Errorf("Unable to marshal response: %s\n", err.Error())
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"InternalServerError","description":"Internal Server Error"}`))
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -78,49 +83,185 @@ func HttpWrite(w http.ResponseWriter, status int, obj interface{}) {
 	w.Write(data)
 }
 
-func InternalServerError() error {
-	description := "Internal Server Error"
-	return osb.HTTPStatusCodeError{
-		StatusCode:  http.StatusInternalServerError,
-		Description: &description,
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// RequestIdMiddleware ensures every request has an X-Request-Id (using the callers if it looks
+// sane, otherwise generating one), it's returned in the response, logged and stored with any
+// tasks the request creates so a failed operation can be traced back to the request.
+func RequestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get("X-Request-Id")
+		if requestId == "" || len(requestId) > 128 || strings.ContainsAny(requestId, " \t\r\n") {
+			id, err := uuid.NewV4()
+			if err != nil {
+				glog.Errorf("Unable to generate request id: %s\n", err.Error())
+			} else {
+				requestId = id.String()
+			}
+			r.Header.Set("X-Request-Id", requestId)
+		}
+		w.Header().Set("X-Request-Id", requestId)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		glog.Infof("[%s] %s %s %d (%s)\n", requestId, r.Method, r.URL.Path, recorder.status, time.Since(start))
+	})
+}
+
+func GetRequestId(c *broker.RequestContext) string {
+	if c == nil || c.Request == nil {
+		return ""
 	}
+	return c.Request.Header.Get("X-Request-Id")
 }
 
-func ConflictErrorWithMessage(description string) error {
-	return osb.HTTPStatusCodeError{
-		StatusCode:  http.StatusConflict,
-		Description: &description,
+const predecessorBindingHeader = "X-Broker-Predecessor-Binding-Id"
+
+// The osb client library predates binding rotation (OSB 2.17) and drops predecessor_binding_id when
+// decoding a bind request, PredecessorBindingMiddleware copies it from the body of the request into
+// a header for Bind. The header is always removed from incoming requests so callers can't set it.
+func PredecessorBindingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(predecessorBindingHeader)
+		if r.Method == "PUT" && r.Body != nil && strings.Contains(r.URL.Path, "/service_bindings/") {
+			body, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				glog.Errorf("Unable to read the body of bind request %s: %s\n", r.URL.Path, err.Error())
+			}
+			var request struct {
+				PredecessorBindingId string `json:"predecessor_binding_id"`
+			}
+			if err = json.Unmarshal(body, &request); err == nil && request.PredecessorBindingId != "" {
+				r.Header.Set(predecessorBindingHeader, request.PredecessorBindingId)
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func GetPredecessorBindingId(c *broker.RequestContext) string {
+	if c == nil || c.Request == nil {
+		return ""
 	}
+	return c.Request.Header.Get(predecessorBindingHeader)
 }
 
-func UnprocessableEntityWithMessage(err string, description string) error {
-	return osb.HTTPStatusCodeError{
-		ResponseError: errors.New(err),
-		StatusCode:    http.StatusUnprocessableEntity,
-		Description:   &description,
+// Returns the network the platform making the request is on, "private" or "public", from the
+// X-Broker-Network header or NETWORK_CONTEXT when the header isn't set. An empty string means
+// the network is unknown.
+func GetNetworkContext(c *broker.RequestContext) string {
+	network := os.Getenv("NETWORK_CONTEXT")
+	if c != nil && c.Request != nil && c.Request.Header.Get("X-Broker-Network") != "" {
+		network = c.Request.Header.Get("X-Broker-Network")
 	}
+	network = strings.ToLower(strings.TrimSpace(network))
+	if network != "private" && network != "public" {
+		return ""
+	}
+	return network
+}
+
+// Returns the organization making the request from the X-Broker-Organization header, or the
+// "organization" of the originating identity when the header isn't set.
+func GetOrganization(c *broker.RequestContext) string {
+	if c == nil || c.Request == nil {
+		return ""
+	}
+	if organization := c.Request.Header.Get("X-Broker-Organization"); organization != "" {
+		return organization
+	}
+	parts := strings.SplitN(GetOriginatingIdentity(c), " ", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	var identity struct {
+		Organization string `json:"organization"`
+	}
+	if err := json.Unmarshal([]byte(parts[1]), &identity); err != nil {
+		return ""
+	}
+	return identity.Organization
+}
+
+// Returns who made the request from the X-Broker-API-Originating-Identity header, the platform
+// followed by its (base64 decoded) description of the user, e.g. cloudfoundry {"user_id":"..."}.
+func GetOriginatingIdentity(c *broker.RequestContext) string {
+	if c == nil || c.Request == nil {
+		return ""
+	}
+	header := c.Request.Header.Get("X-Broker-API-Originating-Identity")
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return header
+	}
+	value, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return header
+	}
+	return parts[0] + " " + string(value)
+}
+
+func InternalServerError() error {
+	return newHTTPError(http.StatusInternalServerError, "InternalServerError", "Internal Server Error")
+}
+
+func ConflictErrorWithMessage(description string) error {
+	return newHTTPError(http.StatusConflict, "Conflict", description)
+}
+
+func UnprocessableEntityWithMessage(err string, description string) error {
+	return newHTTPError(http.StatusUnprocessableEntity, err, description)
 }
 
 func UnprocessableEntity() error {
-	description := "Unprocessable Entity"
-	return osb.HTTPStatusCodeError{
-		StatusCode:  http.StatusUnprocessableEntity,
-		Description: &description,
+	return newHTTPError(http.StatusUnprocessableEntity, "UnprocessableEntity", "Unprocessable Entity")
+}
+
+// Errors from AWS that platform users (or the broker's administrator) can act on are returned
+// with a description of what went wrong, anything else is an internal server error.
+func ProviderError(err error) error {
+	code := ""
+	if aerr, ok := err.(awserr.Error); ok {
+		code = aerr.Code()
+	} else if err != nil && err.Error() == "Unable to find an unused name for the bucket." {
+		code = "BucketAlreadyExists"
+	} else if err != nil && err.Error() == "Provider unavailable" {
+		code = "ProviderUnavailable"
 	}
+	switch code {
+	case "AccessDenied", "AccessDeniedException", "UnauthorizedOperation", "InvalidClientTokenId", "ExpiredToken", "SignatureDoesNotMatch":
+		return newHTTPError(http.StatusInternalServerError, "ProviderAccessDenied", "The broker is not permitted to make this change in AWS ("+code+"), contact the administrator of the broker.")
+	case "BucketAlreadyExists", "BucketAlreadyOwnedByYou", "EntityAlreadyExists":
+		return newHTTPError(http.StatusConflict, "NameInUse", "A bucket or user with the generated name already exists, try again.")
+	case "LimitExceeded", "LimitExceededException", "TooManyBuckets", "ServiceQuotaExceededException":
+		return UnprocessableEntityWithMessage("CapacityExceeded", "An AWS limit was reached ("+code+"), contact the administrator of the broker to have it raised.")
+	case "Throttling", "ThrottlingException", "SlowDown", "RequestLimitExceeded", "TooManyRequestsException":
+		return newHTTPError(http.StatusServiceUnavailable, "ProviderThrottled", "AWS is throttling the broker's requests, try again in a few minutes.")
+	case "ProviderUnavailable":
+		return newHTTPError(http.StatusServiceUnavailable, "ProviderUnavailable", "AWS is failing repeatedly so new buckets are not being created, try again in a few minutes.")
+	}
+	return InternalServerError()
 }
 
 func NotFound() error {
-	description := "Not Found"
-	return osb.HTTPStatusCodeError{
-		StatusCode:  http.StatusNotFound,
-		Description: &description,
-	}
+	return newHTTPError(http.StatusNotFound, "NotFound", "Not Found")
 }
 
 type Action struct {
 	name    string
 	path    string
 	method  string
+	schema  string
 	handler func(string, map[string]string, *broker.RequestContext) (interface{}, error)
 }
 
@@ -136,84 +277,113 @@ func InitFromOptions(ctx context.Context, o Options) (Storage, string, error) {
 	if o.NamePrefix == "" {
 		return nil, "", errors.New("The name prefix was not specified, set NAME_PREFIX in your environment or provide it via the cli using -name-prefix")
 	}
+	if o.SlackWebhookUrl == "" && os.Getenv("SLACK_WEBHOOK_URL") != "" {
+		o.SlackWebhookUrl = os.Getenv("SLACK_WEBHOOK_URL")
+	}
+	if o.TeamsWebhookUrl == "" && os.Getenv("TEAMS_WEBHOOK_URL") != "" {
+		o.TeamsWebhookUrl = os.Getenv("TEAMS_WEBHOOK_URL")
+	}
+	if o.NotifyEmail == "" && os.Getenv("NOTIFY_EMAIL") != "" {
+		o.NotifyEmail = os.Getenv("NOTIFY_EMAIL")
+	}
+	if o.NotifyEmailFrom == "" && os.Getenv("NOTIFY_EMAIL_FROM") != "" {
+		o.NotifyEmailFrom = os.Getenv("NOTIFY_EMAIL_FROM")
+	}
+	if o.SmtpUrl == "" && os.Getenv("SMTP_URL") != "" {
+		o.SmtpUrl = os.Getenv("SMTP_URL")
+	}
+	if err := InitNotifiers(o); err != nil {
+		return nil, "", err
+	}
+	if err := InitEvents(); err != nil {
+		return nil, "", err
+	}
+	if err := InitDatadog(); err != nil {
+		return nil, "", err
+	}
 	storage, err := InitStorage(ctx, o)
+	go (func() {
+		<-ctx.Done()
+		CloseProviders()
+	})()
 	return storage, o.NamePrefix, err
 }
 
+// Builds the OpenAPI 3 document for an action, the schema fragment the action was registered with
+// is used as the operation object, anything it does not specify is filled in with defaults.
+func (b *ActionBase) GetActionSchema(action Action, baseUrl string) (map[string]interface{}, error) {
+	operation := make(map[string]interface{})
+	if action.schema != "" {
+		if err := json.Unmarshal([]byte(action.schema), &operation); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := operation["tags"]; !ok {
+		operation["tags"] = []string{action.name}
+	}
+	if _, ok := operation["summary"]; !ok {
+		operation["summary"] = action.name
+	}
+	if _, ok := operation["operationId"]; !ok {
+		operation["operationId"] = action.name
+	}
+	if _, ok := operation["description"]; !ok {
+		operation["description"] = action.name
+	}
+	if _, ok := operation["responses"]; !ok {
+		operation["responses"] = map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"400": map[string]interface{}{"description": "invalid input, object invalid"},
+		}
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"servers": []interface{}{
+			map[string]interface{}{
+				"description": "Extensions",
+				"url":         baseUrl + "/" + action.name + "/schema",
+			},
+			map[string]interface{}{
+				"description": action.name,
+				"url":         baseUrl + "/" + action.path,
+			},
+		},
+		"info": map[string]interface{}{
+			"description": action.name + " action",
+			"version":     "1.0.0",
+			"title":       action.name,
+			"license": map[string]interface{}{
+				"name": "Apache 2.0",
+				"url":  "http://www.apache.org/licenses/LICENSE-2.0.html",
+			},
+		},
+		"paths": map[string]interface{}{
+			baseUrl + "/" + action.path: map[string]interface{}{
+				strings.ToLower(action.method): operation,
+			},
+		},
+	}, nil
+}
+
 func (b *ActionBase) ActionSchemaHandler(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	instance_id := v["instance_id"]
 	var baseUrl = "/v2/service_instances/" + instance_id + "/actions"
 
 	action_name := v["action_name"]
-	var found = false
 	for _, action := range b.actions {
 		if action.name == action_name {
-			found = true
-			t := template.Must(template.New("openapi3").Parse(`
-				{
-				  "openapi" : "3.0.0",
-				  "servers" : [ {
-				    "description" : "Extensions",
-				    "url" : "{{.BaseUrl}}/{{.Name}}/schema"
-				  }, {
-				    "description" : "{{.Name}}",
-				    "url" : "{{.BaseUrl}}/{{.Path}}"
-				  } ],
-				  "info" : {
-				    "description" : "{{.Name}} action",
-				    "version" : "1.0.0",
-				    "title" : "{{.Name}}",
-				    "license" : {
-				      "name" : "Apache 2.0",
-				      "url" : "http://www.apache.org/licenses/LICENSE-2.0.html"
-				    }
-				  },
-				  "paths" : {
-				    "{{.BaseUrl}}/{{.Path}}" : {
-				      "{{.Method}}" : {
-				        "tags" : [ "{{.Name}}" ],
-				        "summary" : "{{.Name}}",
-				        "operationId" : "{{.Name}}",
-				        "description" : "{{.Name}}",
-				        "responses" : {
-				          "200" : {
-				            "description" : "OK"
-				          },
-				          "400" : {
-				            "description" : "invalid input, object invalid"
-				          },
-				        }
-				      }
-				    }
-				  }
-				}
-				`))
-			var b bytes.Buffer
-			wr := bufio.NewWriter(&b)
-			err := t.Execute(wr, struct {
-				BaseUrl string
-				Name    string
-				Path    string
-				Method  string
-			}{BaseUrl: baseUrl, Name: action.name, Path: action.path, Method: action.method})
+			doc, err := b.GetActionSchema(action, baseUrl)
 			if err != nil {
 				glog.Errorf("Cannot generate swagger doc: %s\n", err.Error())
-				w.WriteHeader(500)
-				w.Write([]byte("Cannot generate swagger doc"))
+				WriteError(w, InternalServerError())
 				return
 			}
-			wr.Flush()
-			w.Header().Add("content-type", "application/json")
-			w.WriteHeader(200)
-			w.Write(b.Bytes())
+			HttpWrite(w, 200, doc)
+			return
 		}
 	}
-	if found == false {
-		w.WriteHeader(404)
-		w.Write([]byte("Not Found"))
-		return
-	}
+	WriteError(w, NotFound())
 }
 
 func (b *ActionBase) RouteActions(router *mux.Router) error {
@@ -225,27 +395,8 @@ func (b *ActionBase) RouteActions(router *mux.Router) error {
 			c := broker.RequestContext{Request: r, Writer: w}
 			obj, herr := act.handler(vars["instance_id"], vars, &c)
 			if herr != nil {
-				type e struct {
-					ErrorMessage *string `json:"error,omitempty"`
-					Description  *string `json:"description,omitempty"`
-				}
-				if httpErr, ok := osb.IsHTTPError(herr); ok {
-					body := &e{}
-					if httpErr.Description != nil {
-						body.Description = httpErr.Description
-					}
-					if httpErr.ErrorMessage != nil {
-						body.ErrorMessage = httpErr.ErrorMessage
-					}
-					HttpWrite(w, httpErr.StatusCode, body)
-					return
-				} else {
-					msg := "InternalServerError"
-					description := "Internal Server Error"
-					body := &e{ErrorMessage:&msg, Description:&description}
-					HttpWrite(w, 500, body)
-					return
-				}
+				WriteError(w, herr)
+				return
 			}
 			if obj != nil {
 				HttpWrite(w, 200, obj)
@@ -258,6 +409,28 @@ func (b *ActionBase) RouteActions(router *mux.Router) error {
 	return nil
 }
 
+// Describes the available actions and their schemas for the catalog, as instance ids are not known
+// the urls contain the {instance_id} placeholder.
+func (b *ActionBase) ConvertActionsToMetadata() []map[string]interface{} {
+	actions := make([]map[string]interface{}, 0)
+	for _, action := range b.actions {
+		var baseUrl = "/v2/service_instances/{instance_id}/actions"
+		schema, err := b.GetActionSchema(action, baseUrl)
+		if err != nil {
+			glog.Errorf("Cannot generate swagger doc for %s: %s\n", action.name, err.Error())
+			continue
+		}
+		actions = append(actions, map[string]interface{}{
+			"name":          action.name,
+			"method":        action.method,
+			"path":          action.path,
+			"discovery_url": baseUrl + "/" + action.name + "/schema",
+			"schema":        schema,
+		})
+	}
+	return actions
+}
+
 func (b *ActionBase) ConvertActionsToExtensions(serviceId string) []osb.ExtensionAPI {
 	extensions := make([]osb.ExtensionAPI, 0)
 	var baseUrl = ""
@@ -270,13 +443,19 @@ func (b *ActionBase) ConvertActionsToExtensions(serviceId string) []osb.Extensio
 	return extensions
 }
 
-func (b *ActionBase) AddActions(name string, path string, method string, handler func(string, map[string]string, *broker.RequestContext) (interface{}, error)) error {
+// The schema is an OpenAPI 3 operation object (as json) describing the parameters, request body and
+// responses of the action, it may be left empty.
+func (b *ActionBase) AddActions(name string, path string, method string, schema string, handler func(string, map[string]string, *broker.RequestContext) (interface{}, error)) error {
+	if schema != "" && !json.Valid([]byte(schema)) {
+		return errors.New("The schema for action " + name + " is not valid json.")
+	}
 	b.Lock()
 	defer b.Unlock()
 	b.actions = append(b.actions, Action{
 		name:    name,
 		path:    path,
 		method:  method,
+		schema:  schema,
 		handler: handler,
 	})
 	return nil
@@ -284,34 +463,390 @@ func (b *ActionBase) AddActions(name string, path string, method string, handler
 
 // These are hacks to support more of V2.14 such as get service instance and get service bindings.
 func CrudeOSBIHacks(router *mux.Router, b *BusinessLogic) {
+	router.HandleFunc("/v2/service_instances/{instance_id}", func(w http.ResponseWriter, r *http.Request) {
+		resp, err := b.FetchInstance(mux.Vars(r)["instance_id"])
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+		HttpWrite(w, 200, resp)
+	}).Methods("GET")
 	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		req := osb.GetBindingRequest{InstanceID: vars["instance_id"], BindingID: vars["binding_id"]}
 		c := broker.RequestContext{Request: r, Writer: w}
 		resp, err := b.GetBinding(&req, &c)
 		if err != nil {
-			type e struct {
-				ErrorMessage *string `json:"error,omitempty"`
-				Description  *string `json:"description,omitempty"`
-			}
-			if httpErr, ok := osb.IsHTTPError(err); ok {
-				body := &e{}
-				if httpErr.Description != nil {
-					body.Description = httpErr.Description
-				}
-				if httpErr.ErrorMessage != nil {
-					body.ErrorMessage = httpErr.ErrorMessage
-				}
-				HttpWrite(w, httpErr.StatusCode, body)
+			WriteError(w, err)
+			return
+		}
+		HttpWrite(w, 200, resp)
+	}).Methods("GET")
+}
+
+// Routes used by administrators of the broker rather than the platform.
+func AdminRoutes(router *mux.Router, b *BusinessLogic) {
+	// Readiness fails (with a 503) when the database can't be reached. Providers aren't checked, an
+	// AWS outage shouldn't take every replica out of the load balancer (and the response doesn't say
+	// more than whether it's ready), their health is at /v2/admin/providers/health.
+	router.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := b.storage.Ping(); err != nil {
+			glog.Errorf("The readiness check could not reach the database: %s\n", err.Error())
+			HttpWrite(w, 503, map[string]bool{"ready": false, "database": false})
+			return
+		}
+		HttpWrite(w, 200, map[string]bool{"ready": true, "database": true})
+	}).Methods("GET")
+
+	router.HandleFunc("/v2/admin/providers/health", func(w http.ResponseWriter, r *http.Request) {
+		checks, err := b.CheckProviders()
+		if err != nil {
+			glog.Errorf("Unable to check the health of providers: %s\n", err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, checks)
+	}).Methods("GET")
+
+	// Instances without requests in IDLE_DAYS, as found by the worker's last check.
+	router.HandleFunc("/v2/admin/idle-instances", func(w http.ResponseWriter, r *http.Request) {
+		instances, err := b.storage.GetIdleInstances()
+		if err != nil {
+			glog.Errorf("Unable to get the idle instances: %s\n", err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, map[string]interface{}{"idle_days": GetIdleDays(), "idle_instances": instances})
+	}).Methods("GET")
+
+	router.HandleFunc("/v2/admin/preprovision", func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := b.storage.GetPoolStatus()
+		if err != nil {
+			glog.Errorf("Unable to get the preprovisioned pool status: %s\n", err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, statuses)
+	}).Methods("GET")
+
+	// The health of each plan's preprovisioned pool, including how many buckets the worker would
+	// start preprovisioning if it checked the pool now.
+	router.HandleFunc("/v2/admin/pools", func(w http.ResponseWriter, r *http.Request) {
+		pools, err := b.storage.GetPoolHealth()
+		if err != nil {
+			glog.Errorf("Unable to get the preprovisioned pool health: %s\n", err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, pools)
+	}).Methods("GET")
+
+	// Summarizes the tasks and provisions of the last ?days (7 by default), e.g. the p95 time to
+	// provision, for measuring the provisioning SLO.
+	router.HandleFunc("/v2/admin/tasks/report", func(w http.ResponseWriter, r *http.Request) {
+		days := 7
+		if r.URL.Query().Get("days") != "" {
+			var err error
+			if days, err = strconv.Atoi(r.URL.Query().Get("days")); err != nil || days < 1 || days > 365 {
+				HttpWrite(w, 422, map[string]string{"error": "InvalidDays", "description": "The days must be a number from 1 to 365."})
 				return
+			}
+		}
+		report, err := b.GetTasksReport(days)
+		if err != nil {
+			glog.Errorf("Unable to get the tasks report: %s\n", err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, report)
+	}).Methods("GET")
+
+	// Lists the most recent tasks with the ?status (failed by default), up to ?limit (100 by default).
+	router.HandleFunc("/v2/admin/tasks", func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("status")
+		if status == "" {
+			status = "failed"
+		}
+		if status != "pending" && status != "started" && status != "finished" && status != "failed" {
+			HttpWrite(w, 422, map[string]string{"error": "InvalidStatus", "description": "The status must be pending, started, finished or failed."})
+			return
+		}
+		limit := 100
+		if value, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && value > 0 && value <= 1000 {
+			limit = value
+		}
+		tasks, err := b.storage.GetTasksByStatus(status, limit)
+		if err != nil {
+			glog.Errorf("Unable to get the %s tasks: %s\n", status, err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, map[string]interface{}{"tasks": tasks})
+	}).Methods("GET")
+
+	// Returns a failed task to the queue, it's retried as if it were new.
+	router.HandleFunc("/v2/admin/tasks/{task_id}/requeue", func(w http.ResponseWriter, r *http.Request) {
+		taskId := mux.Vars(r)["task_id"]
+		if err := b.storage.RequeueTask(taskId); err != nil && err.Error() == "Not found" {
+			HttpWrite(w, 404, map[string]string{"error": "NotFound", "description": "The task was not found or has not failed."})
+			return
+		} else if err != nil {
+			glog.Errorf("Unable to requeue task %s: %s\n", taskId, err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		glog.Infof("Task %s was requeued (request: %s)\n", taskId, r.Header.Get("x-request-id"))
+		HttpWrite(w, 200, map[string]interface{}{"task": taskId, "status": "pending"})
+	}).Methods("POST")
+
+	// Lists the plans with invalid provider settings, an empty list means every plan is valid.
+	router.HandleFunc("/v2/admin/plans/validate", func(w http.ResponseWriter, r *http.Request) {
+		validations, err := b.ValidatePlans()
+		if err != nil {
+			glog.Errorf("Unable to validate the settings of plans: %s\n", err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, validations)
+	}).Methods("GET")
+
+	// Returns the report of the most recent access key audit.
+	router.HandleFunc("/v2/admin/access-keys/audit", func(w http.ResponseWriter, r *http.Request) {
+		audit, err := b.storage.GetLastAccessKeyAudit()
+		if err != nil && err.Error() == "Not found" {
+			HttpWrite(w, 404, map[string]string{"error": "NotFound", "description": "No access key audit has been run yet."})
+			return
+		} else if err != nil {
+			glog.Errorf("Unable to get the last access key audit: %s\n", err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, audit)
+	}).Methods("GET")
+
+	// Lists the instances (including unclaimed preprovisioned buckets), optionally only those with the
+	// ?status or ?plan.
+	router.HandleFunc("/v2/admin/instances", func(w http.ResponseWriter, r *http.Request) {
+		instances, err := b.storage.ListInstances(r.URL.Query().Get("status"), r.URL.Query().Get("plan"))
+		if err != nil {
+			glog.Errorf("Unable to list instances: %s\n", err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, map[string]interface{}{"instances": instances})
+	}).Methods("GET")
+
+	// Lists the most recent tasks of an instance, up to ?limit (25 by default).
+	router.HandleFunc("/v2/admin/instances/{instance_id}/tasks", func(w http.ResponseWriter, r *http.Request) {
+		limit := 25
+		if value, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && value > 0 && value <= 1000 {
+			limit = value
+		}
+		tasks, err := b.storage.GetTasks(mux.Vars(r)["instance_id"], limit)
+		if err != nil {
+			glog.Errorf("Unable to get the tasks of %s: %s\n", mux.Vars(r)["instance_id"], err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, map[string]interface{}{"tasks": tasks})
+	}).Methods("GET")
+
+	// Schedules a task to refresh the instance's status (and endpoint) from its provider.
+	router.HandleFunc("/v2/admin/instances/{instance_id}/resync", func(w http.ResponseWriter, r *http.Request) {
+		instanceId := mux.Vars(r)["instance_id"]
+		if _, err := b.storage.GetInstance(instanceId); err != nil && err.Error() == "Cannot find resource instance" {
+			HttpWrite(w, 404, map[string]string{"error": "NotFound", "description": "The instance was not found."})
+			return
+		} else if err != nil {
+			glog.Errorf("Unable to get instance %s to resync: %s\n", instanceId, err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		taskId, err := b.storage.AddTask(instanceId, ResyncFromProviderUntilAvailableTask, "", r.Header.Get("x-request-id"))
+		if err != nil {
+			glog.Errorf("Unable to schedule the resync of %s: %s\n", instanceId, err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, map[string]interface{}{"task": taskId, "status": "pending"})
+	}).Methods("POST")
+
+	// Lists the backups of an instance including instances that were deprovisioned, whose backups
+	// may be the last copy of their objects.
+	router.HandleFunc("/v2/admin/instances/{instance_id}/backups", func(w http.ResponseWriter, r *http.Request) {
+		backups, err := b.storage.GetBackups(mux.Vars(r)["instance_id"])
+		if err != nil {
+			glog.Errorf("Unable to get the backups of %s: %s\n", mux.Vars(r)["instance_id"], err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, map[string]interface{}{"backups": backups})
+	}).Methods("GET")
+
+	// Exports the bucket and its user as Terraform resources and import blocks, for teams moving the
+	// bucket to Terraform.
+	router.HandleFunc("/v2/admin/instances/{instance_id}/terraform", func(w http.ResponseWriter, r *http.Request) {
+		Instance, err := b.GetInstanceById(mux.Vars(r)["instance_id"])
+		if err != nil && err.Error() == "Cannot find resource instance" {
+			HttpWrite(w, 404, map[string]string{"error": "NotFound", "description": "The instance was not found."})
+			return
+		} else if err != nil {
+			glog.Errorf("Unable to export the instance %s: %s\n", mux.Vars(r)["instance_id"], err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		provider, err := GetProviderByPlan(b.namePrefix, Instance.Plan)
+		if err != nil {
+			glog.Errorf("Unable to export, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		hcl, err := provider.ExportTerraform(Instance)
+		if err != nil {
+			glog.Errorf("Unable to export %s as terraform: %s\n", Instance.Name, err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(200)
+		w.Write([]byte(hcl))
+	}).Methods("GET")
+
+	// Adopts a bucket missing from the database, the body is {"name": <bucket>, "plan": <plan id>} and
+	// optionally the "instance_id" it belongs to. The bucket's access key is rotated, with
+	// "transfer_ownership": true the ownership of its objects is transferred to the broker's account.
+	router.HandleFunc("/v2/admin/adopt", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Name              string `json:"name"`
+			Plan              string `json:"plan"`
+			InstanceId        string `json:"instance_id"`
+			TransferOwnership bool   `json:"transfer_ownership"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "" || body.Plan == "" {
+			HttpWrite(w, 422, map[string]string{"error": "InvalidAdoption", "description": "The body must be a json object with the name of the bucket and its plan."})
+			return
+		}
+		Instance, claimed, err := b.AdoptInstance(body.Name, body.Plan, body.InstanceId)
+		if err != nil && err.Error() == "Not found" {
+			HttpWrite(w, 404, map[string]string{"error": "NotFound", "description": "The plan or bucket was not found."})
+			return
+		} else if err != nil && (err.Error() == "Already tracked" || err.Error() == "Instance id in use") {
+			HttpWrite(w, 409, map[string]string{"error": "Conflict", "description": "The bucket is already tracked or its instance id is in use."})
+			return
+		} else if err != nil {
+			glog.Errorf("Unable to adopt bucket %s: %s\n", body.Name, err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		response := map[string]interface{}{"instance_id": Instance.Id, "name": Instance.Name, "claimed": claimed}
+		if body.TransferOwnership {
+			if taskId, err := b.storage.AddTask(Instance.Id, TransferOwnershipTask, "", r.Header.Get("X-Request-Id")); err != nil {
+				glog.Errorf("Error: Unable to schedule the ownership transfer of adopted bucket %s: %s\n", Instance.Name, err.Error())
 			} else {
-				msg := "InternalServerError"
-				description := "Internal Server Error"
-				body := &e{ErrorMessage:&msg, Description:&description}
-				HttpWrite(w, 500, body)
-				return
+				response["ownership_task"] = taskId
 			}
 		}
-		HttpWrite(w, 200, resp)
+		HttpWrite(w, 200, response)
+	}).Methods("POST")
+
+	// Transfers an instance to another organization and space, the body is {"organization": <guid>,
+	// "space": <guid>} and optionally a "reason". With "force": true plan restrictions and quotas of
+	// the new organization are ignored.
+	router.HandleFunc("/v2/admin/instances/{instance_id}/transfer", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Organization string `json:"organization"`
+			Space        string `json:"space"`
+			Reason       string `json:"reason"`
+			Force        bool   `json:"force"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Organization == "" || body.Space == "" {
+			HttpWrite(w, 422, map[string]string{"error": "InvalidTransfer", "description": "The body must be a json object with the organization and space to transfer the instance to."})
+			return
+		}
+		transfer, err := b.TransferInstance(mux.Vars(r)["instance_id"], InstanceTransfer{ToOrganization: body.Organization, ToSpace: body.Space, Reason: body.Reason, RequestedBy: GetOIDCUser(r)}, body.Force)
+		if err != nil && err.Error() == "Cannot find resource instance" {
+			HttpWrite(w, 404, map[string]string{"error": "NotFound", "description": "The instance was not found."})
+			return
+		} else if err != nil && err.Error() == "Instance busy" {
+			HttpWrite(w, 409, map[string]string{"error": "ConcurrencyError", "description": "The instance cannot be transferred while it is being changed."})
+			return
+		} else if err != nil && err.Error() == "Plan not available" {
+			HttpWrite(w, 422, map[string]string{"error": "PlanNotAvailable", "description": "The plan is not available to the organization."})
+			return
+		} else if err != nil && err.Error() == "Quota exceeded" {
+			HttpWrite(w, 422, map[string]string{"error": "QuotaExceeded", "description": "The organization's quota has been reached."})
+			return
+		} else if err != nil {
+			glog.Errorf("Unable to transfer the instance %s: %s\n", mux.Vars(r)["instance_id"], err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		HttpWrite(w, 200, transfer)
+	}).Methods("POST")
+
+	router.HandleFunc("/v2/admin/plans/{plan_id}/organizations", func(w http.ResponseWriter, r *http.Request) {
+		planId := mux.Vars(r)["plan_id"]
+		organizations, err := b.storage.GetPlanOrganizations()
+		if err != nil {
+			glog.Errorf("Unable to get the organizations of plan %s: %s\n", planId, err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		allowed, ok := organizations[planId]
+		if !ok {
+			allowed = make([]string, 0)
+		}
+		HttpWrite(w, 200, map[string]interface{}{"plan": planId, "organizations": allowed})
 	}).Methods("GET")
+
+	// Restricts a plan to the organizations listed, the body is {"organizations": [<organization>, ...]}.
+	// An empty list makes the plan available to everyone again.
+	router.HandleFunc("/v2/admin/plans/{plan_id}/organizations", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Organizations []string `json:"organizations"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Organizations == nil {
+			HttpWrite(w, 422, map[string]string{"error": "InvalidOrganizations", "description": "The body must be a json object with a list of organizations."})
+			return
+		}
+		for _, organization := range body.Organizations {
+			if strings.TrimSpace(organization) == "" {
+				HttpWrite(w, 422, map[string]string{"error": "InvalidOrganizations", "description": "The organizations must not be empty."})
+				return
+			}
+		}
+		planId := mux.Vars(r)["plan_id"]
+		if err := b.storage.SetPlanOrganizations(planId, body.Organizations); err != nil && err.Error() == "Not found" {
+			HttpWrite(w, 404, map[string]string{"error": "NotFound", "description": "The plan was not found."})
+			return
+		} else if err != nil {
+			glog.Errorf("Unable to set the organizations of plan %s: %s\n", planId, err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		glog.Infof("The organizations of plan %s were set to %v (request: %s)\n", planId, body.Organizations, r.Header.Get("x-request-id"))
+		HttpWrite(w, 200, map[string]interface{}{"plan": planId, "organizations": body.Organizations})
+	}).Methods("PUT")
+
+	// Changes the number of buckets preprovisioned for a plan, the body is {"preprovision": <count>}.
+	router.HandleFunc("/v2/admin/preprovision/{plan_id}", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Preprovision *int `json:"preprovision"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Preprovision == nil || *body.Preprovision < 0 {
+			HttpWrite(w, 422, map[string]string{"error": "InvalidPreprovision", "description": "The body must be a json object with a preprovision count of zero or more."})
+			return
+		}
+		planId := mux.Vars(r)["plan_id"]
+		if err := b.storage.SetPreprovision(planId, *body.Preprovision); err != nil && err.Error() == "Not found" {
+			HttpWrite(w, 404, map[string]string{"error": "NotFound", "description": "The plan was not found."})
+			return
+		} else if err != nil {
+			glog.Errorf("Unable to set the preprovision count of plan %s: %s\n", planId, err.Error())
+			HttpWrite(w, 500, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+			return
+		}
+		glog.Infof("The preprovision count of plan %s was set to %d (request: %s)\n", planId, *body.Preprovision, r.Header.Get("x-request-id"))
+		HttpWrite(w, 200, map[string]interface{}{"plan": planId, "preprovision": *body.Preprovision})
+	}).Methods("PUT")
 }
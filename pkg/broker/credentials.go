@@ -0,0 +1,384 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/golang/glog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StaticCredentials         = "static"
+	STSCredentials            = "sts"
+	IRSACredentials           = "irsa"
+	SecretsManagerCredentials = "secrets-manager"
+)
+
+// CredentialSettings are read from the provider_private_details of a plan (with any provider) and
+// choose how bindings authenticate, the default is the bucket user's static access keys.
+type CredentialSettings struct {
+	Credentials         string `json:"credentials,omitempty"`
+	CredentialsDuration int64  `json:"credentialsDuration,omitempty"`
+	RoleARN             string `json:"roleArn,omitempty"`
+	// CredentialsURI adds the credentials composed into a single S3_URL for frameworks expecting a DSN.
+	CredentialsURI bool `json:"credentialsUri,omitempty"`
+	// SSECustomerKey adds a key generated by the broker for server side encryption with customer
+	// provided keys (sse-c), for teams that must hold their keys rather than leave them in KMS.
+	SSECustomerKey bool `json:"sseCustomerKey,omitempty"`
+}
+
+func ValidateCredentialSettings(settings CredentialSettings) []string {
+	problems := make([]string, 0)
+	switch settings.Credentials {
+	case "", StaticCredentials, STSCredentials, SecretsManagerCredentials:
+	case IRSACredentials:
+		if settings.RoleARN == "" {
+			problems = append(problems, "The plan's credentials are irsa but roleArn is empty.")
+		}
+	default:
+		problems = append(problems, "The credentials "+settings.Credentials+" are not static, sts, irsa or secrets-manager.")
+	}
+	if settings.CredentialsDuration != 0 && (settings.CredentialsDuration < 900 || settings.CredentialsDuration > 43200) {
+		problems = append(problems, "The credentialsDuration must be a number of seconds between 900 and 43200.")
+	}
+	if settings.RoleARN != "" && settings.Credentials != IRSACredentials {
+		problems = append(problems, "The plan has a roleArn but its credentials are not irsa.")
+	}
+	if settings.Credentials == STSCredentials && GetCredentialsReferenceOnly() {
+		problems = append(problems, "The plan's credentials are sts but CREDENTIALS_REFERENCE_ONLY is set, temporary credentials would expire in the secret.")
+	}
+	if settings.SSECustomerKey {
+		if _, err := getCustomerKeyMasterKey(); err != nil {
+			problems = append(problems, "The plan has sseCustomerKey but "+err.Error())
+		}
+	}
+	return problems
+}
+
+// CredentialBroker creates the credentials handed to the bindings of an instance, the provider only
+// manages the bucket (and its user) so new ways of authenticating don't touch provisioning. The
+// instance passed has the access key of the binding.
+type CredentialBroker interface {
+	// Bind is called once when a binding is created, before its credentials are returned.
+	Bind(*Instance, string) error
+	// Credentials returns the credentials of the binding, each time the binding is fetched.
+	Credentials(*Instance, string) (map[string]interface{}, error)
+	// Unbind is called once when the binding is deleted.
+	Unbind(*Instance, string) error
+}
+
+func GetCredentialBroker(storage Storage, provider Provider, plan *ProviderPlan) (CredentialBroker, error) {
+	var settings CredentialSettings
+	if plan.providerPrivateDetails != "" {
+		if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &settings); err != nil {
+			return nil, err
+		}
+	}
+	// sts credentials would expire in the secret, the plan can't be bound or fetched however it got here.
+	if settings.Credentials == STSCredentials && GetCredentialsReferenceOnly() {
+		return nil, errors.New("The plan's credentials are sts, which can't be used with CREDENTIALS_REFERENCE_ONLY")
+	}
+	credentialBroker, err := newCredentialBroker(provider, settings)
+	if err != nil {
+		return nil, err
+	}
+	if settings.SSECustomerKey {
+		credentialBroker = CustomerKeyCredentialBroker{CredentialBroker: credentialBroker, storage: storage}
+	}
+	if settings.CredentialsURI {
+		credentialBroker = URICredentialBroker{CredentialBroker: credentialBroker}
+	}
+	if settings.Credentials == SecretsManagerCredentials || (GetCredentialsReferenceOnly() && settings.Credentials != IRSACredentials) {
+		credentialBroker = SecretsManagerCredentialBroker{CredentialBroker: credentialBroker, provider: provider}
+	}
+	return credentialBroker, nil
+}
+
+// With CREDENTIALS_REFERENCE_ONLY set to true no binding is given secrets, the credentials of every
+// plan (except irsa, which has none) are kept in Secrets Manager and only the secret is returned.
+func GetCredentialsReferenceOnly() bool {
+	return os.Getenv("CREDENTIALS_REFERENCE_ONLY") == "true"
+}
+
+func newCredentialBroker(provider Provider, settings CredentialSettings) (CredentialBroker, error) {
+	switch settings.Credentials {
+	case "", StaticCredentials:
+		return StaticCredentialBroker{provider: provider}, nil
+	case STSCredentials:
+		duration := settings.CredentialsDuration
+		if duration == 0 {
+			duration = 3600
+		}
+		return STSCredentialBroker{provider: provider, duration: duration}, nil
+	case IRSACredentials:
+		return IRSACredentialBroker{provider: provider, roleARN: settings.RoleARN}, nil
+	case SecretsManagerCredentials:
+		// the static credentials are kept in the secret, see GetCredentialBroker.
+		return StaticCredentialBroker{provider: provider}, nil
+	}
+	return nil, errors.New("Unknown credentials " + settings.Credentials + " in the plan.")
+}
+
+// The connection details of the bucket without the static access key.
+func bucketDetails(provider Provider, Instance *Instance) map[string]interface{} {
+	credentials := provider.GetUrl(Instance)
+	delete(credentials, "S3_ACCESS_KEY")
+	delete(credentials, "S3_SECRET_KEY")
+	return credentials
+}
+
+// URICredentialBroker adds the credentials of another broker composed into a url as S3_URL, e.g.,
+// s3://ACCESS:SECRET@s3.us-west-2.amazonaws.com/bucket?region=us-west-2 (with the session_token of
+// temporary credentials). Brokers that don't return keys have no user in the url.
+type URICredentialBroker struct {
+	CredentialBroker
+}
+
+func (broker URICredentialBroker) Credentials(Instance *Instance, BindingId string) (map[string]interface{}, error) {
+	credentials, err := broker.CredentialBroker.Credentials(Instance, BindingId)
+	if err != nil {
+		return nil, err
+	}
+	region, _ := credentials["S3_REGION"].(string)
+	bucket, _ := credentials["S3_BUCKET"].(string)
+	uri := url.URL{Scheme: "s3", Host: "s3." + region + "." + awsDNSSuffix(region), Path: "/" + bucket}
+	if endpoint, err := url.Parse(getS3Endpoint()); err == nil && endpoint.Host != "" {
+		uri.Host = endpoint.Host
+	}
+	if endpointURL, ok := credentials["S3_ENDPOINT_URL"].(string); ok {
+		if endpoint, err := url.Parse(endpointURL); err == nil && endpoint.Host != "" {
+			uri.Host = endpoint.Host
+		}
+	}
+	if accessKey, ok := credentials["S3_ACCESS_KEY"].(string); ok && accessKey != "" {
+		secretKey, _ := credentials["S3_SECRET_KEY"].(string)
+		uri.User = url.UserPassword(accessKey, secretKey)
+	}
+	query := url.Values{}
+	query.Set("region", region)
+	if token, ok := credentials["S3_SESSION_TOKEN"].(string); ok && token != "" {
+		query.Set("session_token", token)
+	}
+	uri.RawQuery = query.Encode()
+	credentials["S3_URL"] = uri.String()
+	return credentials, nil
+}
+
+// Whether the binding's credentials are kept in Secrets Manager.
+func usesSecretsManager(credentialBroker CredentialBroker) bool {
+	_, ok := credentialBroker.(SecretsManagerCredentialBroker)
+	return ok
+}
+
+// Puts the current access keys of the instance's bindings in their secrets after the keys changed
+// (e.g., the instance's credentials were rotated), plans without secrets have nothing to refresh.
+// Every binding is refreshed even if one fails, the first error is returned.
+func RefreshBindingSecrets(storage Storage, provider Provider, Instance *Instance) error {
+	credentialBroker, err := GetCredentialBroker(storage, provider, Instance.Plan)
+	if err != nil {
+		return err
+	}
+	secrets, ok := credentialBroker.(SecretsManagerCredentialBroker)
+	if !ok {
+		return nil
+	}
+	bindings, err := storage.GetBindings(Instance.Id)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for i := range bindings {
+		if err = secrets.Refresh(bindings[i].instance(Instance), bindings[i].Id); err != nil {
+			glog.Errorf("Unable to refresh the secret of binding %s to %s: %s\n", bindings[i].Id, Instance.Name, err.Error())
+			if failed == nil {
+				failed = err
+			}
+		}
+	}
+	return failed
+}
+
+// StaticCredentialBroker returns the access key of the bucket's user (or of a rotated binding).
+type StaticCredentialBroker struct {
+	provider Provider
+}
+
+func (broker StaticCredentialBroker) Bind(Instance *Instance, BindingId string) error {
+	return nil
+}
+
+func (broker StaticCredentialBroker) Credentials(Instance *Instance, BindingId string) (map[string]interface{}, error) {
+	return broker.provider.GetUrl(Instance), nil
+}
+
+func (broker StaticCredentialBroker) Unbind(Instance *Instance, BindingId string) error {
+	return nil
+}
+
+// STSCredentialBroker returns federated credentials limited to the bucket, new credentials are
+// issued each time the binding is fetched and expire after the plan's credentialsDuration.
+type STSCredentialBroker struct {
+	provider Provider
+	duration int64
+}
+
+func (broker STSCredentialBroker) Bind(Instance *Instance, BindingId string) error {
+	return nil
+}
+
+func (broker STSCredentialBroker) Credentials(Instance *Instance, BindingId string) (map[string]interface{}, error) {
+	temporary, err := broker.provider.TemporaryCredentials(Instance, &TemporaryCredentialsOptions{Duration: broker.duration})
+	if err != nil {
+		return nil, err
+	}
+	credentials := bucketDetails(broker.provider, Instance)
+	credentials["S3_ACCESS_KEY"] = temporary.AccessKeyId
+	credentials["S3_SECRET_KEY"] = temporary.SecretAccessKey
+	credentials["S3_SESSION_TOKEN"] = temporary.SessionToken
+	credentials["S3_CREDENTIALS_EXPIRATION"] = temporary.Expiration.UTC().Format(time.RFC3339)
+	return credentials, nil
+}
+
+func (broker STSCredentialBroker) Unbind(Instance *Instance, BindingId string) error {
+	return nil
+}
+
+// IRSACredentialBroker returns no keys, only a role that pods assume with their service account's
+// web identity. Each instance has its own role limited to its bucket, trusting the same identities as
+// the plan's roleArn (a template, its permissions aren't used). The role is removed when the instance
+// is deprovisioned.
+type IRSACredentialBroker struct {
+	provider Provider
+	roleARN  string
+}
+
+func (broker IRSACredentialBroker) Bind(Instance *Instance, BindingId string) error {
+	_, err := broker.provider.CreateInstanceRole(Instance, broker.roleARN)
+	return err
+}
+
+func (broker IRSACredentialBroker) Credentials(Instance *Instance, BindingId string) (map[string]interface{}, error) {
+	roleARN, err := broker.provider.CreateInstanceRole(Instance, broker.roleARN)
+	if err != nil {
+		return nil, err
+	}
+	credentials := bucketDetails(broker.provider, Instance)
+	credentials["AWS_ROLE_ARN"] = roleARN
+	return credentials, nil
+}
+
+func (broker IRSACredentialBroker) Unbind(Instance *Instance, BindingId string) error {
+	return nil
+}
+
+// SecretsManagerCredentialBroker keeps the credentials of another broker in a Secrets Manager secret
+// (in the bucket's region) and only returns the secret's name with the bucket's details, the secret
+// is deleted when the binding is.
+type SecretsManagerCredentialBroker struct {
+	CredentialBroker
+	provider Provider
+}
+
+var secretsManagerClients = struct {
+	sync.Mutex
+	session *session.Session
+	clients map[string]*secretsmanager.SecretsManager
+}{clients: make(map[string]*secretsmanager.SecretsManager)}
+
+func secretsManagerClient(region string) (*secretsmanager.SecretsManager, error) {
+	secretsManagerClients.Lock()
+	defer secretsManagerClients.Unlock()
+	if secretsManagerClients.session == nil {
+		sess, err := NewAWSSession()
+		if err != nil {
+			return nil, err
+		}
+		secretsManagerClients.session = sess
+	}
+	if _, ok := secretsManagerClients.clients[region]; !ok {
+		secretsManagerClients.clients[region] = secretsmanager.New(secretsManagerClients.session, aws.NewConfig().WithRegion(region))
+	}
+	return secretsManagerClients.clients[region], nil
+}
+
+// Secrets are named <SECRETS_MANAGER_PREFIX>/<bucket>/<binding id>, the prefix defaults to s3-broker.
+func secretName(Instance *Instance, BindingId string) string {
+	prefix := os.Getenv("SECRETS_MANAGER_PREFIX")
+	if prefix == "" {
+		prefix = "s3-broker"
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + Instance.Name + "/" + BindingId
+}
+
+func (broker SecretsManagerCredentialBroker) client(Instance *Instance) (*secretsmanager.SecretsManager, error) {
+	region, _ := broker.provider.GetUrl(Instance)["S3_REGION"].(string)
+	return secretsManagerClient(region)
+}
+
+func (broker SecretsManagerCredentialBroker) Bind(Instance *Instance, BindingId string) error {
+	if err := broker.CredentialBroker.Bind(Instance, BindingId); err != nil {
+		return err
+	}
+	return broker.Refresh(Instance, BindingId)
+}
+
+// Refresh puts the current credentials of the binding in its secret (creating it if it's missing),
+// e.g., after the access key it holds was rotated.
+func (broker SecretsManagerCredentialBroker) Refresh(Instance *Instance, BindingId string) error {
+	client, err := broker.client(Instance)
+	if err != nil {
+		return err
+	}
+	credentials, err := broker.CredentialBroker.Credentials(Instance, BindingId)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+	_, err = client.CreateSecret(&secretsmanager.CreateSecretInput{
+		Name:         aws.String(secretName(Instance, BindingId)),
+		Description:  aws.String("The credentials of binding " + BindingId + " to " + Instance.Name),
+		SecretString: aws.String(string(value)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == secretsmanager.ErrCodeResourceExistsException {
+		_, err = client.PutSecretValue(&secretsmanager.PutSecretValueInput{
+			SecretId:     aws.String(secretName(Instance, BindingId)),
+			SecretString: aws.String(string(value)),
+		})
+	}
+	return err
+}
+
+func (broker SecretsManagerCredentialBroker) Credentials(Instance *Instance, BindingId string) (map[string]interface{}, error) {
+	credentials := bucketDetails(broker.provider, Instance)
+	credentials["S3_CREDENTIALS_SECRET"] = secretName(Instance, BindingId)
+	return credentials, nil
+}
+
+func (broker SecretsManagerCredentialBroker) Unbind(Instance *Instance, BindingId string) error {
+	if err := broker.CredentialBroker.Unbind(Instance, BindingId); err != nil {
+		return err
+	}
+	client, err := broker.client(Instance)
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteSecret(&secretsmanager.DeleteSecretInput{
+		SecretId:                   aws.String(secretName(Instance, BindingId)),
+		ForceDeleteWithoutRecovery: aws.Bool(true),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+// The key that encrypts the sse-c keys kept in the database, SSE_C_MASTER_KEY is 32 bytes in base64.
+func getCustomerKeyMasterKey() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("SSE_C_MASTER_KEY"))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("The SSE_C_MASTER_KEY must be 32 bytes encoded in base64.")
+	}
+	return key, nil
+}
+
+func customerKeyCipher() (cipher.AEAD, error) {
+	masterKey, err := getCustomerKeyMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptCustomerKey(key []byte) (string, error) {
+	gcm, err := customerKeyCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, key, nil)), nil
+}
+
+func decryptCustomerKey(encryptedKey string) ([]byte, error) {
+	gcm, err := customerKeyCipher()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("The encrypted customer key is too short.")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// Whether the plan's buckets are encrypted with sse-c keys. Copies made by the broker (backups,
+// restores, seeding and ownership transfers) can't read or write such objects and are refused.
+func UsesCustomerKey(plan *ProviderPlan) bool {
+	var settings CredentialSettings
+	if plan.providerPrivateDetails != "" {
+		if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &settings); err != nil {
+			return false
+		}
+	}
+	return settings.SSECustomerKey
+}
+
+const customerKeyCopyMessage = "The plan encrypts objects with a customer provided key (sse-c), which the broker can't copy."
+
+// Returns the sse-c key of the instance, the key is generated the first time it's needed. Every
+// binding is given the same key, objects written with it can't be read without it.
+func GetCustomerKey(storage Storage, Instance *Instance) ([]byte, error) {
+	encryptedKey, err := storage.GetCustomerKey(Instance.Id)
+	if err != nil && err.Error() == "Not found" {
+		key := make([]byte, 32)
+		if _, err = io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		if encryptedKey, err = encryptCustomerKey(key); err != nil {
+			return nil, err
+		}
+		encryptedKey, err = storage.AddCustomerKey(Instance.Id, encryptedKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decryptCustomerKey(encryptedKey)
+}
+
+// CustomerKeyCredentialBroker adds the instance's sse-c key to the credentials of another broker, as
+// S3_SSE_C_KEY (and its S3_SSE_C_KEY_MD5) in base64, which applications send with every request.
+type CustomerKeyCredentialBroker struct {
+	CredentialBroker
+	storage Storage
+}
+
+func (broker CustomerKeyCredentialBroker) Bind(Instance *Instance, BindingId string) error {
+	if _, err := GetCustomerKey(broker.storage, Instance); err != nil {
+		return err
+	}
+	return broker.CredentialBroker.Bind(Instance, BindingId)
+}
+
+func (broker CustomerKeyCredentialBroker) Credentials(Instance *Instance, BindingId string) (map[string]interface{}, error) {
+	credentials, err := broker.CredentialBroker.Credentials(Instance, BindingId)
+	if err != nil {
+		return nil, err
+	}
+	key, err := GetCustomerKey(broker.storage, Instance)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(key)
+	credentials["S3_SSE_C_ALGORITHM"] = "AES256"
+	credentials["S3_SSE_C_KEY"] = base64.StdEncoding.EncodeToString(key)
+	credentials["S3_SSE_C_KEY_MD5"] = base64.StdEncoding.EncodeToString(sum[:])
+	return credentials, nil
+}
@@ -0,0 +1,241 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The actions the dashboard has buttons for, by the name of the extension action they run.
+var dashboardActions = []struct {
+	Name    string
+	Title   string
+	Confirm string
+}{
+	{Name: "rotate_credentials", Title: "Rotate credentials", Confirm: "Bound apps must be rebound to get the new credentials, rotate them?"},
+	{Name: "backup", Title: "Back up", Confirm: "Copy the bucket's objects to a new backup?"},
+	{Name: "freeze", Title: "Freeze", Confirm: "Writes and deletes will be denied until the bucket is unfrozen, freeze it?"},
+	{Name: "unfreeze", Title: "Unfreeze", Confirm: "Allow writes and deletes again?"},
+}
+
+// Instances are given a dashboard_url when both DASHBOARD_URL (the url the broker is reached at by
+// users, e.g., https://s3-broker.example.com) and DASHBOARD_SECRET are set.
+func GetDashboardUrl() string {
+	if os.Getenv("DASHBOARD_SECRET") == "" {
+		return ""
+	}
+	return strings.TrimSuffix(os.Getenv("DASHBOARD_URL"), "/")
+}
+
+// The dashboard has no login, each instance's page is reached with a token signed with
+// DASHBOARD_SECRET so only those given the dashboard_url can see it.
+func DashboardToken(InstanceId string) string {
+	h := hmac.New(sha256.New, []byte(os.Getenv("DASHBOARD_SECRET")))
+	h.Write([]byte(InstanceId))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func validDashboardToken(InstanceId string, token string) bool {
+	return GetDashboardUrl() != "" && token != "" && hmac.Equal([]byte(token), []byte(DashboardToken(InstanceId)))
+}
+
+// The dashboard_url of the instance, or nil if the dashboard isn't enabled.
+func DashboardUrl(InstanceId string) *string {
+	base := GetDashboardUrl()
+	if base == "" {
+		return nil
+	}
+	dashboard := base + "/dashboard/" + url.PathEscape(InstanceId) + "?token=" + DashboardToken(InstanceId)
+	return &dashboard
+}
+
+type dashboardBar struct {
+	X      int
+	Y      int
+	Height int
+	Label  string
+}
+
+type dashboardPage struct {
+	Base     string
+	Instance *Instance
+	Plan     string
+	Token    string
+	Tasks    []Task
+	Usage    []dashboardBar
+	Latest   *Usage
+	Actions  interface{}
+	Done     string
+	Error    string
+}
+
+func formatBytes(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	value := float64(bytes)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + units[i]
+}
+
+// Scales the stored bytes of up to the last 30 metering periods (oldest first) into the bars of a
+// 600x120 graph.
+func usageBars(usages []Usage) []dashboardBar {
+	if len(usages) > 30 {
+		usages = usages[:30]
+	}
+	var max int64
+	for _, usage := range usages {
+		if usage.Bytes > max {
+			max = usage.Bytes
+		}
+	}
+	bars := make([]dashboardBar, 0)
+	for i := len(usages) - 1; i >= 0; i-- {
+		height := 0
+		if max > 0 {
+			height = int(usages[i].Bytes * 120 / max)
+		}
+		bars = append(bars, dashboardBar{
+			X:      len(bars) * 20,
+			Y:      120 - height,
+			Height: height,
+			Label:  usages[i].End.Format("2006-01-02 15:04") + ": " + formatBytes(usages[i].Bytes),
+		})
+	}
+	return bars
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!doctype html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>{{.Instance.Name}}</title>
+  <style>
+    body { font-family: sans-serif; margin: 2em; color: #222; }
+    table { border-collapse: collapse; margin-bottom: 1.5em; }
+    td, th { padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; text-align: left; vertical-align: top; }
+    .done { background: #e6f4ea; padding: 0.5em; }
+    .error { background: #fce8e6; padding: 0.5em; }
+    form { display: inline; }
+    rect { fill: #4a7bd0; }
+  </style>
+</head>
+<body>
+  <h1>{{.Instance.Name}}{{if .Instance.Alias}} ({{.Instance.Alias}}){{end}}</h1>
+  {{if .Done}}<p class="done">{{.Done}} was started.</p>{{end}}
+  {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+  <table>
+    <tr><th>Status</th><td>{{.Instance.Status}}</td></tr>
+    <tr><th>Plan</th><td>{{.Plan}}</td></tr>
+    {{if .Instance.Region}}<tr><th>Region</th><td>{{.Instance.Region}}</td></tr>{{end}}
+    <tr><th>Endpoint</th><td>{{.Instance.Endpoint}}</td></tr>
+    {{if .Latest}}<tr><th>Stored</th><td>{{.Latest.Objects}} objects as of {{.Latest.End.Format "2006-01-02 15:04"}}</td></tr>{{end}}
+  </table>
+  {{range .Actions}}<form method="post" action="{{$.Base}}/dashboard/{{$.Instance.Id}}/{{.Name}}" onsubmit="return confirm('{{.Confirm}}')"><input type="hidden" name="token" value="{{$.Token}}"><button type="submit">{{.Title}}</button></form> {{end}}
+  <h2>Usage</h2>
+  {{if .Usage}}<svg width="600" height="120" role="img">{{range .Usage}}<rect x="{{.X}}" y="{{.Y}}" width="16" height="{{.Height}}"><title>{{.Label}}</title></rect>{{end}}</svg>{{else}}<p>The bucket hasn't been metered yet.</p>{{end}}
+  <h2>Recent tasks</h2>
+  <table>
+    <tr><th>Action</th><th>Status</th><th>Retries</th><th>Started</th><th>Finished</th><th>Result</th></tr>
+    {{range .Tasks}}<tr><td>{{.Action}}</td><td>{{.Status}}</td><td>{{.Retries}}</td><td>{{if .Started}}{{.Started.Format "2006-01-02 15:04"}}{{end}}</td><td>{{if .Finished}}{{.Finished.Format "2006-01-02 15:04"}}{{end}}</td><td>{{.Result}}</td></tr>{{else}}<tr><td colspan="6">No tasks.</td></tr>{{end}}
+  </table>
+</body>
+</html>
+`))
+
+func (b *BusinessLogic) renderDashboard(w http.ResponseWriter, status int, InstanceId string, done string, message string) {
+	Instance, err := b.GetInstanceById(InstanceId)
+	if err != nil {
+		http.Error(w, "The instance was not found.", http.StatusNotFound)
+		return
+	}
+	page := dashboardPage{Base: GetDashboardUrl(), Instance: Instance, Plan: Instance.Plan.basePlan.Name, Token: DashboardToken(InstanceId), Actions: dashboardActions, Done: done, Error: message}
+	if Instance.Plan.basePlan.Description != "" {
+		page.Plan = page.Plan + " - " + Instance.Plan.basePlan.Description
+	}
+	if page.Tasks, err = b.storage.GetTasks(Instance.Id, 10); err != nil {
+		glog.Errorf("Unable to get the tasks of %s for its dashboard: %s\n", Instance.Name, err.Error())
+	}
+	usages, err := b.storage.GetUsage(Instance.Id)
+	if err != nil {
+		glog.Errorf("Unable to get the usage of %s for its dashboard: %s\n", Instance.Name, err.Error())
+	} else if len(usages) > 0 {
+		page.Usage = usageBars(usages)
+		page.Latest = &usages[0]
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	if err = dashboardTemplate.Execute(w, page); err != nil {
+		glog.Errorf("Unable to render the dashboard of %s: %s\n", Instance.Name, err.Error())
+	}
+}
+
+// Serves the dashboard of each instance (see DashboardUrl), its buttons run the extension actions in
+// dashboardActions as if they were called through the api.
+func DashboardRoutes(router *mux.Router, b *BusinessLogic) {
+	router.HandleFunc("/dashboard/{instance_id}", func(w http.ResponseWriter, r *http.Request) {
+		InstanceId := mux.Vars(r)["instance_id"]
+		if !validDashboardToken(InstanceId, r.URL.Query().Get("token")) {
+			http.Error(w, "The dashboard link is not valid.", http.StatusForbidden)
+			return
+		}
+		done := ""
+		for _, action := range dashboardActions {
+			if action.Name == r.URL.Query().Get("done") {
+				done = action.Title
+			}
+		}
+		b.renderDashboard(w, http.StatusOK, InstanceId, done, "")
+	}).Methods("GET")
+
+	router.HandleFunc("/dashboard/{instance_id}/{action_name}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if !validDashboardToken(vars["instance_id"], r.PostFormValue("token")) {
+			http.Error(w, "The dashboard link is not valid.", http.StatusForbidden)
+			return
+		}
+		allowed := false
+		for _, action := range dashboardActions {
+			allowed = allowed || action.Name == vars["action_name"]
+		}
+		var handler func(string, map[string]string, *broker.RequestContext) (interface{}, error)
+		for _, action := range b.actions {
+			if allowed && action.name == vars["action_name"] {
+				handler = action.handler
+			}
+		}
+		if handler == nil {
+			http.Error(w, "The action was not found.", http.StatusNotFound)
+			return
+		}
+		c := broker.RequestContext{Request: r, Writer: w}
+		if _, err := handler(vars["instance_id"], map[string]string{"instance_id": vars["instance_id"]}, &c); err != nil {
+			message := "The action failed."
+			status := http.StatusInternalServerError
+			if httpErr, ok := osb.IsHTTPError(err); ok {
+				status = httpErr.StatusCode
+				if httpErr.Description != nil {
+					message = *httpErr.Description
+				}
+			}
+			b.renderDashboard(w, status, vars["instance_id"], "", message)
+			return
+		}
+		http.Redirect(w, r, *DashboardUrl(vars["instance_id"])+"&done="+url.QueryEscape(vars["action_name"]), http.StatusSeeOther)
+	}).Methods("POST")
+}
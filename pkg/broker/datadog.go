@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"github.com/golang/glog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Events and task failures are sent to a Datadog agent (DogStatsD) when DATADOG_ENABLED is true,
+// for clusters without prometheus. The agent is found with the agent's own DD_AGENT_HOST and
+// DD_DOGSTATSD_PORT (localhost:8125 by default), DD_TAGS are added to everything sent.
+var datadog = struct {
+	sync.Mutex
+	conn net.Conn
+	tags []string
+}{}
+
+func InitDatadog() error {
+	datadog.Lock()
+	defer datadog.Unlock()
+	if datadog.conn != nil {
+		datadog.conn.Close()
+		datadog.conn = nil
+	}
+	if os.Getenv("DATADOG_ENABLED") != "true" {
+		return nil
+	}
+	host := os.Getenv("DD_AGENT_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	port := os.Getenv("DD_DOGSTATSD_PORT")
+	if port == "" {
+		port = "8125"
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+	datadog.conn = conn
+	datadog.tags = []string{"service:s3-broker"}
+	for _, tag := range strings.FieldsFunc(os.Getenv("DD_TAGS"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		datadog.tags = append(datadog.tags, tag)
+	}
+	return nil
+}
+
+// Tag values can't contain the characters DogStatsD uses as separators.
+func datadogTag(name string, value string) string {
+	return name + ":" + strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", " ").Replace(value)
+}
+
+func sendDatadog(packet string, tags []string) {
+	datadog.Lock()
+	defer datadog.Unlock()
+	if datadog.conn == nil {
+		return
+	}
+	tags = append(append([]string{}, datadog.tags...), tags...)
+	if _, err := datadog.conn.Write([]byte(packet + "|#" + strings.Join(tags, ","))); err != nil {
+		glog.Errorf("Unable to send to the datadog agent: %s\n", err.Error())
+	}
+}
+
+// Sends a Datadog event and increments the s3broker.events counter, alertType is one of info,
+// warning, error or success.
+func SendDatadogEvent(title string, text string, alertType string, tags []string) {
+	text = strings.Replace(text, "\n", "\\n", -1)
+	sendDatadog("_e{"+strconv.Itoa(len(title))+","+strconv.Itoa(len(text))+"}:"+title+"|"+text+"|t:"+alertType+"|s:s3-broker", tags)
+	sendDatadog("s3broker.events:1|c", tags)
+}
+
+func datadogEvent(event Event) {
+	tags := []string{datadogTag("event", string(event.Type)), datadogTag("instance", event.InstanceId)}
+	if event.PlanId != "" {
+		tags = append(tags, datadogTag("plan", event.PlanId))
+	}
+	if event.Organization != "" {
+		tags = append(tags, datadogTag("org", event.Organization))
+	}
+	if event.Region != "" {
+		tags = append(tags, datadogTag("region", event.Region))
+	}
+	SendDatadogEvent(string(event.Type), "Bucket "+event.Name+" ("+event.InstanceId+")", "info", tags)
+}
+
+func datadogTaskFailed(storage Storage, taskId string, result string) {
+	datadog.Lock()
+	enabled := datadog.conn != nil
+	datadog.Unlock()
+	if !enabled {
+		return
+	}
+	tags := []string{datadogTag("task", taskId)}
+	task, err := storage.GetTaskContext(taskId)
+	if err != nil {
+		glog.Errorf("Unable to get task %s to send its failure to datadog: %s\n", taskId, err.Error())
+	} else {
+		tags = append(tags, datadogTag("action", string(task.Action)), datadogTag("instance", task.ResourceId))
+		if task.PlanId != "" {
+			tags = append(tags, datadogTag("plan", task.PlanId))
+		}
+		if task.Organization != "" {
+			tags = append(tags, datadogTag("org", task.Organization))
+		}
+	}
+	SendDatadogEvent("Task failed", "Task "+taskId+" failed: "+result, "error", tags)
+	sendDatadog("s3broker.tasks.failed:1|c", tags)
+}
@@ -0,0 +1,79 @@
+package broker
+
+import (
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"net/http"
+)
+
+// ErrorCode is an error the broker may return in the error field of a response body, the codes are
+// listed in the errors of the service's metadata in the catalog.
+type ErrorCode struct {
+	Code        string `json:"code"`
+	Status      int    `json:"status"`
+	Description string `json:"description"`
+}
+
+var ErrorCodes = []ErrorCode{
+	{"AsyncRequired", 422, "The request must include accepts_incomplete=true."},
+	{"ConcurrencyError", 422, "Another operation on the instance is in progress."},
+	{"InstanceRequired", 422, "The instance id was not provided."},
+	{"InstanceInvalid", 422, "The instance id is already in use or invalid."},
+	{"InvalidParameters", 422, "The provision or update parameters are not valid."},
+	{"PlanNotAvailable", 422, "The plan is not available to the organization."},
+	{"RegionNotAllowed", 422, "The plan does not allow the requested region."},
+	{"QuotaExceeded", 422, "The organization (or space) has reached its quota of instances of the plan."},
+	{"CapacityExceeded", 422, "An AWS limit was reached, the broker's administrator can have it raised."},
+	{"UpgradeError", 422, "The plan can't be changed to the requested plan."},
+	{"ServiceNotYetAvailable", 422, "The instance is not available yet."},
+	{"UnprocessableEntity", 422, "The instance can't be changed in its current state."},
+	{"DeletionProtected", 422, "The instance is protected from deletion."},
+	{"InstanceFrozen", 422, "The instance is frozen (read only) and must be unfrozen first."},
+	{"BucketNotEmpty", 422, "The plan requires buckets to be empty before they're deprovisioned."},
+	{"InvalidPredecessor", 422, "The predecessor binding is not a binding of the instance."},
+	{"InvalidFormat", 422, "The credentials format is not supported (by the plan)."},
+	{"InvalidAlias", 422, "The alias is not valid."},
+	{"InvalidDuration", 422, "The duration of temporary credentials is not valid."},
+	{"InvalidLifecycle", 422, "The lifecycle rules are not valid."},
+	{"InvalidAlert", 422, "The alert is not valid."},
+	{"InvalidWebhook", 422, "The webhook did not respond to the verification challenge."},
+	{"ConfirmationRequired", 422, "The action must be confirmed with the name of the bucket."},
+	{"ObjectLockRequired", 422, "The plan does not create buckets with object lock."},
+	{"BackupRequired", 422, "The backup or restore point to restore was not given."},
+	{"BackupNotFound", 422, "The backup is not a backup of the instance."},
+	{"BackupNotAvailable", 422, "The backup has not finished."},
+	{"ReplicationNotEnabled", 422, "The bucket is not replicated."},
+	{"CustomerKeyNotSupported", 422, "The plan encrypts objects with customer provided keys, which the broker can't copy."},
+	{"NameInUse", 409, "A bucket or user with the generated name already exists, the request can be retried."},
+	{"Conflict", 409, "The request conflicts with an existing instance or binding."},
+	{"NotFound", 404, "The instance or binding was not found."},
+	{"ProviderThrottled", 503, "AWS is throttling the broker, the request can be retried later."},
+	{"ProviderUnavailable", 503, "AWS is failing repeatedly, the request can be retried later."},
+	{"ProviderAccessDenied", 500, "The broker is not permitted to make the change in AWS."},
+	{"InternalServerError", 500, "An unexpected error, the details are in the broker's logs."},
+}
+
+func newHTTPError(status int, code string, description string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:   status,
+		ErrorMessage: &code,
+		Description:  &description,
+	}
+}
+
+// Writes any error as an OSB error body with an error code and description, errors that aren't
+// http errors are internal server errors (their details are only logged, never returned).
+func WriteError(w http.ResponseWriter, err error) {
+	httpErr, ok := osb.IsHTTPError(err)
+	if !ok {
+		HttpWrite(w, http.StatusInternalServerError, map[string]string{"error": "InternalServerError", "description": "Internal Server Error"})
+		return
+	}
+	body := map[string]string{"error": http.StatusText(httpErr.StatusCode), "description": http.StatusText(httpErr.StatusCode)}
+	if httpErr.ErrorMessage != nil {
+		body["error"] = *httpErr.ErrorMessage
+	}
+	if httpErr.Description != nil {
+		body["description"] = *httpErr.Description
+	}
+	HttpWrite(w, httpErr.StatusCode, body)
+}
@@ -0,0 +1,105 @@
+package broker
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/golang/glog"
+	"os"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	InstanceProvisionedEvent   EventType = "instance.provisioned"
+	InstanceDeprovisionedEvent EventType = "instance.deprovisioned"
+	CredentialsRotatedEvent    EventType = "instance.credentials_rotated"
+	PlanChangedEvent           EventType = "instance.plan_changed"
+	StorageQuotaExceededEvent  EventType = "instance.storage_quota_exceeded"
+	AccessKeyDeactivatedEvent  EventType = "instance.access_key_deactivated"
+	AccessKeyReactivatedEvent  EventType = "instance.access_key_reactivated"
+)
+
+// Event is the message body published to SNS_TOPIC_ARN, credentials are never included.
+type Event struct {
+	Type         EventType `json:"type"`
+	InstanceId   string    `json:"instance_id"`
+	Name         string    `json:"name"`
+	PlanId       string    `json:"plan_id,omitempty"`
+	Region       string    `json:"region,omitempty"`
+	Organization string    `json:"organization,omitempty"`
+	RequestId    string    `json:"request_id,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+var events = struct {
+	sync.Mutex
+	topic  string
+	client *sns.SNS
+}{}
+
+// Events are only published to SNS when SNS_TOPIC_ARN is set, they're sent to Datadog whenever
+// it's enabled (see InitDatadog).
+func InitEvents() error {
+	events.Lock()
+	defer events.Unlock()
+	events.topic = os.Getenv("SNS_TOPIC_ARN")
+	events.client = nil
+	if events.topic == "" {
+		return nil
+	}
+	sess, err := NewAWSSession()
+	if err != nil {
+		return err
+	}
+	events.client = sns.New(sess)
+	return nil
+}
+
+// Publishes an event for the instance, the type is also set as the "type" message attribute so
+// subscribers can use an SNS filter policy. Publishing is done in the background and failures are
+// only logged, an event is never a reason to fail the operation it describes.
+func PublishEvent(eventType EventType, Instance *Instance, Organization string, RequestId string) {
+	events.Lock()
+	client := events.client
+	topic := events.topic
+	events.Unlock()
+	event := Event{
+		Type:         eventType,
+		InstanceId:   Instance.Id,
+		Name:         Instance.Name,
+		Region:       Instance.Region,
+		Organization: Organization,
+		RequestId:    RequestId,
+		Time:         time.Now().UTC(),
+	}
+	if Instance.Plan != nil {
+		event.PlanId = Instance.Plan.ID
+	}
+	datadogEvent(event)
+	if client == nil {
+		return
+	}
+	byteData, err := json.Marshal(event)
+	if err != nil {
+		glog.Errorf("Unable to marshal %s event for %s: %s\n", eventType, Instance.Name, err.Error())
+		return
+	}
+	go (func() {
+		_, err := client.Publish(&sns.PublishInput{
+			TopicArn: aws.String(topic),
+			Message:  aws.String(string(byteData)),
+			MessageAttributes: map[string]*sns.MessageAttributeValue{
+				"type": &sns.MessageAttributeValue{
+					DataType:    aws.String("String"),
+					StringValue: aws.String(string(eventType)),
+				},
+			},
+		})
+		if err != nil {
+			glog.Errorf("Unable to publish %s event for %s: %s\n", eventType, Instance.Name, err.Error())
+		}
+	})()
+}
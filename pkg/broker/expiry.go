@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/golang/glog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Instances on plans with a ttl-days attribute (e.g., dev or sandbox plans) are deprovisioned that
+// many days after they're provisioned, 0 (the default) never expires them.
+func GetPlanTTLDays(plan *ProviderPlan) (int64, error) {
+	return planAttributeDays(plan, "ttl-days", 0)
+}
+
+func ValidateExpiryAttributes(plan *ProviderPlan) []string {
+	if _, err := GetPlanTTLDays(plan); err != nil {
+		return []string{err.Error()}
+	}
+	return []string{}
+}
+
+// The owner's webhook is warned this many days (EXPIRY_WARNING_DAYS, 3 by default) before the
+// instance expires.
+func GetExpiryWarningDays() int64 {
+	days, err := strconv.ParseInt(os.Getenv("EXPIRY_WARNING_DAYS"), 10, 64)
+	if err != nil || days < 0 {
+		return 3
+	}
+	return days
+}
+
+// Records when a new instance expires if its plan has a ttl, the webhook and secret given with the
+// provision (if any) are warned before it does.
+func ScheduleExpiration(storage Storage, Instance *Instance, plan *ProviderPlan, webhook string, secret string) error {
+	days, err := GetPlanTTLDays(plan)
+	if err != nil || days == 0 {
+		return err
+	}
+	expiration := Expiration{InstanceId: Instance.Id, Expires: time.Now().Add(time.Hour * 24 * time.Duration(days)), Webhook: webhook, Secret: secret}
+	if err = storage.AddExpiration(&expiration); err != nil {
+		return err
+	}
+	glog.Infof("The instance %s expires at %s\n", Instance.Name, expiration.Expires.Format(time.RFC3339))
+	return nil
+}
+
+// Warns the owners of instances about to expire and schedules the deprovision of those that have.
+// Instances that are deletion protected or frozen aren't deprovisioned until they no longer are,
+// and instances changed to a plan without a ttl no longer expire.
+func RunExpirations(namePrefix string, storage Storage) error {
+	warning := time.Hour * 24 * time.Duration(GetExpiryWarningDays())
+	expirations, err := storage.GetExpirations(time.Now().Add(warning))
+	if err != nil {
+		return err
+	}
+	for _, expiration := range expirations {
+		Instance, err := GetInstanceById(namePrefix, storage, expiration.InstanceId)
+		if err != nil {
+			glog.Errorf("Unable to get the expiring instance %s: %s\n", expiration.InstanceId, err.Error())
+			continue
+		}
+		if days, err := GetPlanTTLDays(Instance.Plan); err == nil && days == 0 {
+			if err = storage.RemoveExpiration(Instance.Id); err != nil {
+				glog.Errorf("Unable to remove the expiration of %s: %s\n", Instance.Name, err.Error())
+			}
+			continue
+		}
+		if expiration.Expires.After(time.Now()) {
+			if expiration.Warned != nil {
+				continue
+			}
+			description := "The bucket " + Instance.Name + " expires at " + expiration.Expires.Format(time.RFC3339) + " and will then be deprovisioned."
+			if expiration.Webhook != "" {
+				metadata, err := json.Marshal(WebhookTaskMetadata{Url: expiration.Webhook, Secret: expiration.Secret, MaxAttempts: 5, Description: description})
+				if err != nil {
+					return err
+				}
+				if _, err = storage.AddTask(Instance.Id, NotifyExpiryWebhookTask, string(metadata), ""); err != nil {
+					glog.Errorf("Unable to schedule the expiry warning of %s: %s\n", Instance.Name, err.Error())
+					continue
+				}
+			}
+			if err = storage.AddEvent(Instance.Id, "expiry-warning", description, ""); err != nil {
+				glog.Errorf("Unable to record the expiry warning of %s: %s\n", Instance.Name, err.Error())
+			}
+			if err = storage.SetExpirationWarned(Instance.Id); err != nil {
+				glog.Errorf("Unable to record the expiry warning of %s: %s\n", Instance.Name, err.Error())
+			}
+			continue
+		}
+		protected, err := storage.IsDeletionProtected(Instance.Id)
+		if err != nil {
+			glog.Errorf("Unable to check the deletion protection of the expired instance %s: %s\n", Instance.Name, err.Error())
+			continue
+		}
+		frozen, err := storage.IsFrozen(Instance.Id)
+		if err != nil {
+			glog.Errorf("Unable to check if the expired instance %s is frozen: %s\n", Instance.Name, err.Error())
+			continue
+		}
+		if protected || frozen {
+			glog.Infof("The instance %s has expired but is deletion protected or frozen, it will not be deprovisioned.\n", Instance.Name)
+			continue
+		}
+		// Plans that require buckets to be empty before they're deprovisioned expire them once they are.
+		provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+		if err != nil {
+			glog.Errorf("Unable to get the provider of the expired instance %s: %s\n", Instance.Name, err.Error())
+			continue
+		}
+		if err = provider.ValidateDeprovision(Instance); err != nil && err.Error() == "Bucket not empty" {
+			glog.Infof("The instance %s has expired but is not empty, it will not be deprovisioned until it is.\n", Instance.Name)
+			continue
+		} else if err != nil {
+			glog.Errorf("Unable to check the expired instance %s can be deprovisioned: %s\n", Instance.Name, err.Error())
+			continue
+		}
+		if _, err = storage.AddTask(Instance.Id, DeleteTask, Instance.Name, ""); err != nil {
+			glog.Errorf("Unable to schedule the deprovision of the expired instance %s: %s\n", Instance.Name, err.Error())
+			continue
+		}
+		if err = storage.AddEvent(Instance.Id, "expired", "The bucket expired and is being deprovisioned.", ""); err != nil {
+			glog.Errorf("Unable to record the expiry of %s: %s\n", Instance.Name, err.Error())
+		}
+		if err = storage.RemoveExpiration(Instance.Id); err != nil {
+			glog.Errorf("Unable to remove the expiration of %s: %s\n", Instance.Name, err.Error())
+		}
+		glog.Infof("The instance %s expired, its deprovision was scheduled.\n", Instance.Name)
+	}
+	return nil
+}
+
+func TickTocExpirations(ctx context.Context, namePrefix string, storage Storage) {
+	next_check := time.NewTicker(time.Minute * 15)
+	defer next_check.Stop()
+	for {
+		if err := RunExpirations(namePrefix, storage); err != nil {
+			glog.Errorf("Unable to check for expired instances: %s\n", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-next_check.C:
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const IdleTag = "candidate-for-removal"
+
+// Claimed instances without any requests in IDLE_DAYS are reported as idle, 0 (the default) turns
+// this off. Requests are read from the metered usage, so only buckets with request metrics (see
+// AWS_S3_REQUEST_METRICS) metered for the whole period can be idle.
+func GetIdleDays() int64 {
+	days, err := strconv.ParseInt(os.Getenv("IDLE_DAYS"), 10, 64)
+	if err != nil || days < 0 {
+		return 0
+	}
+	return days
+}
+
+// With IDLE_TAG set to true idle buckets are tagged candidate-for-removal, the tag is removed once
+// they have requests again.
+func GetIdleTag() bool {
+	return os.Getenv("IDLE_TAG") == "true"
+}
+
+// Updates the idle instances, a notification is sent listing the instances that became idle.
+func RunIdleInstanceDetection(namePrefix string, storage Storage, idleDays int64, tag bool) error {
+	ids, err := storage.FindIdleInstanceIds(time.Now().Add(-time.Hour*24*time.Duration(idleDays)), GetMeteringInterval())
+	if err != nil {
+		return err
+	}
+	previous, err := storage.GetIdleInstances()
+	if err != nil {
+		return err
+	}
+	idle := make(map[string]bool)
+	for _, id := range ids {
+		idle[id] = true
+	}
+	known := make(map[string]bool)
+	for _, instance := range previous {
+		known[instance.Id] = true
+		if idle[instance.Id] {
+			continue
+		}
+		if instance.Tagged {
+			if Instance, err := GetInstanceById(namePrefix, storage, instance.Id); err != nil {
+				glog.Errorf("Unable to get %s to remove its %s tag: %s\n", instance.Name, IdleTag, err.Error())
+			} else if provider, err := GetProviderByPlan(namePrefix, Instance.Plan); err != nil {
+				glog.Errorf("Unable to get the provider of %s to remove its %s tag: %s\n", instance.Name, IdleTag, err.Error())
+			} else if err = provider.Untag(Instance, IdleTag); err != nil {
+				glog.Errorf("Unable to remove the %s tag of %s: %s\n", IdleTag, instance.Name, err.Error())
+				continue
+			}
+		}
+		if err = storage.RemoveIdleInstance(instance.Id); err != nil {
+			glog.Errorf("Unable to remove the idle instance %s: %s\n", instance.Name, err.Error())
+		}
+	}
+	names := make([]string, 0)
+	for _, id := range ids {
+		if !known[id] {
+			if err = storage.AddIdleInstance(id); err != nil {
+				glog.Errorf("Unable to record the idle instance %s: %s\n", id, err.Error())
+				continue
+			}
+		}
+		Instance, err := GetInstanceById(namePrefix, storage, id)
+		if err != nil {
+			glog.Errorf("Unable to get the idle instance %s: %s\n", id, err.Error())
+			continue
+		}
+		if !known[id] {
+			names = append(names, Instance.Name)
+			glog.Infof("The instance %s has had no requests in %d days\n", Instance.Name, idleDays)
+		}
+		if tag {
+			if err = tagIdleInstance(namePrefix, storage, Instance, previous); err != nil {
+				glog.Errorf("Unable to tag the idle instance %s: %s\n", Instance.Name, err.Error())
+			}
+		}
+	}
+	if len(names) > 0 {
+		SendNotification("idle-instances", "Idle buckets", strconv.Itoa(len(names))+" buckets have had no requests in "+strconv.FormatInt(idleDays, 10)+" days and may no longer be needed: "+strings.Join(names, ", ")+". GET /v2/admin/idle-instances lists every idle bucket.")
+	}
+	return nil
+}
+
+func tagIdleInstance(namePrefix string, storage Storage, Instance *Instance, previous []IdleInstance) error {
+	for _, instance := range previous {
+		if instance.Id == Instance.Id && instance.Tagged {
+			return nil
+		}
+	}
+	provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+	if err != nil {
+		return err
+	}
+	if err = provider.Tag(Instance, IdleTag, "true"); err != nil {
+		return err
+	}
+	return storage.SetIdleInstanceTagged(Instance.Id)
+}
+
+func TickTocIdleInstanceDetection(ctx context.Context, namePrefix string, storage Storage) {
+	next_check := time.NewTicker(time.Hour)
+	defer next_check.Stop()
+	for {
+		if days := GetIdleDays(); days > 0 {
+			if err := RunIdleInstanceDetection(namePrefix, storage, days, GetIdleTag()); err != nil {
+				glog.Errorf("Unable to detect idle instances: %s\n", err.Error())
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-next_check.C:
+		}
+	}
+}
@@ -22,6 +22,8 @@ type Instance struct {
 	Engine        string        `json:"engine"`
 	EngineVersion string        `json:"engine_version"`
 	Scheme        string        `json:"scheme"`
+	Region        string        `json:"region,omitempty"`
+	Alias         string        `json:"alias,omitempty"`
 }
 
 type Entry struct {
@@ -34,6 +36,8 @@ type Entry struct {
 	Username string
 	Password string
 	Endpoint string
+	Region   string
+	Alias    string
 }
 
 func (i *Instance) Match(other *Instance) bool {
@@ -68,7 +72,7 @@ func IsReady(status string) bool {
 }
 
 func InProgress(status string) bool {
-	return status == "creating" || status == "starting" || status == "modifying" ||
+	return status == "creating" || status == "provisioning" || status == "starting" || status == "modifying" ||
 		status == "rebooting" || status == "moving-to-vpc" ||
 		status == "renaming" || status == "upgrading" || status == "backtracking" ||
 		status == "maintenance" || status == "resetting-master-credentials" ||
@@ -79,7 +83,7 @@ func InProgress(status string) bool {
 
 func CanGetBindings(status string) bool {
 	// Should we potentially add upgrading to this list?
-	return  status != "creating" && status != "starting" && status != "modifying" &&
+	return  status != "creating" && status != "provisioning" && status != "starting" && status != "modifying" &&
 			status != "stopping" && status != "stopped" && status != "deleting" && status != "deleted" &&
 			status != "incompatible-network" &&
 			// gcloud states
@@ -89,7 +93,7 @@ func CanGetBindings(status string) bool {
 
 func CanBeModified(status string) bool {
 	// aws states
-	return status != "creating" && status != "starting" && status != "modifying" &&
+	return status != "creating" && status != "provisioning" && status != "starting" && status != "modifying" &&
 		status != "rebooting" && status != "moving-to-vpc" && status != "backing-up" &&
 		status != "renaming" && status != "upgrading" && status != "backtracking" &&
 		status != "maintenance" && status != "resetting-master-credentials" &&
@@ -1,13 +1,20 @@
 package broker
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/golang/glog"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
-	
+	uuid "github.com/nu7hatch/gouuid"
 )
 
 type BusinessLogic struct {
@@ -27,47 +34,1076 @@ func NewBusinessLogic(ctx context.Context, o Options) (*BusinessLogic, error) {
 		namePrefix: namePrefix,
 	}
 
-	bl.AddActions("rotate_credentials", "credentials", "PUT", bl.ActionRotateCredentials)
+	go TickTocPagerDutyChecks(ctx, storage)
+
+	bl.AddActions("rotate_credentials", "credentials", "PUT", rotateCredentialsActionSchema, bl.ActionRotateCredentials)
+	bl.AddActions("rotations", "rotations", "GET", rotationsActionSchema, bl.ActionGetRotations)
+	bl.AddActions("access_keys", "access-keys", "GET", accessKeysActionSchema, bl.ActionGetAccessKeys)
+	bl.AddActions("reactivate_access_key", "access-keys/{access_key_id}/reactivate", "POST", reactivateAccessKeyActionSchema, bl.ActionReactivateAccessKey)
+	bl.AddActions("alias", "alias", "PUT", aliasActionSchema, bl.ActionSetAlias)
+	bl.AddActions("purge", "purge", "PUT", purgeActionSchema, bl.ActionPurge)
+	bl.AddActions("policies", "policies", "GET", policiesActionSchema, bl.ActionGetPolicies)
+	bl.AddActions("temporary_credentials", "temporary_credentials", "POST", temporaryCredentialsActionSchema, bl.ActionTemporaryCredentials)
+	bl.AddActions("get_lifecycle", "lifecycle", "GET", getLifecycleActionSchema, bl.ActionGetLifecycle)
+	bl.AddActions("set_lifecycle", "lifecycle", "PUT", setLifecycleActionSchema, bl.ActionSetLifecycle)
+	bl.AddActions("backup", "backups", "POST", backupActionSchema, bl.ActionBackup)
+	bl.AddActions("backups", "backups", "GET", backupsActionSchema, bl.ActionGetBackups)
+	bl.AddActions("restore_points", "restore_points", "GET", restorePointsActionSchema, bl.ActionGetRestorePoints)
+	bl.AddActions("restore", "restore", "PUT", restoreActionSchema, bl.ActionRestore)
+	bl.AddActions("usage", "usage", "GET", usageActionSchema, bl.ActionGetUsage)
+	bl.AddActions("cost", "cost", "GET", costActionSchema, bl.ActionGetCost)
+	bl.AddActions("storage_quota", "storage_quota", "GET", storageQuotaActionSchema, bl.ActionGetStorageQuota)
+	bl.AddActions("add_alert", "alerts", "POST", addAlertActionSchema, bl.ActionAddAlert)
+	bl.AddActions("alerts", "alerts", "GET", alertsActionSchema, bl.ActionGetAlerts)
+	bl.AddActions("remove_alert", "alerts/{alert_id}", "DELETE", removeAlertActionSchema, bl.ActionRemoveAlert)
+	bl.AddActions("freeze", "freeze", "POST", freezeActionSchema, bl.ActionFreeze)
+	bl.AddActions("unfreeze", "unfreeze", "POST", unfreezeActionSchema, bl.ActionUnfreeze)
+	bl.AddActions("policy_history", "policies/history", "GET", policyHistoryActionSchema, bl.ActionGetPolicyHistory)
+	bl.AddActions("rollback_policy", "policies/history/{version_id}", "POST", rollbackPolicyActionSchema, bl.ActionRollbackPolicy)
+	bl.AddActions("scan", "scans", "POST", scanActionSchema, bl.ActionScan)
+	bl.AddActions("findings", "findings", "GET", findingsActionSchema, bl.ActionGetFindings)
+	bl.AddActions("transfer_ownership", "ownership", "POST", transferOwnershipActionSchema, bl.ActionTransferOwnership)
+	bl.AddActions("ownership", "ownership", "GET", ownershipActionSchema, bl.ActionGetOwnership)
+	bl.AddActions("apply_legal_hold", "legal-hold", "POST", applyLegalHoldActionSchema, bl.ActionApplyLegalHold)
+	bl.AddActions("remove_legal_hold", "legal-hold", "DELETE", removeLegalHoldActionSchema, bl.ActionRemoveLegalHold)
+	bl.AddActions("legal_hold", "legal-hold", "GET", legalHoldActionSchema, bl.ActionGetLegalHold)
+	bl.AddActions("replication", "replication", "GET", replicationActionSchema, bl.ActionGetReplication)
+
+	if validations, err := bl.ValidatePlans(); err != nil {
+		glog.Errorf("Unable to validate the settings of plans: %s\n", err.Error())
+	} else {
+		for _, validation := range validations {
+			for _, problem := range validation.Problems {
+				glog.Errorf("The plan %s (%s) is misconfigured: %s\n", validation.Name, validation.PlanId, problem)
+			}
+		}
+	}
 
 	return &bl, nil
 }
 
-func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
-	response := &broker.CatalogResponse{}
-	services, err := b.storage.GetServices()
+type PlanValidation struct {
+	PlanId   string   `json:"plan"`
+	Name     string   `json:"name"`
+	Problems []string `json:"problems"`
+}
+
+// Validates the provider settings of every plan in the catalog, only plans with problems are
+// returned.
+func (b *BusinessLogic) ValidatePlans() ([]PlanValidation, error) {
+	validations := make([]PlanValidation, 0)
+	services, err := b.storage.GetServices()
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		plans, err := b.storage.GetPlans(service.ID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range plans {
+			if problems := ValidatePlanSettings(&plans[i]); len(problems) > 0 {
+				validations = append(validations, PlanValidation{PlanId: plans[i].ID, Name: service.Name + ":" + plans[i].basePlan.Name, Problems: problems})
+			}
+		}
+	}
+	return validations, nil
+}
+
+// Plans are installable on both networks unless their installable_inside_private_network or
+// installable_outside_private_network flag says otherwise, every plan is installable when the
+// network is unknown.
+func PlanInstallableIn(plan osb.Plan, network string) bool {
+	if network == "" || plan.Metadata == nil {
+		return true
+	}
+	if network == "private" {
+		installable, ok := plan.Metadata["installable_inside_private_network"].(bool)
+		return !ok || installable
+	}
+	installable, ok := plan.Metadata["installable_outside_private_network"].(bool)
+	return !ok || installable
+}
+
+// Plans without an allowlist are visible to every organization.
+func PlanVisibleTo(planId string, organizations map[string][]string, organization string) bool {
+	allowed, ok := organizations[planId]
+	if !ok {
+		return true
+	}
+	for _, o := range allowed {
+		if o == organization {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the health of each provider used by a plan in the catalog.
+func (b *BusinessLogic) CheckProviders() ([]ProviderHealth, error) {
+	checks := make([]ProviderHealth, 0)
+	services, err := b.storage.GetServices()
+	if err != nil {
+		return nil, err
+	}
+	checked := make(map[Providers]bool)
+	for _, service := range services {
+		plans, err := b.storage.GetPlans(service.ID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range plans {
+			if checked[plans[i].Provider] {
+				continue
+			}
+			checked[plans[i].Provider] = true
+			checks = append(checks, CheckProviderHealth(b.namePrefix, &plans[i]))
+		}
+	}
+	return checks, nil
+}
+
+func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	response := &broker.CatalogResponse{}
+	services, err := b.storage.GetServices()
+	if err != nil {
+		glog.Errorf("Unable to get the catalog (GetServices failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	actions := b.ConvertActionsToMetadata()
+	pool := make(map[string]PoolStatus)
+	if statuses, err := b.storage.GetPoolStatus(); err != nil {
+		glog.Errorf("Unable to get the preprovisioned pool status for the catalog: %s\n", err.Error())
+	} else {
+		for _, status := range statuses {
+			pool[status.PlanId] = status
+		}
+	}
+	organizations, err := b.storage.GetPlanOrganizations()
+	if err != nil {
+		glog.Errorf("Unable to get the catalog (GetPlanOrganizations failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	network := GetNetworkContext(c)
+	organization := GetOrganization(c)
+	for i := range services {
+		if services[i].Metadata == nil {
+			services[i].Metadata = make(map[string]interface{})
+		}
+		services[i].Metadata["actions"] = actions
+		services[i].Metadata["errors"] = ErrorCodes
+		plans := make([]osb.Plan, 0)
+		for _, plan := range services[i].Plans {
+			if PlanInstallableIn(plan, network) && PlanVisibleTo(plan.ID, organizations, organization) {
+				plans = append(plans, plan)
+			}
+		}
+		services[i].Plans = plans
+		for j := range services[i].Plans {
+			if status, ok := pool[services[i].Plans[j].ID]; ok && services[i].Plans[j].Metadata != nil {
+				services[i].Plans[j].Metadata["preprovision"] = status
+			}
+		}
+	}
+	osbResponse := &osb.CatalogResponse{Services: services}
+	response.CatalogResponse = *osbResponse
+	return response, nil
+}
+
+// Replaces the instance's access key and records the rotation, Actor is who asked for it. Bindings
+// using the old key are moved to the new key as the old key is removed.
+func RotateInstanceCredentials(storage Storage, provider Provider, Instance *Instance, Actor string, RequestId string) (*User, error) {
+	oldKey := Instance.Username
+	user, err := provider.RotateCredentials(Instance)
+	if err != nil {
+		return nil, err
+	}
+	if err = storage.UpdateCredentials(Instance, user); err != nil {
+		glog.Errorf("Error: Unable to record password change for instance %s and user %s: %s\n", Instance.Name, user.AccessKeyId, err.Error())
+		return nil, errors.New("Unable to record the new credentials")
+	}
+	if err = storage.ReplaceBindingKey(Instance.Id, oldKey, user); err != nil {
+		glog.Errorf("Error: Unable to record the new credentials of the bindings of instance %s: %s\n", Instance.Name, err.Error())
+	}
+	rotated := *Instance
+	rotated.Username = user.AccessKeyId
+	rotated.Password = user.SecretAccessKey
+	if err = RefreshBindingSecrets(storage, provider, &rotated); err != nil {
+		glog.Errorf("Error: Unable to refresh the secrets of the bindings of instance %s: %s\n", Instance.Name, err.Error())
+	}
+	if err = storage.AddRotation(Instance.Id, oldKey, user.AccessKeyId, Actor, RequestId); err != nil {
+		glog.Errorf("Error: Unable to record the rotation of credentials for instance %s: %s\n", Instance.Name, err.Error())
+	}
+	PublishEvent(CredentialsRotatedEvent, Instance, "", RequestId)
+	return user, nil
+}
+
+func (b *BusinessLogic) ActionRotateCredentials(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to rotate access keys, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	user, err := RotateInstanceCredentials(b.storage, provider, instance, GetOriginatingIdentity(context), GetRequestId(context))
+	if err != nil {
+		glog.Errorf("Unable to rotate access keys of %s: %s\n", instance.Name, err.Error())
+		return nil, ProviderError(err)
+	}
+
+	return user, nil
+}
+
+// Frozen buckets are read only to the broker as well, operations that change the bucket's objects
+// or configuration are refused up front rather than failing in the worker.
+func (b *BusinessLogic) checkNotFrozen(Instance *Instance) error {
+	frozen, err := b.storage.IsFrozen(Instance.Id)
+	if err != nil {
+		glog.Errorf("Unable to check whether %s is frozen, IsFrozen failed: %s\n", Instance.Name, err.Error())
+		return InternalServerError()
+	}
+	if frozen {
+		return UnprocessableEntityWithMessage("InstanceFrozen", "The instance is frozen, unfreeze it first.")
+	}
+	return nil
+}
+
+// Purging is destructive and cannot be undone, the caller must confirm the operation by passing the
+// name of the bucket in the confirm query parameter. The contents are removed asyncronously by the worker.
+func (b *BusinessLogic) ActionPurge(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	if context == nil || context.Request == nil || context.Request.URL == nil || context.Request.URL.Query().Get("confirm") != instance.Name {
+		return nil, UnprocessableEntityWithMessage("ConfirmationRequired", "The query parameter confirm must be set to the name of the bucket to purge.")
+	}
+	if err = b.checkNotFrozen(instance); err != nil {
+		return nil, err
+	}
+
+	taskId, err := b.storage.AddTask(instance.Id, PurgeTask, "", GetRequestId(context))
+	if err != nil {
+		glog.Errorf("Error: Unable to schedule purge of bucket! (%s): %s\n", instance.Name, err.Error())
+		return nil, InternalServerError()
+	}
+
+	return map[string]string{"task": taskId, "status": "pending"}, nil
+}
+
+func (b *BusinessLogic) ActionGetPolicies(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to get policies, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	policies, err := provider.GetPolicies(instance)
+	if err != nil {
+		glog.Errorf("Unable to get policies, GetPolicies failed: %s\n", err.Error())
+		return nil, ProviderError(err)
+	}
+
+	return policies, nil
+}
+
+// Issues short lived credentials scoped to the bucket, the query parameters read_only, prefix and
+// duration (in seconds, between 900 and 43200) may optionally be used to further limit them.
+func (b *BusinessLogic) ActionTemporaryCredentials(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	options := TemporaryCredentialsOptions{Duration: 3600}
+	if context != nil && context.Request != nil && context.Request.URL != nil {
+		query := context.Request.URL.Query()
+		options.ReadOnly = query.Get("read_only") == "true"
+		options.Prefix = strings.TrimPrefix(query.Get("prefix"), "/")
+		if query.Get("duration") != "" {
+			duration, err := strconv.ParseInt(query.Get("duration"), 10, 64)
+			if err != nil || duration < 900 || duration > 43200 {
+				return nil, UnprocessableEntityWithMessage("InvalidDuration", "The duration must be a number of seconds between 900 and 43200.")
+			}
+			options.Duration = duration
+		}
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to issue temporary credentials, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	credentials, err := provider.TemporaryCredentials(instance, &options)
+	if err != nil {
+		glog.Errorf("Unable to issue temporary credentials, TemporaryCredentials failed: %s\n", err.Error())
+		return nil, ProviderError(err)
+	}
+
+	return credentials, nil
+}
+
+func (b *BusinessLogic) ActionGetLifecycle(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to get lifecycle, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	lifecycle, err := provider.GetLifecycle(instance)
+	if err != nil {
+		glog.Errorf("Unable to get lifecycle, GetLifecycle failed: %s\n", err.Error())
+		return nil, ProviderError(err)
+	}
+
+	return lifecycle, nil
+}
+
+// Replaces the lifecycle rules on the bucket, an empty list of rules removes the lifecycle configuration.
+func (b *BusinessLogic) ActionSetLifecycle(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	if context == nil || context.Request == nil || context.Request.Body == nil {
+		return nil, UnprocessableEntityWithMessage("InvalidLifecycle", "A lifecycle configuration must be provided in the request body.")
+	}
+	var lifecycle LifecycleConfiguration
+	if err = json.NewDecoder(context.Request.Body).Decode(&lifecycle); err != nil {
+		return nil, UnprocessableEntityWithMessage("InvalidLifecycle", "The lifecycle configuration could not be parsed: "+err.Error())
+	}
+	if err = lifecycle.Validate(); err != nil {
+		return nil, UnprocessableEntityWithMessage("InvalidLifecycle", err.Error())
+	}
+	if err = b.checkNotFrozen(instance); err != nil {
+		return nil, err
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to set lifecycle, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	if err = provider.SetLifecycle(instance, &lifecycle); err != nil {
+		glog.Errorf("Unable to set lifecycle, SetLifecycle failed: %s\n", err.Error())
+		return nil, ProviderError(err)
+	}
+
+	byteData, err := json.Marshal(lifecycle)
+	if err != nil {
+		glog.Errorf("Unable to marshal lifecycle for event history: %s\n", err.Error())
+	}
+	if err = b.storage.AddEvent(instance.Id, "lifecycle-changed", "The lifecycle configuration was changed.", string(byteData)); err != nil {
+		glog.Errorf("Error: Unable to record lifecycle change for instance %s: %s\n", instance.Name, err.Error())
+	}
+
+	return lifecycle, nil
+}
+
+// Schedules a copy of the bucket's current contents to the archive bucket, the returned backup id
+// is what should be passed to the restore task.
+func (b *BusinessLogic) ActionBackup(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+	if UsesCustomerKey(instance.Plan) {
+		return nil, UnprocessableEntityWithMessage("CustomerKeyNotSupported", customerKeyCopyMessage)
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		glog.Errorf("Unable to generate backup id: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	byteData, err := json.Marshal(BackupTaskMetadata{Backup: id.String()})
+	if err != nil {
+		glog.Errorf("Unable to marshal backup task meta data: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	if err = b.storage.AddBackup(&Backup{Id: id.String(), InstanceId: instance.Id, Name: instance.Name, Kind: BackupOnDemand, Status: "pending"}); err != nil {
+		glog.Errorf("Error: Unable to record backup of bucket! (%s): %s\n", instance.Name, err.Error())
+		return nil, InternalServerError()
+	}
+
+	taskId, err := b.storage.AddTask(instance.Id, BackupTask, string(byteData), GetRequestId(context))
+	if err != nil {
+		glog.Errorf("Error: Unable to schedule backup of bucket! (%s): %s\n", instance.Name, err.Error())
+		return nil, InternalServerError()
+	}
+
+	return map[string]string{"backup": id.String(), "task": taskId, "status": "pending"}, nil
+}
+
+// Lists the on-demand backups of the instance, newest first. Backups with
+// a status of available can be restored by their id.
+func (b *BusinessLogic) ActionGetBackups(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	backups, err := b.storage.GetBackups(instance.Id)
+	if err != nil {
+		glog.Errorf("Unable to get backups, GetBackups failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	return map[string]interface{}{"backups": backups}, nil
+}
+
+// Lists the restore points taken by the backup plan of the instance (if the plan has one), on-demand
+// backups are not included.
+func (b *BusinessLogic) ActionGetRestorePoints(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to get restore points, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	points, err := provider.GetRestorePoints(instance)
+	if err != nil {
+		glog.Errorf("Unable to get restore points, GetRestorePoints failed: %s\n", err.Error())
+		return nil, ProviderError(err)
+	}
+
+	return map[string]interface{}{"restore_points": points}, nil
+}
+
+// Schedules a restore of the bucket from the backup query parameter, either an on-demand backup id
+// or the id of a restore point.
+func (b *BusinessLogic) ActionRestore(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	if UsesCustomerKey(instance.Plan) {
+		return nil, UnprocessableEntityWithMessage("CustomerKeyNotSupported", customerKeyCopyMessage)
+	}
+	if context == nil || context.Request == nil || context.Request.URL == nil || context.Request.URL.Query().Get("backup") == "" {
+		return nil, UnprocessableEntityWithMessage("BackupRequired", "The query parameter backup must be set to the backup or restore point to restore.")
+	}
+	if err = b.checkNotFrozen(instance); err != nil {
+		return nil, err
+	}
+
+	// Backups in the catalog must be finished and of this bucket, backups taken before the catalog
+	// existed aren't in it and are looked for by the provider.
+	backupId := context.Request.URL.Query().Get("backup")
+	if backup, err := b.storage.GetBackup(backupId); err == nil {
+		if backup.Name != instance.Name {
+			return nil, UnprocessableEntityWithMessage("BackupNotFound", "The backup "+backupId+" is not a backup of this instance.")
+		} else if backup.Status != "available" {
+			return nil, UnprocessableEntityWithMessage("BackupNotAvailable", "The backup "+backupId+" is "+backup.Status+" and cannot be restored.")
+		}
+	} else if err.Error() != "Not found" {
+		glog.Errorf("Unable to restore, GetBackup failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	} else if strings.HasPrefix(backupId, "arn:") {
+		// Restore points must be of this bucket, a recovery point of another bucket could otherwise
+		// be restored into it.
+		provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+		if err != nil {
+			glog.Errorf("Unable to restore, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+			return nil, InternalServerError()
+		}
+		points, err := provider.GetRestorePoints(instance)
+		if err != nil {
+			glog.Errorf("Unable to restore, GetRestorePoints failed: %s\n", err.Error())
+			return nil, ProviderError(err)
+		}
+		found := false
+		for _, point := range points {
+			if point.Id == backupId {
+				found = true
+			}
+		}
+		if !found {
+			return nil, UnprocessableEntityWithMessage("BackupNotFound", "The backup "+backupId+" is not a backup of this instance.")
+		}
+	}
+
+	byteData, err := json.Marshal(RestoreDbTaskMetadata{Backup: backupId})
+	if err != nil {
+		glog.Errorf("Unable to marshal restore task meta data: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	taskId, err := b.storage.AddTask(instance.Id, RestoreDbTask, string(byteData), GetRequestId(context))
+	if err != nil {
+		glog.Errorf("Error: Unable to schedule restore of bucket! (%s): %s\n", instance.Name, err.Error())
+		return nil, InternalServerError()
+	}
+
+	return map[string]string{"task": taskId, "status": "pending"}, nil
+}
+
+func (b *BusinessLogic) ActionGetUsage(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	usage, err := b.storage.GetUsage(instance.Id)
+	if err != nil {
+		glog.Errorf("Unable to get usage, GetUsage failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	return map[string]interface{}{"usage": usage}, nil
+}
+
+// Returns the storage quota of the instance's plan and the bucket's size when it was last metered,
+// a bucket that hasn't been metered yet is reported as ok.
+func (b *BusinessLogic) ActionGetStorageQuota(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	quotaBytes, err := GetStorageQuotaBytes(instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to get the storage quota of %s: %s\n", instance.Name, err.Error())
+		return nil, InternalServerError()
+	}
+	quota, err := b.storage.GetStorageQuota(instance.Id)
+	if err != nil && err.Error() == "Not found" {
+		quota = &StorageQuota{InstanceId: instance.Id, Status: StorageQuotaOk}
+	} else if err != nil {
+		glog.Errorf("Unable to get the storage quota, GetStorageQuota failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	quota.QuotaBytes = quotaBytes
+
+	return map[string]interface{}{"storage_quota": quota, "enforced": IsStorageQuotaEnforced(instance.Plan)}, nil
+}
+
+// Registers a threshold on the bytes, objects or requests of the instance, the (signed) webhook is
+// sent when the metered usage goes over it.
+func (b *BusinessLogic) ActionAddAlert(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	if context == nil || context.Request == nil || context.Request.Body == nil {
+		return nil, UnprocessableEntityWithMessage("InvalidAlert", "An alert must be provided in the request body.")
+	}
+	var body struct {
+		Metric    string `json:"metric"`
+		Threshold int64  `json:"threshold"`
+		Webhook   string `json:"webhook"`
+		Secret    string `json:"secret"`
+	}
+	if err = json.NewDecoder(context.Request.Body).Decode(&body); err != nil {
+		return nil, UnprocessableEntityWithMessage("InvalidAlert", "The body must be a json object with a metric, threshold, webhook and secret.")
+	}
+	if !IsAlertMetric(body.Metric) {
+		return nil, UnprocessableEntityWithMessage("InvalidAlert", "The metric must be bytes, objects or requests.")
+	}
+	if body.Threshold <= 0 {
+		return nil, UnprocessableEntityWithMessage("InvalidAlert", "The threshold must be a positive number.")
+	}
+	if webhook, err := url.Parse(body.Webhook); err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") || webhook.Host == "" {
+		return nil, UnprocessableEntityWithMessage("InvalidAlert", "The webhook must be an http or https url.")
+	}
+	if body.Secret == "" {
+		return nil, UnprocessableEntityWithMessage("InvalidAlert", "A secret is required to sign the webhook.")
+	}
+
+	alert := Alert{InstanceId: instance.Id, Metric: body.Metric, Threshold: body.Threshold, Webhook: body.Webhook, Secret: body.Secret}
+	if alert.Id, err = b.storage.AddAlert(&alert); err != nil {
+		glog.Errorf("Unable to add an alert to %s: %s\n", instance.Name, err.Error())
+		return nil, InternalServerError()
+	}
+
+	return alert, nil
+}
+
+func (b *BusinessLogic) ActionGetAlerts(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	alerts, err := b.storage.GetAlerts(instance.Id)
+	if err != nil {
+		glog.Errorf("Unable to get alerts, GetAlerts failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	return map[string]interface{}{"alerts": alerts}, nil
+}
+
+func (b *BusinessLogic) ActionRemoveAlert(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	if err = b.storage.DeleteAlert(instance.Id, vars["alert_id"]); err != nil && err.Error() == "Not found" {
+		return nil, NotFound()
+	} else if err != nil {
+		glog.Errorf("Unable to remove alert %s of %s: %s\n", vars["alert_id"], instance.Name, err.Error())
+		return nil, InternalServerError()
+	}
+
+	return map[string]string{"alert": vars["alert_id"], "status": "removed"}, nil
+}
+
+// Makes the bucket read only, e.g., during incident response or while its data is migrated. The
+// bucket policy denies writes as well when the bucket_policy query parameter is true.
+func (b *BusinessLogic) ActionFreeze(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	bucketPolicy := false
+	if context != nil && context.Request != nil && context.Request.URL != nil {
+		bucketPolicy = context.Request.URL.Query().Get("bucket_policy") == "true"
+	}
+	return b.setFrozen(InstanceID, true, bucketPolicy)
+}
+
+func (b *BusinessLogic) ActionUnfreeze(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	return b.setFrozen(InstanceID, false, false)
+}
+
+func (b *BusinessLogic) setFrozen(InstanceID string, Frozen bool, BucketPolicy bool) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+	if !CanBeModified(instance.Status) {
+		return nil, UnprocessableEntityWithMessage("ConcurrencyError", "The instance cannot be frozen or unfrozen while it is "+instance.Status+".")
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to freeze, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	if err = provider.Freeze(instance, Frozen, BucketPolicy); err != nil {
+		glog.Errorf("Unable to freeze (%t) %s: %s\n", Frozen, instance.Name, err.Error())
+		return nil, ProviderError(err)
+	}
+	if err = b.storage.SetFrozen(instance.Id, Frozen); err != nil {
+		glog.Errorf("Unable to record that %s is frozen (%t): %s\n", instance.Name, Frozen, err.Error())
+		return nil, InternalServerError()
+	}
+
+	status := "frozen"
+	description := "The bucket was frozen, writes are denied."
+	if !Frozen {
+		status = "unfrozen"
+		description = "The bucket was unfrozen."
+	}
+	RecordPolicyVersion(b.storage, provider, instance, status)
+	if err = b.storage.AddEvent(instance.Id, status, description, ""); err != nil {
+		glog.Errorf("Unable to record the %s event of %s: %s\n", status, instance.Name, err.Error())
+	}
+	glog.Infof("%s: %s\n", instance.Name, description)
+
+	return map[string]interface{}{"status": status, "bucket_policy": BucketPolicy}, nil
+}
+
+func (b *BusinessLogic) ActionGetPolicyHistory(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	versions, err := b.storage.GetPolicyVersions(instance.Id)
+	if err != nil {
+		glog.Errorf("Unable to get the policy history, GetPolicyVersions failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	return map[string]interface{}{"versions": versions}, nil
+}
+
+// Puts back a bucket policy from the instance's history, for when a change (e.g., a bad policy
+// template) locks applications out.
+func (b *BusinessLogic) ActionRollbackPolicy(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+	if !CanBeModified(instance.Status) {
+		return nil, UnprocessableEntityWithMessage("ConcurrencyError", "The bucket policy cannot be rolled back while the instance is "+instance.Status+".")
+	}
+
+	version, err := b.storage.GetPolicyVersion(instance.Id, vars["version_id"])
+	if err != nil && err.Error() == "Not found" {
+		return nil, NotFound()
+	} else if err != nil {
+		glog.Errorf("Unable to roll back the policy, GetPolicyVersion failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to roll back the policy, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	if err = RollbackPolicy(b.storage, provider, instance, version); err != nil {
+		glog.Errorf("Unable to roll back the policy of %s to %s: %s\n", instance.Name, version.Id, err.Error())
+		return nil, ProviderError(err)
+	}
+	glog.Infof("Rolled back the bucket policy of %s to %s (%s)\n", instance.Name, version.Id, version.Reason)
+
+	return map[string]string{"version": version.Id, "status": "rolled back"}, nil
+}
+
+func (b *BusinessLogic) ActionGetRotations(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
 	if err != nil {
-		return nil, err
+		return nil, NotFound()
 	}
-	osbResponse := &osb.CatalogResponse{Services: services}
-	response.CatalogResponse = *osbResponse
-	return response, nil
+
+	rotations, err := b.storage.GetRotations(instance.Id)
+	if err != nil {
+		glog.Errorf("Unable to get rotations, GetRotations failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	return map[string]interface{}{"rotations": rotations}, nil
 }
 
-func (b *BusinessLogic) ActionRotateCredentials(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+func (b *BusinessLogic) ActionGetAccessKeys(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
 	instance, err := b.GetInstanceById(InstanceID)
 	if err != nil {
 		return nil, NotFound()
 	}
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to get access keys, GetProviderByPlan failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	keys, err := GetAccessKeyUsage(b.storage, provider, instance)
+	if err != nil {
+		glog.Errorf("Unable to get access keys of %s: %s\n", instance.Name, err.Error())
+		return nil, ProviderError(err)
+	}
+	return map[string]interface{}{"access_keys": keys, "dormant_days": GetAccessKeyDormantDays()}, nil
+}
 
+// Reactivates an access key deactivated by the access key audit for being unused, the audit won't
+// deactivate it again until it has been unused for the plan's days since it was reactivated.
+func (b *BusinessLogic) ActionReactivateAccessKey(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
 	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
 	if err != nil {
-		glog.Errorf("Unable to rotate access keys, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		glog.Errorf("Unable to reactivate access key, GetProviderByPlan failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	keys, err := provider.GetAccessKeys(instance)
+	if err != nil {
+		glog.Errorf("Unable to get access keys of %s: %s\n", instance.Name, err.Error())
+		return nil, ProviderError(err)
+	}
+	found := false
+	for _, key := range keys {
+		if key.AccessKeyId == vars["access_key_id"] {
+			found = true
+		}
+	}
+	if !found {
+		return nil, NotFound()
+	}
+	if err = b.storage.AddKeyReactivation(instance.Id, vars["access_key_id"], GetOriginatingIdentity(context)); err != nil {
+		glog.Errorf("Unable to record the reactivation of %s: %s\n", vars["access_key_id"], err.Error())
+		return nil, InternalServerError()
+	}
+	if err = provider.SetAccessKeyStatus(instance, vars["access_key_id"], true); err != nil {
+		glog.Errorf("Unable to reactivate access key %s of %s: %s\n", vars["access_key_id"], instance.Name, err.Error())
+		return nil, ProviderError(err)
+	}
+	if err = b.storage.AddEvent(instance.Id, "access-key-reactivated", "The access key "+vars["access_key_id"]+" was reactivated by "+GetOriginatingIdentity(context)+".", ""); err != nil {
+		glog.Errorf("Unable to record the reactivation of %s for %s: %s\n", vars["access_key_id"], instance.Name, err.Error())
+	}
+	PublishEvent(AccessKeyReactivatedEvent, instance, GetOrganization(context), GetRequestId(context))
+
+	usages, err := GetAccessKeyUsage(b.storage, provider, instance)
+	if err != nil {
+		glog.Errorf("Unable to get access keys of %s: %s\n", instance.Name, err.Error())
+		return nil, ProviderError(err)
+	}
+	for _, usage := range usages {
+		if usage.AccessKeyId == vars["access_key_id"] {
+			return usage, nil
+		}
+	}
+	return nil, NotFound()
+}
+
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 ._-]{0,62}$`)
+
+// The alias is a human readable name for the bucket (bucket names are generated), it's returned
+// in the credentials of bindings as S3_BUCKET_ALIAS. An empty alias removes it.
+func (b *BusinessLogic) ActionSetAlias(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	if context == nil || context.Request == nil || context.Request.Body == nil {
+		return nil, UnprocessableEntityWithMessage("InvalidAlias", "An alias must be provided in the request body.")
+	}
+	var body struct {
+		Alias *string `json:"alias"`
+	}
+	if err = json.NewDecoder(context.Request.Body).Decode(&body); err != nil || body.Alias == nil {
+		return nil, UnprocessableEntityWithMessage("InvalidAlias", "The body must be a json object with an alias.")
+	}
+	alias := strings.TrimSpace(*body.Alias)
+	if alias != "" && !aliasPattern.MatchString(alias) {
+		return nil, UnprocessableEntityWithMessage("InvalidAlias", "The alias must be at most 63 letters, numbers, spaces, periods, dashes or underscores and start with a letter or number.")
+	}
+
+	if err = b.storage.SetInstanceAlias(instance.Id, alias); err != nil {
+		glog.Errorf("Unable to set the alias of %s: %s\n", instance.Name, err.Error())
+		return nil, InternalServerError()
+	}
+	if err = b.storage.AddEvent(instance.Id, "alias-changed", "The alias was changed from \""+instance.Alias+"\" to \""+alias+"\".", ""); err != nil {
+		glog.Errorf("Error: Unable to record alias change for instance %s: %s\n", instance.Name, err.Error())
+	}
+
+	return map[string]string{"alias": alias}, nil
+}
+
+func (b *BusinessLogic) ActionGetCost(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	usage, err := b.storage.GetUsage(instance.Id)
+	if err != nil {
+		glog.Errorf("Unable to estimate cost, GetUsage failed: %s\n", err.Error())
 		return nil, InternalServerError()
 	}
 
-	user, err := provider.RotateCredentials(instance)
+	if len(usage) == 0 {
+		return EstimateMonthlyCost(instance.Plan, nil), nil
+	}
+	return EstimateMonthlyCost(instance.Plan, &usage[0]), nil
+}
+
+// Scans the bucket for sensitive data (e.g., personal or financial information) with Macie, the
+// results are summarized by the findings action once the scan completes.
+func (b *BusinessLogic) ActionScan(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
 	if err != nil {
-		glog.Errorf("Unable to rotate access keys, RotateCredentials failed: %s\n", err.Error())
+		glog.Errorf("Unable to scan, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
 		return nil, InternalServerError()
 	}
 
-	err = b.storage.UpdateCredentials(instance, user)
+	job, err := provider.Scan(instance)
+	if err != nil {
+		glog.Errorf("Unable to scan %s, Scan failed: %s\n", instance.Name, err.Error())
+		return nil, ProviderError(err)
+	}
+
+	return job, nil
+}
+
+func (b *BusinessLogic) ActionGetFindings(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
 	if err != nil {
-		glog.Errorf("Error: Unable to record password change for instance %s and user %s\n", instance.Name, user.AccessKeyId)
+		glog.Errorf("Unable to get findings, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
 		return nil, InternalServerError()
 	}
 
-	return user, nil
+	findings, err := provider.GetFindings(instance)
+	if err != nil {
+		glog.Errorf("Unable to get findings for %s, GetFindings failed: %s\n", instance.Name, err.Error())
+		return nil, ProviderError(err)
+	}
+
+	return findings, nil
+}
+
+// Reports the replication of the bucket to its disaster recovery copy, ?max_latency (in seconds, 900
+// by default) is the replication latency above which the replication isn't healthy.
+func (b *BusinessLogic) ActionGetReplication(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	maxLatency := float64(900)
+	if context != nil && context.Request != nil && context.Request.URL != nil && context.Request.URL.Query().Get("max_latency") != "" {
+		maxLatency, err = strconv.ParseFloat(context.Request.URL.Query().Get("max_latency"), 64)
+		if err != nil || maxLatency <= 0 {
+			return nil, UnprocessableEntityWithMessage("InvalidParameters", "The max_latency must be a positive number of seconds.")
+		}
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to get replication, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	health, err := provider.GetReplicationHealth(instance, maxLatency)
+	if err != nil {
+		glog.Errorf("Unable to get replication for %s, GetReplicationHealth failed: %s\n", instance.Name, err.Error())
+		return nil, ProviderError(err)
+	}
+	if !health.Enabled {
+		return nil, UnprocessableEntityWithMessage("ReplicationNotEnabled", "The bucket is not replicated.")
+	}
+
+	return health, nil
+}
+
+// Schedules a batch job that makes the broker's account the owner of every object in the bucket, for
+// buckets that were adopted or shared with other accounts. A transfer already scheduled is returned.
+func (b *BusinessLogic) ActionTransferOwnership(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+	if UsesCustomerKey(instance.Plan) {
+		return nil, UnprocessableEntityWithMessage("CustomerKeyNotSupported", customerKeyCopyMessage)
+	}
+	if err = b.checkNotFrozen(instance); err != nil {
+		return nil, err
+	}
+
+	if task, err := b.storage.GetLastTask(instance.Id, TransferOwnershipTask); err == nil && (task.Status == "pending" || task.Status == "started") {
+		return map[string]string{"task": task.Id, "status": "pending"}, nil
+	}
+	taskId, err := b.storage.AddTask(instance.Id, TransferOwnershipTask, "", GetRequestId(context))
+	if err != nil {
+		glog.Errorf("Error: Unable to schedule the ownership transfer of bucket! (%s): %s\n", instance.Name, err.Error())
+		return nil, InternalServerError()
+	}
+
+	return map[string]string{"task": taskId, "status": "pending"}, nil
+}
+
+// Returns the progress of the last ownership transfer, once its task has started the batch job the
+// job's progress is returned.
+func (b *BusinessLogic) ActionGetOwnership(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	return b.getLastBatchJob(InstanceID, TransferOwnershipTask)
+}
+
+// Returns the batch job started by the last task of the action, or the task until it has started it.
+func (b *BusinessLogic) getLastBatchJob(InstanceID string, action TaskAction) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+
+	task, err := b.storage.GetLastTask(instance.Id, action)
+	if err != nil && err.Error() == "Not found" {
+		return nil, NotFound()
+	} else if err != nil {
+		glog.Errorf("Unable to get the %s job, GetLastTask failed: %s\n", action, err.Error())
+		return nil, InternalServerError()
+	}
+	if task.Status != "finished" || task.Result == "" {
+		return map[string]string{"task": task.Id, "status": task.Status, "result": task.Result}, nil
+	}
+
+	provider, err := GetProviderByPlan(b.namePrefix, instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to get the %s job, cannot find provider (GetProviderByPlan failed): %s\n", action, err.Error())
+		return nil, InternalServerError()
+	}
+	job, err := provider.GetBatchJob(instance, task.Result)
+	if err != nil && err.Error() == "Not found" {
+		return nil, NotFound()
+	} else if err != nil {
+		glog.Errorf("Unable to get the %s job %s of %s: %s\n", action, task.Result, instance.Name, err.Error())
+		return nil, ProviderError(err)
+	}
+	return job, nil
+}
+
+// Places a legal hold on the objects under the prefix query parameter (or every object), for
+// litigation holds on object lock plans. The batch job is started by the worker.
+func (b *BusinessLogic) ActionApplyLegalHold(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	return b.scheduleLegalHold(InstanceID, context, true)
+}
+
+func (b *BusinessLogic) ActionRemoveLegalHold(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	return b.scheduleLegalHold(InstanceID, context, false)
+}
+
+func (b *BusinessLogic) ActionGetLegalHold(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	return b.getLastBatchJob(InstanceID, LegalHoldTask)
+}
+
+func (b *BusinessLogic) scheduleLegalHold(InstanceID string, context *broker.RequestContext, On bool) (interface{}, error) {
+	instance, err := b.GetInstanceById(InstanceID)
+	if err != nil {
+		return nil, NotFound()
+	}
+	if !PlanHasObjectLock(instance.Plan) {
+		return nil, UnprocessableEntityWithMessage("ObjectLockRequired", "Legal holds are only available on plans with object lock.")
+	}
+	if err = b.checkNotFrozen(instance); err != nil {
+		return nil, err
+	}
+
+	hold := LegalHoldTaskMetadata{On: On}
+	if context != nil && context.Request != nil && context.Request.URL != nil {
+		hold.Prefix = context.Request.URL.Query().Get("prefix")
+	}
+	if task, err := b.storage.GetLastTask(instance.Id, LegalHoldTask); err == nil && (task.Status == "pending" || task.Status == "started") {
+		return nil, UnprocessableEntityWithMessage("ConcurrencyError", "Another legal hold is being set on the bucket, wait until its job has started.")
+	}
+	byteData, err := json.Marshal(hold)
+	if err != nil {
+		glog.Errorf("Error: failed to marshal legal hold task metadata: %s\n", err)
+		return nil, InternalServerError()
+	}
+	taskId, err := b.storage.AddTask(instance.Id, LegalHoldTask, string(byteData), GetRequestId(context))
+	if err != nil {
+		glog.Errorf("Error: Unable to schedule the legal hold of bucket! (%s): %s\n", instance.Name, err.Error())
+		return nil, InternalServerError()
+	}
+
+	return map[string]string{"task": taskId, "status": "pending"}, nil
 }
 
 func GetInstanceById(namePrefix string, storage Storage, Id string) (*Instance, error) {
@@ -102,6 +1138,8 @@ func GetInstanceById(namePrefix string, storage Storage, Id string) (*Instance,
 		Instance.Endpoint = entry.Endpoint
 	}
 	Instance.Plan = plan
+	Instance.Region = entry.Region
+	Instance.Alias = entry.Alias
 
 	return Instance, nil
 }
@@ -125,10 +1163,213 @@ func (b *BusinessLogic) GetUnclaimedInstance(PlanId string, InstanceId string) (
 	return Instance, nil
 }
 
+// Registers a bucket created by the broker that is missing from the database (e.g., rows lost in a
+// database restore). The instance id is taken from the bucket's instance tag unless one is given,
+// buckets that were never claimed (or without any instance id) are returned to the preprovisioned
+// pool under a new id.
+func (b *BusinessLogic) AdoptInstance(Name string, PlanId string, InstanceId string) (*Instance, bool, error) {
+	plan, err := b.storage.GetPlanByID(PlanId)
+	if err != nil {
+		return nil, false, err
+	}
+	provider, err := GetProviderByPlan(b.namePrefix, plan)
+	if err != nil {
+		return nil, false, err
+	}
+	Instance, tags, err := provider.Adopt(Name, plan)
+	if err != nil {
+		return nil, false, err
+	}
+	if InstanceId == "" {
+		InstanceId = tags["instance"]
+	}
+	owner := tags["billingcode"]
+	claimed := InstanceId != "" && owner != "preprovisioned"
+	if !claimed {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return nil, false, err
+		}
+		InstanceId = id.String()
+		owner = ""
+	}
+	if err = b.storage.ValidateInstanceID(InstanceId); err != nil {
+		return nil, false, errors.New("Instance id in use")
+	}
+	Instance.Id = InstanceId
+	if err = b.storage.AdoptInstance(Instance, claimed, owner); err != nil {
+		return nil, false, err
+	}
+	// The access key is only rotated once the bucket is tracked, so a conflict leaves the key the
+	// bucket's applications use alone.
+	user, err := provider.RotateCredentials(Instance)
+	if err != nil {
+		if nerr := b.storage.NukeInstance(Instance.Id); nerr != nil {
+			glog.Errorf("Unable to remove the record of %s after its access key failed to rotate: %s\n", Name, nerr.Error())
+		}
+		return nil, false, err
+	}
+	if err = b.storage.UpdateCredentials(Instance, user); err != nil {
+		return nil, false, err
+	}
+	Instance.Username = user.AccessKeyId
+	Instance.Password = user.SecretAccessKey
+	glog.Infof("Adopted bucket %s as instance %s (claimed: %t)\n", Name, InstanceId, claimed)
+	return Instance, claimed, nil
+}
+
+// InstanceTransfer is a change of the organization and space that own an instance, recorded in the
+// instance's event history.
+type InstanceTransfer struct {
+	FromOrganization string `json:"from_organization"`
+	FromSpace        string `json:"from_space"`
+	ToOrganization   string `json:"to_organization"`
+	ToSpace          string `json:"to_space"`
+	Reason           string `json:"reason,omitempty"`
+	RequestedBy      string `json:"requested_by,omitempty"`
+}
+
+// Reassigns the instance to another organization and space (e.g., after a team reorganization)
+// without moving its data. The bucket's billingcode tag is changed to the new organization, the
+// plan must be available to it and its quota must have room unless Force is set.
+func (b *BusinessLogic) TransferInstance(InstanceId string, Transfer InstanceTransfer, Force bool) (*InstanceTransfer, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	Instance, err := b.GetInstanceById(InstanceId)
+	if err != nil {
+		return nil, err
+	}
+	if !CanBeModified(Instance.Status) {
+		return nil, errors.New("Instance busy")
+	}
+	Transfer.FromOrganization, Transfer.FromSpace, err = b.storage.GetInstanceOwner(Instance.Id)
+	if err != nil {
+		return nil, err
+	}
+	if !Force {
+		organizations, err := b.storage.GetPlanOrganizations()
+		if err != nil {
+			return nil, err
+		}
+		if !PlanVisibleTo(Instance.Plan.ID, organizations, Transfer.ToOrganization) {
+			return nil, errors.New("Plan not available")
+		}
+		if Transfer.ToOrganization != Transfer.FromOrganization || Transfer.ToSpace != Transfer.FromSpace {
+			quota, err := b.storage.GetExceededQuota(Instance.Plan.ID, Transfer.ToOrganization, Transfer.ToSpace)
+			if err != nil {
+				return nil, err
+			}
+			if quota != nil {
+				return nil, errors.New("Quota exceeded")
+			}
+		}
+	}
+	provider, err := GetProviderByPlan(b.namePrefix, Instance.Plan)
+	if err != nil {
+		return nil, err
+	}
+	if err = provider.Tag(Instance, "billingcode", Transfer.ToOrganization); err != nil {
+		return nil, err
+	}
+	if err = b.storage.SetInstanceOwner(Instance.Id, Transfer.ToOrganization, Transfer.ToSpace); err != nil {
+		return nil, err
+	}
+	description := "The bucket was transferred from organization " + Transfer.FromOrganization + " (space " + Transfer.FromSpace + ") to organization " + Transfer.ToOrganization + " (space " + Transfer.ToSpace + ")"
+	if Transfer.RequestedBy != "" {
+		description = description + " by " + Transfer.RequestedBy
+	}
+	byteData, err := json.Marshal(Transfer)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.storage.AddEvent(Instance.Id, "transferred", description+".", string(byteData)); err != nil {
+		glog.Errorf("Unable to record the transfer of %s: %s\n", Instance.Name, err.Error())
+	}
+	glog.Infof("%s: %s.\n", Instance.Name, description)
+	return &Transfer, nil
+}
+
+// This is a hack to support callbacks, hopefully this will become an OSB standard. When the webhook
+// and secret query parameters are given a signed callback is sent to the webhook once the operation
+// completes. The optional webhook_max_attempts (up to 20), webhook_backoff (seconds, up to an hour)
+// and webhook_timeout (seconds, up to 5 minutes) query parameters set its retry policy, and the
+// webhook_signature_* parameters how it's signed (see GetWebhookSignature).
+func (b *BusinessLogic) ScheduleWebhook(c *broker.RequestContext, Instance *Instance, action TaskAction, TaskId string) {
+	if c == nil || c.Request == nil || c.Request.URL == nil || c.Request.URL.Query().Get("webhook") == "" || c.Request.URL.Query().Get("secret") == "" {
+		return
+	}
+	query := c.Request.URL.Query()
+	metadata := WebhookTaskMetadata{Url: query.Get("webhook"), Secret: query.Get("secret"), Task: TaskId}
+	if attempts, err := strconv.Atoi(query.Get("webhook_max_attempts")); err == nil && attempts > 0 && attempts <= 20 {
+		metadata.MaxAttempts = attempts
+	}
+	if backoff, err := strconv.ParseInt(query.Get("webhook_backoff"), 10, 64); err == nil && backoff > 0 && backoff <= 3600 {
+		metadata.Backoff = backoff
+	}
+	if timeout, err := strconv.ParseInt(query.Get("webhook_timeout"), 10, 64); err == nil && timeout > 0 && timeout <= 300 {
+		metadata.Timeout = timeout
+	}
+	if signature, err := GetWebhookSignature(query); err == nil {
+		metadata.Signature = &signature
+	}
+	byteData, err := json.Marshal(metadata)
+	if err != nil {
+		glog.Errorf("Error: failed to marshal webhook task metadata: %s\n", err)
+	}
+	if _, err = b.storage.AddTask(Instance.Id, action, string(byteData), GetRequestId(c)); err != nil {
+		glog.Errorf("Error: Unable to schedule webhook! (%s): %s\n", Instance.Name, err.Error())
+	}
+}
+
+// Checks the webhook given with a request has a valid signature and answers a challenge before the
+// request is accepted (when WEBHOOK_VERIFY is set), requests without a webhook are always accepted.
+func (b *BusinessLogic) VerifyWebhook(c *broker.RequestContext) error {
+	if c == nil || c.Request == nil || c.Request.URL == nil || c.Request.URL.Query().Get("webhook") == "" || c.Request.URL.Query().Get("secret") == "" {
+		return nil
+	}
+	query := c.Request.URL.Query()
+	signature, err := GetWebhookSignature(query)
+	if err != nil {
+		return UnprocessableEntityWithMessage("InvalidWebhook", err.Error())
+	}
+	if !GetWebhookVerify() {
+		return nil
+	}
+	if webhook, err := url.Parse(query.Get("webhook")); err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") || webhook.Host == "" {
+		return UnprocessableEntityWithMessage("InvalidWebhook", "The webhook must be an http or https url.")
+	}
+	client, err := NewWebhookClient()
+	if err != nil {
+		glog.Errorf("Unable to verify the webhook (NewWebhookClient failed): %s\n", err.Error())
+		return InternalServerError()
+	}
+	if err = VerifyWebhook(client, query.Get("webhook"), query.Get("secret"), signature, GetRequestId(c)); err != nil {
+		glog.Infof("The webhook %s failed verification: %s\n", query.Get("webhook"), err.Error())
+		return UnprocessableEntityWithMessage("InvalidWebhook", "The webhook did not respond to the verification challenge.")
+	}
+	return nil
+}
+
+func (b *BusinessLogic) provisionInFlight(InstanceID string) *broker.ProvisionResponse {
+	glog.Infof("The provision of %s is already in flight, returning its operation.\n", InstanceID)
+	opkey := osb.OperationKey(InstanceID)
+	response := broker.ProvisionResponse{}
+	response.Async = true
+	response.OperationKey = &opkey
+	response.ExtensionAPIs = b.ConvertActionsToExtensions(InstanceID)
+	response.DashboardURL = DashboardUrl(InstanceID)
+	return &response
+}
+
 // A peice of advice, never try to make this syncronous by waiting for a to return a response. The problem is
 // that can take up to 10 minutes in my experience (depending on the provider), and aside from the API call timing
 // out the other issue is it can cause the mutex lock to make the entire API unresponsive.
 func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
+	// The webhook is verified before taking the lock, a slow webhook would otherwise hold up every request.
+	if err := b.VerifyWebhook(c); err != nil {
+		return nil, err
+	}
 	b.Lock()
 	defer b.Unlock()
 	response := broker.ProvisionResponse{}
@@ -140,11 +1381,6 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 		return nil, UnprocessableEntityWithMessage("InstanceRequired", "The instance ID was not provided.")
 	}
 
-	// Ensure we are not trying to provision a UUID that has ever been used before.
-	if err := b.storage.ValidateInstanceID(request.InstanceID); err != nil {
-		return nil, UnprocessableEntityWithMessage("InstanceInvalid", "The instance ID was either already in-use or invalid.")
-	}
-
 	plan, err := b.storage.GetPlanByID(request.PlanID)
 	if err != nil && err.Error() == "Not found" {
 		return nil, NotFound()
@@ -162,52 +1398,247 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 		response.Exists = true
 	} else if err != nil && err.Error() == "Cannot find resource instance" {
 		response.Exists = false
-		Instance, err = b.GetUnclaimedInstance(request.PlanID, request.InstanceID)
 
-		if err != nil && err.Error() == "Cannot find resource instance" {
+		// A retry of a provision still in flight (possibly on another broker) gets the same operation.
+		provisioning, err := b.storage.IsProvisioning(request.InstanceID)
+		if err != nil {
+			glog.Errorf("Unable to provision (IsProvisioning failed): %s\n", err.Error())
+			return nil, InternalServerError()
+		}
+		if provisioning {
+			return b.provisionInFlight(request.InstanceID), nil
+		}
+
+		// Ensure we are not trying to provision a UUID that has ever been used before.
+		if err := b.storage.ValidateInstanceID(request.InstanceID); err != nil {
+			return nil, UnprocessableEntityWithMessage("InstanceInvalid", "The instance ID was either already in-use or invalid.")
+		}
+
+		if !PlanInstallableIn(plan.basePlan, GetNetworkContext(c)) {
+			return nil, UnprocessableEntityWithMessage("PlanNotAvailable", "The plan cannot be installed on the "+GetNetworkContext(c)+" network.")
+		}
+		organizations, err := b.storage.GetPlanOrganizations()
+		if err != nil {
+			glog.Errorf("Unable to provision (GetPlanOrganizations failed): %s\n", err.Error())
+			return nil, InternalServerError()
+		}
+		organization := request.OrganizationGUID
+		if organization == "" {
+			organization = GetOrganization(c)
+		}
+		if !PlanVisibleTo(plan.ID, organizations, organization) {
+			return nil, UnprocessableEntityWithMessage("PlanNotAvailable", "The plan is not available to the organization.")
+		}
+
+		quota, err := b.storage.GetExceededQuota(request.PlanID, request.OrganizationGUID, request.SpaceGUID)
+		if err != nil {
+			glog.Errorf("Unable to provision (GetExceededQuota failed): %s\n", err.Error())
+			return nil, InternalServerError()
+		}
+		if quota != nil {
+			return nil, UnprocessableEntityWithMessage("QuotaExceeded", "The quota of "+strconv.Itoa(quota.MaxInstances)+" instances has been reached, remove unused instances or ask for the quota to be raised.")
+		}
+
+		folders, err := ParseFolders(request.Parameters)
+		if err != nil {
+			return nil, UnprocessableEntityWithMessage("InvalidParameters", err.Error())
+		}
+		seed, err := ParseSeed(plan, request.Parameters)
+		if err != nil {
+			return nil, UnprocessableEntityWithMessage("InvalidParameters", err.Error())
+		}
+		restore, err := ParseRestoreFrom(b.storage, request.Parameters, organization)
+		if err != nil {
+			return nil, UnprocessableEntityWithMessage("InvalidParameters", err.Error())
+		}
+		if (seed != "" || restore != nil) && UsesCustomerKey(plan) {
+			return nil, UnprocessableEntityWithMessage("CustomerKeyNotSupported", customerKeyCopyMessage+" The bucket can't be seeded or restored from a backup.")
+		}
+
+		started, err := b.storage.StartProvision(request.InstanceID, request.PlanID, GetRequestId(c))
+		if err != nil {
+			glog.Errorf("Unable to provision (StartProvision failed): %s\n", err.Error())
+			return nil, InternalServerError()
+		}
+		if !started {
+			return b.provisionInFlight(request.InstanceID), nil
+		}
+		succeeded := false
+		defer (func() {
+			if err := b.storage.FinishProvision(request.InstanceID, succeeded); err != nil {
+				glog.Errorf("Unable to record the end of the provision of %s: %s\n", request.InstanceID, err.Error())
+			}
+		})()
+
+		// Preprovisioned instances are in the default region, they can't be used for another region.
+		region, _ := request.Parameters["region"].(string)
+		if region == "" {
+			Instance, err = b.GetUnclaimedInstance(request.PlanID, request.InstanceID)
+		}
+
+		if GetProvisionQueue() && (region != "" || (err != nil && err.Error() == "Cannot find resource instance")) {
+			if !PlanAllowsRegion(plan, region) {
+				return nil, UnprocessableEntityWithMessage("RegionNotAllowed", "The region "+region+" is not available on this plan.")
+			}
+			progress := &ProvisionProgress{Owner: request.OrganizationGUID, Region: region}
+			if err = QueueProvision(b.storage, request.InstanceID, plan, progress, GetRequestId(c)); err != nil {
+				glog.Errorf("Error: Unable to queue the provision of %s: %s\n", request.InstanceID, err.Error())
+				if err = b.storage.NukeInstance(request.InstanceID); err != nil {
+					glog.Errorf("Unable to remove the record of the unqueued instance %s: %s\n", request.InstanceID, err.Error())
+				}
+				return nil, InternalServerError()
+			}
+			Instance = progress.instance(request.InstanceID, plan)
+			Instance.Ready = false
+			b.ScheduleWebhook(c, Instance, NotifyCreateServiceWebhookTask, "")
+		} else if region != "" || (err != nil && err.Error() == "Cannot find resource instance") {
 			// Create a new one
 			provider, err := GetProviderByPlan(b.namePrefix, plan)
 			if err != nil {
 				glog.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
 				return nil, InternalServerError()
 			}
-			Instance, err = provider.Provision(request.InstanceID, plan, request.OrganizationGUID)
-			if err != nil {
-				glog.Errorf("Error provisioning resource: %s\n", err.Error())
-				return nil, InternalServerError()
+			breaker := GetCircuitBreaker(plan.Provider)
+			if err = breaker.Allow(); err != nil {
+				glog.Errorf("Unable to provision (request: %s), the %s provider is unavailable.\n", GetRequestId(c), plan.Provider)
+				return nil, ProviderError(err)
 			}
-
-			if err = b.storage.AddInstance(Instance); err != nil {
+			progress := &ProvisionProgress{Owner: request.OrganizationGUID, Region: region}
+			Instance, err = provider.ResumeProvision(request.InstanceID, plan, progress)
+			breaker.Record(err)
+			if err != nil && err.Error() == "Region not allowed" {
+				return nil, UnprocessableEntityWithMessage("RegionNotAllowed", "The region "+region+" is not available on this plan.")
+			} else if err != nil && err.Error() == "Bucket limit reached" {
+				return nil, UnprocessableEntityWithMessage("CapacityExceeded", "No more buckets can be created at this time, contact the administrator of the broker.")
+			} else if err != nil && progress.Name != "" {
+				// Part of the bucket exists, the worker finishes provisioning it from the step that failed.
+				glog.Errorf("Error provisioning resource (request: %s), resuming from the %s step later: %s\n", GetRequestId(c), progress.Step, err.Error())
+				Instance = progress.instance(request.InstanceID, plan)
+				Instance.Status = "creating"
+				Instance.Ready = false
+				// If it can't be resumed what was created is rolled back.
+				if err = b.storage.AddInstance(Instance); err != nil {
+					glog.Errorf("Error: Unable to record the partially provisioned instance (%s), rolling it back: %s\n", Instance.Name, err.Error())
+					RollbackProvision(provider, plan, progress)
+					return nil, InternalServerError()
+				}
+				if err = ScheduleResumeProvision(b.storage, Instance.Id, plan, progress, GetRequestId(c)); err != nil {
+					glog.Errorf("Error: Unable to schedule resuming the provision (%s), rolling it back: %s\n", Instance.Name, err.Error())
+					if RollbackProvision(provider, plan, progress) == nil {
+						if err = b.storage.NukeInstance(Instance.Id); err != nil {
+							glog.Errorf("Unable to remove the record of the rolled back instance %s: %s\n", Instance.Name, err.Error())
+						}
+					}
+					return nil, InternalServerError()
+				}
+				b.ScheduleWebhook(c, Instance, NotifyCreateServiceWebhookTask, "")
+			} else if err != nil {
+				glog.Errorf("Error provisioning resource (request: %s): %s\n", GetRequestId(c), err.Error())
+				return nil, ProviderError(err)
+			} else if err = b.storage.AddInstance(Instance); err != nil {
 				glog.Errorf("Error inserting record into provisioned table: %s\n", err.Error())
 
 				if err = provider.Deprovision(Instance, false); err != nil {
 					glog.Errorf("Error cleaning up (deprovision failed) after insert record failed but provision succeeded (Resource Id:%s Name: %s) %s\n", Instance.Id, Instance.Name, err.Error())
-					if _, err = b.storage.AddTask(Instance.Id, DeleteTask, Instance.Name); err != nil {
+					if _, err = b.storage.AddTask(Instance.Id, DeleteTask, Instance.Name, GetRequestId(c)); err != nil {
 						glog.Errorf("Error: Unable to add task to delete instance, WE HAVE AN ORPHAN! (%s): %s\n", Instance.Name, err.Error())
+						SendNotification("orphan-"+Instance.Name, "Orphaned bucket", "The bucket "+Instance.Name+" was provisioned but could not be recorded or removed, it must be deleted by hand.")
 					}
 				}
 				return nil, InternalServerError()
-			}
-			if !IsAvailable(Instance.Status) {
-				if _, err = b.storage.AddTask(Instance.Id, PerformPostProvisionTask, ""); err != nil {
-					glog.Errorf("Error: Unable to schedule resync from provider! (%s): %s\n", Instance.Name, err.Error())
-				}
-				// This is a hack to support callbacks, hopefully this will become an OSB standard.
-				if c != nil && c.Request != nil && c.Request.URL != nil && c.Request.URL.Query().Get("webhook") != "" && c.Request.URL.Query().Get("secret") != "" {
-					// Schedule a callback
-					byteData, err := json.Marshal(WebhookTaskMetadata{Url: c.Request.URL.Query().Get("webhook"), Secret: c.Request.URL.Query().Get("secret")})
-					if err != nil {
-						glog.Errorf("Error: failed to marshal webhook task metadata: %s\n", err)
-					}
-					if _, err = b.storage.AddTask(Instance.Id, NotifyCreateServiceWebhookTask, string(byteData)); err != nil {
+			} else {
+				RecordPolicyVersion(b.storage, provider, Instance, "provisioned")
+				if !IsAvailable(Instance.Status) {
+					if _, err = b.storage.AddTask(Instance.Id, PerformPostProvisionTask, "", GetRequestId(c)); err != nil {
 						glog.Errorf("Error: Unable to schedule resync from provider! (%s): %s\n", Instance.Name, err.Error())
 					}
+					b.ScheduleWebhook(c, Instance, NotifyCreateServiceWebhookTask, "")
 				}
 			}
 		} else if err != nil {
 			glog.Errorf("Got fatal error from unclaimed instance endpoint: %s\n", err.Error())
 			return nil, InternalServerError()
+		} else if GetProvisionQueue() {
+			// The bucket is usable as it is, the owner specific changes are made by the worker.
+			byteData, err := json.Marshal(PerformPostClaimTaskMetadata{Owner: request.OrganizationGUID})
+			if err != nil {
+				glog.Errorf("Error: failed to marshal post claim task metadata: %s\n", err)
+			}
+			if _, err = b.storage.AddTask(Instance.Id, PerformPostClaimTask, string(byteData), GetRequestId(c)); err != nil {
+				glog.Errorf("Error: Unable to schedule post claim! (%s): %s\n", Instance.Name, err.Error())
+			}
+		} else {
+			// Owner specific changes are retried by the worker if they fail, the bucket is usable either way.
+			provider, err := GetProviderByPlan(b.namePrefix, plan)
+			if err != nil {
+				glog.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+				return nil, InternalServerError()
+			}
+			if claimed, err := provider.PerformPostClaim(Instance, request.OrganizationGUID); err != nil {
+				glog.Errorf("Error performing post claim (request: %s) %s: %s\n", GetRequestId(c), Instance.Name, err.Error())
+				byteData, err := json.Marshal(PerformPostClaimTaskMetadata{Owner: request.OrganizationGUID})
+				if err != nil {
+					glog.Errorf("Error: failed to marshal post claim task metadata: %s\n", err)
+				}
+				if _, err = b.storage.AddTask(Instance.Id, PerformPostClaimTask, string(byteData), GetRequestId(c)); err != nil {
+					glog.Errorf("Error: Unable to schedule post claim! (%s): %s\n", Instance.Name, err.Error())
+				}
+			} else if err = b.storage.UpdateInstance(claimed, claimed.Plan.ID); err != nil {
+				glog.Errorf("Error: Unable to update instance after post claim (%s): %s\n", Instance.Name, err.Error())
+			} else {
+				Instance = claimed
+			}
+		}
+		succeeded = true
+		if Instance.Ready && IsAvailable(Instance.Status) {
+			if err = b.storage.ProvisionAvailable(Instance.Id); err != nil {
+				glog.Errorf("Unable to record that %s is available: %s\n", Instance.Id, err.Error())
+			}
+		}
+		if len(folders) > 0 {
+			byteData, err := json.Marshal(CreateFoldersTaskMetadata{Folders: folders})
+			if err != nil {
+				glog.Errorf("Error: failed to marshal create folders task metadata: %s\n", err)
+			}
+			if _, err = b.storage.AddTask(Instance.Id, CreateFoldersTask, string(byteData), GetRequestId(c)); err != nil {
+				glog.Errorf("Error: Unable to schedule creating the folders of %s: %s\n", Instance.Name, err.Error())
+			}
+		}
+		if seed != "" {
+			byteData, err := json.Marshal(SeedTaskMetadata{Source: seed})
+			if err != nil {
+				glog.Errorf("Error: failed to marshal seed task metadata: %s\n", err)
+			}
+			if _, err = b.storage.AddTask(Instance.Id, SeedTask, string(byteData), GetRequestId(c)); err != nil {
+				glog.Errorf("Error: Unable to schedule seeding %s from %s: %s\n", Instance.Name, seed, err.Error())
+			}
+		}
+		if restore != nil {
+			byteData, err := json.Marshal(restore)
+			if err != nil {
+				glog.Errorf("Error: failed to marshal restore task metadata: %s\n", err)
+			}
+			if _, err = b.storage.AddTask(Instance.Id, RestoreDbTask, string(byteData), GetRequestId(c)); err != nil {
+				glog.Errorf("Error: Unable to schedule restoring %s from %s: %s\n", Instance.Name, restore.Backup, err.Error())
+			}
+		}
+		if c != nil && c.Request != nil && c.Request.URL != nil {
+			if query := c.Request.URL.Query(); query.Get("webhook") != "" && query.Get("secret") != "" {
+				if err = b.storage.SetOwnerWebhook(Instance.Id, query.Get("webhook"), query.Get("secret")); err != nil {
+					glog.Errorf("Error: Unable to record the webhook of the owner of %s: %s\n", Instance.Name, err.Error())
+				}
+			}
+			err = ScheduleExpiration(b.storage, Instance, plan, c.Request.URL.Query().Get("webhook"), c.Request.URL.Query().Get("secret"))
+		} else {
+			err = ScheduleExpiration(b.storage, Instance, plan, "", "")
+		}
+		if err != nil {
+			glog.Errorf("Error: Unable to record when the instance expires (%s): %s\n", Instance.Name, err.Error())
+		}
+		if err = b.storage.SetInstanceOwner(Instance.Id, request.OrganizationGUID, request.SpaceGUID); err != nil {
+			glog.Errorf("Error: Unable to record the owner of the instance (%s): %s\n", Instance.Name, err.Error())
 		}
+		PublishEvent(InstanceProvisionedEvent, Instance, request.OrganizationGUID, GetRequestId(c))
 	} else {
 		glog.Errorf("Unable to get instances: %s\n", err.Error())
 		return nil, InternalServerError()
@@ -222,11 +1653,16 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 	}
 
 	response.ExtensionAPIs = b.ConvertActionsToExtensions(Instance.Id)
+	response.DashboardURL = DashboardUrl(Instance.Id)
 
 	return &response, nil
 }
 
 func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (*broker.DeprovisionResponse, error) {
+	// The webhook is verified before taking the lock, a slow webhook would otherwise hold up every request.
+	if err := b.VerifyWebhook(c); err != nil {
+		return nil, err
+	}
 	b.Lock()
 	defer b.Unlock()
 
@@ -239,19 +1675,46 @@ func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.R
 		return nil, InternalServerError()
 	}
 
+	protected, err := b.storage.IsDeletionProtected(Instance.Id)
+	if err != nil {
+		glog.Errorf("Unable to deprovision, IsDeletionProtected failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	if protected {
+		return nil, UnprocessableEntityWithMessage("DeletionProtected", "Deletion protection is enabled, update the instance with deletion_protection set to false first.")
+	}
+	frozen, err := b.storage.IsFrozen(Instance.Id)
+	if err != nil {
+		glog.Errorf("Unable to deprovision, IsFrozen failed: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	if frozen {
+		return nil, UnprocessableEntityWithMessage("InstanceFrozen", "The instance is frozen, unfreeze it first.")
+	}
+
 	provider, err := GetProviderByPlan(b.namePrefix, Instance.Plan)
 	if err != nil {
 		glog.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
 		return nil, InternalServerError()
 	}
 
+	if c == nil || c.Request == nil || c.Request.URL == nil || c.Request.URL.Query().Get("force") != "true" {
+		if err = provider.ValidateDeprovision(Instance); err != nil && err.Error() == "Bucket not empty" {
+			return nil, UnprocessableEntityWithMessage("BucketNotEmpty", "The bucket must be empty before it's deprovisioned, purge it first or pass force=true.")
+		} else if err != nil {
+			glog.Errorf("Unable to deprovision, ValidateDeprovision failed: %s\n", err.Error())
+			return nil, ProviderError(err)
+		}
+	}
+
 	if err = provider.Deprovision(Instance, true); err != nil {
 		glog.Errorf("Error failed to deprovision: (Id: %s Name: %s) %s\n", Instance.Id, Instance.Name, err.Error())
-		if _, err = b.storage.AddTask(Instance.Id, DeleteTask, Instance.Name); err != nil {
+		if taskId, err := b.storage.AddTask(Instance.Id, DeleteTask, Instance.Name, GetRequestId(c)); err != nil {
 			glog.Errorf("Error: Unable to schedule delete from provider! (%s): %s\n", Instance.Name, err.Error())
 			return nil, InternalServerError()
 		} else {
 			glog.Errorf("Successfully scheduled db to be removed.")
+			b.ScheduleWebhook(c, Instance, NotifyDeprovisionServiceWebhookTask, taskId)
 			response.Async = true
 			return &response, nil
 		}
@@ -260,6 +1723,7 @@ func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.R
 		glog.Errorf("Error removing record from provisioned table: %s\n", err.Error())
 		return nil, InternalServerError()
 	}
+	PublishEvent(InstanceDeprovisionedEvent, Instance, "", GetRequestId(c))
 	response.Async = false
 	return &response, nil
 }
@@ -276,44 +1740,143 @@ func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.Req
 		glog.Errorf("Error finding instance id (during deprovision) from provisioned table: %s\n", err.Error())
 		return nil, InternalServerError()
 	}
-	if request.PlanID == nil {
+	samePlan := request.PlanID == nil || strings.ToLower(*request.PlanID) == strings.ToLower(Instance.Plan.ID)
+	if request.PlanID == nil && len(request.Parameters) == 0 {
 		return nil, UnprocessableEntity()
 	}
 
 	if !IsAvailable(Instance.Status) {
 		return nil, UnprocessableEntityWithMessage("ConcurrencyError", "Clients MUST wait until pending requests have completed for the specified resources.")
 	}
+	if err = b.checkNotFrozen(Instance); err != nil {
+		return nil, err
+	}
+	if err = b.VerifyWebhook(c); err != nil {
+		return nil, err
+	}
+
+	// Parameters (tags, lifecycle, cors and deletion protection) can only be changed on their own, not
+	// along with the plan.
+	if len(request.Parameters) > 0 {
+		if !samePlan {
+			return nil, UnprocessableEntityWithMessage("UpgradeError", "The plan and parameters cannot be changed at the same time.")
+		}
+		byteData, err := json.Marshal(request.Parameters)
+		if err != nil {
+			glog.Errorf("Unable to marshal update parameters: %s\n", err.Error())
+			return nil, InternalServerError()
+		}
+		var settings InstanceSettings
+		decoder := json.NewDecoder(bytes.NewReader(byteData))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&settings); err != nil {
+			return nil, UnprocessableEntityWithMessage("InvalidParameters", "The parameters could not be parsed: "+err.Error())
+		}
+		if err = settings.Validate(); err != nil {
+			return nil, UnprocessableEntityWithMessage("InvalidParameters", err.Error())
+		}
+		if byteData, err = json.Marshal(settings); err != nil {
+			glog.Errorf("Unable to marshal update settings task meta data: %s\n", err.Error())
+			return nil, InternalServerError()
+		}
+		taskId, err := b.storage.AddTask(Instance.Id, UpdateSettingsTask, string(byteData), GetRequestId(c))
+		if err != nil {
+			glog.Errorf("Error: Unable to schedule update of settings! (%s): %s\n", Instance.Name, err.Error())
+			return nil, InternalServerError()
+		}
+		b.ScheduleWebhook(c, Instance, NotifyUpdateServiceWebhookTask, taskId)
+		response.Async = true
+		return &response, nil
+	}
 
-	if strings.ToLower(*request.PlanID) == strings.ToLower(Instance.Plan.ID) {
+	if samePlan {
 		return nil, UnprocessableEntityWithMessage("UpgradeError", "Cannot upgrade to the same plan.")
 	}
 
 	target_plan, err := b.storage.GetPlanByID(*request.PlanID)
 	if err != nil {
 		glog.Errorf("Unable to provision resource (GetPlanByID failed): %s\n", err.Error())
-		return nil, err
+		return nil, InternalServerError()
 	}
 
 	if Instance.Plan.Provider == target_plan.Provider {
 		byteData, err := json.Marshal(ChangePlansTaskMetadata{Plan: *request.PlanID})
 		if err != nil {
 			glog.Errorf("Unable to marshal change plans task meta data: %s\n", err.Error())
-			return nil, err
+			return nil, InternalServerError()
 		}
-		if _, err = b.storage.AddTask(Instance.Id, ChangePlansTask, string(byteData)); err != nil {
+		taskId, err := b.storage.AddTask(Instance.Id, ChangePlansTask, string(byteData), GetRequestId(c))
+		if err != nil {
 			glog.Errorf("Error: Unable to schedule upgrade of a plan! (%s): %s\n", Instance.Name, err.Error())
-			return nil, err
+			return nil, InternalServerError()
+		}
+		b.ScheduleWebhook(c, Instance, NotifyUpdateServiceWebhookTask, taskId)
+		response.Async = true
+		return &response, nil
+	} else if CanChangeProviders(Instance.Plan.Provider, target_plan.Provider) {
+		// the objects are copied to a new bucket on the other provider.
+		if UsesCustomerKey(Instance.Plan) || UsesCustomerKey(target_plan) {
+			return nil, UnprocessableEntityWithMessage("CustomerKeyNotSupported", customerKeyCopyMessage)
+		}
+		byteData, err := json.Marshal(ChangeProvidersTaskMetadata{Plan: *request.PlanID})
+		if err != nil {
+			glog.Errorf("Unable to marshal change providers task meta data: %s\n", err.Error())
+			return nil, InternalServerError()
+		}
+		taskId, err := b.storage.AddTask(Instance.Id, ChangeProvidersTask, string(byteData), GetRequestId(c))
+		if err != nil {
+			glog.Errorf("Error: Unable to schedule moving a bucket across providers! (%s): %s\n", Instance.Name, err.Error())
+			return nil, InternalServerError()
 		}
+		b.ScheduleWebhook(c, Instance, NotifyUpdateServiceWebhookTask, taskId)
 		response.Async = true
 		return &response, nil
 	} else {
-		return nil, UnprocessableEntityWithMessage("UpgradeError", "Cannot upgrade or change plans across provider types.")
+		return nil, UnprocessableEntityWithMessage("UpgradeError", "The plan is on the "+string(target_plan.Provider)+" provider, buckets cannot be moved from the "+string(Instance.Plan.Provider)+" provider.")
 	}
 }
 
 func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
 	response := broker.LastOperationResponse{}
 
+	// Deprovisions that could not finish right away are left to a delete task and provisions that
+	// failed part way to a resume-provision task, only the most recent operation is reported so an
+	// older task can't hide the state of a later one.
+	task, err := b.storage.GetLastOperationTask(request.InstanceID)
+	if err != nil && err.Error() != "Not found" {
+		glog.Errorf("Unable to get resource (%s) status, GetLastOperationTask failed: %s\n", request.InstanceID, err.Error())
+		return nil, InternalServerError()
+	} else if err == nil && task.Action == DeleteTask {
+		desc := "deprovisioning"
+		response.State = osb.StateInProgress
+		if task.Status == "finished" {
+			desc = "deprovisioned"
+			response.State = osb.StateSucceeded
+		} else if task.Status == "failed" {
+			desc = task.Result
+			response.State = osb.StateFailed
+		}
+		response.Description = &desc
+		return &response, nil
+	} else if err == nil && task.Action == ResumeProvisionTask && task.Status != "finished" {
+		desc := "creating"
+		if entry, err := b.storage.GetInstance(request.InstanceID); err == nil && entry.Status == "provisioning" {
+			desc = "provisioning"
+		}
+		response.State = osb.StateInProgress
+		if task.Status == "failed" {
+			desc = task.Result
+			response.State = osb.StateFailed
+		}
+		response.Description = &desc
+		return &response, nil
+	} else if err == nil && task.Status == "failed" {
+		// an update that failed, the bucket itself is still available.
+		response.Description = &task.Result
+		response.State = osb.StateFailed
+		return &response, nil
+	}
+
 	upgrading, err := b.storage.IsUpgrading(request.InstanceID)
 	if err != nil {
 		glog.Errorf("Unable to get resource (%s) status, IsUpgrading failed: %s\n", request.InstanceID, err.Error())
@@ -348,6 +1911,12 @@ func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *brok
 
 	Instance, err := b.GetInstanceById(request.InstanceID)
 	if err != nil && err.Error() == "Cannot find resource instance" {
+		if provisioning, err := b.storage.IsProvisioning(request.InstanceID); err == nil && provisioning {
+			desc := "provisioning"
+			response.Description = &desc
+			response.State = osb.StateInProgress
+			return &response, nil
+		}
 		return nil, NotFound()
 	} else if err != nil {
 		glog.Errorf("Unable to get resource (%s) status: %s\n", request.InstanceID, err.Error())
@@ -357,7 +1926,13 @@ func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *brok
 	b.storage.UpdateInstance(Instance, Instance.Plan.ID)
 
 	if Instance.Ready == true {
-		response.Description = &Instance.Status
+		desc := Instance.Status
+		if config, err := b.GetConfiguration(Instance); err != nil {
+			glog.Errorf("Unable to get the configuration of %s: %s\n", Instance.Name, err.Error())
+		} else if len(config.Drift) > 0 {
+			desc = desc + " (drift: " + strings.Join(config.Drift, "; ") + ")"
+		}
+		response.Description = &desc
 		response.State = osb.StateSucceeded
 	} else if InProgress(Instance.Status) {
 		response.Description = &Instance.Status
@@ -369,6 +1944,121 @@ func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *brok
 	return &response, nil
 }
 
+// Bucket configurations are kept for a minute so platforms polling the last operation (or fetching
+// the instance) don't make a dozen requests to the provider each time.
+var bucketConfigurations = struct {
+	sync.Mutex
+	configs map[string]cachedConfiguration
+}{configs: make(map[string]cachedConfiguration)}
+
+type cachedConfiguration struct {
+	config  *BucketConfiguration
+	checked time.Time
+}
+
+func (b *BusinessLogic) GetConfiguration(Instance *Instance) (*BucketConfiguration, error) {
+	key := Instance.Id + ":" + Instance.Plan.ID
+	bucketConfigurations.Lock()
+	cached, ok := bucketConfigurations.configs[key]
+	bucketConfigurations.Unlock()
+	if ok && time.Since(cached.checked) < time.Minute {
+		return cached.config, nil
+	}
+	provider, err := GetProviderByPlan(b.namePrefix, Instance.Plan)
+	if err != nil {
+		return nil, err
+	}
+	config, err := provider.GetConfiguration(Instance)
+	if err != nil {
+		return nil, err
+	}
+	bucketConfigurations.Lock()
+	for id, entry := range bucketConfigurations.configs {
+		if time.Since(entry.checked) >= time.Minute {
+			delete(bucketConfigurations.configs, id)
+		}
+	}
+	bucketConfigurations.configs[key] = cachedConfiguration{config: config, checked: time.Now()}
+	bucketConfigurations.Unlock()
+	return config, nil
+}
+
+// Fetches the instance (OSB 2.14 GET /v2/service_instances/:id), the parameters are the bucket's
+// actual configuration so changes made outside of the broker can be seen.
+func (b *BusinessLogic) FetchInstance(InstanceID string) (map[string]interface{}, error) {
+	Instance, err := b.GetInstanceById(InstanceID)
+	if err != nil && err.Error() == "Cannot find resource instance" {
+		return nil, NotFound()
+	} else if err != nil {
+		glog.Errorf("Unable to fetch resource (%s): %s\n", InstanceID, err.Error())
+		return nil, InternalServerError()
+	}
+	parameters := map[string]interface{}{"name": Instance.Name, "status": Instance.Status}
+	if Instance.Region != "" {
+		parameters["region"] = Instance.Region
+	}
+	if Instance.Alias != "" {
+		parameters["alias"] = Instance.Alias
+	}
+	if expiration, err := b.storage.GetExpiration(Instance.Id); err == nil {
+		parameters["expires"] = expiration.Expires
+	} else if err.Error() != "Not found" {
+		glog.Errorf("Unable to get the expiration of %s: %s\n", Instance.Name, err.Error())
+	}
+	// the configuration is left out when the provider can't be reached, the rest is from the database.
+	if IsAvailable(Instance.Status) {
+		if config, err := b.GetConfiguration(Instance); err != nil {
+			glog.Errorf("Unable to get the configuration of %s: %s\n", Instance.Name, err.Error())
+		} else {
+			parameters["versioning"] = config.Versioning
+			parameters["encryption"] = config.Encryption
+			if config.KMSKeyId != "" {
+				parameters["kms_key_id"] = config.KMSKeyId
+			}
+			parameters["lifecycle_rules"] = config.LifecycleRules
+			parameters["drift"] = config.Drift
+		}
+	}
+	response := map[string]interface{}{"plan_id": Instance.Plan.ID, "parameters": parameters}
+	if dashboard := DashboardUrl(Instance.Id); dashboard != nil {
+		response["dashboard_url"] = *dashboard
+	}
+	return response, nil
+}
+
+// The credentials of a binding are the provider's urls plus a metadata block describing what was
+// bound to (the engine, its version, the plan and its attributes and the region).
+func GetBindingCredentials(credentialBroker CredentialBroker, Instance *Instance, BindingId string, Format string) (map[string]interface{}, error) {
+	credentials, err := credentialBroker.Credentials(Instance, BindingId)
+	if err != nil {
+		return nil, err
+	}
+	credentials["metadata"] = map[string]interface{}{
+		"engine":     Instance.Engine,
+		"version":    Instance.EngineVersion,
+		"plan":       Instance.Plan.basePlan.Name,
+		"attributes": Instance.Plan.basePlan.Metadata["attributes"],
+		"region":     credentials["S3_REGION"],
+	}
+	if Instance.Alias != "" {
+		credentials["S3_BUCKET_ALIAS"] = Instance.Alias
+	}
+	return FormatBindingCredentials(Format, Instance, BindingId, credentials)
+}
+
+// Returns a copy of the instance with the credentials of the binding.
+func (binding *Binding) instance(Instance *Instance) *Instance {
+	bound := *Instance
+	if binding.AccessKeyId != "" {
+		bound.Username = binding.AccessKeyId
+		bound.Password = binding.SecretAccessKey
+	}
+	return &bound
+}
+
+// A binding is given the instance's current access key unless it names a predecessor binding (OSB
+// binding rotation), in which case a second access key is created for it and becomes the instance's
+// key. The predecessor keeps its key until it is unbound.
 func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext) (*broker.BindResponse, error) {
 	b.Lock()
 	defer b.Unlock()
@@ -389,21 +2079,116 @@ func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext)
 		return nil, InternalServerError()
 	}
 
+	credentialBroker, err := GetCredentialBroker(b.storage, provider, Instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to bind, cannot find credential broker (GetCredentialBroker failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+
+	existing, err := b.storage.GetBinding(request.BindingID)
+	if err == nil && existing.InstanceId != Instance.Id {
+		return nil, ConflictErrorWithMessage("The binding id is already in use by another instance.")
+	} else if err == nil {
+		credentials, err := GetBindingCredentials(credentialBroker, existing.instance(Instance), existing.Id, existing.Format)
+		if err != nil {
+			glog.Errorf("Unable to get the credentials of binding %s: %s\n", existing.Id, err.Error())
+			return nil, ProviderError(err)
+		}
+		return &broker.BindResponse{
+			BindResponse: osb.BindResponse{
+				Async:       false,
+				Credentials: credentials,
+			},
+			Exists: true,
+		}, nil
+	} else if err.Error() != "Not found" {
+		glog.Errorf("Unable to get binding %s: %s\n", request.BindingID, err.Error())
+		return nil, InternalServerError()
+	}
+
+	format, _ := request.Parameters["format"].(string)
+	if !IsCredentialsFormat(format) {
+		return nil, UnprocessableEntityWithMessage("InvalidFormat", "The format must be "+K8sSecretFormat+" or "+CSISecretProviderClassFormat+".")
+	}
+	if format == CSISecretProviderClassFormat && !usesSecretsManager(credentialBroker) {
+		return nil, UnprocessableEntityWithMessage("InvalidFormat", "The "+CSISecretProviderClassFormat+" format is only available on plans with secrets-manager credentials.")
+	}
+	binding := &Binding{
+		Id:              request.BindingID,
+		InstanceId:      Instance.Id,
+		AccessKeyId:     Instance.Username,
+		SecretAccessKey: Instance.Password,
+		Format:          format,
+	}
+	if predecessorId := GetPredecessorBindingId(c); predecessorId != "" {
+		predecessor, err := b.storage.GetBinding(predecessorId)
+		if err != nil && err.Error() == "Not found" {
+			// Bindings created before bindings were recorded use the instance's key, as other unrecorded
+			// bindings may too the key is kept when the predecessor is unbound.
+			predecessor = &Binding{Id: predecessorId, InstanceId: Instance.Id, AccessKeyId: Instance.Username, SecretAccessKey: Instance.Password, Inherited: true}
+			if err = b.storage.AddBinding(predecessor); err != nil {
+				glog.Errorf("Unable to record predecessor binding %s: %s\n", predecessorId, err.Error())
+				return nil, InternalServerError()
+			}
+		} else if err != nil {
+			glog.Errorf("Unable to get predecessor binding %s: %s\n", predecessorId, err.Error())
+			return nil, InternalServerError()
+		}
+		if predecessor.InstanceId != Instance.Id {
+			return nil, UnprocessableEntityWithMessage("InvalidPredecessor", "The predecessor binding is not a binding of this instance.")
+		}
+		user, err := provider.AddAccessKey(Instance)
+		if err != nil {
+			glog.Errorf("Unable to add an access key for %s (rotating binding %s): %s\n", Instance.Name, predecessorId, err.Error())
+			return nil, ProviderError(err)
+		}
+		if err = b.storage.UpdateCredentials(Instance, user); err != nil {
+			glog.Errorf("Error: Unable to record new credentials for instance %s and user %s: %s\n", Instance.Name, user.AccessKeyId, err.Error())
+			if err = provider.RemoveAccessKey(Instance, user.AccessKeyId); err != nil {
+				glog.Errorf("Error: Unable to remove unrecorded access key %s of %s: %s\n", user.AccessKeyId, Instance.Name, err.Error())
+			}
+			return nil, InternalServerError()
+		}
+		if err = b.storage.AddRotation(Instance.Id, predecessor.AccessKeyId, user.AccessKeyId, GetOriginatingIdentity(c), GetRequestId(c)); err != nil {
+			glog.Errorf("Error: Unable to record the rotation of credentials for instance %s: %s\n", Instance.Name, err.Error())
+		}
+		PublishEvent(CredentialsRotatedEvent, Instance, "", GetRequestId(c))
+		binding.Predecessor = predecessorId
+		binding.AccessKeyId = user.AccessKeyId
+		binding.SecretAccessKey = user.SecretAccessKey
+	}
+	if err = credentialBroker.Bind(binding.instance(Instance), binding.Id); err != nil {
+		glog.Errorf("Unable to create the credentials of binding %s: %s\n", request.BindingID, err.Error())
+		return nil, ProviderError(err)
+	}
+	if err = b.storage.AddBinding(binding); err != nil {
+		glog.Errorf("Unable to record binding %s: %s\n", request.BindingID, err.Error())
+		if err = credentialBroker.Unbind(binding.instance(Instance), binding.Id); err != nil {
+			glog.Errorf("Unable to remove the credentials of unrecorded binding %s: %s\n", request.BindingID, err.Error())
+		}
+		return nil, InternalServerError()
+	}
+
 	if request.BindResource != nil && request.BindResource.AppGUID != nil {
 		if err = provider.Tag(Instance, "Binding", request.BindingID); err != nil {
 			glog.Errorf("Error tagging: %s with %s, got %s\n", request.InstanceID, *request.BindResource.AppGUID, err.Error())
-			return nil, InternalServerError()
+			return nil, ProviderError(err)
 		}
 		if err = provider.Tag(Instance, "App", *request.BindResource.AppGUID); err != nil {
 			glog.Errorf("Error tagging: %s with %s, got %s\n", request.InstanceID, *request.BindResource.AppGUID, err.Error())
-			return nil, InternalServerError()
+			return nil, ProviderError(err)
 		}
 	}
 
+	credentials, err := GetBindingCredentials(credentialBroker, binding.instance(Instance), binding.Id, binding.Format)
+	if err != nil {
+		glog.Errorf("Unable to get the credentials of binding %s: %s\n", binding.Id, err.Error())
+		return nil, ProviderError(err)
+	}
 	return &broker.BindResponse{
 		BindResponse: osb.BindResponse{
 			Async:       false,
-			Credentials: provider.GetUrl(Instance),
+			Credentials: credentials,
 		},
 	}, nil
 }
@@ -429,13 +2214,47 @@ func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestCont
 		return nil, InternalServerError()
 	}
 
+	// The access key of a rotated binding is removed once nothing else is bound with it.
+	binding, err := b.storage.GetBinding(request.BindingID)
+	if err == nil && binding.AccessKeyId != "" && binding.AccessKeyId != Instance.Username {
+		bound, err := b.storage.IsAccessKeyBound(Instance.Id, binding.AccessKeyId, binding.Id)
+		if err != nil {
+			glog.Errorf("Unable to check whether access key %s is bound: %s\n", binding.AccessKeyId, err.Error())
+			return nil, InternalServerError()
+		}
+		if !bound {
+			if err = provider.RemoveAccessKey(Instance, binding.AccessKeyId); err != nil {
+				glog.Errorf("Unable to remove access key %s of %s: %s\n", binding.AccessKeyId, Instance.Name, err.Error())
+				return nil, ProviderError(err)
+			}
+		}
+	} else if err != nil && err.Error() != "Not found" {
+		glog.Errorf("Unable to get binding %s: %s\n", request.BindingID, err.Error())
+		return nil, InternalServerError()
+	}
+	if err == nil {
+		credentialBroker, err := GetCredentialBroker(b.storage, provider, Instance.Plan)
+		if err != nil {
+			glog.Errorf("Unable to unbind, cannot find credential broker (GetCredentialBroker failed): %s\n", err.Error())
+			return nil, InternalServerError()
+		}
+		if err = credentialBroker.Unbind(binding.instance(Instance), binding.Id); err != nil {
+			glog.Errorf("Unable to remove the credentials of binding %s: %s\n", request.BindingID, err.Error())
+			return nil, ProviderError(err)
+		}
+		if err = b.storage.DeleteBinding(request.BindingID); err != nil {
+			glog.Errorf("Unable to delete binding %s: %s\n", request.BindingID, err.Error())
+			return nil, InternalServerError()
+		}
+	}
+
 	if err = provider.Untag(Instance, "Binding"); err != nil {
 		glog.Errorf("Error untagging: %s\n", err.Error())
-		return nil, InternalServerError()
+		return nil, ProviderError(err)
 	}
 	if err = provider.Untag(Instance, "App"); err != nil {
 		glog.Errorf("Error untagging: got %s\n", err.Error())
-		return nil, InternalServerError()
+		return nil, ProviderError(err)
 	}
 
 	return &broker.UnbindResponse{
@@ -458,15 +2277,30 @@ func (b *BusinessLogic) GetBinding(request *osb.GetBindingRequest, context *brok
 		return nil, NotFound()
 	} else if err != nil {
 		glog.Errorf("Error finding instance id (during getbinding): %s\n", err.Error())
-		return nil, err
+		return nil, InternalServerError()
 	}
 	provider, err := GetProviderByPlan(b.namePrefix, Instance.Plan)
 	if err != nil {
 		glog.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
 		return nil, InternalServerError()
 	}
+	credentialBroker, err := GetCredentialBroker(b.storage, provider, Instance.Plan)
+	if err != nil {
+		glog.Errorf("Unable to get binding, cannot find credential broker (GetCredentialBroker failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	format := ""
+	if binding, err := b.storage.GetBinding(request.BindingID); err == nil && binding.InstanceId == Instance.Id {
+		Instance = binding.instance(Instance)
+		format = binding.Format
+	}
+	credentials, err := GetBindingCredentials(credentialBroker, Instance, request.BindingID, format)
+	if err != nil {
+		glog.Errorf("Unable to get the credentials of binding %s: %s\n", request.BindingID, err.Error())
+		return nil, ProviderError(err)
+	}
 	return &osb.GetBindingResponse{
-		Credentials: provider.GetUrl(Instance),
+		Credentials: credentials,
 	}, nil
 }
 
@@ -0,0 +1,105 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const (
+	K8sSecretFormat              = "k8s-secret"
+	CSISecretProviderClassFormat = "csi-secret-provider-class"
+)
+
+func IsCredentialsFormat(format string) bool {
+	return format == "" || format == K8sSecretFormat || format == CSISecretProviderClassFormat
+}
+
+// Secret values must be strings, anything else (such as the metadata) is stored as json.
+func secretData(credentials map[string]interface{}) (map[string]string, error) {
+	data := make(map[string]string)
+	for key, value := range credentials {
+		if str, ok := value.(string); ok {
+			data[key] = str
+			continue
+		}
+		byteData, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		data[key] = string(byteData)
+	}
+	return data, nil
+}
+
+func manifestMetadata(Instance *Instance, BindingId string) map[string]interface{} {
+	return map[string]interface{}{
+		"name": Instance.Name,
+		"labels": map[string]string{
+			"app.kubernetes.io/managed-by": "s3-broker",
+		},
+		"annotations": map[string]string{
+			"s3-broker/instance-id": Instance.Id,
+			"s3-broker/binding-id":  BindingId,
+		},
+	}
+}
+
+// Renders the credentials of a binding in the format it was bound with, the manifests are json
+// (which kubectl applies as is) and have no namespace so they're created in the current one. An
+// empty format returns the credentials unchanged.
+func FormatBindingCredentials(format string, Instance *Instance, BindingId string, credentials map[string]interface{}) (map[string]interface{}, error) {
+	switch format {
+	case "":
+		return credentials, nil
+	case K8sSecretFormat:
+		data, err := secretData(credentials)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   manifestMetadata(Instance, BindingId),
+			"type":       "Opaque",
+			"stringData": data,
+		}, nil
+	case CSISecretProviderClassFormat:
+		// The AWS provider of the secrets store CSI driver mounts the keys of the binding's secret as
+		// files and syncs them to a secret of the same name.
+		secret, _ := credentials["S3_CREDENTIALS_SECRET"].(string)
+		if secret == "" {
+			return nil, errors.New("The " + CSISecretProviderClassFormat + " format is only available on plans with secrets-manager credentials.")
+		}
+		keys := []string{"S3_BUCKET", "S3_LOCATION", "S3_ACCESS_KEY", "S3_SECRET_KEY", "S3_REGION"}
+		paths := make([]map[string]string, 0)
+		secretObjectData := make([]map[string]string, 0)
+		for _, key := range keys {
+			paths = append(paths, map[string]string{"path": key, "objectAlias": key})
+			secretObjectData = append(secretObjectData, map[string]string{"objectName": key, "key": key})
+		}
+		// The objects parameter is a yaml document in a string, json is valid yaml.
+		objects, err := json.Marshal([]map[string]interface{}{
+			{"objectName": secret, "objectType": "secretsmanager", "jmesPath": paths},
+		})
+		if err != nil {
+			return nil, err
+		}
+		region, _ := credentials["S3_REGION"].(string)
+		return map[string]interface{}{
+			"apiVersion": "secrets-store.csi.x-k8s.io/v1",
+			"kind":       "SecretProviderClass",
+			"metadata":   manifestMetadata(Instance, BindingId),
+			"spec": map[string]interface{}{
+				"provider": "aws",
+				"parameters": map[string]string{
+					"region":  region,
+					"objects": string(objects),
+				},
+				"secretObjects": []map[string]interface{}{
+					{"secretName": Instance.Name, "type": "Opaque", "data": secretObjectData},
+				},
+			},
+		}, nil
+	}
+	return nil, errors.New("The format " + format + " is not " + K8sSecretFormat + " or " + CSISecretProviderClassFormat + ".")
+}
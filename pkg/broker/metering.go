@@ -0,0 +1,168 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The metering interval is read from METERING_INTERVAL (e.g., 1h) and defaults to a day, as
+// CloudWatch only reports bucket sizes daily shorter intervals only improve the request counts.
+func GetMeteringInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("METERING_INTERVAL"))
+	if err != nil || interval < time.Minute {
+		return time.Hour * 24
+	}
+	return interval
+}
+
+// Records the usage of every claimed instance for the last complete interval. Periods are aligned
+// to the interval so running this from multiple workers does not record the same period twice.
+// Newly recorded usage is sent to METERING_URL if it's set and checked against the plan's storage quota
+// and the instance's alerts.
+func RunMeteringTasks(ctx context.Context, namePrefix string, storage Storage, client *http.Client, interval time.Duration) {
+	end := time.Now().Truncate(interval)
+	start := end.Add(-interval)
+
+	ids, err := storage.GetUnmeteredInstanceIds(start)
+	if err != nil {
+		glog.Errorf("Unable to get instances for metering: %s\n", err.Error())
+		return
+	}
+	recorded := make([]Usage, 0)
+	for _, id := range ids {
+		Instance, err := GetInstanceById(namePrefix, storage, id)
+		if err != nil {
+			glog.Errorf("Unable to get instance %s for metering: %s\n", id, err.Error())
+			continue
+		}
+		provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+		if err != nil {
+			glog.Errorf("Unable to meter %s, cannot find provider (GetProviderByPlan failed): %s\n", id, err.Error())
+			continue
+		}
+		usage, err := provider.GetUsage(Instance, start, end)
+		if err != nil {
+			glog.Errorf("Unable to get usage for %s: %s\n", id, err.Error())
+			continue
+		}
+		added, err := storage.AddUsage(usage)
+		if err != nil {
+			glog.Errorf("Unable to record usage for %s: %s\n", id, err.Error())
+			continue
+		}
+		if added {
+			recorded = append(recorded, *usage)
+			if err = CheckStorageQuota(storage, provider, Instance, usage); err != nil {
+				glog.Errorf("Unable to check the storage quota of %s: %s\n", id, err.Error())
+			}
+			if err = CheckAlerts(storage, Instance, usage); err != nil {
+				glog.Errorf("Unable to check the alerts of %s: %s\n", id, err.Error())
+			}
+		}
+	}
+	if len(ids) > 0 {
+		glog.Infof("Recorded usage for %d of %d instances (%s to %s)\n", len(recorded), len(ids), start, end)
+	}
+
+	if os.Getenv("METERING_URL") != "" && len(recorded) > 0 {
+		if err := SendUsage(ctx, client, os.Getenv("METERING_URL"), os.Getenv("METERING_SECRET"), recorded); err != nil {
+			glog.Errorf("Unable to send usage to the metering url: %s\n", err.Error())
+		}
+	}
+}
+
+// Usage is posted as a json array, when a secret is set the body is signed the same way as
+// webhooks (see GetDefaultWebhookSignature).
+func SendUsage(ctx context.Context, client *http.Client, url string, secret string, usage []Usage) error {
+	byteData, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(byteData))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("content-type", "application/json")
+	if secret != "" {
+		GetDefaultWebhookSignature().Sign(req, secret, byteData)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 399 {
+		return errors.New("Got invalid http status code from the metering url: " + resp.Status)
+	}
+	return nil
+}
+
+type CostEstimate struct {
+	PlanCents    int64      `json:"plan_cents"`
+	StorageCents int64      `json:"storage_cents"`
+	TotalCents   int64      `json:"total_cents"`
+	Bytes        int64      `json:"bytes"`
+	MeasuredAt   *time.Time `json:"measured_at,omitempty"`
+}
+
+// Estimates the monthly cost of an instance as the plans price (converted to a month) plus the
+// most recently measured storage at STORAGE_COST_CENTS_PER_GB (2.3 cents, the S3 standard price,
+// by default) per GB-month. Usage may be nil if none has been recorded yet.
+func EstimateMonthlyCost(plan *ProviderPlan, usage *Usage) CostEstimate {
+	var estimate CostEstimate
+	if price, ok := plan.basePlan.Metadata["price"].(map[string]interface{}); ok {
+		cents, _ := price["cents"].(int)
+		unit, _ := price["unit"].(string)
+		switch unit {
+		case "year":
+			estimate.PlanCents = int64(cents) / 12
+		case "month":
+			estimate.PlanCents = int64(cents)
+		case "day":
+			estimate.PlanCents = int64(cents) * 30
+		case "hour":
+			estimate.PlanCents = int64(cents) * 730
+		}
+	}
+	if usage != nil {
+		centsPerGb, err := strconv.ParseFloat(os.Getenv("STORAGE_COST_CENTS_PER_GB"), 64)
+		if err != nil || centsPerGb < 0 {
+			centsPerGb = 2.3
+		}
+		estimate.Bytes = usage.Bytes
+		estimate.StorageCents = int64(float64(usage.Bytes) / (1024 * 1024 * 1024) * centsPerGb)
+		estimate.MeasuredAt = &usage.End
+	}
+	estimate.TotalCents = estimate.PlanCents + estimate.StorageCents
+	return estimate
+}
+
+func TickTocMeteringTasks(ctx context.Context, namePrefix string, storage Storage) {
+	client, err := NewWebhookClient()
+	if err != nil {
+		glog.Errorf("Unable to start metering: %s\n", err.Error())
+		return
+	}
+	interval := GetMeteringInterval()
+	next_check := time.NewTicker(time.Minute * 15)
+	defer next_check.Stop()
+	for {
+		RunMeteringTasks(ctx, namePrefix, storage, client, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-next_check.C:
+		}
+	}
+}
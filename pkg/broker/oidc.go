@@ -0,0 +1,483 @@
+package broker
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OIDCRole string
+
+const (
+	OIDCViewer   OIDCRole = "viewer"
+	OIDCOperator OIDCRole = "operator"
+)
+
+const oidcSessionCookie = "s3broker_session"
+
+// The name of the user whose bearer token was verified is kept in the request's context.
+type oidcUserKey struct{}
+
+// OIDC protects the admin api (/v2/admin), the admin dashboard (/admin) and instance dashboards
+// (/dashboard) when OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_REDIRECT_URL are set.
+func GetOIDCEnabled() bool {
+	return os.Getenv("OIDC_ISSUER") != "" && os.Getenv("OIDC_CLIENT_ID") != "" && os.Getenv("OIDC_CLIENT_SECRET") != "" && os.Getenv("OIDC_REDIRECT_URL") != ""
+}
+
+// Bearer tokens given to the admin api must have this audience (OIDC_AUDIENCE), this defaults to
+// the client id.
+func getOIDCAudience() string {
+	if os.Getenv("OIDC_AUDIENCE") != "" {
+		return os.Getenv("OIDC_AUDIENCE")
+	}
+	return os.Getenv("OIDC_CLIENT_ID")
+}
+
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) != "" {
+			items = append(items, strings.TrimSpace(item))
+		}
+	}
+	return items
+}
+
+// The role of a user is found from the groups in the OIDC_ROLES_CLAIM claim (groups by default),
+// members of OIDC_OPERATOR_GROUPS are operators and of OIDC_VIEWER_GROUPS are viewers. Without
+// OIDC_VIEWER_GROUPS everyone the issuer authenticates is a viewer.
+func getOIDCRole(claims map[string]interface{}) (OIDCRole, bool) {
+	name := os.Getenv("OIDC_ROLES_CLAIM")
+	if name == "" {
+		name = "groups"
+	}
+	groups := make(map[string]bool)
+	switch value := claims[name].(type) {
+	case string:
+		for _, group := range strings.Fields(value) {
+			groups[group] = true
+		}
+	case []interface{}:
+		for _, group := range value {
+			if group, ok := group.(string); ok {
+				groups[group] = true
+			}
+		}
+	}
+	for _, group := range splitList(os.Getenv("OIDC_OPERATOR_GROUPS")) {
+		if groups[group] {
+			return OIDCOperator, true
+		}
+	}
+	viewers := splitList(os.Getenv("OIDC_VIEWER_GROUPS"))
+	if len(viewers) == 0 {
+		return OIDCViewer, true
+	}
+	for _, group := range viewers {
+		if groups[group] {
+			return OIDCViewer, true
+		}
+	}
+	return "", false
+}
+
+type oidcProvider struct {
+	sync.Mutex
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSUri               string `json:"jwks_uri"`
+	keys                  map[string]*rsa.PublicKey
+	fetched               time.Time
+}
+
+var oidc = &oidcProvider{}
+var oidcClient = &http.Client{Timeout: time.Second * 10}
+
+func getJson(uri string, obj interface{}) error {
+	resp, err := oidcClient.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Unable to get " + uri + ": " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(obj)
+}
+
+// Reads the issuer's discovery document and signing keys, they're fetched again (at most once a
+// minute) when a token is signed with a key that isn't known so keys can be rotated by the issuer.
+func (p *oidcProvider) refresh(force bool) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.keys != nil && (!force || time.Since(p.fetched) < time.Minute) {
+		return nil
+	}
+	var discovery struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSUri               string `json:"jwks_uri"`
+	}
+	if err := getJson(strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJson(discovery.JWKSUri, &jwks); err != nil {
+		return err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, key := range jwks.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			continue
+		}
+		keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.AuthorizationEndpoint = discovery.AuthorizationEndpoint
+	p.TokenEndpoint = discovery.TokenEndpoint
+	p.JWKSUri = discovery.JWKSUri
+	p.keys = keys
+	p.fetched = time.Now()
+	return nil
+}
+
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	if err := p.refresh(false); err != nil {
+		return nil, err
+	}
+	p.Lock()
+	key, ok := p.keys[kid]
+	p.Unlock()
+	if ok {
+		return key, nil
+	}
+	if err := p.refresh(true); err != nil {
+		return nil, err
+	}
+	p.Lock()
+	defer p.Unlock()
+	if key, ok = p.keys[kid]; !ok {
+		return nil, errors.New("The token was signed with an unknown key.")
+	}
+	return key, nil
+}
+
+// Verifies a (RS256 signed) token from the issuer for the audience and returns its claims.
+func verifyOIDCToken(token string, audience string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("The token is not a JWT.")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil {
+		return nil, errors.New("The token's header is not valid.")
+	}
+	if header.Alg != "RS256" {
+		return nil, errors.New("The token is not signed with RS256.")
+	}
+	key, err := oidc.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("The token's signature is not valid.")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("The token's signature is not valid.")
+	}
+	var claims map[string]interface{}
+	if data, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(data, &claims) != nil {
+		return nil, errors.New("The token's claims are not valid.")
+	}
+	if issuer, _ := claims["iss"].(string); strings.TrimSuffix(issuer, "/") != strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/") {
+		return nil, errors.New("The token is from another issuer.")
+	}
+	audiences := make([]string, 0)
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = append(audiences, aud)
+	case []interface{}:
+		for _, a := range aud {
+			if a, ok := a.(string); ok {
+				audiences = append(audiences, a)
+			}
+		}
+	}
+	found := false
+	for _, aud := range audiences {
+		found = found || aud == audience
+	}
+	if !found {
+		return nil, errors.New("The token is for another audience.")
+	}
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); !ok || exp+60 < now {
+		return nil, errors.New("The token has expired.")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && nbf-60 > now {
+		return nil, errors.New("The token is not valid yet.")
+	}
+	return claims, nil
+}
+
+type oidcSession struct {
+	Subject string   `json:"sub"`
+	Name    string   `json:"name"`
+	Role    OIDCRole `json:"role"`
+	Expires int64    `json:"exp"`
+}
+
+// Values kept in cookies (the session and the login state) are signed with the client secret.
+func signOIDCValue(value []byte) string {
+	h := hmac.New(sha256.New, []byte(os.Getenv("OIDC_CLIENT_SECRET")))
+	h.Write(value)
+	return base64.RawURLEncoding.EncodeToString(value) + "." + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func readOIDCValue(signed string) ([]byte, bool) {
+	parts := strings.Split(signed, ".")
+	if len(parts) != 2 {
+		return nil, false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, false
+	}
+	return value, hmac.Equal([]byte(signOIDCValue(value)), []byte(signed))
+}
+
+func getOIDCSession(r *http.Request) (*oidcSession, bool) {
+	cookie, err := r.Cookie(oidcSessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	value, ok := readOIDCValue(cookie.Value)
+	if !ok {
+		return nil, false
+	}
+	var session oidcSession
+	if err = json.Unmarshal(value, &session); err != nil || session.Expires < time.Now().Unix() {
+		return nil, false
+	}
+	return &session, true
+}
+
+// The name of the user signed in with OIDC (or whose bearer token was verified) making the request,
+// or an empty string.
+func GetOIDCUser(r *http.Request) string {
+	if session, ok := getOIDCSession(r); ok {
+		return session.Name
+	}
+	if name, ok := r.Context().Value(oidcUserKey{}).(string); ok {
+		return name
+	}
+	return ""
+}
+
+func oidcSessionName(claims map[string]interface{}) string {
+	for _, claim := range []string{"email", "preferred_username", "name", "sub"} {
+		if value, ok := claims[claim].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Browsers are sent to the issuer to log in, the page they were on is kept in the (signed) state
+// so they can be returned to it.
+func redirectToOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if err := oidc.refresh(false); err != nil {
+		glog.Errorf("Unable to read the OIDC issuer's configuration: %s\n", err.Error())
+		http.Error(w, "Unable to reach the login provider.", http.StatusServiceUnavailable)
+		return
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	state, _ := json.Marshal(map[string]string{"nonce": base64.RawURLEncoding.EncodeToString(nonce), "return": r.URL.RequestURI()})
+	signed := signOIDCValue(state)
+	http.SetCookie(w, &http.Cookie{Name: oidcSessionCookie + "_state", Value: signed, Path: "/", HttpOnly: true, Secure: strings.HasPrefix(os.Getenv("OIDC_REDIRECT_URL"), "https://"), SameSite: http.SameSiteLaxMode, MaxAge: 600})
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", os.Getenv("OIDC_CLIENT_ID"))
+	query.Set("redirect_uri", os.Getenv("OIDC_REDIRECT_URL"))
+	query.Set("scope", "openid profile email")
+	query.Set("state", signed)
+	oidc.Lock()
+	endpoint := oidc.AuthorizationEndpoint
+	oidc.Unlock()
+	separator := "?"
+	if strings.Contains(endpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, endpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// Exchanges the code the issuer returned for an id token and starts a session of 8 hours (or until
+// the id token expires if sooner).
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	stateCookie, err := r.Cookie(oidcSessionCookie + "_state")
+	if err != nil || stateCookie.Value != r.URL.Query().Get("state") {
+		http.Error(w, "The login has expired, try again.", http.StatusBadRequest)
+		return
+	}
+	state, ok := readOIDCValue(stateCookie.Value)
+	var returnTo struct {
+		Return string `json:"return"`
+	}
+	if !ok || json.Unmarshal(state, &returnTo) != nil || !strings.HasPrefix(returnTo.Return, "/") || strings.HasPrefix(returnTo.Return, "//") {
+		http.Error(w, "The login has expired, try again.", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("error") != "" {
+		http.Error(w, "The login failed: "+r.URL.Query().Get("error"), http.StatusUnauthorized)
+		return
+	}
+	oidc.Lock()
+	endpoint := oidc.TokenEndpoint
+	oidc.Unlock()
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", r.URL.Query().Get("code"))
+	form.Set("redirect_uri", os.Getenv("OIDC_REDIRECT_URL"))
+	form.Set("client_id", os.Getenv("OIDC_CLIENT_ID"))
+	form.Set("client_secret", os.Getenv("OIDC_CLIENT_SECRET"))
+	resp, err := oidcClient.PostForm(endpoint, form)
+	if err != nil {
+		glog.Errorf("Unable to exchange the OIDC code for a token: %s\n", err.Error())
+		http.Error(w, "Unable to reach the login provider.", http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tokens); err != nil || resp.StatusCode != http.StatusOK || tokens.IdToken == "" {
+		glog.Errorf("The OIDC issuer did not return an id token (%s)\n", resp.Status)
+		http.Error(w, "The login failed.", http.StatusUnauthorized)
+		return
+	}
+	claims, err := verifyOIDCToken(tokens.IdToken, os.Getenv("OIDC_CLIENT_ID"))
+	if err != nil {
+		glog.Errorf("The OIDC id token is not valid: %s\n", err.Error())
+		http.Error(w, "The login failed.", http.StatusUnauthorized)
+		return
+	}
+	role, ok := getOIDCRole(claims)
+	if !ok {
+		http.Error(w, "You are not allowed to use the broker's dashboards.", http.StatusForbidden)
+		return
+	}
+	subject, _ := claims["sub"].(string)
+	session := oidcSession{Subject: subject, Name: oidcSessionName(claims), Role: role, Expires: time.Now().Add(time.Hour * 8).Unix()}
+	if exp, ok := claims["exp"].(float64); ok && int64(exp) < session.Expires {
+		session.Expires = int64(exp)
+	}
+	value, _ := json.Marshal(session)
+	secure := strings.HasPrefix(os.Getenv("OIDC_REDIRECT_URL"), "https://")
+	http.SetCookie(w, &http.Cookie{Name: oidcSessionCookie, Value: signOIDCValue(value), Path: "/", HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode, Expires: time.Unix(session.Expires, 0)})
+	http.SetCookie(w, &http.Cookie{Name: oidcSessionCookie + "_state", Value: "", Path: "/", HttpOnly: true, Secure: secure, MaxAge: -1})
+	glog.Infof("%s logged in as a %s\n", session.Name, session.Role)
+	http.Redirect(w, r, returnTo.Return, http.StatusFound)
+}
+
+func oidcDenied(w http.ResponseWriter, api bool, status int, description string) {
+	if api {
+		code := "Unauthorized"
+		if status == http.StatusForbidden {
+			code = "Forbidden"
+		}
+		HttpWrite(w, status, map[string]string{"error": code, "description": description})
+		return
+	}
+	http.Error(w, description, status)
+}
+
+// Requires a login (a session for dashboards, or a bearer token or session for the admin api) on
+// the admin api and dashboards when OIDC is enabled. Viewers may only make GET requests, changes
+// need an operator.
+func OIDCMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api := strings.HasPrefix(r.URL.Path, "/v2/admin/")
+		dashboard := r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/dashboard/")
+		if !GetOIDCEnabled() || (!api && !dashboard) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var name string
+		var role OIDCRole
+		if session, ok := getOIDCSession(r); ok {
+			name, role = session.Name, session.Role
+		} else if auth := r.Header.Get("Authorization"); api && strings.HasPrefix(auth, "Bearer ") {
+			claims, err := verifyOIDCToken(strings.TrimPrefix(auth, "Bearer "), getOIDCAudience())
+			if err != nil {
+				oidcDenied(w, api, http.StatusUnauthorized, err.Error())
+				return
+			}
+			if role, ok = getOIDCRole(claims); !ok {
+				oidcDenied(w, api, http.StatusForbidden, "You are not allowed to use the admin api.")
+				return
+			}
+			name = oidcSessionName(claims)
+			r = r.WithContext(context.WithValue(r.Context(), oidcUserKey{}, name))
+		} else if api {
+			oidcDenied(w, api, http.StatusUnauthorized, "A bearer token from the OIDC issuer is required.")
+			return
+		} else {
+			if r.Method != "GET" {
+				oidcDenied(w, api, http.StatusUnauthorized, "Your login has expired, reload the page.")
+				return
+			}
+			redirectToOIDCLogin(w, r)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			if role != OIDCOperator {
+				oidcDenied(w, api, http.StatusForbidden, "Only operators can make changes.")
+				return
+			}
+			glog.Infof("%s %s by %s (%s)\n", r.Method, r.URL.Path, name, role)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The callback the issuer returns browsers to after they log in, OIDC_REDIRECT_URL must be the
+// broker's url with this path.
+func OIDCRoutes(router *mux.Router) {
+	router.HandleFunc("/oauth2/callback", oidcCallback).Methods("GET")
+}
@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const pagerDutyEventsUrl = "https://events.pagerduty.com/v2/enqueue"
+
+// Incidents are only triggered when PAGERDUTY_ROUTING_KEY (the integration key of an Events API v2
+// integration) is set.
+func GetPagerDutyRoutingKey() string {
+	return os.Getenv("PAGERDUTY_ROUTING_KEY")
+}
+
+// The worker is stalled when tasks are pending and it hasn't started one in this many minutes
+// (PAGERDUTY_WORKER_STALL_MINUTES, 15 by default).
+func GetPagerDutyWorkerStallMinutes() int64 {
+	minutes, err := strconv.ParseInt(os.Getenv("PAGERDUTY_WORKER_STALL_MINUTES"), 10, 64)
+	if err != nil || minutes < 1 {
+		return 15
+	}
+	return minutes
+}
+
+// An empty preprovisioned pool only pages when the plan is popular enough to keep at least this
+// many buckets preprovisioned (PAGERDUTY_POOL_TARGET, 5 by default).
+func GetPagerDutyPoolTarget() int {
+	target, err := strconv.Atoi(os.Getenv("PAGERDUTY_POOL_TARGET"))
+	if err != nil || target < 1 {
+		return 5
+	}
+	return target
+}
+
+// Deprovisions that fail leave orphaned buckets, this many (PAGERDUTY_DEPROVISION_FAILURES, 3 by
+// default) in a day pages.
+func GetPagerDutyDeprovisionFailures() int {
+	failures, err := strconv.Atoi(os.Getenv("PAGERDUTY_DEPROVISION_FAILURES"))
+	if err != nil || failures < 1 {
+		return 3
+	}
+	return failures
+}
+
+// The incidents triggered by this broker (by dedup key), so each is only triggered once and is
+// resolved when its condition clears.
+var pagerDuty = struct {
+	sync.Mutex
+	client    *http.Client
+	triggered map[string]bool
+}{triggered: make(map[string]bool)}
+
+func sendPagerDutyEvent(action string, dedupKey string, summary string, details map[string]interface{}) error {
+	event := map[string]interface{}{
+		"routing_key":  GetPagerDutyRoutingKey(),
+		"event_action": action,
+		"dedup_key":    dedupKey,
+	}
+	if action == "trigger" {
+		source, _ := os.Hostname()
+		event["payload"] = map[string]interface{}{
+			"summary":        summary,
+			"source":         source,
+			"severity":       "critical",
+			"component":      "s3-broker",
+			"custom_details": details,
+		}
+	}
+	return postJSON(pagerDuty.client, pagerDutyEventsUrl, event)
+}
+
+// Triggers an incident for the condition (dedupKey) when it's true, and resolves the incident
+// when the condition no longer is.
+func PagerDutyCondition(dedupKey string, active bool, summary string, details map[string]interface{}) {
+	pagerDuty.Lock()
+	defer pagerDuty.Unlock()
+	if pagerDuty.client == nil || active == pagerDuty.triggered[dedupKey] {
+		return
+	}
+	action := "resolve"
+	if active {
+		action = "trigger"
+	}
+	if err := sendPagerDutyEvent(action, dedupKey, summary, details); err != nil {
+		glog.Errorf("Unable to %s the pagerduty incident %s: %s\n", action, dedupKey, err.Error())
+		return
+	}
+	if active {
+		glog.Infof("Triggered the pagerduty incident %s: %s\n", dedupKey, summary)
+		pagerDuty.triggered[dedupKey] = true
+	} else {
+		glog.Infof("Resolved the pagerduty incident %s\n", dedupKey)
+		delete(pagerDuty.triggered, dedupKey)
+	}
+}
+
+func RunPagerDutyChecks(storage Storage) {
+	if activity, err := storage.GetWorkerActivity(); err != nil {
+		glog.Errorf("Unable to get the worker's activity for pagerduty: %s\n", err.Error())
+	} else {
+		stall := time.Minute * time.Duration(GetPagerDutyWorkerStallMinutes())
+		stalled := activity.Pending > 0 && (activity.LastStarted == nil || time.Since(*activity.LastStarted) > stall)
+		details := map[string]interface{}{"pending_tasks": activity.Pending}
+		if activity.LastStarted != nil {
+			details["last_started"] = activity.LastStarted
+		}
+		PagerDutyCondition("s3-broker-worker-stalled", stalled, "The s3-broker worker hasn't started a task in "+stall.String()+", "+strconv.Itoa(activity.Pending)+" tasks are pending.", details)
+	}
+
+	if statuses, err := storage.GetPoolStatus(); err != nil {
+		glog.Errorf("Unable to get the preprovisioned pool status for pagerduty: %s\n", err.Error())
+	} else {
+		for _, status := range statuses {
+			empty := status.Target >= GetPagerDutyPoolTarget() && status.Available == 0
+			PagerDutyCondition("s3-broker-pool-empty-"+status.PlanId, empty, "The s3-broker preprovisioned pool of plan "+status.PlanId+" is empty.", map[string]interface{}{"plan": status.PlanId, "target": status.Target, "provisioning": status.Provisioning})
+		}
+	}
+
+	if tasks, err := storage.GetTasksByStatus("failed", 100); err != nil {
+		glog.Errorf("Unable to get the failed tasks for pagerduty: %s\n", err.Error())
+	} else {
+		orphans := make([]string, 0)
+		for _, task := range tasks {
+			if task.Action == DeleteTask && task.Finished != nil && time.Since(*task.Finished) < time.Hour*24 {
+				orphans = append(orphans, task.ResourceId)
+			}
+		}
+		PagerDutyCondition("s3-broker-deprovision-failures", len(orphans) >= GetPagerDutyDeprovisionFailures(), strconv.Itoa(len(orphans))+" s3-broker deprovisions failed in the last day, their buckets may be orphaned.", map[string]interface{}{"instances": orphans})
+	}
+}
+
+// Checks for conditions worth paging about every minute, this is run by the broker (not the worker)
+// so a stalled worker is noticed.
+func TickTocPagerDutyChecks(ctx context.Context, storage Storage) {
+	if GetPagerDutyRoutingKey() == "" {
+		return
+	}
+	client, err := NewWebhookClient()
+	if err != nil {
+		glog.Errorf("Unable to create the pagerduty client: %s\n", err.Error())
+		return
+	}
+	pagerDuty.Lock()
+	pagerDuty.client = client
+	pagerDuty.Unlock()
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		RunPagerDutyChecks(storage)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
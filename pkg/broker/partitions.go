@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"os"
+)
+
+// The partition the broker runs in (aws, aws-us-gov or aws-cn), used in the ARNs of policies and
+// resources. AWS_PARTITION overrides the partition of AWS_REGION.
+func awsPartition() string {
+	if os.Getenv("AWS_PARTITION") != "" {
+		return os.Getenv("AWS_PARTITION")
+	}
+	if partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), os.Getenv("AWS_REGION")); ok {
+		return partition.ID()
+	}
+	return endpoints.AwsPartitionID
+}
+
+// ARNs are built here rather than concatenated where they're used, so they're in the partition
+// the broker runs in. S3 ARNs have no region or account.
+func awsARN(service string, region string, resource string) string {
+	account := os.Getenv("AWS_ACCOUNT_ID")
+	if service == endpoints.S3ServiceID {
+		account = ""
+	}
+	return arn.ARN{Partition: awsPartition(), Service: service, Region: region, AccountID: account, Resource: resource}.String()
+}
+
+func bucketARN(BucketName string) string {
+	return awsARN(endpoints.S3ServiceID, "", BucketName)
+}
+
+// The ARN of an object, or of every object under a prefix when it ends with *.
+func objectARN(BucketName string, Key string) string {
+	return awsARN(endpoints.S3ServiceID, "", BucketName+"/"+Key)
+}
+
+func kmsKeyARN(Region string, KeyId string) string {
+	return awsARN(endpoints.KmsServiceID, Region, "key/"+KeyId)
+}
+
+// IAM is global, its ARNs have no region.
+func iamPolicyARN(PolicyName string) string {
+	return awsARN(endpoints.IamServiceID, "", "policy/"+PolicyName)
+}
+
+// The domain of the endpoints in a region, e.g., amazonaws.com or amazonaws.com.cn.
+func awsDNSSuffix(region string) string {
+	if partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return partition.DNSSuffix()
+	}
+	return "amazonaws.com"
+}
+
+// With AWS_USE_FIPS_ENDPOINT set to true every request goes to the FIPS 140-2 endpoint of its
+// service, services without one in a region use their regular endpoint.
+func GetUseFIPSEndpoint() bool {
+	return os.Getenv("AWS_USE_FIPS_ENDPOINT") == "true"
+}
+
+// Resolves the FIPS endpoint of a service, the endpoints data names them as regions (fips-us-east-1
+// or us-east-1-fips) except S3's which are s3-fips.<region>.<domain>.
+func fipsEndpointFor(service string, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+	for _, fipsRegion := range []string{"fips-" + region, region + "-fips"} {
+		resolved, err := endpoints.DefaultResolver().EndpointFor(service, fipsRegion, endpoints.StrictMatchingOption)
+		if err == nil {
+			return resolved, nil
+		}
+	}
+	resolved, err := endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	if err == nil && service == endpoints.S3ServiceID {
+		resolved.URL = "https://s3-fips." + region + "." + awsDNSSuffix(region)
+	}
+	return resolved, err
+}
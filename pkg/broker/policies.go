@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"strings"
+)
+
+// The Sid prefixes of the statements the broker keeps in bucket policies (the storage quota's write
+// block, freezing and required tags), they reflect the instance's current state and aren't rolled back.
+var managedPolicySids = []string{"StorageQuotaBlockWrites", "Freeze", "RequireTag"}
+
+func isManagedPolicyStatement(statement interface{}) bool {
+	fields, ok := statement.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, prefix := range managedPolicySids {
+		if strings.HasPrefix(fmt.Sprint(fields["Sid"]), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the policy with its broker managed statements replaced by those of the current policy.
+func withManagedStatements(Policy string, Current string) (string, error) {
+	managed := make([]interface{}, 0)
+	if Current != "" {
+		current := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(Current), &current); err != nil {
+			return "", err
+		}
+		existing, _ := current["Statement"].([]interface{})
+		for _, statement := range existing {
+			if isManagedPolicyStatement(statement) {
+				managed = append(managed, statement)
+			}
+		}
+	}
+	policy := map[string]interface{}{"Version": "2012-10-17"}
+	if Policy != "" {
+		if err := json.Unmarshal([]byte(Policy), &policy); err != nil {
+			return "", err
+		}
+	}
+	existing, _ := policy["Statement"].([]interface{})
+	statements := make([]interface{}, 0)
+	for _, statement := range existing {
+		if !isManagedPolicyStatement(statement) {
+			statements = append(statements, statement)
+		}
+	}
+	statements = append(statements, managed...)
+	if len(statements) == 0 {
+		return "", nil
+	}
+	policy["Statement"] = statements
+	document, err := json.Marshal(policy)
+	if err != nil {
+		return "", err
+	}
+	return string(document), nil
+}
+
+// Records the bucket policy the instance has after the broker changed it, unless it's the same as
+// the last version recorded. The history is what rollbacks return to, failing to record it is only
+// logged so it never fails the change itself.
+func RecordPolicyVersion(storage Storage, provider Provider, Instance *Instance, Reason string) {
+	policy, err := provider.GetBucketPolicyDocument(Instance)
+	if err != nil {
+		glog.Errorf("Unable to record the bucket policy of %s, GetBucketPolicyDocument failed: %s\n", Instance.Name, err.Error())
+		return
+	}
+	versions, err := storage.GetPolicyVersions(Instance.Id)
+	if err != nil {
+		glog.Errorf("Unable to record the bucket policy of %s, GetPolicyVersions failed: %s\n", Instance.Name, err.Error())
+		return
+	}
+	if len(versions) > 0 && versions[0].Policy == policy {
+		return
+	}
+	if _, err = storage.AddPolicyVersion(&PolicyVersion{InstanceId: Instance.Id, Policy: policy, Reason: Reason}); err != nil {
+		glog.Errorf("Unable to record the bucket policy of %s, AddPolicyVersion failed: %s\n", Instance.Name, err.Error())
+	}
+}
+
+// Applies a previous version of the bucket policy, the current policy is recorded first in case it
+// was changed outside of the broker. The statements the broker manages are kept as they are now, so
+// a rollback can't unfreeze the bucket, lift its storage quota or drop its required tags.
+func RollbackPolicy(storage Storage, provider Provider, Instance *Instance, Version *PolicyVersion) error {
+	RecordPolicyVersion(storage, provider, Instance, "current")
+	current, err := provider.GetBucketPolicyDocument(Instance)
+	if err != nil {
+		return err
+	}
+	policy, err := withManagedStatements(Version.Policy, current)
+	if err != nil {
+		return err
+	}
+	if err = provider.PutBucketPolicyDocument(Instance, policy); err != nil {
+		return err
+	}
+	RecordPolicyVersion(storage, provider, Instance, "rollback to "+Version.Id)
+	return nil
+}
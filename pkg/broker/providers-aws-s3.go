@@ -1,22 +1,179 @@
 package broker
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/backup"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/macie2"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3control"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/golang/glog"
 	uuid "github.com/nu7hatch/gouuid"
+	"golang.org/x/time/rate"
 )
 
 type S3Settings struct {
-	Versioned bool   `json:"versioned,omitempty"`
-	Encrypted bool   `json:"encrypted,omitempty"`
-	KMSKeyId  string `json:"kmsKeyId,omitempty"`
+	Versioned  bool     `json:"versioned,omitempty"`
+	Encrypted  bool     `json:"encrypted,omitempty"`
+	KMSKeyId   string   `json:"kmsKeyId,omitempty"`
+	Regions    []string `json:"regions,omitempty"`
+	Region     string   `json:"region,omitempty"`
+	DataEvents bool     `json:"dataEvents,omitempty"`
+	BackupPlan string   `json:"backupPlanId,omitempty"`
+	Analytics  bool     `json:"analytics,omitempty"`
+	// RequireEmpty refuses deprovisioning buckets that still have objects (unless forced).
+	RequireEmpty bool `json:"requireEmpty,omitempty"`
+	// RequiredTags are object tags every object must be uploaded with, the tag must have one of
+	// the listed values or any value if none are listed (e.g., {"classification":["internal","confidential"]}).
+	RequiredTags map[string][]string `json:"requiredTags,omitempty"`
+	// The lifecycle of versioned buckets is part of what a plan offers, so it's read from the plan's
+	// attributes (see readLifecycleAttributes) rather than the private details.
+	NoncurrentExpirationDays int64 `json:"-"`
+	TransitionDays           int64 `json:"-"`
+	// ObjectLock creates buckets with object lock enabled (which requires versioning) so legal holds
+	// can be placed on their objects, it can't be enabled on existing buckets.
+	ObjectLock bool `json:"objectLock,omitempty"`
+	// EndpointURL and ForcePathStyle are handed to bindings (as S3_ENDPOINT_URL and S3_FORCE_PATH_STYLE)
+	// so applications use an S3 compatible gateway or a VPC interface endpoint, the broker's own
+	// requests use AWS_ENDPOINT and AWS_S3_FORCE_PATH_STYLE.
+	EndpointURL    string `json:"endpointUrl,omitempty"`
+	ForcePathStyle bool   `json:"forcePathStyle,omitempty"`
+	CredentialSettings
+}
+
+// Reads a number of days from the plan's attributes, attributes are usually strings (e.g., "180")
+// but numbers are accepted as well. The default is returned if the attribute isn't set.
+func planAttributeDays(plan *ProviderPlan, name string, def int64) (int64, error) {
+	return planAttributeNumber(plan, name, def, "a number of days")
+}
+
+func planAttributeNumber(plan *ProviderPlan, name string, def int64, unit string) (int64, error) {
+	attributes, _ := plan.basePlan.Metadata["attributes"].(map[string]interface{})
+	switch value := attributes[name].(type) {
+	case nil:
+		return def, nil
+	case float64:
+		if value < 0 {
+			return 0, errors.New("The plan attribute " + name + " must not be negative.")
+		}
+		return int64(value), nil
+	case string:
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || number < 0 {
+			return 0, errors.New("The plan attribute " + name + " must be " + unit + ".")
+		}
+		return number, nil
+	}
+	return 0, errors.New("The plan attribute " + name + " must be " + unit + ".")
+}
+
+// Versioned buckets expire noncurrent versions after noncurrent-expiration-days (180 by default)
+// and move objects to STANDARD_IA after ia-transition-days (30 by default), either may be 0 to
+// turn it off.
+func (settings *S3Settings) readLifecycleAttributes(plan *ProviderPlan) error {
+	var err error
+	if settings.NoncurrentExpirationDays, err = planAttributeDays(plan, "noncurrent-expiration-days", 180); err != nil {
+		return err
+	}
+	if settings.TransitionDays, err = planAttributeDays(plan, "ia-transition-days", 30); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ValidateS3Attributes checks the lifecycle attributes of an aws-s3 plan.
+func ValidateS3Attributes(plan *ProviderPlan) []string {
+	problems := make([]string, 0)
+	var settings S3Settings
+	if err := settings.readLifecycleAttributes(plan); err != nil {
+		return append(problems, err.Error())
+	}
+	if settings.TransitionDays > 0 && settings.TransitionDays < 30 {
+		problems = append(problems, "The plan attribute ia-transition-days must be at least 30, S3 doesn't allow earlier transitions to STANDARD_IA.")
+	}
+	if settings.TransitionDays > 0 && settings.NoncurrentExpirationDays > 0 && settings.NoncurrentExpirationDays <= settings.TransitionDays {
+		problems = append(problems, "The plan attribute noncurrent-expiration-days must be more than ia-transition-days.")
+	}
+	return problems
+}
+
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// ValidateS3Settings checks the provider_private_details of an aws-s3 plan, unknown fields (usually
+// typos) and settings that would only fail once a bucket is provisioned are reported.
+func ValidateS3Settings(details string) []string {
+	problems := make([]string, 0)
+	var settings S3Settings
+	decoder := json.NewDecoder(strings.NewReader(details))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&settings); err != nil {
+		return append(problems, "The settings are not valid: "+err.Error())
+	}
+	if settings.Encrypted && settings.KMSKeyId == "" {
+		problems = append(problems, "The plan is encrypted but kmsKeyId is empty (is its environment variable set?).")
+	}
+	if !settings.Encrypted && settings.KMSKeyId != "" {
+		problems = append(problems, "The plan has a kmsKeyId but is not encrypted.")
+	}
+	if settings.Encrypted && len(settings.Regions) > 0 && !strings.Contains(settings.KMSKeyId, "mrk-") {
+		problems = append(problems, "The plan allows other regions but kmsKeyId is not a multi-region key.")
+	}
+	for _, region := range append(settings.Regions, settings.Region) {
+		if region != "" && !regionPattern.MatchString(region) {
+			problems = append(problems, "The region "+region+" is not a valid region.")
+		}
+	}
+	if settings.DataEvents && os.Getenv("CLOUDTRAIL_TRAIL_NAME") == "" {
+		problems = append(problems, "The plan requires data events but CLOUDTRAIL_TRAIL_NAME is not set.")
+	}
+	if settings.BackupPlan != "" && os.Getenv("AWS_BACKUP_ROLE_ARN") == "" {
+		problems = append(problems, "The plan requires backups but AWS_BACKUP_ROLE_ARN is not set.")
+	}
+	if settings.BackupPlan != "" && !settings.Versioned {
+		problems = append(problems, "The plan has a backupPlanId but is not versioned, only versioned buckets can be backed up.")
+	}
+	if settings.BackupPlan != "" && settings.SSECustomerKey {
+		problems = append(problems, "The plan has a backupPlanId but sseCustomerKey, AWS Backup can't back up objects encrypted with customer provided keys.")
+	}
+	if settings.ObjectLock && !settings.Versioned {
+		problems = append(problems, "The plan has objectLock but is not versioned, object lock requires versioning.")
+	}
+	if settings.Analytics && os.Getenv("AWS_S3_ANALYTICS_BUCKET") == "" {
+		problems = append(problems, "The plan requires analytics but AWS_S3_ANALYTICS_BUCKET is not set.")
+	}
+	for tag := range settings.RequiredTags {
+		if tag == "" {
+			problems = append(problems, "The plan's requiredTags contains an empty tag name.")
+		}
+	}
+	if endpoint, err := url.Parse(settings.EndpointURL); settings.EndpointURL != "" && (err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "") {
+		problems = append(problems, "The plan's endpointUrl "+settings.EndpointURL+" is not an http or https url.")
+	}
+	return append(problems, ValidateCredentialSettings(settings.CredentialSettings)...)
 }
 
 type User struct {
@@ -27,9 +184,10 @@ type User struct {
 }
 
 type UserPolicyStatement struct {
-	Resource []string `json:"Resource"`
-	Action   []string `json:"Action"`
-	Effect   string   `json:"Effect"`
+	Resource  []string               `json:"Resource"`
+	Action    []string               `json:"Action"`
+	Effect    string                 `json:"Effect"`
+	Condition map[string]interface{} `json:"Condition,omitempty"`
 }
 
 type UserPolicy struct {
@@ -46,8 +204,29 @@ type AWSInstanceS3Provider struct {
 	Provider
 	iam           *iam.IAM
 	s3            *s3.S3
+	sts           *sts.STS
+	cloudwatch    *cloudwatch.CloudWatch
+	cloudtrail    *cloudtrail.CloudTrail
+	macie         *macie2.Macie2
+	backup        *backup.Backup
+	s3control     *s3control.S3Control
+	trailLock     *sync.Mutex
+	region        string
+	regions       *regionalClients
 	namePrefix    string
-	instanceCache map[string]*Instance
+	instanceCache *InstanceCache
+}
+
+// Buckets can only be managed (and their metrics read) from clients in the same region, clients
+// for regions other than AWS_REGION are created as they're needed and shared afterwards.
+type regionalClients struct {
+	sync.Mutex
+	session    *session.Session
+	s3         map[string]*s3.S3
+	cloudwatch map[string]*cloudwatch.CloudWatch
+	macie      map[string]*macie2.Macie2
+	backup     map[string]*backup.Backup
+	s3control  map[string]*s3control.S3Control
 }
 
 type Principal struct {
@@ -55,11 +234,12 @@ type Principal struct {
 }
 
 type BucketPolicyStatement struct {
-	Sid       string    `json:"Sid"`
-	Effect    string    `json:"Effect"`
-	Principal Principal `json:"Principal"`
-	Action    string    `json:"Action"`
-	Resource  string    `json:"Resource"`
+	Sid       string                 `json:"Sid"`
+	Effect    string                 `json:"Effect"`
+	Principal Principal              `json:"Principal"`
+	Action    string                 `json:"Action"`
+	Resource  string                 `json:"Resource"`
+	Condition map[string]interface{} `json:"Condition,omitempty"`
 }
 
 type BucketPolicy struct {
@@ -75,20 +255,134 @@ func NewAWSInstanceS3Provider(namePrefix string) (*AWSInstanceS3Provider, error)
 	if os.Getenv("AWS_ACCOUNT_ID") == "" {
 		return nil, errors.New("Unable to find AWS_ACCOUNT_ID environment variable.")
 	}
-	t := time.NewTicker(time.Second * 5)
-	AWSInstanceS3Provider := &AWSInstanceS3Provider{
+	sess, err := NewAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	return &AWSInstanceS3Provider{
 		namePrefix:    namePrefix,
-		instanceCache: make(map[string]*Instance),
-		iam:           iam.New(session.New(&aws.Config{Region: aws.String(os.Getenv("AWS_REGION"))})),
-		s3:            s3.New(session.New(&aws.Config{Region: aws.String(os.Getenv("AWS_REGION"))})),
+		instanceCache: NewInstanceCache(1024, time.Minute),
+		iam:           iam.New(sess),
+		s3:            s3.New(sess, s3Config(os.Getenv("AWS_REGION"))),
+		sts:           sts.New(sess),
+		cloudwatch:    cloudwatch.New(sess),
+		cloudtrail:    cloudtrail.New(sess),
+		macie:         macie2.New(sess),
+		backup:        backup.New(sess),
+		s3control:     s3control.New(sess),
+		trailLock:     &sync.Mutex{},
+		region:        os.Getenv("AWS_REGION"),
+		regions: &regionalClients{
+			session:    sess,
+			s3:         make(map[string]*s3.S3),
+			cloudwatch: make(map[string]*cloudwatch.CloudWatch),
+			macie:      make(map[string]*macie2.Macie2),
+			backup:     make(map[string]*backup.Backup),
+			s3control:  make(map[string]*s3control.S3Control),
+		},
+	}, nil
+}
+
+// forRegion returns a copy of the provider that manages buckets in the region, an empty region is
+// the default AWS_REGION.
+func (provider AWSInstanceS3Provider) forRegion(region string) AWSInstanceS3Provider {
+	if region == "" || region == provider.region {
+		return provider
+	}
+	provider.regions.Lock()
+	defer provider.regions.Unlock()
+	if _, ok := provider.regions.s3[region]; !ok {
+		provider.regions.s3[region] = s3.New(provider.regions.session, s3Config(region))
+		provider.regions.cloudwatch[region] = cloudwatch.New(provider.regions.session, aws.NewConfig().WithRegion(region))
+		provider.regions.macie[region] = macie2.New(provider.regions.session, aws.NewConfig().WithRegion(region))
+		provider.regions.backup[region] = backup.New(provider.regions.session, aws.NewConfig().WithRegion(region))
+		provider.regions.s3control[region] = s3control.New(provider.regions.session, aws.NewConfig().WithRegion(region))
+	}
+	provider.s3 = provider.regions.s3[region]
+	provider.cloudwatch = provider.regions.cloudwatch[region]
+	provider.macie = provider.regions.macie[region]
+	provider.backup = provider.regions.backup[region]
+	provider.s3control = provider.regions.s3control[region]
+	provider.region = region
+	return provider
+}
+
+// The S3 endpoint and addressing are set with AWS_ENDPOINT and AWS_S3_FORCE_PATH_STYLE, bindings are
+// given them as well. S3_ENDPOINT_URL and S3_FORCE_PATH_STYLE are deprecated names that are only read
+// when the others aren't set.
+func getS3Endpoint() string {
+	if os.Getenv("AWS_ENDPOINT") != "" {
+		return os.Getenv("AWS_ENDPOINT")
+	}
+	return os.Getenv("S3_ENDPOINT_URL")
+}
+
+func getS3ForcePathStyle() bool {
+	if os.Getenv("AWS_S3_FORCE_PATH_STYLE") != "" {
+		return os.Getenv("AWS_S3_FORCE_PATH_STYLE") == "true"
+	}
+	return os.Getenv("S3_FORCE_PATH_STYLE") == "true"
+}
+
+// The session already has AWS_ENDPOINT, the deprecated S3_ENDPOINT_URL only ever applied to the S3
+// requests (not IAM, STS or CloudWatch) and still does.
+func s3Config(region string) *aws.Config {
+	config := aws.NewConfig().WithRegion(region)
+	if endpoint := getS3Endpoint(); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	if getS3ForcePathStyle() {
+		config = config.WithS3ForcePathStyle(true)
+	}
+	return config
+}
+
+// IAM in particular has low request limits, bursts of provisioning (such as filling the preprovision
+// pool) are spread out by a rate limiter shared by every client created from the session, throttled
+// requests that still happen are retried with exponential backoff. AWS_MAX_RETRIES and
+// AWS_REQUESTS_PER_SECOND can be used to tune these.
+func NewAWSSession() (*session.Session, error) {
+	maxRetries, err := strconv.Atoi(os.Getenv("AWS_MAX_RETRIES"))
+	if err != nil || maxRetries < 0 {
+		maxRetries = 8
+	}
+	requestsPerSecond, err := strconv.ParseFloat(os.Getenv("AWS_REQUESTS_PER_SECOND"), 64)
+	if err != nil || requestsPerSecond <= 0 {
+		requestsPerSecond = 10
+	}
+	awsConfig := &aws.Config{Region: aws.String(os.Getenv("AWS_REGION"))}
+	// AWS_ENDPOINT points every client at an S3 compatible service such as LocalStack or MinIO,
+	// these generally require path style addressing (http://host/bucket/key) as well.
+	if os.Getenv("AWS_ENDPOINT") != "" {
+		awsConfig.Endpoint = aws.String(os.Getenv("AWS_ENDPOINT"))
 	}
-	go (func() {
-		for {
-			AWSInstanceS3Provider.instanceCache = make(map[string]*Instance)
-			<-t.C
+	if os.Getenv("AWS_S3_FORCE_PATH_STYLE") == "true" {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	if os.Getenv("S3_ENDPOINT_URL") != "" || os.Getenv("S3_FORCE_PATH_STYLE") != "" {
+		glog.Warningf("S3_ENDPOINT_URL and S3_FORCE_PATH_STYLE are deprecated, use AWS_ENDPOINT and AWS_S3_FORCE_PATH_STYLE instead.\n")
+	}
+	if GetUseFIPSEndpoint() {
+		awsConfig.EndpointResolver = endpoints.ResolverFunc(fipsEndpointFor)
+	}
+	config := request.WithRetryer(awsConfig, client.DefaultRetryer{
+		NumMaxRetries:    maxRetries,
+		MinRetryDelay:    100 * time.Millisecond,
+		MaxRetryDelay:    5 * time.Second,
+		MinThrottleDelay: 500 * time.Millisecond,
+		MaxThrottleDelay: 30 * time.Second,
+	})
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	limiter := rate.NewLimiter(rate.Limit(requestsPerSecond), 1)
+	sess.Handlers.Send.PushFront(func(r *request.Request) {
+		if err := limiter.Wait(r.Context()); err != nil {
+			r.Error = err
 		}
-	})()
-	return AWSInstanceS3Provider, nil
+	})
+	return sess, nil
 }
 
 func (provider AWSInstanceS3Provider) CreateUser(UserName string) (*User, error) {
@@ -152,6 +446,9 @@ func (provider AWSInstanceS3Provider) GetAccessKeyId(BucketName string) (*string
 	if err != nil {
 		return nil, err
 	}
+	if len(res.AccessKeyMetadata) == 0 {
+		return nil, errors.New("Not found")
+	}
 	return aws.String(*res.AccessKeyMetadata[0].AccessKeyId), nil
 }
 
@@ -174,6 +471,9 @@ func (provider AWSInstanceS3Provider) GetPolicyARN(BucketName string) (*string,
 	if err != nil {
 		return nil, err
 	}
+	if len(res.AttachedPolicies) == 0 {
+		return nil, errors.New("Not found")
+	}
 	return aws.String(*res.AttachedPolicies[0].PolicyArn), nil
 }
 
@@ -208,7 +508,7 @@ func (provider AWSInstanceS3Provider) CreateUserPolicy(UserName string, BucketNa
 		Statement: []UserPolicyStatement{
 			UserPolicyStatement{
 				Effect:   "Allow",
-				Resource: []string{"arn:aws:s3:::" + BucketName + "/*", "arn:aws:s3:::" + BucketName},
+				Resource: []string{objectARN(BucketName, "*"), bucketARN(BucketName)},
 				Action:   []string{"s3:*"},
 			},
 		},
@@ -217,7 +517,7 @@ func (provider AWSInstanceS3Provider) CreateUserPolicy(UserName string, BucketNa
 	if Encrypted && KMSKeyID != "" {
 		policy.Statement = append(policy.Statement, UserPolicyStatement{
 			Effect:   "Allow",
-			Resource: []string{"arn:aws:kms:" + os.Getenv("AWS_REGION") + ":" + os.Getenv("AWS_ACCOUNT_ID") + ":key/" + KMSKeyID},
+			Resource: []string{kmsKeyARN(provider.region, KMSKeyID)},
 			Action:   []string{"kms:Decrypt", "kms:Encrypt", "kms:DescribeKey", "kms:ReEncrypt*", "kms:GenerateDataKey*"},
 		})
 	}
@@ -249,25 +549,73 @@ func (provider AWSInstanceS3Provider) AttachUserPolicy(UserName string, Policy *
 	return err
 }
 
-func (provider AWSInstanceS3Provider) CreateRandomName() string {
-	id, _ := uuid.NewV4()
-	return provider.namePrefix + "-u" + (strings.Split(id.String(), "-")[0])
-}
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*[a-z0-9]$`)
+var ipAddressPattern = regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+$`)
 
-func (provider AWSInstanceS3Provider) GetInstance(name string, plan *ProviderPlan) (*Instance, error) {
-	if provider.instanceCache[name+plan.ID] != nil {
-		return provider.instanceCache[name+plan.ID], nil
+// The name is used for both the bucket and its IAM user, so it must satisfy the S3 bucket naming
+// rules (which are stricter than IAM's).
+func ValidateBucketName(name string) error {
+	if len(name) < 3 || len(name) > 63 {
+		return errors.New("The bucket name " + name + " must be between 3 and 63 characters long.")
 	}
+	if !bucketNamePattern.MatchString(name) {
+		return errors.New("The bucket name " + name + " may only contain lowercase letters, numbers, dots and hyphens and must start and end with a letter or number.")
+	}
+	if strings.Contains(name, "..") || strings.Contains(name, ".-") || strings.Contains(name, "-.") {
+		return errors.New("The bucket name " + name + " must not contain adjacent periods or periods next to hyphens.")
+	}
+	if ipAddressPattern.MatchString(name) {
+		return errors.New("The bucket name " + name + " must not be formatted as an ip address.")
+	}
+	return nil
+}
 
-	ARN, err := provider.GetPolicyARN(name)
+// CreateName generates a bucket (and user) name from BUCKET_NAME_TEMPLATE, which defaults to
+// {prefix}-u{random}. The template may contain {prefix} (the name prefix), {environment} (from
+// BUCKET_NAME_ENVIRONMENT), {plan} (the plans name) and {random}, a random hex string of
+// BUCKET_NAME_RANDOM_LENGTH (8 by default) characters.
+func (provider AWSInstanceS3Provider) CreateName(plan *ProviderPlan) (string, error) {
+	template := os.Getenv("BUCKET_NAME_TEMPLATE")
+	if template == "" {
+		template = "{prefix}-u{random}"
+	}
+	length, err := strconv.Atoi(os.Getenv("BUCKET_NAME_RANDOM_LENGTH"))
+	if err != nil || length <= 0 || length > 32 {
+		length = 8
+	}
+	id, err := uuid.NewV4()
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	planName := ""
+	if plan != nil {
+		planName = plan.basePlan.Name
+	}
+	name := strings.NewReplacer(
+		"{prefix}", provider.namePrefix,
+		"{environment}", os.Getenv("BUCKET_NAME_ENVIRONMENT"),
+		"{plan}", planName,
+		"{random}", strings.Replace(id.String(), "-", "", -1)[0:length],
+	).Replace(template)
+	name = strings.ToLower(name)
+	if err := ValidateBucketName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// The status is derived from the bucket, it's "incomplete" if the bucket is gone (deleted by hand
+// or not yet provisioned) or its user's policy is known to be detached, the instance is still
+// returned so it can be deprovisioned. The policy is only looked up to fill in the provider id, if
+// IAM can't be reached (or is throttling) the bucket is reported as is and isn't cached.
+func (provider AWSInstanceS3Provider) GetInstance(name string, plan *ProviderPlan) (*Instance, error) {
+	if instance, ok := provider.instanceCache.Get(name + plan.ID); ok {
+		return instance, nil
 	}
 
-	return &Instance{
+	instance := &Instance{
 		Id:            "", // provider should not store this.
 		Name:          name,
-		ProviderId:    *ARN,
 		Plan:          plan,
 		Username:      "", // provider should not store this.
 		Password:      "", // provider should not store this.
@@ -277,119 +625,418 @@ func (provider AWSInstanceS3Provider) GetInstance(name string, plan *ProviderPla
 		Engine:        "s3",
 		EngineVersion: "aws-1",
 		Scheme:        "s3",
-	}, nil
+	}
+
+	// buckets in other regions answer with a redirect (301) rather than not found, they exist.
+	_, err := provider.s3.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(name)})
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == 404 {
+		instance.Status = "incomplete"
+		instance.Ready = false
+		return instance, nil
+	} else if ok && rerr.StatusCode() != 301 && rerr.StatusCode() != 403 && rerr.StatusCode() != 400 {
+		return nil, err
+	} else if err != nil && !ok {
+		return nil, err
+	}
+
+	ARN, err := provider.GetPolicyARN(name)
+	if isMissing(err) {
+		instance.Status = "incomplete"
+		instance.Ready = false
+		return instance, nil
+	} else if err != nil {
+		glog.Warningf("Unable to get the policy of %s, its provider id is unknown: %s\n", name, err.Error())
+		return instance, nil
+	}
+	instance.ProviderId = *ARN
+	provider.instanceCache.Put(name+plan.ID, instance)
+	return instance, nil
 }
 
 func (provider AWSInstanceS3Provider) PerformPostProvision(db *Instance) (*Instance, error) {
 	return db, nil
 }
 
+// Preprovisioned buckets are created before their owner is known, once claimed they're tagged with
+// the owner the same as buckets provisioned on demand.
+func (provider AWSInstanceS3Provider) PerformPostClaim(Instance *Instance, Owner string) (*Instance, error) {
+	if err := provider.Tag(Instance, "billingcode", Owner); err != nil {
+		return nil, err
+	}
+	if err := provider.Tag(Instance, "instance", Instance.Id); err != nil {
+		return nil, err
+	}
+	return Instance, nil
+}
+
+// Rebuilds an instance for a bucket (and its user) that exists but is not in the database, such as
+// after a database restore. The secret key of the user cannot be recovered, the instance returned
+// has no credentials until its access key is rotated (with RotateCredentials). The bucket's tags are
+// returned, buckets are tagged with their instance id and owner (billingcode) when they're
+// provisioned or claimed.
+func (provider AWSInstanceS3Provider) Adopt(Name string, plan *ProviderPlan) (*Instance, map[string]string, error) {
+	if !strings.HasPrefix(Name, provider.namePrefix) {
+		return nil, nil, errors.New("Not found")
+	}
+	location, err := provider.s3.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(Name)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchBucket {
+		return nil, nil, errors.New("Not found")
+	} else if err != nil {
+		return nil, nil, err
+	}
+	// buckets in us-east-1 have no location constraint.
+	region := s3.NormalizeBucketLocation(aws.StringValue(location.LocationConstraint))
+	if region == provider.region {
+		region = ""
+	}
+	provider = provider.forRegion(region)
+	user, err := provider.iam.GetUser(&iam.GetUserInput{UserName: aws.String(Name)})
+	if err != nil {
+		return nil, nil, err
+	}
+	tagSet, err := provider.GetTags(Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	tags := make(map[string]string)
+	for _, tag := range tagSet {
+		tags[*tag.Key] = *tag.Value
+	}
+	return &Instance{
+		Name:          Name,
+		ProviderId:    *user.User.Arn,
+		Plan:          plan,
+		Endpoint:      provider.bucketEndpoint(Name),
+		Status:        "available",
+		Ready:         true,
+		Engine:        "s3",
+		EngineVersion: "aws-1",
+		Scheme:        "s3",
+		Region:        region,
+	}, tags, nil
+}
+
 func (provider AWSInstanceS3Provider) GetUrl(instance *Instance) map[string]interface{} {
-	return map[string]interface{}{
+	credentials := map[string]interface{}{
 		"S3_BUCKET":     instance.Name,
 		"S3_LOCATION":   instance.Endpoint,
 		"S3_ACCESS_KEY": instance.Username,
 		"S3_SECRET_KEY": instance.Password,
-		"S3_REGION":     os.Getenv("AWS_REGION"),
+		"S3_REGION":     provider.forRegion(instance.Region).region,
+	}
+	var settings S3Settings
+	if instance.Plan != nil && instance.Plan.providerPrivateDetails != "" {
+		if err := json.Unmarshal([]byte(instance.Plan.providerPrivateDetails), &settings); err != nil {
+			glog.Errorf("Unable to read the endpoint of the plan of %s: %s\n", instance.Name, err.Error())
+		}
+	}
+	if settings.EndpointURL == "" {
+		settings.EndpointURL = getS3Endpoint()
+		settings.ForcePathStyle = settings.ForcePathStyle || getS3ForcePathStyle()
+	}
+	if settings.EndpointURL != "" {
+		credentials["S3_ENDPOINT_URL"] = settings.EndpointURL
+	}
+	if settings.ForcePathStyle {
+		credentials["S3_FORCE_PATH_STYLE"] = "true"
 	}
+	return credentials
 }
 
-func (provider AWSInstanceS3Provider) emptyBucket(BucketName string) error {
-	var output *s3.ListObjectsOutput = nil
-	var err error = nil
-	output, err = provider.s3.ListObjects(&s3.ListObjectsInput{Bucket:aws.String(BucketName)})
-	if err != nil {
-		return err
-	}
-	if len(output.Contents) == 0 {
+func (provider AWSInstanceS3Provider) deleteObjects(BucketName string, objects []*s3.ObjectIdentifier) error {
+	if len(objects) == 0 {
 		return nil
 	}
-	objects := make([]*s3.ObjectIdentifier, 0)
-	for _, obj := range output.Contents {
-		if(obj != nil && obj.Key != nil) {
-			objects = append(objects, &s3.ObjectIdentifier{
-				Key:obj.Key,
-			})
-		}
-	}
-	_, err = provider.s3.DeleteObjects(&s3.DeleteObjectsInput{
-		Bucket:aws.String(BucketName),
-		Delete:&s3.Delete{
-			Objects:objects,
+	output, err := provider.s3.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(BucketName),
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
 		},
 	})
 	if err != nil {
 		return err
 	}
-	if output.IsTruncated != nil && *output.IsTruncated == true  {
-		return provider.emptyBucket(BucketName)
+	if len(output.Errors) > 0 && output.Errors[0] != nil {
+		return errors.New("Unable to delete " + aws.StringValue(output.Errors[0].Key) + " from " + BucketName + ": " + aws.StringValue(output.Errors[0].Message))
 	}
 	return nil
 }
 
+// Each page of a listing is at most 1000 keys, which is also the limit for a single DeleteObjects
+// call, so every page is deleted as one batch before moving to the next.
+func (provider AWSInstanceS3Provider) emptyBucket(BucketName string, Prefix string) error {
+	var deleted int64 = 0
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(BucketName), Prefix: aws.String(Prefix)}
+	for {
+		output, err := provider.s3.ListObjectsV2(input)
+		if err != nil {
+			return err
+		}
+		objects := make([]*s3.ObjectIdentifier, 0)
+		for _, obj := range output.Contents {
+			if obj != nil && obj.Key != nil {
+				objects = append(objects, &s3.ObjectIdentifier{
+					Key: obj.Key,
+				})
+			}
+		}
+		if err = provider.deleteObjects(BucketName, objects); err != nil {
+			return err
+		}
+		deleted = deleted + int64(len(objects))
+		if len(objects) > 0 {
+			glog.Infof("Deleted %d objects from %s/%s\n", deleted, BucketName, Prefix)
+		}
+		if output.IsTruncated == nil || *output.IsTruncated == false || output.NextContinuationToken == nil {
+			return nil
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+}
 
-func (provider AWSInstanceS3Provider) emptyBucketVersions(BucketName string) error {
-	var output *s3.ListObjectVersionsOutput = nil
-	var err error = nil
-	output, err = provider.s3.ListObjectVersions(&s3.ListObjectVersionsInput{Bucket:aws.String(BucketName)})
-	if err != nil {
-		return err
+func (provider AWSInstanceS3Provider) emptyBucketVersions(BucketName string, Prefix string) error {
+	var deleted int64 = 0
+	input := &s3.ListObjectVersionsInput{Bucket: aws.String(BucketName), Prefix: aws.String(Prefix)}
+	for {
+		output, err := provider.s3.ListObjectVersions(input)
+		if err != nil {
+			return err
+		}
+		objects := make([]*s3.ObjectIdentifier, 0)
+		for _, obj := range output.Versions {
+			if obj != nil && obj.Key != nil {
+				objects = append(objects, &s3.ObjectIdentifier{
+					Key:       obj.Key,
+					VersionId: obj.VersionId,
+				})
+			}
+		}
+		for _, obj := range output.DeleteMarkers {
+			if obj != nil && obj.Key != nil {
+				objects = append(objects, &s3.ObjectIdentifier{
+					Key:       obj.Key,
+					VersionId: obj.VersionId,
+				})
+			}
+		}
+		// Versions and delete markers together may exceed the 1000 key limit on DeleteObjects.
+		for start := 0; start < len(objects); start = start + 1000 {
+			end := start + 1000
+			if end > len(objects) {
+				end = len(objects)
+			}
+			if err = provider.deleteObjects(BucketName, objects[start:end]); err != nil {
+				return err
+			}
+		}
+		deleted = deleted + int64(len(objects))
+		if len(objects) > 0 {
+			glog.Infof("Deleted %d object versions from %s/%s\n", deleted, BucketName, Prefix)
+		}
+		if output.IsTruncated == nil || *output.IsTruncated == false {
+			return nil
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.VersionIdMarker = output.NextVersionIdMarker
 	}
-	if len(output.Versions) == 0 && len(output.DeleteMarkers) == 0 {
-		return nil
+}
+
+func (provider AWSInstanceS3Provider) emptyPrefix(BucketName string, Prefix string) error {
+	if err := provider.emptyBucket(BucketName, Prefix); err != nil {
+		return err
 	}
-	objects := make([]*s3.ObjectIdentifier, 0)
-	for _, obj := range output.Versions {
-		if(obj != nil && obj.Key != nil) {
-			objects = append(objects, &s3.ObjectIdentifier{
-				Key:obj.Key,
-				VersionId:obj.VersionId,
-			})
+	return provider.emptyBucketVersions(BucketName, Prefix)
+}
+
+func (provider AWSInstanceS3Provider) listPrefixes(BucketName string) ([]string, error) {
+	prefixes := make([]string, 0)
+	err := provider.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(BucketName), Delimiter: aws.String("/")}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, prefix := range page.CommonPrefixes {
+			if prefix != nil && prefix.Prefix != nil {
+				prefixes = append(prefixes, *prefix.Prefix)
+			}
 		}
+		return true
+	})
+	return prefixes, err
+}
+
+// Very large buckets can take days to empty one page at a time, when AWS_S3_DELETE_CONCURRENCY is
+// greater than one the top level prefixes of the bucket are emptied in parallel by that many workers.
+// A final pass over the whole bucket picks up keys at the root that are not under any prefix.
+func (provider AWSInstanceS3Provider) EmptyBucket(BucketName string) error {
+	concurrency, err := strconv.Atoi(os.Getenv("AWS_S3_DELETE_CONCURRENCY"))
+	if err != nil || concurrency < 1 {
+		concurrency = 1
 	}
-	for _, obj := range output.DeleteMarkers {
-		if(obj != nil && obj.Key != nil) {
-			objects = append(objects, &s3.ObjectIdentifier{
-				Key:obj.Key,
-				VersionId:obj.VersionId,
-			})
+	if concurrency > 1 {
+		prefixes, err := provider.listPrefixes(BucketName)
+		if err != nil {
+			return err
+		}
+		work := make(chan string)
+		errs := make(chan error, len(prefixes))
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go (func() {
+				defer wg.Done()
+				for prefix := range work {
+					if err := provider.emptyPrefix(BucketName, prefix); err != nil {
+						errs <- err
+					}
+				}
+			})()
+		}
+		for _, prefix := range prefixes {
+			work <- prefix
 		}
+		close(work)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			return err
+		}
+	}
+	return provider.emptyPrefix(BucketName, "")
+}
+
+func (provider AWSInstanceS3Provider) DeleteBucket(BucketName string) error {
+	if err := provider.EmptyBucket(BucketName); err != nil {
+		return err
 	}
-	_, err = provider.s3.DeleteObjects(&s3.DeleteObjectsInput{
+	_, err := provider.s3.DeleteBucket(&s3.DeleteBucketInput{
 		Bucket: aws.String(BucketName),
-		Delete: &s3.Delete{
-			Objects: objects,
-		},
+	})
+	return err
+}
+
+// Adds (or removes) the bucket from the object level (data event) logging of the trail named by
+// CLOUDTRAIL_TRAIL_NAME. Buckets are kept in the first event selector that logs S3 objects, one is
+// added if the trail does not have any. Removing is a no-op if no trail is configured or the bucket
+// is not logged. Note a selector holds at most 250 buckets, AWS rejects any more than that.
+func (provider AWSInstanceS3Provider) SetDataEvents(BucketName string, enabled bool) error {
+	trail := os.Getenv("CLOUDTRAIL_TRAIL_NAME")
+	if trail == "" {
+		if enabled {
+			return errors.New("The plan requires data events but CLOUDTRAIL_TRAIL_NAME is not set.")
+		}
+		return nil
+	}
+	// The selectors are read, modified and written back, concurrent changes would lose buckets.
+	provider.trailLock.Lock()
+	defer provider.trailLock.Unlock()
+
+	out, err := provider.cloudtrail.GetEventSelectors(&cloudtrail.GetEventSelectorsInput{
+		TrailName: aws.String(trail),
 	})
 	if err != nil {
 		return err
 	}
-	if output.IsTruncated != nil && *output.IsTruncated == true  {
-		return provider.emptyBucketVersions(BucketName)
+	arn := objectARN(BucketName, "")
+	var selector *cloudtrail.DataResource
+	changed := false
+	eventSelectors := make([]*cloudtrail.EventSelector, 0)
+	for _, eventSelector := range out.EventSelectors {
+		resources := make([]*cloudtrail.DataResource, 0)
+		for _, resource := range eventSelector.DataResources {
+			if resource.Type == nil || *resource.Type != "AWS::S3::Object" {
+				resources = append(resources, resource)
+				continue
+			}
+			values := make([]*string, 0)
+			for _, value := range resource.Values {
+				if *value == arn {
+					if enabled {
+						return nil
+					}
+					changed = true
+					continue
+				}
+				values = append(values, value)
+			}
+			// A data resource without any values is invalid, drop it once its last bucket is removed.
+			if len(values) == 0 {
+				continue
+			}
+			resource.Values = values
+			resources = append(resources, resource)
+			if selector == nil {
+				selector = resource
+			}
+		}
+		eventSelector.DataResources = resources
+		if len(resources) > 0 || (eventSelector.IncludeManagementEvents != nil && *eventSelector.IncludeManagementEvents) {
+			eventSelectors = append(eventSelectors, eventSelector)
+		}
 	}
-	return nil
-}
-
-func (provider AWSInstanceS3Provider) DeleteBucket(BucketName string) error {
-	if err := provider.emptyBucket(BucketName); err != nil {
-		return err
+	out.EventSelectors = eventSelectors
+	if enabled {
+		if selector == nil {
+			out.EventSelectors = append(out.EventSelectors, &cloudtrail.EventSelector{
+				ReadWriteType:           aws.String(cloudtrail.ReadWriteTypeAll),
+				IncludeManagementEvents: aws.Bool(false),
+				DataResources: []*cloudtrail.DataResource{
+					&cloudtrail.DataResource{
+						Type:   aws.String("AWS::S3::Object"),
+						Values: []*string{aws.String(arn)},
+					},
+				},
+			})
+		} else {
+			selector.Values = append(selector.Values, aws.String(arn))
+		}
+		changed = true
 	}
-	if  err := provider.emptyBucketVersions(BucketName); err != nil {
-		return err
+	if !changed {
+		return nil
 	}
-	_, err := provider.s3.DeleteBucket(&s3.DeleteBucketInput{
-		Bucket: aws.String(BucketName),
+	_, err = provider.cloudtrail.PutEventSelectors(&cloudtrail.PutEventSelectorsInput{
+		TrailName:      aws.String(trail),
+		EventSelectors: out.EventSelectors,
 	})
 	return err
 }
 
 func (provider AWSInstanceS3Provider) CreateBucket(BucketName string, Plan *S3Settings) (*string, error) {
-	res, err := provider.s3.CreateBucket(&s3.CreateBucketInput{
+	input := &s3.CreateBucketInput{
 		Bucket: aws.String(BucketName),
-	})
+	}
+	if Plan.ObjectLock {
+		input.ObjectLockEnabledForBucket = aws.Bool(true)
+	}
+	// us-east-1 is the only region that must not be given as a location constraint.
+	if provider.region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(provider.region),
+		}
+	}
+	res, err := provider.s3.CreateBucket(input)
 	if err != nil {
 		return nil, err
 	}
+	if err = provider.ConfigureBucket(BucketName, Plan); err != nil {
+		return nil, err
+	}
+	return aws.String(strings.Replace(strings.Replace(*res.Location, "http://", "", -1), "/", "", -1)), nil
+}
+
+// The endpoint of a bucket, as returned when it's created.
+func (provider AWSInstanceS3Provider) bucketEndpoint(BucketName string) string {
+	if awsPartition() != endpoints.AwsPartitionID {
+		return BucketName + ".s3." + provider.region + "." + awsDNSSuffix(provider.region)
+	}
+	if provider.region != "us-east-1" {
+		return BucketName + ".s3.amazonaws.com"
+	}
+	return BucketName
+}
+
+// Applies the plan's settings (versioning, metrics, analytics and encryption) to a new bucket, each
+// setting replaces any previous configuration so it's safe to apply more than once.
+func (provider AWSInstanceS3Provider) ConfigureBucket(BucketName string, Plan *S3Settings) error {
+	var err error
 	if Plan.Versioned {
 		_, err := provider.s3.PutBucketVersioning(&s3.PutBucketVersioningInput{
 			Bucket: aws.String(BucketName),
@@ -397,27 +1044,76 @@ func (provider AWSInstanceS3Provider) CreateBucket(BucketName string, Plan *S3Se
 				Status: aws.String("Enabled"),
 			},
 		})
-		_, err = provider.s3.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		if err != nil {
+			return err
+		}
+		rule := &s3.LifecycleRule{
+			Prefix: aws.String(""),
+			Status: aws.String("Enabled"),
+			ID:     aws.String("versioned"),
+		}
+		if Plan.NoncurrentExpirationDays > 0 {
+			rule.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{
+				NoncurrentDays: aws.Int64(Plan.NoncurrentExpirationDays),
+			}
+		}
+		if Plan.TransitionDays > 0 {
+			rule.NoncurrentVersionTransitions = []*s3.NoncurrentVersionTransition{
+				{
+					NoncurrentDays: aws.Int64(Plan.TransitionDays),
+					StorageClass:   aws.String("STANDARD_IA"),
+				},
+			}
+			rule.Transitions = []*s3.Transition{
+				{
+					Days:         aws.Int64(Plan.TransitionDays),
+					StorageClass: aws.String("STANDARD_IA"),
+				},
+			}
+		}
+		// a rule without any expiration or transition is invalid.
+		if Plan.NoncurrentExpirationDays > 0 || Plan.TransitionDays > 0 {
+			_, err = provider.s3.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+				Bucket: aws.String(BucketName),
+				LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+					Rules: []*s3.LifecycleRule{rule},
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if os.Getenv("AWS_S3_REQUEST_METRICS") == "true" {
+		_, err = provider.s3.PutBucketMetricsConfiguration(&s3.PutBucketMetricsConfigurationInput{
+			Bucket:               aws.String(BucketName),
+			Id:                   aws.String("EntireBucket"),
+			MetricsConfiguration: &s3.MetricsConfiguration{Id: aws.String("EntireBucket")},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// Storage class analysis reports (daily csv files) are delivered to the analytics bucket under
+	// a prefix of the bucket's name.
+	if Plan.Analytics {
+		if os.Getenv("AWS_S3_ANALYTICS_BUCKET") == "" {
+			return errors.New("The plan requires analytics but AWS_S3_ANALYTICS_BUCKET is not set.")
+		}
+		_, err = provider.s3.PutBucketAnalyticsConfiguration(&s3.PutBucketAnalyticsConfigurationInput{
 			Bucket: aws.String(BucketName),
-			LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
-				Rules: []*s3.LifecycleRule{
-					{
-						Prefix: aws.String(""),
-						Status: aws.String("Enabled"),
-						ID:     aws.String("versioned"),
-						NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{
-							NoncurrentDays: aws.Int64(180),
-						},
-						NoncurrentVersionTransitions: []*s3.NoncurrentVersionTransition{
-							{
-								NoncurrentDays: aws.Int64(30),
-								StorageClass:   aws.String("STANDARD_IA"),
-							},
-						},
-						Transitions: []*s3.Transition{
-							{
-								Days:         aws.Int64(30),
-								StorageClass: aws.String("STANDARD_IA"),
+			Id:     aws.String("EntireBucket"),
+			AnalyticsConfiguration: &s3.AnalyticsConfiguration{
+				Id: aws.String("EntireBucket"),
+				StorageClassAnalysis: &s3.StorageClassAnalysis{
+					DataExport: &s3.StorageClassAnalysisDataExport{
+						OutputSchemaVersion: aws.String(s3.StorageClassAnalysisSchemaVersionV1),
+						Destination: &s3.AnalyticsExportDestination{
+							S3BucketDestination: &s3.AnalyticsS3BucketDestination{
+								Bucket:          aws.String(bucketARN(os.Getenv("AWS_S3_ANALYTICS_BUCKET"))),
+								BucketAccountId: aws.String(os.Getenv("AWS_ACCOUNT_ID")),
+								Format:          aws.String(s3.AnalyticsS3ExportFileFormatCsv),
+								Prefix:          aws.String(BucketName + "/"),
 							},
 						},
 					},
@@ -425,7 +1121,7 @@ func (provider AWSInstanceS3Provider) CreateBucket(BucketName string, Plan *S3Se
 			},
 		})
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 	if Plan.Encrypted && Plan.KMSKeyId != "" {
@@ -443,28 +1139,116 @@ func (provider AWSInstanceS3Provider) CreateBucket(BucketName string, Plan *S3Se
 			},
 		})
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	return aws.String(strings.Replace(strings.Replace(*res.Location, "http://", "", -1), "/", "", -1)), nil
+	return nil
 }
 
-func (provider AWSInstanceS3Provider) AddBucketPolicy(BucketName string, ARN string) error {
-	policy := BucketPolicy{
-		Version: "2012-10-17",
-		ID:      "Policy47474747",
-		Statement: []BucketPolicyStatement{
-			BucketPolicyStatement{
-				Sid:    "Stmt47474747",
-				Effect: "Allow",
-				Principal: Principal{
-					AWS: ARN,
-				},
-				Resource: "arn:aws:s3:::" + BucketName + "/*",
-				Action:   "s3:*",
-			},
-		},
+// The broker's principal (as aws:PrincipalArn matches it) from GetCallerIdentity, denies in bucket
+// policies exempt the broker so its own copies (backups, restores, seeds) and folders still work. An
+// assumed role is matched by the role with or without a path.
+var brokerPrincipal = struct {
+	sync.Mutex
+	arns []string
+}{}
+
+func (provider AWSInstanceS3Provider) brokerPrincipalArns() ([]string, error) {
+	brokerPrincipal.Lock()
+	defer brokerPrincipal.Unlock()
+	if brokerPrincipal.arns != nil {
+		return brokerPrincipal.arns, nil
 	}
+	res, err := provider.sts.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, err
+	}
+	caller, err := arn.Parse(aws.StringValue(res.Arn))
+	if err != nil {
+		return nil, err
+	}
+	if parts := strings.Split(caller.Resource, "/"); caller.Service == "sts" && len(parts) > 1 && parts[0] == "assumed-role" {
+		role := "arn:" + caller.Partition + ":iam::" + caller.AccountID + ":role/"
+		brokerPrincipal.arns = []string{role + parts[1], role + "*/" + parts[1]}
+	} else {
+		brokerPrincipal.arns = []string{caller.String()}
+	}
+	return brokerPrincipal.arns, nil
+}
+
+// Required tags are enforced by denying uploads (and tag changes) that set tags without setting each
+// required tag to an allowed value, removing an object's tags is denied as well. Requests without
+// any tags aren't denied, the parts of a multipart upload (and copies keeping the source's tags)
+// can't carry them. The broker is exempt so its own copies aren't denied.
+func (provider AWSInstanceS3Provider) requiredTagStatements(BucketName string, RequiredTags map[string][]string) ([]BucketPolicyStatement, error) {
+	statements := make([]BucketPolicyStatement, 0)
+	if len(RequiredTags) == 0 {
+		return statements, nil
+	}
+	broker, err := provider.brokerPrincipalArns()
+	if err != nil {
+		return nil, err
+	}
+	exempt := map[string][]string{"aws:PrincipalArn": broker}
+	keys := make([]string, 0)
+	for key := range RequiredTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		condition := map[string]interface{}{
+			"Null":       map[string]string{"s3:RequestObjectTag/" + key: "true", "s3:RequestObjectTagKeys": "false"},
+			"ArnNotLike": exempt,
+		}
+		if len(RequiredTags[key]) > 0 {
+			condition = map[string]interface{}{
+				"StringNotEquals": map[string][]string{"s3:RequestObjectTag/" + key: RequiredTags[key]},
+				"Null":            map[string]string{"s3:RequestObjectTagKeys": "false"},
+				"ArnNotLike":      exempt,
+			}
+		}
+		for _, action := range []string{"s3:PutObject", "s3:PutObjectTagging"} {
+			statements = append(statements, BucketPolicyStatement{
+				Sid:       "RequireTag" + strconv.Itoa(i) + strings.TrimPrefix(action, "s3:"),
+				Effect:    "Deny",
+				Principal: Principal{AWS: "*"},
+				Resource:  objectARN(BucketName, "*"),
+				Action:    action,
+				Condition: condition,
+			})
+		}
+	}
+	return append(statements, BucketPolicyStatement{
+		Sid:       "RequireTagDeleteObjectTagging",
+		Effect:    "Deny",
+		Principal: Principal{AWS: "*"},
+		Resource:  objectARN(BucketName, "*"),
+		Action:    "s3:DeleteObjectTagging",
+		Condition: map[string]interface{}{"ArnNotLike": exempt},
+	}), nil
+}
+
+func (provider AWSInstanceS3Provider) AddBucketPolicy(BucketName string, ARN string, RequiredTags map[string][]string) error {
+	policy := BucketPolicy{
+		Version: "2012-10-17",
+		ID:      "Policy47474747",
+		Statement: []BucketPolicyStatement{
+			BucketPolicyStatement{
+				Sid:    "Stmt47474747",
+				Effect: "Allow",
+				Principal: Principal{
+					AWS: ARN,
+				},
+				Resource: objectARN(BucketName, "*"),
+				Action:   "s3:*",
+			},
+		},
+	}
+	statements, err := provider.requiredTagStatements(BucketName, RequiredTags)
+	if err != nil {
+		return err
+	}
+	policy.Statement = append(policy.Statement, statements...)
 	policyString, err := json.Marshal(policy)
 	if err != nil {
 		return err
@@ -476,6 +1260,154 @@ func (provider AWSInstanceS3Provider) AddBucketPolicy(BucketName string, ARN str
 	return err
 }
 
+// Writes are blocked with a statement in the bucket policy that denies uploads (by anyone, the broker
+// can still remove objects), the rest of the policy is kept as it is.
+func (provider AWSInstanceS3Provider) BlockWrites(Instance *Instance, Blocked bool) error {
+	statements := make([]BucketPolicyStatement, 0)
+	if Blocked {
+		// The broker still has to write to the bucket (e.g., restores and seeds) while it's blocked.
+		broker, err := provider.brokerPrincipalArns()
+		if err != nil {
+			return err
+		}
+		statements = append(statements, BucketPolicyStatement{
+			Sid:       "StorageQuotaBlockWrites",
+			Effect:    "Deny",
+			Principal: Principal{AWS: "*"},
+			Resource:  objectARN(Instance.Name, "*"),
+			Action:    "s3:PutObject",
+			Condition: map[string]interface{}{"ArnNotLike": map[string][]string{"aws:PrincipalArn": broker}},
+		})
+	}
+	return provider.setPolicyStatements(Instance, "StorageQuotaBlockWrites", statements)
+}
+
+// Replaces the statements of the bucket policy whose Sid starts with the prefix, the rest of the
+// policy is kept as it is. The policy is removed if no statements are left.
+func (provider AWSInstanceS3Provider) setPolicyStatements(Instance *Instance, SidPrefix string, Statements []BucketPolicyStatement) error {
+	provider = provider.forRegion(Instance.Region)
+	policy := map[string]interface{}{"Version": "2012-10-17"}
+	res, err := provider.s3.GetBucketPolicy(&s3.GetBucketPolicyInput{
+		Bucket: aws.String(Instance.Name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchBucketPolicy" {
+		if len(Statements) == 0 {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	} else if err = json.Unmarshal([]byte(*res.Policy), &policy); err != nil {
+		return err
+	}
+	existing, _ := policy["Statement"].([]interface{})
+	statements := make([]interface{}, 0)
+	for _, statement := range existing {
+		if fields, ok := statement.(map[string]interface{}); !ok || !strings.HasPrefix(fmt.Sprint(fields["Sid"]), SidPrefix) {
+			statements = append(statements, statement)
+		}
+	}
+	for _, statement := range Statements {
+		statements = append(statements, statement)
+	}
+	if len(statements) == 0 {
+		_, err = provider.s3.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{
+			Bucket: aws.String(Instance.Name),
+		})
+		return err
+	}
+	policy["Statement"] = statements
+	policyString, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	_, err = provider.s3.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(Instance.Name),
+		Policy: aws.String(string(policyString)),
+	})
+	return err
+}
+
+// Freezing makes the bucket read only, an inline policy on the bucket's user denies changing objects
+// (which covers every access key and temporary credential of the user) and optionally the bucket
+// policy denies it to anyone else, e.g., roles given access to the bucket. Unfreezing removes both.
+// Unlike a storage quota's write block the broker isn't exempt, a frozen bucket stays as it is until
+// it's unfrozen and the broker refuses operations that would change it.
+func (provider AWSInstanceS3Provider) Freeze(Instance *Instance, Frozen bool, BucketPolicy bool) error {
+	provider = provider.forRegion(Instance.Region)
+	if !Frozen {
+		if err := provider.setPolicyStatements(Instance, "Freeze", nil); err != nil {
+			return err
+		}
+		_, err := provider.iam.DeleteUserPolicy(&iam.DeleteUserPolicyInput{
+			UserName:   aws.String(Instance.Name),
+			PolicyName: aws.String("freeze"),
+		})
+		if isMissing(err) {
+			return nil
+		}
+		return err
+	}
+	document, err := json.Marshal(map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Sid":      "FreezeDenyWrites",
+				"Effect":   "Deny",
+				"Action":   []string{"s3:Put*", "s3:Delete*", "s3:RestoreObject", "s3:AbortMultipartUpload"},
+				"Resource": []string{bucketARN(Instance.Name), objectARN(Instance.Name, "*")},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = provider.iam.PutUserPolicy(&iam.PutUserPolicyInput{
+		UserName:       aws.String(Instance.Name),
+		PolicyName:     aws.String("freeze"),
+		PolicyDocument: aws.String(string(document)),
+	}); err != nil {
+		return err
+	}
+	if !BucketPolicy {
+		return nil
+	}
+	// Only object actions are denied so the broker can still change the bucket's policy to unfreeze it.
+	return provider.setPolicyStatements(Instance, "Freeze", []BucketPolicyStatement{
+		{Sid: "FreezeDenyPut", Effect: "Deny", Principal: Principal{AWS: "*"}, Resource: objectARN(Instance.Name, "*"), Action: "s3:Put*"},
+		{Sid: "FreezeDenyDelete", Effect: "Deny", Principal: Principal{AWS: "*"}, Resource: objectARN(Instance.Name, "*"), Action: "s3:Delete*"},
+	})
+}
+
+// The bucket policy as it is in S3, empty if the bucket has none.
+func (provider AWSInstanceS3Provider) GetBucketPolicyDocument(Instance *Instance) (string, error) {
+	provider = provider.forRegion(Instance.Region)
+	res, err := provider.s3.GetBucketPolicy(&s3.GetBucketPolicyInput{
+		Bucket: aws.String(Instance.Name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchBucketPolicy" {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return *res.Policy, nil
+}
+
+// Replaces the bucket policy, an empty policy removes it.
+func (provider AWSInstanceS3Provider) PutBucketPolicyDocument(Instance *Instance, Policy string) error {
+	provider = provider.forRegion(Instance.Region)
+	if Policy == "" {
+		_, err := provider.s3.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{
+			Bucket: aws.String(Instance.Name),
+		})
+		return err
+	}
+	_, err := provider.s3.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(Instance.Name),
+		Policy: aws.String(Policy),
+	})
+	return err
+}
+
 func (provider AWSInstanceS3Provider) GetTags(BucketName string) ([]*s3.Tag, error) {
 	res, err := provider.s3.GetBucketTagging(&s3.GetBucketTaggingInput{
 		Bucket: aws.String(BucketName),
@@ -487,68 +1419,466 @@ func (provider AWSInstanceS3Provider) GetTags(BucketName string) ([]*s3.Tag, err
 	return res.TagSet, nil
 }
 
-func (provider AWSInstanceS3Provider) Provision(Id string, plan *ProviderPlan, Owner string) (*Instance, error) {
+// CheckBucketCapacity compares the number of buckets in the account against AWS_S3_BUCKET_LIMIT
+// (the account's service limit), a warning is logged once fewer than AWS_S3_BUCKET_HEADROOM
+// (10 by default) buckets remain and provisioning is refused at the limit. Nothing is checked
+// unless the limit is set, accounts can have their limit raised well past the old default of 100.
+func (provider AWSInstanceS3Provider) CheckBucketCapacity() error {
+	limit, err := strconv.Atoi(os.Getenv("AWS_S3_BUCKET_LIMIT"))
+	if err != nil || limit <= 0 {
+		return nil
+	}
+	headroom, err := strconv.Atoi(os.Getenv("AWS_S3_BUCKET_HEADROOM"))
+	if err != nil || headroom < 0 {
+		headroom = 10
+	}
+	res, err := provider.s3.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		return err
+	}
+	remaining := limit - len(res.Buckets)
+	if remaining <= 0 {
+		glog.Errorf("Unable to provision, the account has %d buckets which is the limit of %d.\n", len(res.Buckets), limit)
+		return errors.New("Bucket limit reached")
+	}
+	if remaining < headroom {
+		glog.Warningf("Only %d buckets remain before the account limit of %d is reached, request a limit increase.\n", remaining, limit)
+	}
+	return nil
+}
+
+func (provider AWSInstanceS3Provider) Provision(Id string, plan *ProviderPlan, Owner string, Region string) (*Instance, error) {
+	return provider.ResumeProvision(Id, plan, &ProvisionProgress{Owner: Owner, Region: Region})
+}
+
+// ResumeProvision creates the bucket one step at a time (user, key, bucket, policy, attach and
+// tag), the progress is updated after each step so if one fails (e.g., the new user isn't visible
+// to S3 yet) it can be resumed from that step rather than starting over and orphaning the user.
+// Each step can be repeated, a step that failed after AWS made the change finds its own user,
+// bucket or policy on the next attempt.
+func (provider AWSInstanceS3Provider) ResumeProvision(Id string, plan *ProviderPlan, progress *ProvisionProgress) (*Instance, error) {
 	var settings S3Settings
 	if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &settings); err != nil {
 		return nil, err
 	}
-
-	name := provider.CreateRandomName()
-	user, err := provider.CreateUser(name)
-	if err != nil {
+	if err := settings.readLifecycleAttributes(plan); err != nil {
 		return nil, err
 	}
 
-	endpoint, err := provider.CreateBucket(user.UserName, &settings)
-	if err != nil {
-		return nil, err
+	if progress.Step == "" {
+		// plans expanded from a region template have their region set.
+		if progress.Region == "" {
+			progress.Region = settings.Region
+		}
+		if progress.Region != "" && progress.Region != provider.region {
+			allowed := progress.Region == settings.Region
+			for _, region := range settings.Regions {
+				if region == progress.Region {
+					allowed = true
+				}
+			}
+			if !allowed {
+				return nil, errors.New("Region not allowed")
+			}
+		}
+		if err := provider.forRegion(progress.Region).CheckBucketCapacity(); err != nil {
+			return nil, err
+		}
+		progress.Step = ProvisionStepUser
 	}
+	provider = provider.forRegion(progress.Region)
 
-	instance := &Instance{
-		Id:            Id,
-		Name:          name,
-		ProviderId:    user.ARN,
-		Plan:          plan,
-		Username:      user.AccessKeyId,
-		Password:      user.SecretAccessKey,
-		Endpoint:      *endpoint,
-		Status:        "available",
-		Ready:         true,
-		Engine:        "s3",
-		EngineVersion: "aws-1",
-		Scheme:        "s3",
+	// A name that's already taken (by a user or bucket in any account) is only retried with a new
+	// name when it was picked by this attempt, on a resumed attempt the user or bucket is ours.
+	resumed := progress.Name != ""
+	for attempt := 0; progress.Step != ProvisionStepDone; {
+		switch progress.Step {
+		case ProvisionStepUser:
+			if progress.Name == "" {
+				if attempt >= 5 {
+					return nil, errors.New("Unable to find an unused name for the bucket.")
+				}
+				attempt++
+				name, err := provider.CreateName(plan)
+				if err != nil {
+					return nil, err
+				}
+				progress.Name = name
+			}
+			res, err := provider.iam.CreateUser(&iam.CreateUserInput{UserName: aws.String(progress.Name)})
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeEntityAlreadyExistsException && !resumed {
+				glog.Infof("The user %s already exists, trying another name.\n", progress.Name)
+				progress.Name = ""
+				continue
+			} else if ok && aerr.Code() == iam.ErrCodeEntityAlreadyExistsException {
+				user, err := provider.iam.GetUser(&iam.GetUserInput{UserName: aws.String(progress.Name)})
+				if err != nil {
+					return nil, err
+				}
+				progress.UserARN = *user.User.Arn
+			} else if err != nil {
+				return nil, err
+			} else {
+				progress.UserARN = *res.User.Arn
+			}
+			progress.Step = ProvisionStepKey
+		case ProvisionStepKey:
+			// keys created by an attempt that failed before recording them are unusable, a user may
+			// only have two keys so they're removed.
+			keys, err := provider.iam.ListAccessKeys(&iam.ListAccessKeysInput{UserName: aws.String(progress.Name)})
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range keys.AccessKeyMetadata {
+				if progress.AccessKeyId != "" && *key.AccessKeyId == progress.AccessKeyId {
+					continue
+				}
+				if _, err = provider.iam.DeleteAccessKey(&iam.DeleteAccessKeyInput{AccessKeyId: key.AccessKeyId, UserName: aws.String(progress.Name)}); err != nil {
+					return nil, err
+				}
+			}
+			if progress.AccessKeyId == "" {
+				key, err := provider.iam.CreateAccessKey(&iam.CreateAccessKeyInput{UserName: aws.String(progress.Name)})
+				if err != nil {
+					return nil, err
+				}
+				progress.AccessKeyId = *key.AccessKey.AccessKeyId
+				progress.SecretAccessKey = *key.AccessKey.SecretAccessKey
+			}
+			progress.Step = ProvisionStepBucket
+		case ProvisionStepBucket:
+			endpoint, err := provider.CreateBucket(progress.Name, &settings)
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou && resumed {
+				if err = provider.ConfigureBucket(progress.Name, &settings); err != nil {
+					return nil, err
+				}
+				endpoint = aws.String(provider.bucketEndpoint(progress.Name))
+			} else if ok && (aerr.Code() == s3.ErrCodeBucketAlreadyExists || aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou) {
+				glog.Infof("The bucket %s already exists, trying another name.\n", progress.Name)
+				if err = provider.DeleteAccessKey(progress.Name); err != nil {
+					return nil, err
+				}
+				if err = provider.DeleteUser(progress.Name); err != nil {
+					return nil, err
+				}
+				progress.Name = ""
+				progress.UserARN = ""
+				progress.AccessKeyId = ""
+				progress.SecretAccessKey = ""
+				progress.Step = ProvisionStepUser
+				resumed = false
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			progress.Endpoint = *endpoint
+			progress.Step = ProvisionStepPolicy
+		case ProvisionStepPolicy:
+			if err := retryUntilConsistent(func() error { return provider.AddBucketPolicy(progress.Name, progress.UserARN, settings.RequiredTags) }); err != nil {
+				return nil, err
+			}
+			policy, err := provider.CreateUserPolicy(progress.Name, progress.Name, settings.Encrypted, settings.KMSKeyId)
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeEntityAlreadyExistsException {
+				progress.PolicyARN = iamPolicyARN(progress.Name + "policy")
+			} else if err != nil {
+				return nil, err
+			} else {
+				progress.PolicyARN = policy.ARN
+			}
+			progress.Step = ProvisionStepAttach
+		case ProvisionStepAttach:
+			if err := retryUntilConsistent(func() error { return provider.AttachUserPolicy(progress.Name, &SimplePolicy{ARN: progress.PolicyARN}) }); err != nil {
+				return nil, err
+			}
+			progress.Step = ProvisionStepTag
+		case ProvisionStepTag:
+			instance := progress.instance(Id, plan)
+			if err := retryUntilConsistent(func() error { return provider.Tag(instance, "billingcode", progress.Owner) }); err != nil {
+				return nil, err
+			}
+			if err := provider.Tag(instance, "instance", Id); err != nil {
+				return nil, err
+			}
+			if settings.DataEvents {
+				if err := provider.SetDataEvents(progress.Name, true); err != nil {
+					return nil, err
+				}
+			}
+			if settings.BackupPlan != "" {
+				if err := provider.AddToBackupPlan(progress.Name, settings.BackupPlan); err != nil {
+					return nil, err
+				}
+			}
+			progress.Step = ProvisionStepDone
+		default:
+			return nil, errors.New("Unknown provisioning step " + progress.Step)
+		}
 	}
+	return progress.instance(Id, plan), nil
+}
 
-	time.Sleep(time.Second * time.Duration(10))
-	if err := provider.Tag(instance, "billingcode", Owner); err != nil {
-		return nil, err
+// Newly created buckets and IAM users take a few seconds to become visible to other AWS APIs, until
+// they are the calls fail with not found or (for bucket policies) invalid principal errors. Those
+// errors are retried with a backoff, anything else is returned immediately.
+func retryUntilConsistent(f func() error) error {
+	delay := 250 * time.Millisecond
+	var err error
+	for attempt := 0; attempt < 8; attempt++ {
+		err = f()
+		aerr, ok := err.(awserr.Error)
+		if err == nil || !ok {
+			return err
+		}
+		if aerr.Code() != "NoSuchBucket" && aerr.Code() != "NoSuchEntity" && aerr.Code() != "MalformedPolicy" {
+			return err
+		}
+		time.Sleep(delay)
+		delay = delay * 2
 	}
+	return err
+}
 
-	if err := provider.AddBucketPolicy(user.UserName, user.ARN); err != nil {
-		return nil, err
+// RollbackProvision removes what a provision that won't be finished created, in the reverse order
+// of the steps up to (and including) the one that failed. Every resource is attempted even if
+// removing an earlier one failed, the error lists all of the resources that could not be removed.
+func (provider AWSInstanceS3Provider) RollbackProvision(plan *ProviderPlan, progress *ProvisionProgress) error {
+	if progress.Name == "" {
+		return nil
+	}
+	var settings S3Settings
+	if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &settings); err != nil {
+		return err
+	}
+	provider = provider.forRegion(progress.Region)
+	removed := make([]string, 0)
+	failed := make([]string, 0)
+	remove := func(resource string, f func() error) {
+		if err := f(); err != nil && !isMissing(err) {
+			glog.Errorf("Unable to remove the %s of %s while rolling back its provision: %s\n", resource, progress.Name, err.Error())
+			failed = append(failed, resource+" ("+err.Error()+")")
+		} else if err == nil {
+			removed = append(removed, resource)
+		}
+	}
+
+	if progress.reached(ProvisionStepTag) {
+		if settings.BackupPlan != "" {
+			remove("backup selection", func() error { return provider.RemoveFromBackupPlan(progress.Name, settings.BackupPlan) })
+		}
+		if settings.DataEvents {
+			remove("data events", func() error { return provider.SetDataEvents(progress.Name, false) })
+		}
+	}
+	if progress.reached(ProvisionStepPolicy) {
+		policyARN := progress.PolicyARN
+		if policyARN == "" {
+			policyARN = iamPolicyARN(progress.Name + "policy")
+		}
+		if progress.reached(ProvisionStepAttach) {
+			remove("user policy attachment", func() error {
+				_, err := provider.iam.DetachUserPolicy(&iam.DetachUserPolicyInput{PolicyArn: aws.String(policyARN), UserName: aws.String(progress.Name)})
+				return err
+			})
+		}
+		remove("user policy", func() error { return provider.DeleteUserPolicy(policyARN) })
+	}
+	// the bucket policy is removed with the bucket.
+	if progress.reached(ProvisionStepBucket) {
+		remove("bucket", func() error { return provider.DeleteBucket(progress.Name) })
+	}
+	if progress.reached(ProvisionStepKey) {
+		remove("access keys", func() error {
+			keys, err := provider.iam.ListAccessKeys(&iam.ListAccessKeysInput{UserName: aws.String(progress.Name)})
+			if err != nil {
+				return err
+			}
+			for _, key := range keys.AccessKeyMetadata {
+				if _, err = provider.iam.DeleteAccessKey(&iam.DeleteAccessKeyInput{AccessKeyId: key.AccessKeyId, UserName: aws.String(progress.Name)}); err != nil && !isMissing(err) {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	remove("user", func() error { return provider.DeleteUser(progress.Name) })
+
+	glog.Infof("Rolled back the provision of %s from the %s step, removed: [%s] failed: [%s]\n", progress.Name, progress.Step, strings.Join(removed, ", "), strings.Join(failed, ", "))
+	if len(failed) > 0 {
+		return errors.New("Unable to remove " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (provider AWSInstanceS3Provider) ValidateDeprovision(Instance *Instance) error {
+	var settings S3Settings
+	if err := json.Unmarshal([]byte(Instance.Plan.providerPrivateDetails), &settings); err != nil {
+		return err
+	}
+	if !settings.RequireEmpty {
+		return nil
 	}
-	policy, err := provider.CreateUserPolicy(user.UserName, user.UserName, settings.Encrypted, settings.KMSKeyId)
+	provider = provider.forRegion(Instance.Region)
+	// versions are listed so noncurrent versions in versioned buckets count as well.
+	res, err := provider.s3.ListObjectVersions(&s3.ListObjectVersionsInput{
+		Bucket:  aws.String(Instance.Name),
+		MaxKeys: aws.Int64(1),
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
+	if len(res.Versions) > 0 {
+		return errors.New("Bucket not empty")
+	}
+	return nil
+}
 
-	if err := provider.AttachUserPolicy(user.UserName, policy); err != nil {
-		return nil, err
+// Resources that were already removed (a bucket or user deleted by hand) are reported as not found
+// by AWS, or as "Not found" when looked up by the broker.
+func isMissing(err error) bool {
+	if err == nil {
+		return false
 	}
-	return instance, nil
+	if err.Error() == "Not found" {
+		return true
+	}
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == s3.ErrCodeNoSuchBucket || aerr.Code() == iam.ErrCodeNoSuchEntityException)
 }
 
+// Each resource of the bucket is removed in turn, resources that are already missing are skipped so
+// the rest (in particular the IAM user) are still removed. The resources removed and those that were
+// already missing are logged.
 func (provider AWSInstanceS3Provider) Deprovision(Instance *Instance, takeSnapshot bool) error {
-	if err := provider.DeleteBucket(Instance.Name); err != nil {
+	provider = provider.forRegion(Instance.Region)
+	provider.instanceCache.Delete(Instance.Name + Instance.Plan.ID)
+	var settings S3Settings
+	if err := json.Unmarshal([]byte(Instance.Plan.providerPrivateDetails), &settings); err != nil {
+		return err
+	}
+	removed := make([]string, 0)
+	missing := make([]string, 0)
+	remove := func(resource string, f func() error) error {
+		if err := f(); isMissing(err) {
+			missing = append(missing, resource)
+		} else if err != nil {
+			return err
+		} else {
+			removed = append(removed, resource)
+		}
+		return nil
+	}
+
+	if err := remove("bucket", func() error { return provider.DeleteBucket(Instance.Name) }); err != nil {
+		return err
+	}
+	// the bucket is removed from the trail even if the plan no longer logs data events.
+	if err := provider.SetDataEvents(Instance.Name, false); err != nil {
+		return err
+	}
+	if settings.BackupPlan != "" {
+		if err := remove("backup selection", func() error { return provider.RemoveFromBackupPlan(Instance.Name, settings.BackupPlan) }); err != nil {
+			return err
+		}
+	}
+	// the role of irsa bindings has the user's policy attached, it has to go first.
+	if err := remove("role", func() error { return provider.deleteInstanceRole(Instance) }); err != nil {
+		return err
+	}
+	err := remove("user policy", func() error {
+		policyARN := iamPolicyARN(Instance.Name + "policy")
+		if attached, err := provider.GetPolicyARN(Instance.Name); err == nil {
+			policyARN = *attached
+			if _, err = provider.iam.DetachUserPolicy(&iam.DetachUserPolicyInput{PolicyArn: attached, UserName: aws.String(Instance.Name)}); err != nil && !isMissing(err) {
+				return err
+			}
+		} else if !isMissing(err) {
+			return err
+		}
+		return provider.DeleteUserPolicy(policyARN)
+	})
+	if err != nil {
+		return err
+	}
+	// the user can't be removed while it has the inline policy of a frozen instance.
+	if _, err = provider.iam.DeleteUserPolicy(&iam.DeleteUserPolicyInput{UserName: aws.String(Instance.Name), PolicyName: aws.String("freeze")}); err != nil && !isMissing(err) {
 		return err
 	}
-	if err := provider.DetachUserPolicy(Instance.Name); err != nil {
+	err = remove("access keys", func() error {
+		keys, err := provider.iam.ListAccessKeys(&iam.ListAccessKeysInput{UserName: aws.String(Instance.Name)})
+		if err != nil {
+			return err
+		}
+		if len(keys.AccessKeyMetadata) == 0 {
+			return errors.New("Not found")
+		}
+		for _, key := range keys.AccessKeyMetadata {
+			if _, err = provider.iam.DeleteAccessKey(&iam.DeleteAccessKeyInput{AccessKeyId: key.AccessKeyId, UserName: aws.String(Instance.Name)}); err != nil && !isMissing(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = remove("user", func() error { return provider.DeleteUser(Instance.Name) }); err != nil {
 		return err
 	}
-	if err := provider.DeleteAccessKey(Instance.Name); err != nil {
+	glog.Infof("Deprovisioned %s, removed: [%s] already missing: [%s]\n", Instance.Name, strings.Join(removed, ", "), strings.Join(missing, ", "))
+	return nil
+}
+
+// Returns the role (named after the bucket) that irsa bindings of the instance assume, creating it if
+// it doesn't exist yet. The role trusts the same identities as the template role and has the policy
+// of the bucket's user, so it can only use the instance's bucket.
+func (provider AWSInstanceS3Provider) CreateInstanceRole(Instance *Instance, TemplateRoleARN string) (string, error) {
+	if role, err := provider.iam.GetRole(&iam.GetRoleInput{RoleName: aws.String(Instance.Name)}); err == nil {
+		return aws.StringValue(role.Role.Arn), nil
+	} else if !isMissing(err) {
+		return "", err
+	}
+	template, err := arn.Parse(TemplateRoleARN)
+	if err != nil {
+		return "", err
+	}
+	templateRole, err := provider.iam.GetRole(&iam.GetRoleInput{RoleName: aws.String(template.Resource[strings.LastIndex(template.Resource, "/")+1:])})
+	if err != nil {
+		return "", err
+	}
+	trust, err := url.QueryUnescape(aws.StringValue(templateRole.Role.AssumeRolePolicyDocument))
+	if err != nil {
+		return "", err
+	}
+	policyARN, err := provider.GetPolicyARN(Instance.Name)
+	if err != nil {
+		return "", err
+	}
+	role, err := provider.iam.CreateRole(&iam.CreateRoleInput{
+		RoleName:                 aws.String(Instance.Name),
+		AssumeRolePolicyDocument: aws.String(trust),
+		Description:              aws.String("The irsa role of " + Instance.Name),
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err = provider.iam.AttachRolePolicy(&iam.AttachRolePolicyInput{RoleName: aws.String(Instance.Name), PolicyArn: policyARN}); err != nil {
+		return "", err
+	}
+	return aws.StringValue(role.Role.Arn), nil
+}
+
+func (provider AWSInstanceS3Provider) deleteInstanceRole(Instance *Instance) error {
+	policies, err := provider.iam.ListAttachedRolePolicies(&iam.ListAttachedRolePoliciesInput{RoleName: aws.String(Instance.Name)})
+	if err != nil {
 		return err
 	}
-	return provider.DeleteUser(Instance.Name)
+	for _, policy := range policies.AttachedPolicies {
+		if _, err = provider.iam.DetachRolePolicy(&iam.DetachRolePolicyInput{RoleName: aws.String(Instance.Name), PolicyArn: policy.PolicyArn}); err != nil && !isMissing(err) {
+			return err
+		}
+	}
+	_, err = provider.iam.DeleteRole(&iam.DeleteRoleInput{RoleName: aws.String(Instance.Name)})
+	return err
 }
 
 func (provider AWSInstanceS3Provider) Modify(Instance *Instance, plan *ProviderPlan) (*Instance, error) {
@@ -556,20 +1886,29 @@ func (provider AWSInstanceS3Provider) Modify(Instance *Instance, plan *ProviderP
 }
 
 func (provider AWSInstanceS3Provider) Tag(Instance *Instance, Name string, Value string) error {
+	provider = provider.forRegion(Instance.Region)
 	tags, err := provider.GetTags(Instance.Name)
 	if err != nil {
 		return err
 	}
+	// tag names must be unique, an existing tag with the same name is replaced.
+	var newTags []*s3.Tag = make([]*s3.Tag, 0)
+	for _, tag := range tags {
+		if *tag.Key != Name {
+			newTags = append(newTags, tag)
+		}
+	}
 	_, err = provider.s3.PutBucketTagging(&s3.PutBucketTaggingInput{
 		Bucket: aws.String(Instance.Name),
 		Tagging: &s3.Tagging{
-			TagSet: append(tags, &s3.Tag{Key: aws.String(Name), Value: aws.String(Value)}),
+			TagSet: append(newTags, &s3.Tag{Key: aws.String(Name), Value: aws.String(Value)}),
 		},
 	})
 	return err
 }
 
 func (provider AWSInstanceS3Provider) Untag(Instance *Instance, Name string) error {
+	provider = provider.forRegion(Instance.Region)
 	tags, err := provider.GetTags(Instance.Name)
 	if err != nil {
 		return err
@@ -592,3 +1931,1376 @@ func (provider AWSInstanceS3Provider) Untag(Instance *Instance, Name string) err
 func (provider AWSInstanceS3Provider) RotateCredentials(Instance *Instance) (*User, error) {
 	return provider.RotateAccessKey(Instance.Name, Instance.ProviderId)
 }
+
+// Creates a second access key for the bucket's user without removing the current one, IAM allows
+// at most two keys per user so this fails (with LimitExceeded) until one of them is removed.
+func (provider AWSInstanceS3Provider) AddAccessKey(Instance *Instance) (*User, error) {
+	resp, err := provider.iam.CreateAccessKey(&iam.CreateAccessKeyInput{
+		UserName: aws.String(Instance.Name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &User{
+		ARN:             Instance.ProviderId,
+		AccessKeyId:     *resp.AccessKey.AccessKeyId,
+		SecretAccessKey: *resp.AccessKey.SecretAccessKey,
+		UserName:        Instance.Name,
+	}, nil
+}
+
+func (provider AWSInstanceS3Provider) GetAccessKeys(Instance *Instance) ([]AccessKey, error) {
+	res, err := provider.iam.ListAccessKeys(&iam.ListAccessKeysInput{
+		UserName: aws.String(Instance.Name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]AccessKey, 0)
+	for _, key := range res.AccessKeyMetadata {
+		accessKey := AccessKey{AccessKeyId: *key.AccessKeyId, Status: *key.Status, Created: *key.CreateDate}
+		used, err := provider.iam.GetAccessKeyLastUsed(&iam.GetAccessKeyLastUsedInput{AccessKeyId: key.AccessKeyId})
+		if err != nil {
+			return nil, err
+		}
+		// a key that has never been used has a service and region of N/A and no date.
+		if used.AccessKeyLastUsed != nil && used.AccessKeyLastUsed.LastUsedDate != nil {
+			accessKey.LastUsed = used.AccessKeyLastUsed.LastUsedDate
+			accessKey.LastUsedService = aws.StringValue(used.AccessKeyLastUsed.ServiceName)
+			accessKey.LastUsedRegion = aws.StringValue(used.AccessKeyLastUsed.Region)
+		}
+		keys = append(keys, accessKey)
+	}
+	return keys, nil
+}
+
+func (provider AWSInstanceS3Provider) RemoveAccessKey(Instance *Instance, AccessKeyId string) error {
+	_, err := provider.iam.DeleteAccessKey(&iam.DeleteAccessKeyInput{
+		AccessKeyId: aws.String(AccessKeyId),
+		UserName:    aws.String(Instance.Name),
+	})
+	if err != nil && isMissing(err) {
+		return nil
+	}
+	return err
+}
+
+func (provider AWSInstanceS3Provider) SetAccessKeyStatus(Instance *Instance, AccessKeyId string, Active bool) error {
+	status := iam.StatusTypeInactive
+	if Active {
+		status = iam.StatusTypeActive
+	}
+	_, err := provider.iam.UpdateAccessKey(&iam.UpdateAccessKeyInput{
+		AccessKeyId: aws.String(AccessKeyId),
+		Status:      aws.String(status),
+		UserName:    aws.String(Instance.Name),
+	})
+	return err
+}
+
+// Checks the broker's credentials are valid (with GetCallerIdentity) and, when AWS_HEALTH_CHECK_BUCKET
+// is set, that it can reach that bucket. Both are cheap and need no extra permissions.
+func (provider AWSInstanceS3Provider) HealthCheck() error {
+	if _, err := provider.sts.GetCallerIdentity(&sts.GetCallerIdentityInput{}); err != nil {
+		return err
+	}
+	if bucket := os.Getenv("AWS_HEALTH_CHECK_BUCKET"); bucket != "" {
+		if _, err := provider.s3.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (provider AWSInstanceS3Provider) Purge(Instance *Instance) error {
+	provider = provider.forRegion(Instance.Region)
+	return provider.EmptyBucket(Instance.Name)
+}
+
+func (provider AWSInstanceS3Provider) GetBucketPolicy(BucketName string) (interface{}, error) {
+	res, err := provider.s3.GetBucketPolicy(&s3.GetBucketPolicyInput{
+		Bucket: aws.String(BucketName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var policy interface{}
+	if err = json.Unmarshal([]byte(*res.Policy), &policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (provider AWSInstanceS3Provider) GetUserPolicy(BucketName string) (interface{}, error) {
+	ARN, err := provider.GetPolicyARN(BucketName)
+	if err != nil {
+		return nil, err
+	}
+	res, err := provider.iam.GetPolicy(&iam.GetPolicyInput{
+		PolicyArn: ARN,
+	})
+	if err != nil {
+		return nil, err
+	}
+	version, err := provider.iam.GetPolicyVersion(&iam.GetPolicyVersionInput{
+		PolicyArn: ARN,
+		VersionId: res.Policy.DefaultVersionId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// IAM returns the policy document url encoded.
+	document, err := url.QueryUnescape(*version.PolicyVersion.Document)
+	if err != nil {
+		return nil, err
+	}
+	var policy interface{}
+	if err = json.Unmarshal([]byte(document), &policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (provider AWSInstanceS3Provider) GetPolicies(Instance *Instance) (*Policies, error) {
+	provider = provider.forRegion(Instance.Region)
+	// buckets without a policy (e.g., the statements were removed by hand) have a nil bucket policy.
+	bucketPolicy, err := provider.GetBucketPolicy(Instance.Name)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchBucketPolicy" {
+		bucketPolicy = nil
+	} else if err != nil {
+		return nil, err
+	}
+	userPolicy, err := provider.GetUserPolicy(Instance.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &Policies{
+		BucketPolicy: bucketPolicy,
+		UserPolicy:   userPolicy,
+	}, nil
+}
+
+func (provider AWSInstanceS3Provider) TemporaryCredentials(Instance *Instance, Options *TemporaryCredentialsOptions) (*TemporaryCredentials, error) {
+	provider = provider.forRegion(Instance.Region)
+	var settings S3Settings
+	if err := json.Unmarshal([]byte(Instance.Plan.providerPrivateDetails), &settings); err != nil {
+		return nil, err
+	}
+
+	objectActions := []string{"s3:GetObject", "s3:GetObjectVersion"}
+	bucketActions := []string{"s3:ListBucket", "s3:ListBucketVersions", "s3:GetBucketLocation"}
+	if !Options.ReadOnly {
+		objectActions = []string{"s3:GetObject", "s3:GetObjectVersion", "s3:PutObject", "s3:DeleteObject", "s3:DeleteObjectVersion", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"}
+		bucketActions = append(bucketActions, "s3:ListBucketMultipartUploads")
+	}
+
+	bucketStatement := UserPolicyStatement{
+		Effect:   "Allow",
+		Resource: []string{bucketARN(Instance.Name)},
+		Action:   bucketActions,
+	}
+	if Options.Prefix != "" {
+		bucketStatement.Condition = map[string]interface{}{
+			"StringLike": map[string]interface{}{
+				"s3:prefix": []string{Options.Prefix + "*"},
+			},
+		}
+	}
+
+	policy := UserPolicy{
+		Version: "2012-10-17",
+		Statement: []UserPolicyStatement{
+			bucketStatement,
+			UserPolicyStatement{
+				Effect:   "Allow",
+				Resource: []string{objectARN(Instance.Name, Options.Prefix+"*")},
+				Action:   objectActions,
+			},
+		},
+	}
+
+	if settings.Encrypted && settings.KMSKeyId != "" {
+		kmsActions := []string{"kms:Decrypt", "kms:DescribeKey"}
+		if !Options.ReadOnly {
+			kmsActions = append(kmsActions, "kms:Encrypt", "kms:ReEncrypt*", "kms:GenerateDataKey*")
+		}
+		policy.Statement = append(policy.Statement, UserPolicyStatement{
+			Effect:   "Allow",
+			Resource: []string{kmsKeyARN(provider.region, settings.KMSKeyId)},
+			Action:   kmsActions,
+		})
+	}
+
+	policyString, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	// The federated user name is limited to 32 characters.
+	name := Instance.Name
+	if len(name) > 32 {
+		name = name[0:32]
+	}
+
+	res, err := provider.sts.GetFederationToken(&sts.GetFederationTokenInput{
+		Name:            aws.String(name),
+		Policy:          aws.String(string(policyString)),
+		DurationSeconds: aws.Int64(Options.Duration),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TemporaryCredentials{
+		AccessKeyId:     *res.Credentials.AccessKeyId,
+		SecretAccessKey: *res.Credentials.SecretAccessKey,
+		SessionToken:    *res.Credentials.SessionToken,
+		Expiration:      *res.Credentials.Expiration,
+		Bucket:          Instance.Name,
+		Prefix:          Options.Prefix,
+		ReadOnly:        Options.ReadOnly,
+	}, nil
+}
+
+func (provider AWSInstanceS3Provider) GetLifecycle(Instance *Instance) (*LifecycleConfiguration, error) {
+	provider = provider.forRegion(Instance.Region)
+	res, err := provider.s3.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(Instance.Name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchLifecycleConfiguration" {
+		return &LifecycleConfiguration{Rules: make([]*s3.LifecycleRule, 0)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &LifecycleConfiguration{Rules: res.Rules}, nil
+}
+
+// Reads the versioning, default encryption and lifecycle of the bucket and compares them with the
+// plan's settings, a bucket changed by hand (e.g., versioning suspended) is reported as drift.
+func (provider AWSInstanceS3Provider) GetConfiguration(Instance *Instance) (*BucketConfiguration, error) {
+	var settings S3Settings
+	if err := json.Unmarshal([]byte(Instance.Plan.providerPrivateDetails), &settings); err != nil {
+		return nil, err
+	}
+	if err := settings.readLifecycleAttributes(Instance.Plan); err != nil {
+		return nil, err
+	}
+	provider = provider.forRegion(Instance.Region)
+	config := &BucketConfiguration{Versioning: "Disabled", Encryption: "none", Drift: make([]string, 0)}
+
+	versioning, err := provider.s3.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(Instance.Name)})
+	if err != nil {
+		return nil, err
+	}
+	if versioning.Status != nil {
+		config.Versioning = *versioning.Status
+	}
+	encryption, err := provider.s3.GetBucketEncryption(&s3.GetBucketEncryptionInput{Bucket: aws.String(Instance.Name)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ServerSideEncryptionConfigurationNotFoundError" {
+		// not encrypted by default.
+	} else if err != nil {
+		return nil, err
+	} else if encryption.ServerSideEncryptionConfiguration != nil {
+		for _, rule := range encryption.ServerSideEncryptionConfiguration.Rules {
+			if rule.ApplyServerSideEncryptionByDefault != nil {
+				config.Encryption = aws.StringValue(rule.ApplyServerSideEncryptionByDefault.SSEAlgorithm)
+				config.KMSKeyId = aws.StringValue(rule.ApplyServerSideEncryptionByDefault.KMSMasterKeyID)
+			}
+		}
+	}
+	lifecycle, err := provider.GetLifecycle(Instance)
+	if err != nil {
+		return nil, err
+	}
+	config.LifecycleRules = len(lifecycle.Rules)
+
+	if settings.Versioned && config.Versioning != s3.BucketVersioningStatusEnabled {
+		config.Drift = append(config.Drift, "versioning is "+strings.ToLower(config.Versioning)+" but the plan enables it")
+	}
+	if settings.Encrypted && config.Encryption == "none" {
+		config.Drift = append(config.Drift, "default encryption is off but the plan enables it")
+	} else if settings.Encrypted && settings.KMSKeyId != "" && !strings.HasSuffix(config.KMSKeyId, settings.KMSKeyId) && !strings.HasSuffix(settings.KMSKeyId, config.KMSKeyId) {
+		config.Drift = append(config.Drift, "the bucket is encrypted with "+config.KMSKeyId+" rather than the plan's key "+settings.KMSKeyId)
+	}
+	if settings.Versioned && (settings.NoncurrentExpirationDays > 0 || settings.TransitionDays > 0) && config.LifecycleRules == 0 {
+		config.Drift = append(config.Drift, "the bucket has no lifecycle rules but the plan expires or transitions noncurrent versions")
+	}
+	return config, nil
+}
+
+func (provider AWSInstanceS3Provider) SetLifecycle(Instance *Instance, Lifecycle *LifecycleConfiguration) error {
+	provider = provider.forRegion(Instance.Region)
+	if len(Lifecycle.Rules) == 0 {
+		_, err := provider.s3.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{
+			Bucket: aws.String(Instance.Name),
+		})
+		return err
+	}
+	_, err := provider.s3.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(Instance.Name),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+			Rules: Lifecycle.Rules,
+		},
+	})
+	return err
+}
+
+func (provider AWSInstanceS3Provider) UpdateInstanceSettings(Instance *Instance, Settings *InstanceSettings) error {
+	regional := provider.forRegion(Instance.Region)
+	if len(Settings.Tags) > 0 {
+		tags, err := regional.GetTags(Instance.Name)
+		if err != nil {
+			return err
+		}
+		newTags := make([]*s3.Tag, 0)
+		for _, tag := range tags {
+			if _, ok := Settings.Tags[*tag.Key]; !ok {
+				newTags = append(newTags, tag)
+			}
+		}
+		for name, value := range Settings.Tags {
+			newTags = append(newTags, &s3.Tag{Key: aws.String(name), Value: aws.String(value)})
+		}
+		_, err = regional.s3.PutBucketTagging(&s3.PutBucketTaggingInput{
+			Bucket:  aws.String(Instance.Name),
+			Tagging: &s3.Tagging{TagSet: newTags},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if Settings.Lifecycle != nil {
+		if err := provider.SetLifecycle(Instance, Settings.Lifecycle); err != nil {
+			return err
+		}
+	}
+	if Settings.Cors != nil {
+		if len(Settings.Cors.Rules) == 0 {
+			if _, err := regional.s3.DeleteBucketCors(&s3.DeleteBucketCorsInput{Bucket: aws.String(Instance.Name)}); err != nil {
+				return err
+			}
+		} else {
+			_, err := regional.s3.PutBucketCors(&s3.PutBucketCorsInput{
+				Bucket:            aws.String(Instance.Name),
+				CORSConfiguration: &s3.CORSConfiguration{CORSRules: Settings.Cors.Rules},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (provider AWSInstanceS3Provider) GetBackupPrefix(BucketName string, BackupId string) string {
+	return BucketName + "/" + BackupId + "/"
+}
+
+// Copies the current version of every object in the bucket to the archive bucket set by
+// AWS_S3_ARCHIVE_BUCKET, objects are stored under the prefix returned by GetBackupPrefix. The backup
+// returned has the number of objects and bytes copied.
+func (provider AWSInstanceS3Provider) Backup(Instance *Instance, BackupId string) (*Backup, error) {
+	archive := os.Getenv("AWS_S3_ARCHIVE_BUCKET")
+	if archive == "" {
+		return nil, errors.New("Unable to backup, the AWS_S3_ARCHIVE_BUCKET environment variable was not set.")
+	}
+	backup := &Backup{Id: BackupId, InstanceId: Instance.Id, Name: Instance.Name}
+	prefix := provider.GetBackupPrefix(Instance.Name, BackupId)
+	// copies are sent to the archive bucket (in the default region), the bucket may be elsewhere.
+	archiveClient := provider.s3
+	provider = provider.forRegion(Instance.Region)
+	var copyErr error = nil
+	err := provider.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(Instance.Name)}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if obj == nil || obj.Key == nil {
+				continue
+			}
+			copyErr = copyObject(archiveClient, archive, prefix+*obj.Key, Instance.Name, *obj.Key, aws.Int64Value(obj.Size))
+			if copyErr != nil {
+				return false
+			}
+			backup.Objects++
+			backup.Bytes = backup.Bytes + aws.Int64Value(obj.Size)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if copyErr != nil {
+		return nil, copyErr
+	}
+	return backup, nil
+}
+
+// Reads the current version of every object in the bucket, one at a time, for copying the bucket to
+// another provider.
+func (provider AWSInstanceS3Provider) ReadObjects(Instance *Instance, Read func(string, io.Reader) error) error {
+	provider = provider.forRegion(Instance.Region)
+	var readErr error = nil
+	err := provider.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(Instance.Name)}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if obj == nil || obj.Key == nil {
+				continue
+			}
+			var out *s3.GetObjectOutput
+			if out, readErr = provider.s3.GetObject(&s3.GetObjectInput{Bucket: aws.String(Instance.Name), Key: obj.Key}); readErr != nil {
+				return false
+			}
+			readErr = Read(*obj.Key, out.Body)
+			out.Body.Close()
+			if readErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return readErr
+}
+
+// Writes an object to the bucket (in parts, it may be larger than a single put allows), for copying
+// a bucket from another provider.
+func (provider AWSInstanceS3Provider) WriteObject(Instance *Instance, Key string, Body io.Reader) error {
+	provider = provider.forRegion(Instance.Region)
+	_, err := s3manager.NewUploaderWithClient(provider.s3).Upload(&s3manager.UploadInput{
+		Bucket: aws.String(Instance.Name),
+		Key:    aws.String(Key),
+		Body:   Body,
+	})
+	return err
+}
+
+// Adds the bucket to the AWS Backup plan (by id) using a selection named after the bucket, AWS
+// Backup assumes the role in AWS_BACKUP_ROLE_ARN to take backups. Note the bucket must be versioned.
+func (provider AWSInstanceS3Provider) AddToBackupPlan(BucketName string, BackupPlanId string) error {
+	if os.Getenv("AWS_BACKUP_ROLE_ARN") == "" {
+		return errors.New("The plan requires backups but AWS_BACKUP_ROLE_ARN is not set.")
+	}
+	_, err := provider.backup.CreateBackupSelection(&backup.CreateBackupSelectionInput{
+		BackupPlanId:     aws.String(BackupPlanId),
+		CreatorRequestId: aws.String(BucketName),
+		BackupSelection: &backup.Selection{
+			IamRoleArn:    aws.String(os.Getenv("AWS_BACKUP_ROLE_ARN")),
+			SelectionName: aws.String(BucketName),
+			Resources:     []*string{aws.String(bucketARN(BucketName))},
+		},
+	})
+	return err
+}
+
+// Removes the bucket's selection from the backup plan, existing recovery points are kept until they
+// expire (per the plan's lifecycle).
+func (provider AWSInstanceS3Provider) RemoveFromBackupPlan(BucketName string, BackupPlanId string) error {
+	var selectionId *string
+	err := provider.backup.ListBackupSelectionsPages(&backup.ListBackupSelectionsInput{BackupPlanId: aws.String(BackupPlanId)}, func(page *backup.ListBackupSelectionsOutput, lastPage bool) bool {
+		for _, selection := range page.BackupSelectionsList {
+			if selection.SelectionName != nil && *selection.SelectionName == BucketName {
+				selectionId = selection.SelectionId
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil || selectionId == nil {
+		return err
+	}
+	_, err = provider.backup.DeleteBackupSelection(&backup.DeleteBackupSelectionInput{
+		BackupPlanId: aws.String(BackupPlanId),
+		SelectionId:  selectionId,
+	})
+	return err
+}
+
+func (provider AWSInstanceS3Provider) GetRestorePoints(Instance *Instance) ([]RestorePoint, error) {
+	provider = provider.forRegion(Instance.Region)
+	points := make([]RestorePoint, 0)
+	err := provider.backup.ListRecoveryPointsByResourcePages(&backup.ListRecoveryPointsByResourceInput{ResourceArn: aws.String(bucketARN(Instance.Name))}, func(page *backup.ListRecoveryPointsByResourceOutput, lastPage bool) bool {
+		for _, point := range page.RecoveryPoints {
+			if point.RecoveryPointArn == nil {
+				continue
+			}
+			restorePoint := RestorePoint{Id: *point.RecoveryPointArn}
+			if point.CreationDate != nil {
+				restorePoint.Created = *point.CreationDate
+			}
+			if point.Status != nil {
+				restorePoint.Status = *point.Status
+			}
+			if point.BackupSizeBytes != nil {
+				restorePoint.Bytes = *point.BackupSizeBytes
+			}
+			points = append(points, restorePoint)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// Whether the recovery point is a restore point of the bucket.
+func (provider AWSInstanceS3Provider) isRestorePoint(Instance *Instance, RecoveryPointArn string) (bool, error) {
+	points, err := provider.GetRestorePoints(Instance)
+	if err != nil {
+		return false, err
+	}
+	for _, point := range points {
+		if point.Id == RecoveryPointArn {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Restores the bucket from either a restore point (a recovery point arn from GetRestorePoints) or an
+// on-demand backup id. Restore points are restored by an AWS Backup job that finishes on its own,
+// on-demand backups are copied back from the archive bucket. Objects are overwritten but objects
+// created since the backup are not removed. SourceName is the bucket the backup was taken of when
+// it's restored into another (e.g., a new instance), an empty name is the bucket itself.
+func (provider AWSInstanceS3Provider) Restore(Instance *Instance, BackupId string, SourceName string) error {
+	if SourceName == "" {
+		SourceName = Instance.Name
+	}
+	if strings.HasPrefix(BackupId, "arn:") {
+		if os.Getenv("AWS_BACKUP_ROLE_ARN") == "" {
+			return errors.New("Unable to restore, the AWS_BACKUP_ROLE_ARN environment variable was not set.")
+		}
+		// only restore points of this bucket may be restored into it, not another tenant's.
+		if ok, err := provider.isRestorePoint(Instance, BackupId); err != nil {
+			return err
+		} else if !ok {
+			return errors.New("Backup not found")
+		}
+		provider = provider.forRegion(Instance.Region)
+		_, err := provider.backup.StartRestoreJob(&backup.StartRestoreJobInput{
+			IamRoleArn:       aws.String(os.Getenv("AWS_BACKUP_ROLE_ARN")),
+			IdempotencyToken: aws.String(Instance.Name + BackupId),
+			RecoveryPointArn: aws.String(BackupId),
+			Metadata: map[string]*string{
+				"DestinationBucketName": aws.String(Instance.Name),
+				"NewBucket":             aws.String("false"),
+			},
+		})
+		return err
+	}
+
+	archive := os.Getenv("AWS_S3_ARCHIVE_BUCKET")
+	if archive == "" {
+		return errors.New("Unable to restore, the AWS_S3_ARCHIVE_BUCKET environment variable was not set.")
+	}
+	prefix := provider.GetBackupPrefix(SourceName, BackupId)
+	archiveClient := provider.s3
+	provider = provider.forRegion(Instance.Region)
+	var copyErr error = nil
+	found := false
+	err := archiveClient.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(archive), Prefix: aws.String(prefix)}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if obj == nil || obj.Key == nil {
+				continue
+			}
+			found = true
+			copyErr = copyObject(provider.s3, Instance.Name, strings.TrimPrefix(*obj.Key, prefix), archive, *obj.Key, aws.Int64Value(obj.Size))
+			if copyErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if copyErr == nil && !found {
+		return errors.New("Backup not found")
+	}
+	return copyErr
+}
+
+// The largest object CopyObject can copy, larger objects are copied in parts.
+const maxCopyObjectBytes = int64(5 * 1024 * 1024 * 1024)
+
+// The size of each part of a multipart copy, 10,000 parts covers the largest object S3 allows.
+const copyPartBytes = int64(1024 * 1024 * 1024)
+
+// Copies an object (the current version) of Size bytes to the bucket and key with CopyObject, or
+// with a multipart upload of UploadPartCopy parts when it's over the 5GB CopyObject allows.
+func copyObject(client *s3.S3, Bucket string, Key string, SourceBucket string, SourceKey string, Size int64) error {
+	source := aws.String(url.PathEscape(SourceBucket + "/" + SourceKey))
+	if Size <= maxCopyObjectBytes {
+		_, err := client.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(Bucket),
+			Key:        aws.String(Key),
+			CopySource: source,
+		})
+		return err
+	}
+	upload, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(Bucket),
+		Key:    aws.String(Key),
+	})
+	if err != nil {
+		return err
+	}
+	parts := make([]*s3.CompletedPart, 0)
+	for start := int64(0); start < Size; start = start + copyPartBytes {
+		end := start + copyPartBytes - 1
+		if end >= Size {
+			end = Size - 1
+		}
+		number := aws.Int64(int64(len(parts) + 1))
+		res, err := client.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(Bucket),
+			Key:             aws.String(Key),
+			UploadId:        upload.UploadId,
+			PartNumber:      number,
+			CopySource:      source,
+			CopySourceRange: aws.String("bytes=" + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end, 10)),
+		})
+		if err != nil {
+			client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String(Bucket), Key: aws.String(Key), UploadId: upload.UploadId})
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: res.CopyPartResult.ETag, PartNumber: number})
+	}
+	_, err = client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(Bucket),
+		Key:             aws.String(Key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String(Bucket), Key: aws.String(Key), UploadId: upload.UploadId})
+	}
+	return err
+}
+
+type listedObject struct {
+	size int64
+	etag string
+}
+
+// Lists the objects under the prefix by key (without the prefix).
+func listObjects(client *s3.S3, Bucket string, Prefix string) (map[string]listedObject, error) {
+	objects := make(map[string]listedObject)
+	err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(Bucket), Prefix: aws.String(Prefix)}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if obj == nil || obj.Key == nil {
+				continue
+			}
+			objects[strings.TrimPrefix(*obj.Key, Prefix)] = listedObject{size: aws.Int64Value(obj.Size), etag: aws.StringValue(obj.ETag)}
+		}
+		return true
+	})
+	return objects, err
+}
+
+// Verifies an on-demand backup was restored by comparing the listing of the backup in the archive
+// bucket with the bucket. Etags are compared unless the bucket is encrypted with a KMS key (its etags
+// are not the MD5 of the object, so a copy has a different etag). Restore points are restored by an
+// AWS Backup job that finishes on its own, those are reported as not verified.
+func (provider AWSInstanceS3Provider) VerifyRestore(Instance *Instance, BackupId string, SourceName string) (*RestoreVerification, error) {
+	if SourceName == "" {
+		SourceName = Instance.Name
+	}
+	verification := &RestoreVerification{Backup: BackupId, Created: time.Now()}
+	if strings.HasPrefix(BackupId, "arn:") {
+		verification.Reason = "Restores from restore points are completed by AWS Backup and are not verified."
+		return verification, nil
+	}
+	var settings S3Settings
+	if err := json.Unmarshal([]byte(Instance.Plan.providerPrivateDetails), &settings); err != nil {
+		return nil, err
+	}
+	compareETags := !(settings.Encrypted && settings.KMSKeyId != "")
+
+	archive := os.Getenv("AWS_S3_ARCHIVE_BUCKET")
+	if archive == "" {
+		return nil, errors.New("Unable to verify the restore, the AWS_S3_ARCHIVE_BUCKET environment variable was not set.")
+	}
+	source, err := listObjects(provider.s3, archive, provider.GetBackupPrefix(SourceName, BackupId))
+	if err != nil {
+		return nil, err
+	}
+	destination, err := listObjects(provider.forRegion(Instance.Region).s3, Instance.Name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(source))
+	for key := range source {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sourceSum := sha256.New()
+	destinationSum := sha256.New()
+	entry := func(key string, object listedObject) string {
+		if compareETags {
+			return key + "\t" + strconv.FormatInt(object.size, 10) + "\t" + object.etag + "\n"
+		}
+		return key + "\t" + strconv.FormatInt(object.size, 10) + "\n"
+	}
+	for _, key := range keys {
+		verification.Objects++
+		verification.Bytes = verification.Bytes + source[key].size
+		sourceSum.Write([]byte(entry(key, source[key])))
+		restored, ok := destination[key]
+		if !ok {
+			verification.Missing++
+		} else if restored.size != source[key].size || (compareETags && restored.etag != source[key].etag) {
+			verification.Mismatched++
+		}
+		if ok {
+			destinationSum.Write([]byte(entry(key, restored)))
+		}
+		if (!ok || entry(key, restored) != entry(key, source[key])) && len(verification.Examples) < 10 {
+			verification.Examples = append(verification.Examples, key)
+		}
+	}
+	verification.SourceChecksum = hex.EncodeToString(sourceSum.Sum(nil))
+	verification.DestinationChecksum = hex.EncodeToString(destinationSum.Sum(nil))
+	verification.Verified = verification.Missing == 0 && verification.Mismatched == 0
+	if !verification.Verified {
+		verification.Reason = strconv.FormatInt(verification.Missing, 10) + " of " + strconv.FormatInt(verification.Objects, 10) + " objects are missing and " + strconv.FormatInt(verification.Mismatched, 10) + " differ from the backup."
+	}
+	return verification, nil
+}
+
+func (provider AWSInstanceS3Provider) getMetric(MetricName string, Statistic string, Start time.Time, End time.Time, Period int64, Dimensions map[string]string) ([]*cloudwatch.Datapoint, error) {
+	dimensions := make([]*cloudwatch.Dimension, 0)
+	for name, value := range Dimensions {
+		dimensions = append(dimensions, &cloudwatch.Dimension{Name: aws.String(name), Value: aws.String(value)})
+	}
+	res, err := provider.cloudwatch.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/S3"),
+		MetricName: aws.String(MetricName),
+		Dimensions: dimensions,
+		StartTime:  aws.Time(Start),
+		EndTime:    aws.Time(End),
+		Period:     aws.Int64(Period),
+		Statistics: []*string{aws.String(Statistic)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Datapoints, nil
+}
+
+// The storage metrics are only reported once a day (and a day late), the most recent value in the
+// two days before the end of the period is used.
+func (provider AWSInstanceS3Provider) getLatestStorageMetric(BucketName string, MetricName string, StorageType string, End time.Time) (int64, error) {
+	datapoints, err := provider.getMetric(MetricName, "Average", End.Add(-48*time.Hour), End, 86400, map[string]string{"BucketName": BucketName, "StorageType": StorageType})
+	if err != nil {
+		return 0, err
+	}
+	var latest *cloudwatch.Datapoint
+	for _, datapoint := range datapoints {
+		if latest == nil || datapoint.Timestamp.After(*latest.Timestamp) {
+			latest = datapoint
+		}
+	}
+	if latest == nil || latest.Average == nil {
+		return 0, nil
+	}
+	return int64(*latest.Average), nil
+}
+
+// Request counts are only available for buckets with request metrics enabled (see
+// AWS_S3_REQUEST_METRICS), otherwise they're reported as zero and RequestMetrics is false.
+func (provider AWSInstanceS3Provider) GetUsage(Instance *Instance, Start time.Time, End time.Time) (*Usage, error) {
+	provider = provider.forRegion(Instance.Region)
+	usage := Usage{Resource: Instance.Id, Start: Start, End: End}
+	_, err := provider.s3.GetBucketMetricsConfiguration(&s3.GetBucketMetricsConfigurationInput{
+		Bucket: aws.String(Instance.Name),
+		Id:     aws.String("EntireBucket"),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchConfiguration" {
+		usage.RequestMetrics = false
+	} else if err != nil {
+		return nil, err
+	} else {
+		usage.RequestMetrics = true
+	}
+	for _, storageType := range []string{"StandardStorage", "StandardIAStorage"} {
+		bytes, err := provider.getLatestStorageMetric(Instance.Name, "BucketSizeBytes", storageType, End)
+		if err != nil {
+			return nil, err
+		}
+		usage.Bytes += bytes
+	}
+	objects, err := provider.getLatestStorageMetric(Instance.Name, "NumberOfObjects", "AllStorageTypes", End)
+	if err != nil {
+		return nil, err
+	}
+	usage.Objects = objects
+	datapoints, err := provider.getMetric("AllRequests", "Sum", Start, End, 3600, map[string]string{"BucketName": Instance.Name, "FilterId": "EntireBucket"})
+	if err != nil {
+		return nil, err
+	}
+	for _, datapoint := range datapoints {
+		if datapoint.Sum != nil {
+			usage.Requests += int64(*datapoint.Sum)
+		}
+	}
+	return &usage, nil
+}
+
+// Reads the bucket's replication rules and the last hour of their CloudWatch replication metrics,
+// ReplicationLatency is the most recent maximum and OperationsFailedReplication the total over the
+// hour. Buckets without a replication configuration aren't enabled.
+func (provider AWSInstanceS3Provider) GetReplicationHealth(Instance *Instance, MaxLatency float64) (*ReplicationHealth, error) {
+	provider = provider.forRegion(Instance.Region)
+	health := &ReplicationHealth{Healthy: true, MaxLatencySeconds: MaxLatency, Rules: make([]ReplicationRuleHealth, 0)}
+	res, err := provider.s3.GetBucketReplication(&s3.GetBucketReplicationInput{
+		Bucket: aws.String(Instance.Name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ReplicationConfigurationNotFoundError" {
+		health.Healthy = false
+		return health, nil
+	} else if err != nil {
+		return nil, err
+	}
+	health.Enabled = true
+	End := time.Now()
+	Start := End.Add(-time.Hour)
+	for _, rule := range res.ReplicationConfiguration.Rules {
+		ruleHealth := ReplicationRuleHealth{RuleId: aws.StringValue(rule.ID), Status: aws.StringValue(rule.Status), Prefix: aws.StringValue(rule.Prefix)}
+		if rule.Filter != nil && rule.Filter.Prefix != nil {
+			ruleHealth.Prefix = *rule.Filter.Prefix
+		} else if rule.Filter != nil && rule.Filter.And != nil && rule.Filter.And.Prefix != nil {
+			ruleHealth.Prefix = *rule.Filter.And.Prefix
+		}
+		if rule.Destination != nil {
+			ruleHealth.Destination = strings.TrimPrefix(aws.StringValue(rule.Destination.Bucket), "arn:"+awsPartition()+":s3:::")
+			ruleHealth.MetricsEnabled = rule.Destination.Metrics != nil && aws.StringValue(rule.Destination.Metrics.Status) == s3.MetricsStatusEnabled
+		}
+		if ruleHealth.Status == s3.ReplicationRuleStatusEnabled && ruleHealth.MetricsEnabled {
+			dimensions := map[string]string{"SourceBucket": Instance.Name, "DestinationBucket": ruleHealth.Destination, "RuleId": ruleHealth.RuleId}
+			latest := func(MetricName string) (*float64, error) {
+				datapoints, err := provider.getMetric(MetricName, "Maximum", Start, End, 300, dimensions)
+				if err != nil {
+					return nil, err
+				}
+				var latest *cloudwatch.Datapoint
+				for _, datapoint := range datapoints {
+					if latest == nil || datapoint.Timestamp.After(*latest.Timestamp) {
+						latest = datapoint
+					}
+				}
+				if latest == nil {
+					return nil, nil
+				}
+				if ruleHealth.Updated == nil || latest.Timestamp.After(*ruleHealth.Updated) {
+					ruleHealth.Updated = latest.Timestamp
+				}
+				return latest.Maximum, nil
+			}
+			if ruleHealth.LatencySeconds, err = latest("ReplicationLatency"); err != nil {
+				return nil, err
+			}
+			if value, err := latest("OperationsPendingReplication"); err != nil {
+				return nil, err
+			} else if value != nil {
+				ruleHealth.PendingOperations = aws.Int64(int64(*value))
+			}
+			if value, err := latest("BytesPendingReplication"); err != nil {
+				return nil, err
+			} else if value != nil {
+				ruleHealth.PendingBytes = aws.Int64(int64(*value))
+			}
+			datapoints, err := provider.getMetric("OperationsFailedReplication", "Sum", Start, End, 3600, dimensions)
+			if err != nil {
+				return nil, err
+			}
+			var failed int64
+			for _, datapoint := range datapoints {
+				if datapoint.Sum != nil {
+					failed += int64(*datapoint.Sum)
+				}
+			}
+			ruleHealth.FailedOperations = aws.Int64(failed)
+			if failed > 0 || (ruleHealth.LatencySeconds != nil && *ruleHealth.LatencySeconds > MaxLatency) {
+				health.Healthy = false
+			}
+		}
+		health.Rules = append(health.Rules, ruleHealth)
+	}
+	return health, nil
+}
+
+// Starts a one time Macie classification job for the bucket, Macie must be enabled in the account
+// (and region of the bucket). Findings are available once the job completes, which may take a while
+// for large buckets.
+func (provider AWSInstanceS3Provider) Scan(Instance *Instance) (*ScanJob, error) {
+	provider = provider.forRegion(Instance.Region)
+	token, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	created := time.Now()
+	out, err := provider.macie.CreateClassificationJob(&macie2.CreateClassificationJobInput{
+		ClientToken: aws.String(token.String()),
+		JobType:     aws.String(macie2.JobTypeOneTime),
+		Name:        aws.String(Instance.Name + "-" + strconv.FormatInt(created.Unix(), 10)),
+		S3JobDefinition: &macie2.S3JobDefinition{
+			BucketDefinitions: []*macie2.S3BucketDefinitionForJob{
+				&macie2.S3BucketDefinitionForJob{
+					AccountId: aws.String(os.Getenv("AWS_ACCOUNT_ID")),
+					Buckets:   []*string{aws.String(Instance.Name)},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ScanJob{JobId: *out.JobId, Created: created}, nil
+}
+
+func (provider AWSInstanceS3Provider) GetFindings(Instance *Instance) (*FindingsSummary, error) {
+	provider = provider.forRegion(Instance.Region)
+	summary := FindingsSummary{BySeverity: make(map[string]int64), ByType: make(map[string]int64)}
+	for _, groupBy := range []string{macie2.GroupBySeverityDescription, macie2.GroupByType} {
+		out, err := provider.macie.GetFindingStatistics(&macie2.GetFindingStatisticsInput{
+			GroupBy: aws.String(groupBy),
+			FindingCriteria: &macie2.FindingCriteria{
+				Criterion: map[string]*macie2.CriterionAdditionalProperties{
+					"resourcesAffected.s3Bucket.name": &macie2.CriterionAdditionalProperties{
+						Eq: []*string{aws.String(Instance.Name)},
+					},
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range out.CountsByGroup {
+			if group.GroupKey == nil || group.Count == nil {
+				continue
+			}
+			if groupBy == macie2.GroupByType {
+				summary.ByType[*group.GroupKey] = *group.Count
+			} else {
+				summary.BySeverity[*group.GroupKey] = *group.Count
+				summary.Total = summary.Total + *group.Count
+			}
+		}
+	}
+	return &summary, nil
+}
+
+// Objects uploaded by other accounts (e.g., to a bucket shared across accounts, or before a bucket
+// was adopted) stay owned by the uploader, so the bucket's user can be denied access to them. The
+// ownership is transferred by an S3 Batch Operations job copying every object onto itself, the copy
+// is made by the broker's account so it owns the result. A copy onto itself must change something,
+// the server side encryption is set (to the plan's KMS key or AES256) for that.
+//
+// The manifest of objects and the report of objects that failed are written to S3_BATCH_BUCKET
+// (which must be in the bucket's region), the job runs as the role S3_BATCH_ROLE_ARN.
+func (provider AWSInstanceS3Provider) TransferOwnership(Instance *Instance) (*BatchJob, error) {
+	var settings S3Settings
+	if err := json.Unmarshal([]byte(Instance.Plan.providerPrivateDetails), &settings); err != nil {
+		return nil, err
+	}
+	operation := &s3control.S3CopyObjectOperation{
+		TargetResource:          aws.String(bucketARN(Instance.Name)),
+		MetadataDirective:       aws.String(s3control.S3MetadataDirectiveCopy),
+		CannedAccessControlList: aws.String(s3control.S3CannedAccessControlListBucketOwnerFullControl),
+		NewObjectMetadata:       &s3control.S3ObjectMetadata{SSEAlgorithm: aws.String(s3control.S3SSEAlgorithmAes256)},
+	}
+	if settings.Encrypted && settings.KMSKeyId != "" {
+		operation.NewObjectMetadata.SSEAlgorithm = aws.String(s3control.S3SSEAlgorithmKms)
+		operation.SSEAwsKmsKeyId = aws.String(settings.KMSKeyId)
+	}
+	return provider.startBatchJob(Instance, "", false, "ownership", "Transfer the ownership of the objects in "+Instance.Name, &s3control.JobOperation{S3PutObjectCopy: operation})
+}
+
+// Places (or removes) a legal hold on every version of the objects under the prefix, or in the whole
+// bucket if the prefix is empty. Legal holds are only possible on buckets created with object lock.
+func (provider AWSInstanceS3Provider) SetLegalHold(Instance *Instance, Prefix string, On bool) (*BatchJob, error) {
+	status := s3control.S3ObjectLockLegalHoldStatusOff
+	description := "Remove the legal hold on the objects in " + Instance.Name + "/" + Prefix
+	if On {
+		status = s3control.S3ObjectLockLegalHoldStatusOn
+		description = "Place a legal hold on the objects in " + Instance.Name + "/" + Prefix
+	}
+	return provider.startBatchJob(Instance, Prefix, true, "legal-hold", description, &s3control.JobOperation{
+		S3PutObjectLegalHold: &s3control.S3SetObjectLegalHoldOperation{
+			LegalHold: &s3control.S3ObjectLockLegalHold{Status: aws.String(status)},
+		},
+	})
+}
+
+// Starts a batch job running the operation on every object under the prefix (every version of them
+// with Versions, otherwise only the current one), the manifest and a report of the objects that
+// failed are kept in S3_BATCH_BUCKET under the kind of job and bucket.
+func (provider AWSInstanceS3Provider) startBatchJob(Instance *Instance, Prefix string, Versions bool, Kind string, Description string, Operation *s3control.JobOperation) (*BatchJob, error) {
+	if os.Getenv("S3_BATCH_BUCKET") == "" || os.Getenv("S3_BATCH_ROLE_ARN") == "" {
+		return nil, errors.New("Batch operations are not configured")
+	}
+	provider = provider.forRegion(Instance.Region)
+	created := time.Now()
+
+	// the manifest is streamed to S3 (in parts) as the bucket is listed rather than built in memory,
+	// buckets can have millions of objects. The SDK has no manifest generators to list them for us.
+	key := Kind + "/" + Instance.Name + "/" + strconv.FormatInt(created.Unix(), 10) + "/manifest.csv"
+	reader, writer := io.Pipe()
+	listed := make(chan error, 1)
+	var objects int64
+	fields := []*string{aws.String("Bucket"), aws.String("Key")}
+	if Versions {
+		fields = append(fields, aws.String(s3control.JobManifestFieldNameVersionId))
+	}
+	go func() {
+		var err, werr error
+		if Versions {
+			input := &s3.ListObjectVersionsInput{Bucket: aws.String(Instance.Name)}
+			if Prefix != "" {
+				input.Prefix = aws.String(Prefix)
+			}
+			err = provider.s3.ListObjectVersionsPages(input, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+				for _, version := range page.Versions {
+					if _, werr = io.WriteString(writer, Instance.Name+","+url.PathEscape(*version.Key)+","+aws.StringValue(version.VersionId)+"\n"); werr != nil {
+						return false
+					}
+					objects++
+				}
+				return true
+			})
+		} else {
+			input := &s3.ListObjectsV2Input{Bucket: aws.String(Instance.Name)}
+			if Prefix != "" {
+				input.Prefix = aws.String(Prefix)
+			}
+			err = provider.s3.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+				for _, object := range page.Contents {
+					if _, werr = io.WriteString(writer, Instance.Name+","+url.PathEscape(*object.Key)+"\n"); werr != nil {
+						return false
+					}
+					objects++
+				}
+				return true
+			})
+		}
+		if err == nil {
+			err = werr
+		}
+		writer.CloseWithError(err)
+		listed <- err
+	}()
+	_, err := s3manager.NewUploaderWithClient(provider.s3).Upload(&s3manager.UploadInput{
+		Bucket: aws.String(os.Getenv("S3_BATCH_BUCKET")),
+		Key:    aws.String(key),
+		Body:   reader,
+	})
+	// a failed upload stops the listing.
+	reader.Close()
+	if lerr := <-listed; lerr != nil && err == nil {
+		err = lerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if objects == 0 {
+		if _, err = provider.s3.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(os.Getenv("S3_BATCH_BUCKET")), Key: aws.String(key)}); err != nil {
+			glog.Errorf("Unable to remove the empty batch manifest %s: %s\n", key, err.Error())
+		}
+		return &BatchJob{Created: created, Status: s3control.JobStatusComplete}, nil
+	}
+	out, err := provider.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(os.Getenv("S3_BATCH_BUCKET")),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	job, err := provider.s3control.CreateJob(&s3control.CreateJobInput{
+		AccountId:            aws.String(os.Getenv("AWS_ACCOUNT_ID")),
+		ClientRequestToken:   aws.String(token.String()),
+		ConfirmationRequired: aws.Bool(false),
+		Description:          aws.String(Description),
+		Priority:             aws.Int64(10),
+		RoleArn:              aws.String(os.Getenv("S3_BATCH_ROLE_ARN")),
+		Manifest: &s3control.JobManifest{
+			Location: &s3control.JobManifestLocation{
+				ObjectArn: aws.String(objectARN(os.Getenv("S3_BATCH_BUCKET"), key)),
+				ETag:      aws.String(strings.Trim(aws.StringValue(out.ETag), "\"")),
+			},
+			Spec: &s3control.JobManifestSpec{
+				Format: aws.String(s3control.JobManifestFormatS3batchOperationsCsv20180820),
+				Fields: fields,
+			},
+		},
+		Operation: Operation,
+		Report: &s3control.JobReport{
+			Bucket:      aws.String(bucketARN(os.Getenv("S3_BATCH_BUCKET"))),
+			Enabled:     aws.Bool(true),
+			Format:      aws.String(s3control.JobReportFormatReportCsv20180820),
+			Prefix:      aws.String(Kind + "/" + Instance.Name),
+			ReportScope: aws.String(s3control.JobReportScopeFailedTasksOnly),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BatchJob{JobId: *job.JobId, Created: created, Status: s3control.JobStatusNew, Objects: objects}, nil
+}
+
+func (provider AWSInstanceS3Provider) GetBatchJob(Instance *Instance, JobId string) (*BatchJob, error) {
+	provider = provider.forRegion(Instance.Region)
+	out, err := provider.s3control.DescribeJob(&s3control.DescribeJobInput{
+		AccountId: aws.String(os.Getenv("AWS_ACCOUNT_ID")),
+		JobId:     aws.String(JobId),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3control.ErrCodeNotFoundException {
+		return nil, errors.New("Not found")
+	} else if err != nil {
+		return nil, err
+	}
+	job := &BatchJob{
+		JobId:   JobId,
+		Created: aws.TimeValue(out.Job.CreationTime),
+		Status:  aws.StringValue(out.Job.Status),
+	}
+	if out.Job.ProgressSummary != nil {
+		job.Objects = aws.Int64Value(out.Job.ProgressSummary.TotalNumberOfTasks)
+		job.Succeeded = aws.Int64Value(out.Job.ProgressSummary.NumberOfTasksSucceeded)
+		job.Failed = aws.Int64Value(out.Job.ProgressSummary.NumberOfTasksFailed)
+	}
+	return job, nil
+}
+
+// Terraform identifiers may only contain letters, digits, underscores and dashes and can't start
+// with a digit, dashes are replaced as well so names match the underscored names Terraform users
+// usually write.
+var terraformInvalid = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func terraformName(name string) string {
+	id := terraformInvalid.ReplaceAllString(name, "_")
+	if id == "" || (id[0] >= '0' && id[0] <= '9') {
+		id = "bucket_" + id
+	}
+	return id
+}
+
+// Quotes a string for HCL, interpolation sequences are escaped so they're kept literally.
+func hclString(value string) string {
+	quoted := strconv.Quote(value)
+	quoted = strings.Replace(quoted, "${", "$${", -1)
+	return strings.Replace(quoted, "%{", "%%{", -1)
+}
+
+func writeTerraformImport(hcl *strings.Builder, resource string, id string) {
+	hcl.WriteString("import {\n  to = " + resource + "\n  id = " + hclString(id) + "\n}\n\n")
+}
+
+func writeTerraformPolicy(hcl *strings.Builder, policy interface{}) error {
+	document, err := json.MarshalIndent(policy, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	hcl.WriteString("  policy = jsonencode(" + strings.Replace(strings.Replace(string(document), "${", "$${", -1), "%{", "%%{", -1) + ")\n")
+	return nil
+}
+
+// ExportTerraform describes the bucket, its configuration, its user and policies as Terraform
+// resources with import blocks (Terraform 1.5 or later), so they can be managed by Terraform without
+// recreating the bucket. Access keys can't be imported (the secret isn't readable), the current key
+// keeps working until it's removed.
+func (provider AWSInstanceS3Provider) ExportTerraform(Instance *Instance) (string, error) {
+	var settings S3Settings
+	if err := json.Unmarshal([]byte(Instance.Plan.providerPrivateDetails), &settings); err != nil {
+		return "", err
+	}
+	config, err := provider.GetConfiguration(Instance)
+	if err != nil {
+		return "", err
+	}
+	lifecycle, err := provider.GetLifecycle(Instance)
+	if err != nil {
+		return "", err
+	}
+	policies, err := provider.GetPolicies(Instance)
+	if err != nil {
+		return "", err
+	}
+	policyARN, err := provider.GetPolicyARN(Instance.Name)
+	if err != nil {
+		return "", err
+	}
+	provider = provider.forRegion(Instance.Region)
+	tags, err := provider.GetTags(Instance.Name)
+	if err != nil {
+		return "", err
+	}
+
+	id := terraformName(Instance.Name)
+	bucket := "aws_s3_bucket." + id
+	var hcl strings.Builder
+	hcl.WriteString("# Bucket " + Instance.Name + " (instance " + Instance.Id + ") in region " + provider.region + ", exported from the s3 broker.\n")
+	hcl.WriteString("# Run terraform plan to confirm there are no changes before applying, then remove the instance from\n")
+	hcl.WriteString("# the broker without deprovisioning it so the broker no longer manages the bucket.\n\n")
+
+	writeTerraformImport(&hcl, bucket, Instance.Name)
+	hcl.WriteString("resource \"aws_s3_bucket\" \"" + id + "\" {\n  bucket = " + hclString(Instance.Name) + "\n")
+	if len(tags) > 0 {
+		hcl.WriteString("  tags = {\n")
+		for _, tag := range tags {
+			hcl.WriteString("    " + hclString(aws.StringValue(tag.Key)) + " = " + hclString(aws.StringValue(tag.Value)) + "\n")
+		}
+		hcl.WriteString("  }\n")
+	}
+	hcl.WriteString("}\n\n")
+
+	if config.Versioning != "Disabled" {
+		writeTerraformImport(&hcl, "aws_s3_bucket_versioning."+id, Instance.Name)
+		hcl.WriteString("resource \"aws_s3_bucket_versioning\" \"" + id + "\" {\n  bucket = " + bucket + ".id\n")
+		hcl.WriteString("  versioning_configuration {\n    status = " + hclString(config.Versioning) + "\n  }\n}\n\n")
+	}
+
+	if config.Encryption != "none" {
+		writeTerraformImport(&hcl, "aws_s3_bucket_server_side_encryption_configuration."+id, Instance.Name)
+		hcl.WriteString("resource \"aws_s3_bucket_server_side_encryption_configuration\" \"" + id + "\" {\n  bucket = " + bucket + ".id\n")
+		hcl.WriteString("  rule {\n    apply_server_side_encryption_by_default {\n      sse_algorithm = " + hclString(config.Encryption) + "\n")
+		if config.KMSKeyId != "" {
+			hcl.WriteString("      kms_master_key_id = " + hclString(config.KMSKeyId) + "\n")
+		}
+		hcl.WriteString("    }\n  }\n}\n\n")
+	}
+
+	if len(lifecycle.Rules) > 0 {
+		writeTerraformImport(&hcl, "aws_s3_bucket_lifecycle_configuration."+id, Instance.Name)
+		hcl.WriteString("resource \"aws_s3_bucket_lifecycle_configuration\" \"" + id + "\" {\n  bucket = " + bucket + ".id\n")
+		for _, rule := range lifecycle.Rules {
+			hcl.WriteString("  rule {\n    id     = " + hclString(aws.StringValue(rule.ID)) + "\n    status = " + hclString(aws.StringValue(rule.Status)) + "\n")
+			prefix := aws.StringValue(rule.Prefix)
+			if rule.Filter != nil && rule.Filter.Prefix != nil {
+				prefix = *rule.Filter.Prefix
+			}
+			if rule.Filter != nil && (rule.Filter.Tag != nil || rule.Filter.And != nil) {
+				hcl.WriteString("    # the rule's tag filter is not exported, add it before applying.\n")
+			}
+			hcl.WriteString("    filter {\n      prefix = " + hclString(prefix) + "\n    }\n")
+			if rule.Expiration != nil && rule.Expiration.Days != nil {
+				hcl.WriteString("    expiration {\n      days = " + strconv.FormatInt(*rule.Expiration.Days, 10) + "\n    }\n")
+			}
+			for _, transition := range rule.Transitions {
+				if transition.Days != nil {
+					hcl.WriteString("    transition {\n      days          = " + strconv.FormatInt(*transition.Days, 10) + "\n      storage_class = " + hclString(aws.StringValue(transition.StorageClass)) + "\n    }\n")
+				}
+			}
+			if rule.NoncurrentVersionExpiration != nil && rule.NoncurrentVersionExpiration.NoncurrentDays != nil {
+				hcl.WriteString("    noncurrent_version_expiration {\n      noncurrent_days = " + strconv.FormatInt(*rule.NoncurrentVersionExpiration.NoncurrentDays, 10) + "\n    }\n")
+			}
+			for _, transition := range rule.NoncurrentVersionTransitions {
+				if transition.NoncurrentDays != nil {
+					hcl.WriteString("    noncurrent_version_transition {\n      noncurrent_days = " + strconv.FormatInt(*transition.NoncurrentDays, 10) + "\n      storage_class   = " + hclString(aws.StringValue(transition.StorageClass)) + "\n    }\n")
+				}
+			}
+			if rule.AbortIncompleteMultipartUpload != nil && rule.AbortIncompleteMultipartUpload.DaysAfterInitiation != nil {
+				hcl.WriteString("    abort_incomplete_multipart_upload {\n      days_after_initiation = " + strconv.FormatInt(*rule.AbortIncompleteMultipartUpload.DaysAfterInitiation, 10) + "\n    }\n")
+			}
+			hcl.WriteString("  }\n")
+		}
+		hcl.WriteString("}\n\n")
+	}
+
+	if policies.BucketPolicy != nil {
+		writeTerraformImport(&hcl, "aws_s3_bucket_policy."+id, Instance.Name)
+		hcl.WriteString("resource \"aws_s3_bucket_policy\" \"" + id + "\" {\n  bucket = " + bucket + ".id\n")
+		if err = writeTerraformPolicy(&hcl, policies.BucketPolicy); err != nil {
+			return "", err
+		}
+		hcl.WriteString("}\n\n")
+	}
+
+	writeTerraformImport(&hcl, "aws_iam_user."+id, Instance.Name)
+	hcl.WriteString("resource \"aws_iam_user\" \"" + id + "\" {\n  name = " + hclString(Instance.Name) + "\n}\n\n")
+
+	writeTerraformImport(&hcl, "aws_iam_policy."+id, *policyARN)
+	hcl.WriteString("resource \"aws_iam_policy\" \"" + id + "\" {\n  name = " + hclString((*policyARN)[strings.LastIndex(*policyARN, "/")+1:]) + "\n")
+	if err = writeTerraformPolicy(&hcl, policies.UserPolicy); err != nil {
+		return "", err
+	}
+	hcl.WriteString("}\n\n")
+
+	writeTerraformImport(&hcl, "aws_iam_user_policy_attachment."+id, Instance.Name+"/"+*policyARN)
+	hcl.WriteString("resource \"aws_iam_user_policy_attachment\" \"" + id + "\" {\n  user       = aws_iam_user." + id + ".name\n  policy_arn = aws_iam_policy." + id + ".arn\n}\n")
+	return hcl.String(), nil
+}
+
+// Creates each folder as a zero-byte object (its key ending in a slash), so tools that list the
+// bucket by delimiter show the folders before anything is stored in them.
+func (provider AWSInstanceS3Provider) CreateFolders(Instance *Instance, Folders []string) error {
+	provider = provider.forRegion(Instance.Region)
+	for _, folder := range Folders {
+		_, err := provider.s3.PutObject(&s3.PutObjectInput{
+			Bucket:        aws.String(Instance.Name),
+			Key:           aws.String(folder),
+			Body:          strings.NewReader(""),
+			ContentLength: aws.Int64(0),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies up to Limit objects from the source (a bucket and prefix, see SplitSeedSource) into the
+// bucket in key order, starting after the key StartAfter. The source is listed in the default
+// region, objects are copied without the source's prefix.
+func (provider AWSInstanceS3Provider) Seed(Instance *Instance, Source string, StartAfter string, Limit int64) (*SeedProgress, error) {
+	bucket, prefix := SplitSeedSource(Source)
+	sourceClient := provider.s3
+	provider = provider.forRegion(Instance.Region)
+	progress := &SeedProgress{StartAfter: StartAfter, Done: true}
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)}
+	if StartAfter != "" {
+		input.StartAfter = aws.String(StartAfter)
+	}
+	var copyErr error = nil
+	err := sourceClient.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if obj == nil || obj.Key == nil {
+				continue
+			}
+			if progress.Objects >= Limit {
+				progress.Done = false
+				return false
+			}
+			// the prefix's own key (a folder marker) has no name in the bucket, a prefix without a
+			// trailing slash leaves one on the keys under it.
+			key := strings.TrimPrefix(*obj.Key, prefix)
+			if !strings.HasSuffix(prefix, "/") {
+				key = strings.TrimPrefix(key, "/")
+			}
+			if key == "" {
+				progress.StartAfter = *obj.Key
+				continue
+			}
+			copyErr = copyObject(provider.s3, Instance.Name, key, bucket, *obj.Key, aws.Int64Value(obj.Size))
+			if copyErr != nil {
+				return false
+			}
+			progress.StartAfter = *obj.Key
+			progress.Objects++
+			progress.Bytes = progress.Bytes + aws.Int64Value(obj.Size)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if copyErr != nil {
+		return nil, copyErr
+	}
+	return progress, nil
+}
@@ -0,0 +1,406 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	uuid "github.com/nu7hatch/gouuid"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeSettings are read from the provider_private_details of plans using the fake provider. Delay
+// is how long each operation takes (e.g., "5s") and FailureRate is the chance (0 to 1) that any
+// operation fails.
+type FakeSettings struct {
+	Delay       string  `json:"delay,omitempty"`
+	FailureRate float64 `json:"failure_rate,omitempty"`
+	CredentialSettings
+}
+
+func ValidateFakeSettings(details string) []string {
+	problems := make([]string, 0)
+	var settings FakeSettings
+	decoder := json.NewDecoder(strings.NewReader(details))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&settings); err != nil {
+		return append(problems, "The settings are not valid: "+err.Error())
+	}
+	if settings.Delay != "" {
+		if _, err := time.ParseDuration(settings.Delay); err != nil {
+			problems = append(problems, "The delay is not a valid duration: "+err.Error())
+		}
+	}
+	if settings.FailureRate < 0 || settings.FailureRate > 1 {
+		problems = append(problems, "The failure_rate must be between 0 and 1.")
+	}
+	return append(problems, ValidateCredentialSettings(settings.CredentialSettings)...)
+}
+
+// FakeInstanceProvider simulates buckets without talking to AWS so the broker (preprovisioning,
+// tasks and webhooks) can be run locally. Nothing is created, every instance with the name prefix
+// exists and only lifecycle rules are remembered (in memory, per process).
+type FakeInstanceProvider struct {
+	Provider
+	namePrefix string
+	lifecycles *sync.Map
+}
+
+func NewFakeInstanceProvider(namePrefix string) (*FakeInstanceProvider, error) {
+	glog.Warningf("The fake provider is in use, buckets will not actually be created.\n")
+	return &FakeInstanceProvider{
+		namePrefix: namePrefix,
+		lifecycles: &sync.Map{},
+	}, nil
+}
+
+func (provider FakeInstanceProvider) simulate(plan *ProviderPlan, operation string) error {
+	var settings FakeSettings
+	if plan != nil && plan.providerPrivateDetails != "" {
+		if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &settings); err != nil {
+			return err
+		}
+	}
+	if settings.Delay != "" {
+		delay, err := time.ParseDuration(settings.Delay)
+		if err != nil {
+			return err
+		}
+		time.Sleep(delay)
+	}
+	if settings.FailureRate > 0 && rand.Float64() < settings.FailureRate {
+		return errors.New("The fake provider failed to " + operation + " (simulated failure).")
+	}
+	return nil
+}
+
+func (provider FakeInstanceProvider) newInstance(name string, plan *ProviderPlan) *Instance {
+	return &Instance{
+		Id:            "",
+		Name:          name,
+		ProviderId:    "arn:fake:iam::000000000000:user/" + name,
+		Plan:          plan,
+		Username:      "",
+		Password:      "",
+		Endpoint:      "",
+		Status:        "available",
+		Ready:         true,
+		Engine:        "s3",
+		EngineVersion: "fake-1",
+		Scheme:        "s3",
+	}
+}
+
+func (provider FakeInstanceProvider) newUser(name string) *User {
+	accessKey, _ := uuid.NewV4()
+	secretKey, _ := uuid.NewV4()
+	return &User{
+		ARN:             "arn:fake:iam::000000000000:user/" + name,
+		UserName:        name,
+		AccessKeyId:     "FAKE" + strings.ToUpper(strings.Replace(accessKey.String(), "-", "", -1))[0:16],
+		SecretAccessKey: strings.Replace(secretKey.String(), "-", "", -1),
+	}
+}
+
+func (provider FakeInstanceProvider) GetInstance(name string, plan *ProviderPlan) (*Instance, error) {
+	if !strings.HasPrefix(name, provider.namePrefix) {
+		return nil, errors.New("Not found")
+	}
+	return provider.newInstance(name, plan), nil
+}
+
+func (provider FakeInstanceProvider) Provision(Id string, plan *ProviderPlan, Owner string, Region string) (*Instance, error) {
+	if err := provider.simulate(plan, "provision"); err != nil {
+		return nil, err
+	}
+	id, _ := uuid.NewV4()
+	name := provider.namePrefix + "-u" + (strings.Split(id.String(), "-")[0])
+	user := provider.newUser(name)
+	instance := provider.newInstance(name, plan)
+	instance.Id = Id
+	instance.Username = user.AccessKeyId
+	instance.Password = user.SecretAccessKey
+	instance.Endpoint = name + ".s3.localhost"
+	instance.Region = Region
+	return instance, nil
+}
+
+func (provider FakeInstanceProvider) ResumeProvision(Id string, plan *ProviderPlan, progress *ProvisionProgress) (*Instance, error) {
+	instance, err := provider.Provision(Id, plan, progress.Owner, progress.Region)
+	if err != nil {
+		return nil, err
+	}
+	progress.Step = ProvisionStepDone
+	progress.Name = instance.Name
+	return instance, nil
+}
+
+func (provider FakeInstanceProvider) RollbackProvision(plan *ProviderPlan, progress *ProvisionProgress) error {
+	return nil
+}
+
+func (provider FakeInstanceProvider) Adopt(Name string, plan *ProviderPlan) (*Instance, map[string]string, error) {
+	instance, err := provider.GetInstance(Name, plan)
+	if err != nil {
+		return nil, nil, err
+	}
+	instance.Endpoint = Name + ".s3.localhost"
+	return instance, map[string]string{}, nil
+}
+
+func (provider FakeInstanceProvider) ValidateDeprovision(Instance *Instance) error {
+	return nil
+}
+
+func (provider FakeInstanceProvider) Deprovision(Instance *Instance, takeSnapshot bool) error {
+	if err := provider.simulate(Instance.Plan, "deprovision"); err != nil {
+		return err
+	}
+	provider.lifecycles.Delete(Instance.Name)
+	return nil
+}
+
+func (provider FakeInstanceProvider) Modify(Instance *Instance, plan *ProviderPlan) (*Instance, error) {
+	return nil, errors.New("S3 buckets cannot be modified, only created or destroyed.")
+}
+
+func (provider FakeInstanceProvider) Tag(Instance *Instance, Name string, Value string) error {
+	return provider.simulate(Instance.Plan, "tag")
+}
+
+func (provider FakeInstanceProvider) Untag(Instance *Instance, Name string) error {
+	return provider.simulate(Instance.Plan, "untag")
+}
+
+func (provider FakeInstanceProvider) PerformPostProvision(db *Instance) (*Instance, error) {
+	return db, nil
+}
+
+func (provider FakeInstanceProvider) PerformPostClaim(db *Instance, Owner string) (*Instance, error) {
+	if err := provider.simulate(db.Plan, "claim"); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (provider FakeInstanceProvider) GetUrl(instance *Instance) map[string]interface{} {
+	region := instance.Region
+	if region == "" {
+		region = "fake"
+	}
+	return map[string]interface{}{
+		"S3_BUCKET":     instance.Name,
+		"S3_LOCATION":   instance.Endpoint,
+		"S3_ACCESS_KEY": instance.Username,
+		"S3_SECRET_KEY": instance.Password,
+		"S3_REGION":     region,
+	}
+}
+
+func (provider FakeInstanceProvider) RotateCredentials(Instance *Instance) (*User, error) {
+	if err := provider.simulate(Instance.Plan, "rotate credentials"); err != nil {
+		return nil, err
+	}
+	return provider.newUser(Instance.Name), nil
+}
+
+func (provider FakeInstanceProvider) AddAccessKey(Instance *Instance) (*User, error) {
+	if err := provider.simulate(Instance.Plan, "add an access key"); err != nil {
+		return nil, err
+	}
+	return provider.newUser(Instance.Name), nil
+}
+
+// The fake provider doesn't remember when keys were created, they're always reported as new.
+func (provider FakeInstanceProvider) GetAccessKeys(Instance *Instance) ([]AccessKey, error) {
+	if err := provider.simulate(Instance.Plan, "list access keys"); err != nil {
+		return nil, err
+	}
+	return []AccessKey{AccessKey{AccessKeyId: Instance.Username, Status: "Active", Created: time.Now()}}, nil
+}
+
+func (provider FakeInstanceProvider) RemoveAccessKey(Instance *Instance, AccessKeyId string) error {
+	return provider.simulate(Instance.Plan, "remove an access key")
+}
+
+func (provider FakeInstanceProvider) SetAccessKeyStatus(Instance *Instance, AccessKeyId string, Active bool) error {
+	return provider.simulate(Instance.Plan, "set the status of an access key")
+}
+
+func (provider FakeInstanceProvider) HealthCheck() error {
+	return nil
+}
+
+func (provider FakeInstanceProvider) Purge(Instance *Instance) error {
+	return provider.simulate(Instance.Plan, "purge")
+}
+
+func (provider FakeInstanceProvider) GetPolicies(Instance *Instance) (*Policies, error) {
+	return &Policies{
+		BucketPolicy: map[string]interface{}{},
+		UserPolicy:   map[string]interface{}{},
+	}, nil
+}
+
+func (provider FakeInstanceProvider) TemporaryCredentials(Instance *Instance, Options *TemporaryCredentialsOptions) (*TemporaryCredentials, error) {
+	if err := provider.simulate(Instance.Plan, "issue temporary credentials"); err != nil {
+		return nil, err
+	}
+	user := provider.newUser(Instance.Name)
+	token, _ := uuid.NewV4()
+	return &TemporaryCredentials{
+		AccessKeyId:     user.AccessKeyId,
+		SecretAccessKey: user.SecretAccessKey,
+		SessionToken:    token.String(),
+		Expiration:      time.Now().Add(time.Duration(Options.Duration) * time.Second),
+		Bucket:          Instance.Name,
+		Prefix:          Options.Prefix,
+		ReadOnly:        Options.ReadOnly,
+	}, nil
+}
+
+func (provider FakeInstanceProvider) GetLifecycle(Instance *Instance) (*LifecycleConfiguration, error) {
+	if lifecycle, ok := provider.lifecycles.Load(Instance.Name); ok {
+		return lifecycle.(*LifecycleConfiguration), nil
+	}
+	return &LifecycleConfiguration{Rules: make([]*s3.LifecycleRule, 0)}, nil
+}
+
+func (provider FakeInstanceProvider) SetLifecycle(Instance *Instance, Lifecycle *LifecycleConfiguration) error {
+	if err := provider.simulate(Instance.Plan, "set the lifecycle"); err != nil {
+		return err
+	}
+	if len(Lifecycle.Rules) == 0 {
+		provider.lifecycles.Delete(Instance.Name)
+		return nil
+	}
+	provider.lifecycles.Store(Instance.Name, Lifecycle)
+	return nil
+}
+
+func (provider FakeInstanceProvider) BlockWrites(Instance *Instance, Blocked bool) error {
+	return provider.simulate(Instance.Plan, "block writes")
+}
+
+func (provider FakeInstanceProvider) Freeze(Instance *Instance, Frozen bool, BucketPolicy bool) error {
+	if Frozen {
+		return provider.simulate(Instance.Plan, "freeze")
+	}
+	return provider.simulate(Instance.Plan, "unfreeze")
+}
+
+func (provider FakeInstanceProvider) GetBucketPolicyDocument(Instance *Instance) (string, error) {
+	if err := provider.simulate(Instance.Plan, "get bucket policy"); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+func (provider FakeInstanceProvider) PutBucketPolicyDocument(Instance *Instance, Policy string) error {
+	return provider.simulate(Instance.Plan, "put bucket policy")
+}
+
+func (provider FakeInstanceProvider) UpdateInstanceSettings(Instance *Instance, Settings *InstanceSettings) error {
+	if Settings.Lifecycle != nil {
+		return provider.SetLifecycle(Instance, Settings.Lifecycle)
+	}
+	return provider.simulate(Instance.Plan, "update settings")
+}
+
+func (provider FakeInstanceProvider) Backup(Instance *Instance, BackupId string) (*Backup, error) {
+	if err := provider.simulate(Instance.Plan, "backup"); err != nil {
+		return nil, err
+	}
+	return &Backup{Id: BackupId, InstanceId: Instance.Id, Name: Instance.Name}, nil
+}
+
+func (provider FakeInstanceProvider) ReadObjects(Instance *Instance, Read func(string, io.Reader) error) error {
+	return provider.simulate(Instance.Plan, "read objects")
+}
+
+func (provider FakeInstanceProvider) WriteObject(Instance *Instance, Key string, Body io.Reader) error {
+	return provider.simulate(Instance.Plan, "write object")
+}
+
+func (provider FakeInstanceProvider) GetRestorePoints(Instance *Instance) ([]RestorePoint, error) {
+	return make([]RestorePoint, 0), nil
+}
+
+func (provider FakeInstanceProvider) Restore(Instance *Instance, BackupId string, SourceName string) error {
+	return provider.simulate(Instance.Plan, "restore")
+}
+
+func (provider FakeInstanceProvider) VerifyRestore(Instance *Instance, BackupId string, SourceName string) (*RestoreVerification, error) {
+	return &RestoreVerification{Backup: BackupId, Verified: true, Created: time.Now()}, nil
+}
+
+func (provider FakeInstanceProvider) GetConfiguration(Instance *Instance) (*BucketConfiguration, error) {
+	return &BucketConfiguration{Versioning: "Disabled", Encryption: "none", Drift: make([]string, 0)}, nil
+}
+
+func (provider FakeInstanceProvider) ExportTerraform(Instance *Instance) (string, error) {
+	return "# " + Instance.Name + " is a fake bucket, there is nothing to import.\n", nil
+}
+
+func (provider FakeInstanceProvider) Scan(Instance *Instance) (*ScanJob, error) {
+	if err := provider.simulate(Instance.Plan, "scan"); err != nil {
+		return nil, err
+	}
+	id, _ := uuid.NewV4()
+	return &ScanJob{JobId: strings.Replace(id.String(), "-", "", -1), Created: time.Now()}, nil
+}
+
+func (provider FakeInstanceProvider) GetFindings(Instance *Instance) (*FindingsSummary, error) {
+	return &FindingsSummary{BySeverity: map[string]int64{}, ByType: map[string]int64{}}, nil
+}
+
+func (provider FakeInstanceProvider) GetReplicationHealth(Instance *Instance, MaxLatency float64) (*ReplicationHealth, error) {
+	if err := provider.simulate(Instance.Plan, "get replication health"); err != nil {
+		return nil, err
+	}
+	return &ReplicationHealth{MaxLatencySeconds: MaxLatency, Rules: make([]ReplicationRuleHealth, 0)}, nil
+}
+
+func (provider FakeInstanceProvider) GetUsage(Instance *Instance, Start time.Time, End time.Time) (*Usage, error) {
+	if err := provider.simulate(Instance.Plan, "get usage"); err != nil {
+		return nil, err
+	}
+	return &Usage{Resource: Instance.Id, Start: Start, End: End}, nil
+}
+
+func (provider FakeInstanceProvider) TransferOwnership(Instance *Instance) (*BatchJob, error) {
+	return &BatchJob{JobId: "fake-" + Instance.Name, Created: time.Now(), Status: "Complete"}, nil
+}
+
+func (provider FakeInstanceProvider) SetLegalHold(Instance *Instance, Prefix string, On bool) (*BatchJob, error) {
+	if err := provider.simulate(Instance.Plan, "set legal hold"); err != nil {
+		return nil, err
+	}
+	return &BatchJob{JobId: "fake-legal-hold-" + Instance.Name, Created: time.Now(), Status: "Complete"}, nil
+}
+
+func (provider FakeInstanceProvider) GetBatchJob(Instance *Instance, JobId string) (*BatchJob, error) {
+	return &BatchJob{JobId: JobId, Created: time.Now(), Status: "Complete"}, nil
+}
+
+func (provider FakeInstanceProvider) CreateFolders(Instance *Instance, Folders []string) error {
+	return provider.simulate(Instance.Plan, "create-folders")
+}
+
+func (provider FakeInstanceProvider) Seed(Instance *Instance, Source string, StartAfter string, Limit int64) (*SeedProgress, error) {
+	if err := provider.simulate(Instance.Plan, "seed"); err != nil {
+		return nil, err
+	}
+	return &SeedProgress{StartAfter: StartAfter, Done: true}, nil
+}
+
+func (provider FakeInstanceProvider) CreateInstanceRole(Instance *Instance, TemplateRoleARN string) (string, error) {
+	if err := provider.simulate(Instance.Plan, "create the instance role"); err != nil {
+		return "", err
+	}
+	return "arn:aws:iam::000000000000:role/" + Instance.Name, nil
+}
@@ -1,7 +1,15 @@
 package broker
 
 import (
+	"encoding/json"
 	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 )
 
@@ -9,12 +17,28 @@ type Providers string
 
 const (
 	AWSS3Instance   		Providers = "aws-s3"
+	FakeInstance   			Providers = "fake"
 	Unknown        			Providers = "unknown"
 )
 
+// The upgrade matrix, the pairs of providers a bucket can be moved between by changing its plan.
+// PROVIDER_CHANGES lists them as from:to pairs (e.g., "aws-s3:fake"), none are allowed by default.
+// The worker copies the objects to a new bucket, so both providers must be able to read and write
+// objects.
+func CanChangeProviders(From Providers, To Providers) bool {
+	for _, pair := range splitList(os.Getenv("PROVIDER_CHANGES")) {
+		if pair == string(From)+":"+string(To) {
+			return true
+		}
+	}
+	return false
+}
+
 func GetProvidersFromString(str string) Providers {
 	if str == "aws-s3" {
 		return AWSS3Instance
+	} else if str == "fake" {
+		return FakeInstance
 	}
 	return Unknown
 }
@@ -27,22 +51,500 @@ type ProviderPlan struct {
 	Scheme                 string    `json:"scheme"`
 }
 
+// ValidatePlanSettings returns the problems with the provider_private_details of the plan, it does
+// not need (or create) the plan's provider.
+func ValidatePlanSettings(plan *ProviderPlan) []string {
+	if plan.Provider == AWSS3Instance {
+		return append(append(append(append(append(ValidateS3Settings(plan.providerPrivateDetails), ValidateS3Attributes(plan)...), ValidateQuotaAttributes(plan)...), ValidateAccessKeyAttributes(plan)...), ValidateSeedAttributes(plan)...), ValidateExpiryAttributes(plan)...)
+	} else if plan.Provider == FakeInstance {
+		return append(append(append(append(ValidateFakeSettings(plan.providerPrivateDetails), ValidateQuotaAttributes(plan)...), ValidateAccessKeyAttributes(plan)...), ValidateSeedAttributes(plan)...), ValidateExpiryAttributes(plan)...)
+	}
+	return []string{"The plan's provider is unknown."}
+}
+
+// Reads the folders provision parameter, a list of key prefixes to create in the new bucket (at most
+// 100). Each is returned ending with a slash along with its parents, e.g., "a/b" creates "a/" and
+// "a/b/".
+func ParseFolders(parameters map[string]interface{}) ([]string, error) {
+	value, ok := parameters["folders"]
+	if !ok || value == nil {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("The folders must be a list of key prefixes.")
+	}
+	if len(list) > 100 {
+		return nil, errors.New("At most 100 folders can be created.")
+	}
+	seen := make(map[string]bool)
+	folders := make([]string, 0)
+	for _, item := range list {
+		folder, ok := item.(string)
+		if !ok || strings.Trim(folder, "/") == "" {
+			return nil, errors.New("Each folder must be a non-empty key prefix.")
+		}
+		if strings.HasPrefix(folder, "/") || strings.Contains(folder, "//") || len(folder) > 1000 {
+			return nil, errors.New("The folder " + folder + " is not a valid key prefix.")
+		}
+		parts := strings.Split(strings.TrimSuffix(folder, "/"), "/")
+		for i := range parts {
+			prefix := strings.Join(parts[:i+1], "/") + "/"
+			if !seen[prefix] {
+				seen[prefix] = true
+				folders = append(folders, prefix)
+			}
+		}
+	}
+	return folders, nil
+}
+
+// Whether buckets on the plan can be created in the region (empty is the default region), the
+// provider checks this again when it provisions.
+func PlanAllowsRegion(plan *ProviderPlan, region string) bool {
+	if region == "" || plan.Provider != AWSS3Instance {
+		return true
+	}
+	var settings S3Settings
+	if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &settings); err != nil {
+		return false
+	}
+	if region == settings.Region || (settings.Region == "" && region == os.Getenv("AWS_REGION")) {
+		return true
+	}
+	for _, allowed := range settings.Regions {
+		if allowed == region {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether buckets on the plan are created with object lock, so legal holds can be placed on them.
+func PlanHasObjectLock(plan *ProviderPlan) bool {
+	var settings struct {
+		ObjectLock bool `json:"objectLock"`
+	}
+	if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &settings); err != nil {
+		return false
+	}
+	return settings.ObjectLock
+}
+
+// AccessKey is an access key of a bucket's user, LastUsed is nil if the key has never been used
+// (IAM only tracks use since April 2015).
+type AccessKey struct {
+	AccessKeyId     string     `json:"access_key_id"`
+	Status          string     `json:"status"`
+	Created         time.Time  `json:"created"`
+	LastUsed        *time.Time `json:"last_used,omitempty"`
+	LastUsedService string     `json:"last_used_service,omitempty"`
+	LastUsedRegion  string     `json:"last_used_region,omitempty"`
+}
+
+// The number of days since the key was last used, or created if it never has been. A key that has
+// been reactivated is idle from its reactivation (if that's later).
+func (key AccessKey) IdleDays(now time.Time, reactivated *time.Time) int64 {
+	since := key.Created
+	if key.LastUsed != nil {
+		since = *key.LastUsed
+	}
+	if reactivated != nil && reactivated.After(since) {
+		since = *reactivated
+	}
+	return int64(now.Sub(since).Hours() / 24)
+}
+
 type Provider interface {
 	GetInstance(string, *ProviderPlan) (*Instance, error)
-	Provision(string, *ProviderPlan, string) (*Instance, error)
+	Provision(string, *ProviderPlan, string, string) (*Instance, error)
+	ResumeProvision(string, *ProviderPlan, *ProvisionProgress) (*Instance, error)
+	RollbackProvision(*ProviderPlan, *ProvisionProgress) error
 	Deprovision(*Instance, bool) error
+	ValidateDeprovision(*Instance) error
 	Modify(*Instance, *ProviderPlan) (*Instance, error)
 	Tag(*Instance, string, string) error
 	Untag(*Instance, string) error
 	PerformPostProvision(*Instance) (*Instance, error)
+	PerformPostClaim(*Instance, string) (*Instance, error)
+	UpdateInstanceSettings(*Instance, *InstanceSettings) error
+	Adopt(string, *ProviderPlan) (*Instance, map[string]string, error)
 	GetUrl(*Instance) map[string]interface{}
 	RotateCredentials(*Instance) (*User, error)
+	AddAccessKey(*Instance) (*User, error)
+	GetAccessKeys(*Instance) ([]AccessKey, error)
+	RemoveAccessKey(*Instance, string) error
+	SetAccessKeyStatus(*Instance, string, bool) error
+	Purge(*Instance) error
+	GetPolicies(*Instance) (*Policies, error)
+	TemporaryCredentials(*Instance, *TemporaryCredentialsOptions) (*TemporaryCredentials, error)
+	GetLifecycle(*Instance) (*LifecycleConfiguration, error)
+	GetConfiguration(*Instance) (*BucketConfiguration, error)
+	ExportTerraform(*Instance) (string, error)
+	SetLifecycle(*Instance, *LifecycleConfiguration) error
+	BlockWrites(*Instance, bool) error
+	Freeze(*Instance, bool, bool) error
+	GetBucketPolicyDocument(*Instance) (string, error)
+	PutBucketPolicyDocument(*Instance, string) error
+	Backup(*Instance, string) (*Backup, error)
+	ReadObjects(*Instance, func(string, io.Reader) error) error
+	WriteObject(*Instance, string, io.Reader) error
+	GetRestorePoints(*Instance) ([]RestorePoint, error)
+	Restore(*Instance, string, string) error
+	VerifyRestore(*Instance, string, string) (*RestoreVerification, error)
+	GetUsage(*Instance, time.Time, time.Time) (*Usage, error)
+	Scan(*Instance) (*ScanJob, error)
+	GetFindings(*Instance) (*FindingsSummary, error)
+	GetReplicationHealth(*Instance, float64) (*ReplicationHealth, error)
+	HealthCheck() error
+	TransferOwnership(*Instance) (*BatchJob, error)
+	GetBatchJob(*Instance, string) (*BatchJob, error)
+	SetLegalHold(*Instance, string, bool) (*BatchJob, error)
+	CreateFolders(*Instance, []string) error
+	Seed(*Instance, string, string, int64) (*SeedProgress, error)
+	CreateInstanceRole(*Instance, string) (string, error)
+}
+
+const (
+	ProvisionStepUser   = "user"
+	ProvisionStepKey    = "key"
+	ProvisionStepBucket = "bucket"
+	ProvisionStepPolicy = "policy"
+	ProvisionStepAttach = "attach"
+	ProvisionStepTag    = "tag"
+	ProvisionStepDone   = "done"
+)
+
+var provisionSteps = []string{ProvisionStepUser, ProvisionStepKey, ProvisionStepBucket, ProvisionStepPolicy, ProvisionStepAttach, ProvisionStepTag, ProvisionStepDone}
+
+// Whether provisioning got to (started) the step, the step that failed may have been partly done.
+func (progress *ProvisionProgress) reached(step string) bool {
+	for _, s := range provisionSteps {
+		if s == step {
+			return true
+		}
+		if s == progress.Step {
+			return false
+		}
+	}
+	return false
+}
+
+// ProvisionProgress records how far provisioning a bucket got, Step is the next step to run (an
+// empty step has not started). A provision that fails part way keeps its progress in the metadata
+// of a resume-provision task so the worker can continue from the step that failed. The secret key
+// is never part of the metadata, it's kept with the instance (its resources row) like any other.
+type ProvisionProgress struct {
+	Step            string `json:"step"`
+	Name            string `json:"name,omitempty"`
+	Owner           string `json:"owner"`
+	Region          string `json:"region,omitempty"`
+	UserARN         string `json:"user_arn,omitempty"`
+	AccessKeyId     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"-"`
+	Endpoint        string `json:"endpoint,omitempty"`
+	PolicyARN       string `json:"policy_arn,omitempty"`
+}
+
+func (progress *ProvisionProgress) instance(Id string, plan *ProviderPlan) *Instance {
+	return &Instance{
+		Id:            Id,
+		Name:          progress.Name,
+		ProviderId:    progress.UserARN,
+		Plan:          plan,
+		Username:      progress.AccessKeyId,
+		Password:      progress.SecretAccessKey,
+		Endpoint:      progress.Endpoint,
+		Status:        "available",
+		Ready:         true,
+		Engine:        "s3",
+		EngineVersion: "aws-1",
+		Scheme:        "s3",
+		Region:        progress.Region,
+	}
+}
+
+// BucketConfiguration is the versioning, encryption and lifecycle state of the bucket as read from
+// the provider, Drift lists the differences from what the plan configures.
+type BucketConfiguration struct {
+	Versioning     string   `json:"versioning"`
+	Encryption     string   `json:"encryption"`
+	KMSKeyId       string   `json:"kms_key_id,omitempty"`
+	LifecycleRules int      `json:"lifecycle_rules"`
+	Drift          []string `json:"drift"`
+}
+
+// RestoreVerification compares the objects of a backup with the bucket after it was restored, a
+// checksum of the listing (keys, sizes and etags) of each is computed over the backup's objects.
+// Verified is false when objects are missing or differ, or when the restore can't be verified.
+type RestoreVerification struct {
+	Backup              string    `json:"backup"`
+	Verified            bool      `json:"verified"`
+	Reason              string    `json:"reason,omitempty"`
+	Objects             int64     `json:"objects"`
+	Bytes               int64     `json:"bytes"`
+	Missing             int64     `json:"missing"`
+	Mismatched          int64     `json:"mismatched"`
+	Examples            []string  `json:"examples,omitempty"`
+	SourceChecksum      string    `json:"source_checksum,omitempty"`
+	DestinationChecksum string    `json:"destination_checksum,omitempty"`
+	Created             time.Time `json:"created"`
+}
+
+// RestorePoint is a backup taken automatically by the backup plan of the instance, the id can be
+// passed to the restore task in place of an on-demand backup id.
+type RestorePoint struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Status  string    `json:"status"`
+	Bytes   int64     `json:"bytes"`
+}
+
+// ScanJob is a sensitive data classification job started for a bucket.
+type ScanJob struct {
+	JobId   string    `json:"job_id"`
+	Created time.Time `json:"created"`
 }
 
+// BatchJob is an S3 Batch Operations job over the objects of a bucket, such as rewriting them so
+// they are owned by the broker's account or placing legal holds. Objects is the number of objects
+// in the job.
+type BatchJob struct {
+	JobId     string    `json:"job_id"`
+	Created   time.Time `json:"created"`
+	Status    string    `json:"status"`
+	Objects   int64     `json:"objects"`
+	Succeeded int64     `json:"succeeded"`
+	Failed    int64     `json:"failed"`
+}
+
+// FindingsSummary counts the sensitive data findings for a bucket, grouped by severity (Low,
+// Medium, High) and by finding type (e.g., SensitiveData:S3Object/Personal).
+type FindingsSummary struct {
+	Total      int64            `json:"total"`
+	BySeverity map[string]int64 `json:"by_severity"`
+	ByType     map[string]int64 `json:"by_type"`
+}
+
+// ReplicationHealth is the replication of a bucket to its disaster recovery copies, one entry for
+// each rule of its replication configuration. Healthy is set when no rule has failed operations or
+// a latency over the maximum allowed.
+type ReplicationHealth struct {
+	Enabled           bool                    `json:"enabled"`
+	Healthy           bool                    `json:"healthy"`
+	MaxLatencySeconds float64                 `json:"max_latency_seconds"`
+	Rules             []ReplicationRuleHealth `json:"rules"`
+}
+
+// ReplicationRuleHealth is the most recent replication metrics of a rule, the metrics are only
+// reported for rules with replication metrics enabled.
+type ReplicationRuleHealth struct {
+	RuleId            string     `json:"rule_id"`
+	Status            string     `json:"status"`
+	Prefix            string     `json:"prefix,omitempty"`
+	Destination       string     `json:"destination"`
+	MetricsEnabled    bool       `json:"metrics_enabled"`
+	LatencySeconds    *float64   `json:"latency_seconds,omitempty"`
+	PendingOperations *int64     `json:"pending_operations,omitempty"`
+	PendingBytes      *int64     `json:"pending_bytes,omitempty"`
+	FailedOperations  *int64     `json:"failed_operations,omitempty"`
+	Updated           *time.Time `json:"updated,omitempty"`
+}
+
+// Usage of an instance over a period, Bytes and Objects are the amount stored at the end of the
+// period and Requests is the number of requests made during it.
+type Usage struct {
+	Resource string    `json:"resource"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Bytes    int64     `json:"bytes"`
+	Objects  int64     `json:"objects"`
+	Requests int64     `json:"requests"`
+	// RequestMetrics is whether the bucket had request metrics, without them Requests is always zero.
+	RequestMetrics bool `json:"request_metrics"`
+}
+
+type Policies struct {
+	BucketPolicy interface{} `json:"bucket_policy"`
+	UserPolicy   interface{} `json:"user_policy"`
+}
+
+// Providers hold sessions and background routines so they're expensive to create, each one is
+// created once per name prefix and shared by every request and task.
+var providerRegistry = struct {
+	sync.Mutex
+	providers map[string]Provider
+}{providers: make(map[string]Provider)}
+
 func GetProviderByPlan(namePrefix string, plan *ProviderPlan) (Provider, error) {
+	providerRegistry.Lock()
+	defer providerRegistry.Unlock()
+	key := string(plan.Provider) + ":" + namePrefix
+	if provider, ok := providerRegistry.providers[key]; ok {
+		return provider, nil
+	}
+	var provider Provider
 	if plan.Provider == AWSS3Instance {
-		return NewAWSInstanceS3Provider(namePrefix)
+		awsProvider, err := NewAWSInstanceS3Provider(namePrefix)
+		if err != nil {
+			return nil, err
+		}
+		provider = awsProvider
+	} else if plan.Provider == FakeInstance {
+		fakeProvider, err := NewFakeInstanceProvider(namePrefix)
+		if err != nil {
+			return nil, err
+		}
+		provider = fakeProvider
 	} else {
 		return nil, errors.New("Unable to find provider for plan.")
 	}
+	providerRegistry.providers[key] = provider
+	return provider, nil
+}
+
+func CloseProviders() {
+	providerRegistry.Lock()
+	defer providerRegistry.Unlock()
+	for key, provider := range providerRegistry.providers {
+		if closer, ok := provider.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				glog.Errorf("Unable to close provider %s: %s\n", key, err.Error())
+			}
+		}
+	}
+	providerRegistry.providers = make(map[string]Provider)
+}
+
+type TemporaryCredentialsOptions struct {
+	ReadOnly bool
+	Prefix   string
+	Duration int64
+}
+
+type TemporaryCredentials struct {
+	AccessKeyId     string    `json:"S3_ACCESS_KEY"`
+	SecretAccessKey string    `json:"S3_SECRET_KEY"`
+	SessionToken    string    `json:"S3_SESSION_TOKEN"`
+	Expiration      time.Time `json:"expiration"`
+	Bucket          string    `json:"S3_BUCKET"`
+	Prefix          string    `json:"prefix,omitempty"`
+	ReadOnly        bool      `json:"read_only"`
+}
+
+type CorsConfiguration struct {
+	Rules []*s3.CORSRule `json:"rules"`
+}
+
+func (c *CorsConfiguration) Validate() error {
+	if len(c.Rules) == 0 {
+		return nil
+	}
+	for _, rule := range c.Rules {
+		if rule == nil {
+			return errors.New("CORS rules must not be null.")
+		}
+	}
+	return (&s3.CORSConfiguration{CORSRules: c.Rules}).Validate()
+}
+
+// InstanceSettings are the parameters that can be changed on an existing instance without changing
+// plans, anything not set is left as is. Tags are added (or replace tags with the same name), an
+// empty list of lifecycle or CORS rules removes them. Deletion protection is enforced by the broker.
+type InstanceSettings struct {
+	Tags               map[string]string       `json:"tags,omitempty"`
+	Lifecycle          *LifecycleConfiguration `json:"lifecycle,omitempty"`
+	Cors               *CorsConfiguration      `json:"cors,omitempty"`
+	DeletionProtection *bool                   `json:"deletion_protection,omitempty"`
+}
+
+func (s *InstanceSettings) Validate() error {
+	for name := range s.Tags {
+		if name == "" {
+			return errors.New("Tag names must not be empty.")
+		}
+	}
+	if s.Lifecycle != nil {
+		if err := s.Lifecycle.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.Cors != nil {
+		if err := s.Cors.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type LifecycleConfiguration struct {
+	Rules []*s3.LifecycleRule `json:"rules"`
+}
+
+func (l *LifecycleConfiguration) Validate() error {
+	if len(l.Rules) == 0 {
+		return nil
+	}
+	ids := make(map[string]bool)
+	for _, rule := range l.Rules {
+		if rule == nil {
+			return errors.New("Lifecycle rules must not be null.")
+		}
+		if rule.ID == nil || *rule.ID == "" {
+			return errors.New("Each lifecycle rule must have an ID.")
+		}
+		if ids[*rule.ID] {
+			return errors.New("The lifecycle rule ID " + *rule.ID + " is used more than once.")
+		}
+		ids[*rule.ID] = true
+		if rule.Status == nil || (*rule.Status != "Enabled" && *rule.Status != "Disabled") {
+			return errors.New("The status of lifecycle rule " + *rule.ID + " must be Enabled or Disabled.")
+		}
+	}
+	return (&s3.BucketLifecycleConfiguration{Rules: l.Rules}).Validate()
+}
+
+type ProviderHealth struct {
+	Provider  string        `json:"provider"`
+	Healthy   bool          `json:"healthy"`
+	Error     string        `json:"error,omitempty"`
+	LatencyMs int64         `json:"latency_ms"`
+	Checked   time.Time     `json:"checked"`
+	Breaker   BreakerStatus `json:"breaker"`
+}
+
+// Health checks are kept for 30 seconds so monitoring doesn't call the provider on every request.
+var providerHealth = struct {
+	sync.Mutex
+	checks map[string]ProviderHealth
+}{checks: make(map[string]ProviderHealth)}
+
+func CheckProviderHealth(namePrefix string, plan *ProviderPlan) ProviderHealth {
+	key := string(plan.Provider) + ":" + namePrefix
+	providerHealth.Lock()
+	check, ok := providerHealth.checks[key]
+	providerHealth.Unlock()
+	if ok && time.Since(check.Checked) < time.Second*30 {
+		check.Breaker = GetCircuitBreaker(plan.Provider).Status()
+		return check
+	}
+
+	check = ProviderHealth{Provider: string(plan.Provider), Healthy: true}
+	start := time.Now()
+	provider, err := GetProviderByPlan(namePrefix, plan)
+	if err == nil {
+		err = provider.HealthCheck()
+	}
+	check.LatencyMs = int64(time.Since(start) / time.Millisecond)
+	check.Checked = time.Now()
+	if err != nil {
+		glog.Errorf("The health check of the %s provider failed: %s\n", plan.Provider, err.Error())
+		check.Healthy = false
+		check.Error = err.Error()
+	}
+	providerHealth.Lock()
+	providerHealth.checks[key] = check
+	providerHealth.Unlock()
+	check.Breaker = GetCircuitBreaker(plan.Provider).Status()
+	return check
 }
@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"github.com/golang/glog"
+	"os"
+	"strconv"
+)
+
+// Plans with a storage-quota-gb attribute include that much storage, 0 (or no attribute) is no quota.
+func GetStorageQuotaBytes(plan *ProviderPlan) (int64, error) {
+	gb, err := planAttributeNumber(plan, "storage-quota-gb", 0, "a number of GB")
+	if err != nil {
+		return 0, err
+	}
+	return gb * 1024 * 1024 * 1024, nil
+}
+
+// Writes are only blocked on plans with the storage-quota-enforced attribute set to true.
+func IsStorageQuotaEnforced(plan *ProviderPlan) bool {
+	attributes, _ := plan.basePlan.Metadata["attributes"].(map[string]interface{})
+	switch value := attributes["storage-quota-enforced"].(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+	return false
+}
+
+// Enforced quotas block writes once a bucket is QUOTA_BLOCK_PERCENT (120 by default) of its quota,
+// until then the owner is only warned.
+func GetStorageQuotaBlockPercent() int64 {
+	percent, err := strconv.ParseInt(os.Getenv("QUOTA_BLOCK_PERCENT"), 10, 64)
+	if err != nil || percent < 100 {
+		return 120
+	}
+	return percent
+}
+
+func ValidateQuotaAttributes(plan *ProviderPlan) []string {
+	problems := make([]string, 0)
+	quota, err := GetStorageQuotaBytes(plan)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if quota == 0 && IsStorageQuotaEnforced(plan) {
+		problems = append(problems, "The plan attribute storage-quota-enforced is set but the plan has no storage-quota-gb.")
+	}
+	return problems
+}
+
+// Compares the measured size of the bucket with its plan's quota and records the result. The owner
+// is warned (with an event and a notification) when the bucket goes over its quota, and writes are
+// blocked (or unblocked once it's back under its quota) for plans that enforce it.
+func CheckStorageQuota(storage Storage, provider Provider, Instance *Instance, usage *Usage) error {
+	quotaBytes, err := GetStorageQuotaBytes(Instance.Plan)
+	if err != nil {
+		return err
+	}
+	previous, err := storage.GetStorageQuota(Instance.Id)
+	if err != nil && err.Error() == "Not found" {
+		previous = &StorageQuota{InstanceId: Instance.Id, Status: StorageQuotaOk}
+	} else if err != nil {
+		return err
+	}
+	if quotaBytes == 0 && previous.Status != StorageQuotaBlocked {
+		return nil
+	}
+
+	quota := StorageQuota{InstanceId: Instance.Id, QuotaBytes: quotaBytes, Bytes: usage.Bytes, Status: StorageQuotaOk}
+	if quotaBytes > 0 && usage.Bytes > quotaBytes {
+		quota.Status = StorageQuotaExceeded
+		if IsStorageQuotaEnforced(Instance.Plan) && usage.Bytes > quotaBytes/100*GetStorageQuotaBlockPercent() {
+			quota.Status = StorageQuotaBlocked
+		}
+	}
+
+	if quota.Status == StorageQuotaBlocked && previous.Status != StorageQuotaBlocked {
+		if err = provider.BlockWrites(Instance, true); err != nil {
+			return err
+		}
+		RecordPolicyVersion(storage, provider, Instance, "storage quota blocked writes")
+	} else if quota.Status != StorageQuotaBlocked && previous.Status == StorageQuotaBlocked {
+		if err = provider.BlockWrites(Instance, false); err != nil {
+			return err
+		}
+		RecordPolicyVersion(storage, provider, Instance, "storage quota unblocked writes")
+	}
+	if quota.Status != previous.Status {
+		glog.Infof("The storage quota of %s is %s (%d of %d bytes)\n", Instance.Name, quota.Status, quota.Bytes, quota.QuotaBytes)
+	}
+	if quota.Status != StorageQuotaOk && quota.Status != previous.Status {
+		PublishEvent(StorageQuotaExceededEvent, Instance, "", "")
+		message := Instance.Name + " uses " + strconv.FormatInt(quota.Bytes/(1024*1024*1024), 10) + "GB of its " + strconv.FormatInt(quota.QuotaBytes/(1024*1024*1024), 10) + "GB quota."
+		if quota.Status == StorageQuotaBlocked {
+			message = message + " Writes to the bucket are blocked until it's back under its quota."
+		}
+		SendNotification("storage-quota-"+Instance.Id, "Storage quota exceeded", message)
+		if err = ScheduleOwnerWebhook(storage, Instance, "storage-quota-"+quota.Status, message); err != nil {
+			glog.Errorf("Unable to schedule the owner webhook for the storage quota of %s: %s\n", Instance.Name, err.Error())
+		}
+	}
+	return storage.SetStorageQuota(&quota)
+}
@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The provisioning SLO (in seconds) promised to teams is read from PROVISION_SLO_SECONDS, reports
+// include the fraction of provisions that met it when it's set.
+func GetProvisionSLOSeconds() float64 {
+	seconds, err := strconv.ParseFloat(os.Getenv("PROVISION_SLO_SECONDS"), 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return seconds
+}
+
+type TasksReport struct {
+	Days       int              `json:"days"`
+	Tasks      []TaskReport     `json:"tasks"`
+	Provisions *ProvisionReport `json:"provisions"`
+}
+
+func (b *BusinessLogic) GetTasksReport(days int) (*TasksReport, error) {
+	since := time.Now().Add(-time.Hour * 24 * time.Duration(days))
+	tasks, err := b.storage.GetTaskReports(since)
+	if err != nil {
+		return nil, err
+	}
+	provisions, err := b.storage.GetProvisionReport(since, GetProvisionSLOSeconds())
+	if err != nil {
+		return nil, err
+	}
+	return &TasksReport{Days: days, Tasks: tasks, Provisions: provisions}, nil
+}
+
+// TaskMetricsCollector exports the task and provision reports of the last 7 days as prometheus
+// gauges, they're computed from the database when scraped so every broker reports the same values.
+type TaskMetricsCollector struct {
+	logic          *BusinessLogic
+	tasks          *prometheus.Desc
+	taskRetries    *prometheus.Desc
+	taskDuration   *prometheus.Desc
+	provisions     *prometheus.Desc
+	provisionTime  *prometheus.Desc
+	provisionInSLO *prometheus.Desc
+}
+
+func NewTaskMetricsCollector(b *BusinessLogic) *TaskMetricsCollector {
+	return &TaskMetricsCollector{
+		logic:          b,
+		tasks:          prometheus.NewDesc("s3broker_tasks", "The tasks created in the last 7 days by action and status.", []string{"action", "status"}, nil),
+		taskRetries:    prometheus.NewDesc("s3broker_task_retries_average", "The average retries of tasks created in the last 7 days by action.", []string{"action"}, nil),
+		taskDuration:   prometheus.NewDesc("s3broker_task_duration_seconds", "The duration of tasks finished in the last 7 days by action.", []string{"action", "quantile"}, nil),
+		provisions:     prometheus.NewDesc("s3broker_provisions", "The provisions started in the last 7 days by status.", []string{"status"}, nil),
+		provisionTime:  prometheus.NewDesc("s3broker_provision_duration_seconds", "The duration of provisions finished in the last 7 days.", []string{"quantile"}, nil),
+		provisionInSLO: prometheus.NewDesc("s3broker_provisions_within_slo_ratio", "The fraction of provisions finished in the last 7 days within PROVISION_SLO_SECONDS.", nil, nil),
+	}
+}
+
+func (c *TaskMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.tasks
+	ch <- c.taskRetries
+	ch <- c.taskDuration
+	ch <- c.provisions
+	ch <- c.provisionTime
+	ch <- c.provisionInSLO
+}
+
+func (c *TaskMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	report, err := c.logic.GetTasksReport(7)
+	if err != nil {
+		glog.Errorf("Unable to collect task metrics: %s\n", err.Error())
+		return
+	}
+	for _, task := range report.Tasks {
+		ch <- prometheus.MustNewConstMetric(c.tasks, prometheus.GaugeValue, float64(task.Finished), task.Action, "finished")
+		ch <- prometheus.MustNewConstMetric(c.tasks, prometheus.GaugeValue, float64(task.Failed), task.Action, "failed")
+		ch <- prometheus.MustNewConstMetric(c.tasks, prometheus.GaugeValue, float64(task.Pending), task.Action, "pending")
+		ch <- prometheus.MustNewConstMetric(c.taskRetries, prometheus.GaugeValue, task.AverageRetries, task.Action)
+		ch <- prometheus.MustNewConstMetric(c.taskDuration, prometheus.GaugeValue, task.P50Seconds, task.Action, "0.5")
+		ch <- prometheus.MustNewConstMetric(c.taskDuration, prometheus.GaugeValue, task.P95Seconds, task.Action, "0.95")
+	}
+	ch <- prometheus.MustNewConstMetric(c.provisions, prometheus.GaugeValue, float64(report.Provisions.Finished), "finished")
+	ch <- prometheus.MustNewConstMetric(c.provisions, prometheus.GaugeValue, float64(report.Provisions.Failed), "failed")
+	ch <- prometheus.MustNewConstMetric(c.provisions, prometheus.GaugeValue, float64(report.Provisions.Total-report.Provisions.Finished-report.Provisions.Failed), "unfinished")
+	ch <- prometheus.MustNewConstMetric(c.provisionTime, prometheus.GaugeValue, report.Provisions.P50Seconds, "0.5")
+	ch <- prometheus.MustNewConstMetric(c.provisionTime, prometheus.GaugeValue, report.Provisions.P95Seconds, "0.95")
+	if report.Provisions.SLOSeconds > 0 {
+		ch <- prometheus.MustNewConstMetric(c.provisionInSLO, prometheus.GaugeValue, report.Provisions.WithinSLO)
+	}
+}
@@ -0,0 +1,41 @@
+package broker
+
+import (
+	"errors"
+)
+
+// New instances can be restored from a backup of another instance of the same organization with the
+// restore_from provision parameter (the id of an on-demand backup, including backups of
+// deprovisioned instances), e.g., a point in time copy of production for debugging. The backup is
+// restored by a restore task once the new bucket is created. Restore points (AWS Backup) can only be
+// restored in place.
+func ParseRestoreFrom(storage Storage, parameters map[string]interface{}, organization string) (*RestoreDbTaskMetadata, error) {
+	value, ok := parameters["restore_from"]
+	if !ok || value == nil {
+		return nil, nil
+	}
+	backupId, ok := value.(string)
+	if !ok || backupId == "" {
+		return nil, errors.New("The restore_from parameter must be the id of a backup.")
+	}
+	if _, ok := parameters["seed"]; ok {
+		return nil, errors.New("A bucket can't be both seeded and restored from a backup.")
+	}
+	backup, err := storage.GetBackup(backupId)
+	if err != nil && err.Error() == "Not found" {
+		return nil, errors.New("The backup " + backupId + " was not found.")
+	} else if err != nil {
+		return nil, err
+	}
+	if backup.Status != "available" {
+		return nil, errors.New("The backup " + backupId + " is " + backup.Status + " and cannot be restored.")
+	}
+	owner, _, err := storage.GetInstanceOwner(backup.InstanceId)
+	if err != nil && err.Error() != "Cannot find resource instance" {
+		return nil, err
+	}
+	if err != nil || owner != organization {
+		return nil, errors.New("The backup " + backupId + " was not found.")
+	}
+	return &RestoreDbTaskMetadata{Backup: backup.Id, SourceInstance: backup.InstanceId, SourceName: backup.Name}, nil
+}
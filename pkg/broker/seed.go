@@ -0,0 +1,98 @@
+package broker
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// New buckets can be seeded with a copy of the objects under a source (a bucket and optional prefix,
+// e.g., "templates/assets/"), either every bucket on a plan with the plan's seed attribute or one
+// bucket with the seed provision parameter. As the broker can read buckets users can't, seed
+// parameters must be the plan's seed or under a source in SEED_SOURCES (comma separated).
+func GetSeedSources() []string {
+	return splitList(os.Getenv("SEED_SOURCES"))
+}
+
+// SeedTaskMetadata is the source being copied and the progress of the copy so far, objects are
+// copied in key order so StartAfter is the last key copied.
+type SeedTaskMetadata struct {
+	Source     string `json:"source"`
+	StartAfter string `json:"start_after,omitempty"`
+	Objects    int64  `json:"objects"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// SeedProgress is what a provider copied in one pass of a seed, Done is set once nothing is left.
+type SeedProgress struct {
+	StartAfter string
+	Objects    int64
+	Bytes      int64
+	Done       bool
+}
+
+// Splits a source into its bucket and prefix.
+func SplitSeedSource(source string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(source, "s3://"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func validSeedSource(source string) bool {
+	bucket, _ := SplitSeedSource(source)
+	return bucket != "" && !strings.ContainsAny(bucket, " *?")
+}
+
+func getPlanSeed(plan *ProviderPlan) (string, error) {
+	attributes, _ := plan.basePlan.Metadata["attributes"].(map[string]interface{})
+	switch value := attributes["seed"].(type) {
+	case nil:
+		return "", nil
+	case string:
+		if value == "" || validSeedSource(value) {
+			return strings.TrimPrefix(value, "s3://"), nil
+		}
+	}
+	return "", errors.New("The plan attribute seed must be a bucket and optional prefix (e.g., templates/assets/).")
+}
+
+func ValidateSeedAttributes(plan *ProviderPlan) []string {
+	seed, err := getPlanSeed(plan)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if seed != "" && UsesCustomerKey(plan) {
+		return []string{"The plan has a seed but sseCustomerKey, seeded objects couldn't be encrypted with the bucket's key."}
+	}
+	return []string{}
+}
+
+// The source to seed a new bucket from, the seed provision parameter (if given) or the plan's seed.
+// An empty source means the bucket isn't seeded.
+func ParseSeed(plan *ProviderPlan, parameters map[string]interface{}) (string, error) {
+	planSeed, err := getPlanSeed(plan)
+	if err != nil {
+		return "", err
+	}
+	value, ok := parameters["seed"]
+	if !ok || value == nil {
+		return planSeed, nil
+	}
+	source, ok := value.(string)
+	if !ok || !validSeedSource(source) {
+		return "", errors.New("The seed must be a bucket and optional prefix (e.g., templates/assets/).")
+	}
+	source = strings.TrimPrefix(source, "s3://")
+	if source == planSeed {
+		return source, nil
+	}
+	for _, allowed := range GetSeedSources() {
+		allowed = strings.TrimPrefix(allowed, "s3://")
+		if source == allowed || (strings.HasPrefix(source, allowed) && (strings.HasSuffix(allowed, "/") || strings.HasPrefix(source, allowed+"/"))) {
+			return source, nil
+		}
+	}
+	return "", errors.New("The seed " + source + " is not an allowed source.")
+}
@@ -6,10 +6,11 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/golang/glog"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -38,21 +39,51 @@ select
     plans.beta,
     plans.provider,
     plans.provider_private_details::text,
-    plans.deprecated
+    plans.deprecated,
+    plans.created,
+    plans.updated
 from plans join services on services.service = plans.service
-    where services.deleted = false and plans.deleted = false `
+    where services.deleted = false and plans.deleted = false and plans.regions = '' `
 
-const servicesQuery string = `
+// catalogQuery returns each service joined to its plans, services without any plans are
+// returned once with an empty plan id so they still appear in the catalog.
+const catalogQuery string = `
 select
-    service,
-    name,
-    human_name,
-    description,
-    categories,
-    image,
-    beta,
-    deprecated
-from services where deleted = false `
+    services.service,
+    services.name,
+    services.human_name,
+    services.description,
+    services.categories,
+    services.image,
+    services.beta,
+    services.deprecated,
+    coalesce(plans.plan::text, ''),
+    services.service,
+    services.name as service_name,
+    coalesce(plans.name::text, ''),
+    coalesce(plans.human_name, ''),
+    coalesce(plans.description, ''),
+    coalesce(plans.version, ''),
+    coalesce(plans.type::text, ''),
+    coalesce(plans.scheme::text, ''),
+    coalesce(plans.categories, ''),
+    coalesce(plans.cost_cents, 0),
+    coalesce(plans.cost_unit::text, ''),
+    coalesce(plans.attributes::text, '{}'),
+    coalesce(plans.installable_inside_private_network, false),
+    coalesce(plans.installable_outside_private_network, false),
+    coalesce(plans.supports_multiple_installations, false),
+    coalesce(plans.supports_sharing, false),
+    coalesce(plans.preprovision, 0),
+    coalesce(plans.beta, false),
+    coalesce(plans.provider, ''),
+    coalesce(plans.provider_private_details::text, '{}'),
+    coalesce(plans.deprecated, false),
+    coalesce(plans.created, now()),
+    coalesce(plans.updated, now())
+from services left join plans on plans.service = services.service and plans.deleted = false and plans.regions = ''
+    where services.deleted = false
+order by services.name, services.service, plans.name `
 
 var sqlCreateScript string = `
 do $$
@@ -140,6 +171,10 @@ begin
         created timestamp with time zone not null default now(),
         updated timestamp with time zone not null default now()
     );
+    -- plans with regions (a comma separated list) are templates, they aren't offered themselves but
+    -- are expanded into a plan for each region below.
+    alter table plans add column if not exists regions varchar(1024) not null default '';
+    alter table plans add column if not exists template uuid references plans("plan");
     drop trigger if exists plans_updated on plans;
     create trigger plans_updated before update on plans for each row execute procedure mark_updated_column();
 
@@ -157,6 +192,12 @@ begin
         updated timestamp with time zone not null default now(),
         deleted bool not null default false
     );
+    alter table resources add column if not exists organization varchar(1024) not null default '';
+    alter table resources add column if not exists space varchar(1024) not null default '';
+    alter table resources add column if not exists region varchar(128) not null default '';
+    alter table resources add column if not exists deletion_protection boolean not null default false;
+    alter table resources add column if not exists frozen boolean not null default false;
+    alter table resources add column if not exists alias varchar(200) not null default '';
     drop trigger if exists resources_updated on resources;
     create trigger resources_updated before update on resources for each row execute procedure mark_updated_column();
 
@@ -194,9 +235,262 @@ begin
         alter table plans alter column provider TYPE varchar(1024) using provider::varchar(1024);
     end if;
 
+    alter table tasks add column if not exists request_id varchar(128) not null default '';
+    -- tasks waiting to be retried (e.g., a webhook's backoff) aren't popped before not_before.
+    alter table tasks add column if not exists not_before timestamp with time zone;
+    update tasks set not_before = (metadata::jsonb->>'next_attempt')::timestamp with time zone where not_before is null and status = 'pending' and deleted = false and metadata like '%"next_attempt"%';
+    -- resume-provision tasks once kept the secret key in their progress, it's with the resource.
+    update tasks set metadata = (metadata::jsonb - 'secret_access_key')::text where action = 'resume-provision' and metadata like '%"secret_access_key"%';
+
     drop trigger if exists tasks_updated on tasks;
     create trigger tasks_updated before update on tasks for each row execute procedure mark_updated_column();
 
+    create table if not exists events
+    (
+        event uuid not null primary key,
+        resource varchar(1024) references resources("id") not null,
+        type varchar(1024) not null,
+        description text not null default '',
+        metadata text not null default '',
+        created timestamp with time zone not null default now()
+    );
+
+    create table if not exists usage
+    (
+        usage uuid not null primary key default uuid_generate_v4(),
+        resource varchar(1024) references resources("id") not null,
+        period_start timestamp with time zone not null,
+        period_end timestamp with time zone not null,
+        bytes bigint not null default 0,
+        objects bigint not null default 0,
+        requests bigint not null default 0,
+        created timestamp with time zone not null default now(),
+        unique (resource, period_start)
+    );
+    -- whether the bucket had request metrics in the period, without them requests are always zero.
+    alter table usage add column if not exists request_metrics boolean not null default false;
+
+    -- limits the number of instances an organization (or space) may have, an empty organization
+    -- is the default for every organization, an empty space counts instances in every space and
+    -- a null plan counts instances of any plan.
+    create table if not exists quotas
+    (
+        quota uuid not null primary key default uuid_generate_v4(),
+        organization varchar(1024) not null default '',
+        space varchar(1024) not null default '',
+        plan uuid references plans("plan"),
+        max_instances int not null check (max_instances >= 0),
+        created timestamp with time zone not null default now(),
+        updated timestamp with time zone not null default now(),
+        deleted bool not null default false
+    );
+    drop trigger if exists quotas_updated on quotas;
+    create trigger quotas_updated before update on quotas for each row execute procedure mark_updated_column();
+
+    -- claiming a preprovisioned resource changes its id to the instance id, the references to it
+    -- follow the change so its task and event history is kept.
+    if exists (select 1 from pg_constraint where conname = 'tasks_resource_fkey' and confupdtype <> 'c') then
+        alter table tasks drop constraint tasks_resource_fkey;
+        alter table tasks add constraint tasks_resource_fkey foreign key (resource) references resources("id") on update cascade;
+    end if;
+    if exists (select 1 from pg_constraint where conname = 'events_resource_fkey' and confupdtype <> 'c') then
+        alter table events drop constraint events_resource_fkey;
+        alter table events add constraint events_resource_fkey foreign key (resource) references resources("id") on update cascade;
+    end if;
+    if exists (select 1 from pg_constraint where conname = 'usage_resource_fkey' and confupdtype <> 'c') then
+        alter table usage drop constraint usage_resource_fkey;
+        alter table usage add constraint usage_resource_fkey foreign key (resource) references resources("id") on update cascade;
+    end if;
+
+    -- a record of each time a preprovisioned resource was claimed (pool_id is the id it had in the
+    -- pool) and when it was returned to the pool or deleted.
+    create table if not exists claims
+    (
+        claim uuid not null primary key default uuid_generate_v4(),
+        pool_id varchar(1024) not null,
+        instance varchar(1024) not null,
+        name varchar(200) not null,
+        plan uuid references plans("plan") not null,
+        claimed timestamp with time zone not null default now(),
+        released timestamp with time zone
+    );
+
+    -- the access keys replaced by each credential rotation and who asked for it.
+    create table if not exists rotations
+    (
+        rotation uuid not null primary key default uuid_generate_v4(),
+        resource varchar(1024) references resources("id") on update cascade not null,
+        old_key varchar(128) not null default '',
+        new_key varchar(128) not null default '',
+        actor text not null default '',
+        request_id varchar(128) not null default '',
+        created timestamp with time zone not null default now()
+    );
+
+    -- the bindings of each resource and the access key each was given, a binding created with a
+    -- predecessor (to rotate credentials) has its own key until the predecessor is unbound.
+    create table if not exists bindings
+    (
+        binding varchar(1024) not null primary key,
+        resource varchar(1024) references resources("id") on update cascade not null,
+        predecessor varchar(1024) not null default '',
+        access_key varchar(128) not null default '',
+        secret_key varchar(128) not null default '',
+        created timestamp with time zone not null default now(),
+        deleted boolean not null default false
+    );
+    alter table bindings add column if not exists format varchar(128) not null default '';
+    -- predecessors created before bindings were recorded, their key may be used by other unrecorded bindings.
+    alter table bindings add column if not exists inherited boolean not null default false;
+
+    -- provisions in flight by instance id, so a provision retried by the platform (possibly sent to
+    -- another broker) doesn't provision a second bucket. Finished provisions are kept.
+    create table if not exists provisions
+    (
+        instance varchar(1024) not null primary key,
+        plan uuid references plans("plan") not null,
+        request_id varchar(128) not null default '',
+        started timestamp with time zone not null default now(),
+        finished timestamp with time zone
+    );
+    -- when the bucket became available (finished is when the request did, a queued or resumed bucket
+    -- is available later) and why a provision failed, failed provisions are kept for the report.
+    alter table provisions add column if not exists available timestamp with time zone;
+    alter table provisions add column if not exists error text not null default '';
+
+    -- plans with organizations listed are only offered to (and can only be provisioned by) those
+    -- organizations, plans without any are available to everyone.
+    create table if not exists plan_organizations
+    (
+        plan uuid references plans("plan") not null,
+        organization varchar(1024) not null,
+        created timestamp with time zone not null default now(),
+        primary key (plan, organization)
+    );
+
+    -- preprovisions that failed (their resource is removed), kept for the pool health report.
+    create table if not exists pool_failures
+    (
+        failure uuid not null primary key default uuid_generate_v4(),
+        plan varchar(1024) not null,
+        error text not null default '',
+        created timestamp with time zone not null default now()
+    );
+
+    -- the report of each access key audit (see audit.go), the latest is served to admins.
+    create table if not exists key_audits
+    (
+        audit uuid not null primary key default uuid_generate_v4(),
+        report json not null,
+        created timestamp with time zone not null default now()
+    );
+
+    -- on-demand backups, stored in the archive bucket. The
+    -- backups of a deleted resource are kept (the resource row is only marked deleted).
+    create table if not exists backups
+    (
+        backup varchar(1024) not null primary key,
+        resource varchar(1024) references resources("id") on update cascade not null,
+        name varchar(1024) not null,
+        kind varchar(128) not null default 'on-demand',
+        status varchar(128) not null default 'pending',
+        objects bigint not null default 0,
+        bytes bigint not null default 0,
+        created timestamp with time zone not null default now(),
+        finished timestamp with time zone
+    );
+    create index if not exists backups_resource on backups (resource);
+
+    -- the storage quota state of resources on plans with a storage-quota-gb attribute, updated each
+    -- time the resource's usage is metered.
+    create table if not exists storage_quotas
+    (
+        resource varchar(1024) references resources("id") on update cascade not null primary key,
+        quota_bytes bigint not null default 0,
+        bytes bigint not null default 0,
+        status varchar(128) not null default 'ok',
+        updated timestamp with time zone not null default now()
+    );
+    drop trigger if exists storage_quotas_updated on storage_quotas;
+    create trigger storage_quotas_updated before update on storage_quotas for each row execute procedure mark_updated_column();
+
+    -- thresholds registered with the add_alert action, the webhook is sent when the metered usage of
+    -- the resource goes over the threshold (again only after it's been back under it).
+    create table if not exists alerts
+    (
+        alert uuid not null primary key default uuid_generate_v4(),
+        resource varchar(1024) references resources("id") on update cascade not null,
+        metric varchar(128) not null,
+        threshold bigint not null,
+        webhook varchar(4096) not null,
+        secret varchar(1024) not null,
+        triggered timestamp with time zone,
+        created timestamp with time zone not null default now()
+    );
+    create index if not exists alerts_resource on alerts (resource);
+
+    -- every bucket policy the broker has applied to a resource, the newest is the current policy
+    -- (an empty policy is a bucket without one).
+    create table if not exists policy_versions
+    (
+        version uuid not null primary key default uuid_generate_v4(),
+        resource varchar(1024) references resources("id") on update cascade not null,
+        policy text not null,
+        reason varchar(1024) not null,
+        created timestamp with time zone not null default now()
+    );
+    create index if not exists policy_versions_resource on policy_versions (resource, created);
+
+    -- the sse-c key of each resource on a plan with sseCustomerKey, encrypted with SSE_C_MASTER_KEY.
+    create table if not exists customer_keys
+    (
+        resource varchar(1024) references resources("id") on update cascade not null primary key,
+        encrypted_key text not null,
+        created timestamp with time zone not null default now()
+    );
+
+    -- when an access key deactivated for being unused was last reactivated, the access key audit
+    -- counts its idle days from then.
+    create table if not exists key_reactivations
+    (
+        access_key varchar(128) not null primary key,
+        resource varchar(1024) references resources("id") on update cascade not null,
+        actor varchar(1024) not null default '',
+        created timestamp with time zone not null default now()
+    );
+    create index if not exists key_reactivations_resource on key_reactivations (resource);
+
+    -- claimed instances without any requests in the last IDLE_DAYS, Tagged is set once the bucket is
+    -- tagged candidate-for-removal.
+    create table if not exists idle_instances
+    (
+        resource varchar(1024) references resources("id") on update cascade not null primary key,
+        detected timestamp with time zone not null default now(),
+        tagged boolean not null default false
+    );
+
+    -- when instances on plans with a ttl expire, the owner's webhook (if any) is warned before the
+    -- instance is deprovisioned.
+    create table if not exists expirations
+    (
+        resource varchar(1024) references resources("id") on update cascade not null primary key,
+        expires timestamp with time zone not null,
+        webhook varchar(1024) not null default '',
+        secret varchar(1024) not null default '',
+        warned timestamp with time zone,
+        created timestamp with time zone not null default now()
+    );
+
+    -- the webhook (and secret) given when each instance was provisioned, its owner is sent webhooks
+    -- about changes the broker makes on its own (e.g., access keys it deactivates).
+    create table if not exists owner_webhooks
+    (
+        resource varchar(1024) references resources("id") on update cascade not null primary key,
+        webhook varchar(1024) not null,
+        secret varchar(1024) not null,
+        created timestamp with time zone not null default now()
+    );
+
     -- populate some default services
     if (select count(*) from services) = 0 then
         insert into services 
@@ -217,12 +511,29 @@ begin
             ('faa8e0b0-529a-54a8-42aa-fd219e12fea1', '0124611d-2971-4533-8e38-a816a7a95ff1', 'shield-versioned',    'AWS S3 - Shield Versioned','Amazon S3 Bucket - Versioned (Encrypted)', 'v1', 's3', 's3', 'Data Stores', 16000, 0, '{"versioned":"true", "geo-replication":"false", "encrypted":"true"}', 'aws-s3', '{"versioned":true, "encrypted":true, "kmsKeyId":"${AWS_KMS_KEY_ID}"}', false);
             
     end if;
+
+    -- expand region templated plans, each region gets a plan with a stable id (derived from the
+    -- template and region) named <template name>-<region> with the region set in its
+    -- provider_private_details. Plans for regions no longer listed are marked deleted.
+    insert into plans
+        (plan, service, name, human_name, description, version, type, scheme, categories, cost_cents, cost_unit, attributes, provider, provider_private_details, installable_inside_private_network, installable_outside_private_network, supports_multiple_installations, supports_sharing, preprovision, beta, deprecated, deleted, template)
+    select
+        uuid_generate_v5(templates.plan, regions.region), templates.service, templates.name || '-' || regions.region, templates.human_name || ' (' || regions.region || ')', templates.description, templates.version, templates.type, templates.scheme, templates.categories, templates.cost_cents, templates.cost_unit, templates.attributes, templates.provider, (templates.provider_private_details::jsonb || jsonb_build_object('region', regions.region))::json, templates.installable_inside_private_network, templates.installable_outside_private_network, templates.supports_multiple_installations, templates.supports_sharing, templates.preprovision, templates.beta, templates.deprecated, templates.deleted, templates.plan
+    from plans templates cross join lateral (select trim(region) as region from unnest(string_to_array(templates.regions, ',')) as region where trim(region) <> '') regions
+    where templates.regions <> ''
+    on conflict (plan) do update set
+        service = excluded.service, name = excluded.name, human_name = excluded.human_name, description = excluded.description, version = excluded.version, type = excluded.type, scheme = excluded.scheme, categories = excluded.categories, cost_cents = excluded.cost_cents, cost_unit = excluded.cost_unit, attributes = excluded.attributes, provider = excluded.provider, provider_private_details = excluded.provider_private_details, installable_inside_private_network = excluded.installable_inside_private_network, installable_outside_private_network = excluded.installable_outside_private_network, supports_multiple_installations = excluded.supports_multiple_installations, supports_sharing = excluded.supports_sharing, preprovision = excluded.preprovision, beta = excluded.beta, deprecated = excluded.deprecated, deleted = excluded.deleted;
+
+    update plans set deleted = true
+    from plans templates
+    where plans.template = templates.plan and plans.deleted = false and
+        plans.plan not in (select uuid_generate_v5(templates.plan, trim(region)) from unnest(string_to_array(templates.regions, ',')) as region);
 end
 $$
 `
 
 func cancelOnInterrupt(ctx context.Context, db *sql.DB) {
-	term := make(chan os.Signal)
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
 	for {
@@ -235,6 +546,177 @@ func cancelOnInterrupt(ctx context.Context, db *sql.DB) {
 	}
 }
 
+type Quota struct {
+	Id           string
+	Organization string
+	Space        string
+	PlanId       string
+	MaxInstances int
+	Instances    int
+}
+
+// PoolHealth is a plans preprovisioned pool in more detail than PoolStatus, Failed counts the
+// preprovisions that failed in the last day and ToProvision how many buckets the worker would start
+// preprovisioning now.
+type PoolHealth struct {
+	PlanId                 string `json:"plan"`
+	Target                 int    `json:"target"`
+	Available              int    `json:"available"`
+	Provisioning           int    `json:"provisioning"`
+	Failed                 int    `json:"failed_last_day"`
+	LastFailure            string `json:"last_failure,omitempty"`
+	OldestAvailableSeconds int64  `json:"oldest_available_seconds"`
+	ToProvision            int    `json:"to_provision"`
+}
+
+// InstanceSummary describes an instance (or an unclaimed preprovisioned bucket) for the admin api,
+// it never includes credentials.
+type InstanceSummary struct {
+	Id           string    `json:"id"`
+	Name         string    `json:"name"`
+	PlanId       string    `json:"plan"`
+	Status       string    `json:"status"`
+	Claimed      bool      `json:"claimed"`
+	Region       string    `json:"region,omitempty"`
+	Alias        string    `json:"alias,omitempty"`
+	Organization string    `json:"organization,omitempty"`
+	Frozen       bool      `json:"frozen"`
+	Created      time.Time `json:"created"`
+}
+
+// TaskReport summarizes the tasks of an action created in a period, durations are from when the
+// task was created until it finished (including time spent waiting to be retried).
+type TaskReport struct {
+	Action         string  `json:"action"`
+	Total          int64   `json:"total"`
+	Finished       int64   `json:"finished"`
+	Failed         int64   `json:"failed"`
+	Pending        int64   `json:"pending"`
+	SuccessRate    float64 `json:"success_rate"`
+	AverageRetries float64 `json:"average_retries"`
+	P50Seconds     float64 `json:"p50_seconds"`
+	P95Seconds     float64 `json:"p95_seconds"`
+}
+
+// ProvisionReport summarizes the provision requests started in a period, Finished are those whose
+// bucket became available and durations are from the request starting until then. WithinSLO is the
+// fraction of finished provisions that took at most SLOSeconds (when set).
+type ProvisionReport struct {
+	Total      int64   `json:"total"`
+	Finished   int64   `json:"finished"`
+	Failed     int64   `json:"failed"`
+	P50Seconds float64 `json:"p50_seconds"`
+	P95Seconds float64 `json:"p95_seconds"`
+	SLOSeconds float64 `json:"slo_seconds,omitempty"`
+	WithinSLO  float64 `json:"within_slo,omitempty"`
+}
+
+type PoolStatus struct {
+	PlanId        string `json:"plan"`
+	Target        int    `json:"target"`
+	Available     int    `json:"available"`
+	Provisioning  int    `json:"provisioning"`
+	EstimatedWait int64  `json:"estimated_wait_seconds"`
+}
+
+// Rotation is a credential rotation, Actor is who asked for it (the originating identity of the
+// request, or the broker for automatic rotations).
+type Rotation struct {
+	OldAccessKeyId string    `json:"old_access_key_id"`
+	NewAccessKeyId string    `json:"new_access_key_id"`
+	Actor          string    `json:"actor"`
+	RequestId      string    `json:"request_id"`
+	Created        time.Time `json:"created"`
+}
+
+// Binding is a binding of a resource and the access key it was given.
+type Binding struct {
+	Id              string
+	InstanceId      string
+	Predecessor     string
+	AccessKeyId     string
+	SecretAccessKey string
+	Format          string
+	Inherited       bool
+	Created         time.Time
+}
+
+const (
+	BackupOnDemand = "on-demand"
+)
+
+// Backup is a copy of the objects of a bucket in the archive bucket, Kind is BackupOnDemand.
+type Backup struct {
+	Id         string     `json:"id"`
+	InstanceId string     `json:"instance_id"`
+	Name       string     `json:"name"`
+	Kind       string     `json:"kind"`
+	Status     string     `json:"status"`
+	Objects    int64      `json:"objects"`
+	Bytes      int64      `json:"bytes"`
+	Created    time.Time  `json:"created"`
+	Finished   *time.Time `json:"finished,omitempty"`
+}
+
+const (
+	StorageQuotaOk       = "ok"
+	StorageQuotaExceeded = "exceeded"
+	StorageQuotaBlocked  = "blocked"
+)
+
+// StorageQuota is the size of a bucket compared to its plan's quota when it was last metered, writes
+// to the bucket are denied while the status is StorageQuotaBlocked.
+type StorageQuota struct {
+	InstanceId string    `json:"instance_id"`
+	QuotaBytes int64     `json:"quota_bytes"`
+	Bytes      int64     `json:"bytes"`
+	Status     string    `json:"status"`
+	Updated    time.Time `json:"updated"`
+}
+
+// Alert is a threshold on the bytes, objects or requests of an instance's metered usage, Triggered is
+// when its webhook was last sent (and nil once the usage is back under the threshold).
+type Alert struct {
+	Id         string     `json:"id"`
+	InstanceId string     `json:"instance_id"`
+	Metric     string     `json:"metric"`
+	Threshold  int64      `json:"threshold"`
+	Webhook    string     `json:"webhook"`
+	Secret     string     `json:"-"`
+	Triggered  *time.Time `json:"triggered,omitempty"`
+	Created    time.Time  `json:"created"`
+}
+
+// IdleInstance is a claimed instance that has had no requests since it was Detected as idle,
+// LastRequest is the end of the last metering period with requests (nil if it's never had any).
+type IdleInstance struct {
+	InstanceSummary
+	Detected    time.Time  `json:"detected"`
+	LastRequest *time.Time `json:"last_request,omitempty"`
+	Bytes       int64      `json:"bytes"`
+	Tagged      bool       `json:"tagged"`
+}
+
+// Expiration is when an instance on a plan with a ttl is deprovisioned, Warned is when the owner's
+// webhook was told it's about to expire.
+type Expiration struct {
+	InstanceId string     `json:"instance_id"`
+	Expires    time.Time  `json:"expires"`
+	Webhook    string     `json:"webhook,omitempty"`
+	Secret     string     `json:"-"`
+	Warned     *time.Time `json:"warned,omitempty"`
+}
+
+// PolicyVersion is a bucket policy the broker applied to an instance and why, e.g., provisioned,
+// storage quota or a rollback.
+type PolicyVersion struct {
+	Id         string    `json:"id"`
+	InstanceId string    `json:"instance_id"`
+	Policy     string    `json:"policy"`
+	Reason     string    `json:"reason"`
+	Created    time.Time `json:"created"`
+}
+
 type Storage interface {
 	GetPlans(string) ([]ProviderPlan, error)
 	GetPlanByID(string) (*ProviderPlan, error)
@@ -243,10 +725,12 @@ type Storage interface {
 	DeleteInstance(*Instance) error
 	UpdateInstance(*Instance, string) error
 	UpdateCredentials(*Instance, *User) error
-	AddTask(string, TaskAction, string) (string, error)
+	AddTask(string, TaskAction, string, string) (string, error)
+	AddEvent(string, string, string, string) error
 	GetServices() ([]osb.Service, error)
 	UpdateTask(string, *string, *int64, *string, *string, *time.Time, *time.Time) error
 	PopPendingTask() (*Task, error)
+	DelayTask(string, time.Time) error
 	GetUnclaimedInstance(string, string) (*Entry, error)
 	ReturnClaimedInstance(string) error
 	StartProvisioningTasks() ([]Entry, error)
@@ -254,12 +738,169 @@ type Storage interface {
 	WarnOnUnfinishedTasks()
 	IsRestoring(string) (bool, error)
 	IsUpgrading(string) (bool, error)
+	GetLastTask(string, TaskAction) (*Task, error)
+	GetLastOperationTask(string) (*Task, error)
+	GetTasks(string, int) ([]Task, error)
+	GetTasksByStatus(string, int) ([]Task, error)
+	GetTaskContext(string) (*TaskContext, error)
+	GetWorkerActivity() (*WorkerActivity, error)
+	RequeueTask(string) error
 	ValidateInstanceID(string) error
+	StartProvision(string, string, string) (bool, error)
+	FinishProvision(string, bool) error
+	ProvisionAvailable(string) error
+	FailProvision(string, string) error
+	IsProvisioning(string) (bool, error)
+	GetInstanceOwner(string) (string, string, error)
+	SetInstanceOwner(string, string, string) error
+	AdoptInstance(*Instance, bool, string) error
+	SetDeletionProtection(string, bool) error
+	SetInstanceAlias(string, string) error
+	IsDeletionProtected(string) (bool, error)
+	GetExceededQuota(string, string, string) (*Quota, error)
+	GetPoolStatus() ([]PoolStatus, error)
+	SetPreprovision(string, int) error
+	ListenForPreprovisionChanges(context.Context) (<-chan string, error)
+	GetUnmeteredInstanceIds(time.Time) ([]string, error)
+	AddUsage(*Usage) (bool, error)
+	GetUsage(string) ([]Usage, error)
+	AddRotation(string, string, string, string, string) error
+	GetRotations(string) ([]Rotation, error)
+	AddBinding(*Binding) error
+	GetBinding(string) (*Binding, error)
+	DeleteBinding(string) error
+	IsAccessKeyBound(string, string, string) (bool, error)
+	GetBindings(string) ([]Binding, error)
+	GetAccessKeyBindings(string) (map[string][]string, error)
+	AddKeyReactivation(string, string, string) error
+	GetKeyReactivations(string) (map[string]time.Time, error)
+	FindIdleInstanceIds(time.Time, time.Duration) ([]string, error)
+	GetIdleInstances() ([]IdleInstance, error)
+	AddIdleInstance(string) error
+	SetIdleInstanceTagged(string) error
+	RemoveIdleInstance(string) error
+	AddExpiration(*Expiration) error
+	GetExpiration(string) (*Expiration, error)
+	SetOwnerWebhook(string, string, string) error
+	GetOwnerWebhook(string) (string, string, error)
+	GetExpirations(time.Time) ([]Expiration, error)
+	SetExpirationWarned(string) error
+	RemoveExpiration(string) error
+	ReplaceBindingKey(string, string, *User) error
+	GetAvailableInstanceIds() ([]string, error)
+	ListInstances(string, string) ([]InstanceSummary, error)
+	AddAccessKeyAudit(*AccessKeyAudit) error
+	GetLastAccessKeyAudit() (*AccessKeyAudit, error)
+	GetPlanOrganizations() (map[string][]string, error)
+	SetPlanOrganizations(string, []string) error
+	GetPoolHealth() ([]PoolHealth, error)
+	GetTaskReports(time.Time) ([]TaskReport, error)
+	GetProvisionReport(time.Time, float64) (*ProvisionReport, error)
+	AddPoolFailure(string, string) error
+	AddBackup(*Backup) error
+	FinishBackup(string, string, int64, int64) error
+	GetBackup(string) (*Backup, error)
+	GetBackups(string) ([]Backup, error)
+	GetStorageQuota(string) (*StorageQuota, error)
+	SetStorageQuota(*StorageQuota) error
+	AddAlert(*Alert) (string, error)
+	GetAlerts(string) ([]Alert, error)
+	DeleteAlert(string, string) error
+	SetAlertTriggered(string, bool) error
+	AddPolicyVersion(*PolicyVersion) (string, error)
+	GetPolicyVersions(string) ([]PolicyVersion, error)
+	GetPolicyVersion(string, string) (*PolicyVersion, error)
+	SetFrozen(string, bool) error
+	IsFrozen(string) (bool, error)
+	GetCustomerKey(string) (string, error)
+	AddCustomerKey(string, string) (string, error)
+	Ping() error
 }
 
 type PostgresStorage struct {
 	Storage
-	db *sql.DB
+	db  *sql.DB
+	url string
+}
+
+// planRow holds the columns selected for a plan by plansQuery and catalogQuery.
+type planRow struct {
+	planId, serviceId, serviceName, name, humanName, description string
+	engineVersion, engineType, scheme, categories, costUnits     string
+	provider, attributes, providerPrivateDetails                 string
+	costInCents, preprovision                                    int
+	beta, deprecated                                             bool
+	installInsidePrivateNetwork, installOutsidePrivateNetwork    bool
+	supportsMultipleInstallations, supportsSharing               bool
+	created, updated                                             time.Time
+}
+
+func (r *planRow) fields() []interface{} {
+	return []interface{}{&r.planId, &r.serviceId, &r.serviceName, &r.name, &r.humanName, &r.description, &r.engineVersion, &r.engineType, &r.scheme, &r.categories, &r.costInCents, &r.costUnits, &r.attributes, &r.installInsidePrivateNetwork, &r.installOutsidePrivateNetwork, &r.supportsMultipleInstallations, &r.supportsSharing, &r.preprovision, &r.beta, &r.provider, &r.providerPrivateDetails, &r.deprecated, &r.created, &r.updated}
+}
+
+func (r *planRow) plan() (*ProviderPlan, error) {
+	var free = falsePtr()
+	if r.costInCents == 0 {
+		free = truePtr()
+	}
+
+	var attributesJson map[string]interface{}
+	if err := json.Unmarshal([]byte(r.attributes), &attributesJson); err != nil {
+		glog.Errorf("Unable to unmarshal attributes in plans query: %s\n", err.Error())
+		return nil, err
+	}
+	var state = "ga"
+	if r.beta == true {
+		state = "beta"
+	}
+	if r.deprecated == true {
+		state = "deprecated"
+	}
+	return &ProviderPlan{
+		basePlan: osb.Plan{
+			ID:          r.planId,
+			Name:        r.name,
+			Description: r.description,
+			Free:        free,
+			Schemas: &osb.Schemas{
+				ServiceInstance: &osb.ServiceInstanceSchema{
+					Create: &osb.InputParametersSchema{},
+				},
+			},
+			Metadata: map[string]interface{}{
+				"addon_service": map[string]interface{}{
+					"id":   r.serviceId,
+					"name": r.serviceName,
+				},
+				"created_at":                          r.created,
+				"description":                         r.description,
+				"human_name":                          r.humanName,
+				"id":                                  r.planId,
+				"installable_inside_private_network":  r.installInsidePrivateNetwork,
+				"installable_outside_private_network": r.installOutsidePrivateNetwork,
+				"name":                                r.name,
+				"key":                                 r.serviceName + ":" + r.name,
+				"price": map[string]interface{}{
+					"cents": r.costInCents,
+					"unit":  r.costUnits,
+				},
+				"compliance":    []interface{}{},
+				"space_default": false,
+				"state":         state,
+				"attributes":    attributesJson,
+				"updated_at":    r.updated,
+				"engine": map[string]string{
+					"type":    r.engineType,
+					"version": r.engineVersion,
+				},
+			},
+		},
+		Provider:               GetProvidersFromString(r.provider),
+		Scheme:                 r.scheme,
+		providerPrivateDetails: os.ExpandEnv(r.providerPrivateDetails),
+		ID:                     r.planId,
+	}, nil
 }
 
 func (b *PostgresStorage) getPlans(subquery string, arg string) ([]ProviderPlan, error) {
@@ -272,124 +913,68 @@ func (b *PostgresStorage) getPlans(subquery string, arg string) ([]ProviderPlan,
 	defer rows.Close()
 	plans := make([]ProviderPlan, 0)
 	for rows.Next() {
-		var planId, serviceId, serviceName, name, humanName, description, engineVersion, engineType, scheme, categories, costUnits, provider, attributes, providerPrivateDetails string
-		var costInCents, preprovision int
-		var beta, deprecated, installInsidePrivateNetwork, installOutsidePrivateNetwork, supportsMultipleInstallations, supportsSharing bool
-		var created, updated time.Time
-
-		err := rows.Scan(&planId, &serviceId, &serviceName, &name, &humanName, &description, &engineVersion, &engineType, &scheme, &categories, &costInCents, &costUnits, &attributes, &installInsidePrivateNetwork, &installOutsidePrivateNetwork, &supportsMultipleInstallations, &supportsSharing, &preprovision, &beta, &provider, &providerPrivateDetails, &deprecated)
-		if err != nil {
+		var row planRow
+		if err := rows.Scan(row.fields()...); err != nil {
 			glog.Errorf("Scan from query failed: %s\n", err.Error())
 			return nil, err
 		}
-		var free = falsePtr()
-		if costInCents == 0 {
-			free = truePtr()
-		}
-
-		var attributesJson map[string]interface{}
-		if err = json.Unmarshal([]byte(attributes), &attributesJson); err != nil {
-			glog.Errorf("Unable to unmarshal attributes in plans query: %s\n", err.Error())
+		plan, err := row.plan()
+		if err != nil {
 			return nil, err
 		}
-		var state = "ga"
-		if beta == true {
-			state = "beta"
-		}
-		if deprecated == true {
-			state = "deprecated"
-		}
-		plans = append(plans, ProviderPlan{
-			basePlan: osb.Plan{
-				ID:          planId,
-				Name:        name,
-				Description: description,
-				Free:        free,
-				Schemas: &osb.Schemas{
-					ServiceInstance: &osb.ServiceInstanceSchema{
-						Create: &osb.InputParametersSchema{},
-					},
-				},
-				Metadata: map[string]interface{}{
-					"addon_service": map[string]interface{}{
-						"id":   serviceId,
-						"name": serviceName,
-					},
-					"created_at":                          created,
-					"description":                         description,
-					"human_name":                          humanName,
-					"id":                                  planId,
-					"installable_inside_private_network":  installInsidePrivateNetwork,
-					"installable_outside_private_network": installOutsidePrivateNetwork,
-					"name":                                name,
-					"key":                                 serviceName + ":" + name,
-					"price": map[string]interface{}{
-						"cents": costInCents,
-						"unit":  costUnits,
-					},
-					"compliance":    []interface{}{},
-					"space_default": false,
-					"state":         state,
-					"attributes":    attributesJson,
-					"updated_at":    updated,
-					"engine": map[string]string{
-						"type": engineType,
-						"version": engineVersion,
-					},
-				},
-			},
-			Provider:               GetProvidersFromString(provider),
-			Scheme:                 scheme,
-			providerPrivateDetails: os.ExpandEnv(providerPrivateDetails),
-			ID:                     planId,
-		})
+		plans = append(plans, *plan)
 	}
-	return plans, nil
+	return plans, rows.Err()
 }
 
 func (b *PostgresStorage) GetServices() ([]osb.Service, error) {
 	services := make([]osb.Service, 0)
 
-	rows, err := b.db.Query(servicesQuery)
+	rows, err := b.db.Query(catalogQuery)
 	if err != nil {
+		glog.Errorf("GetServices query failed: %s\n", err.Error())
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var service_id, service_name, plan_human_name, plan_description, plan_categories, plan_image string
+		var service_id, service_name, service_human_name, service_description, service_categories, service_image string
 		var beta, deprecated bool
-		err = rows.Scan(&service_id, &service_name, &plan_human_name, &plan_description, &plan_categories, &plan_image, &beta, &deprecated)
+		var row planRow
+		err = rows.Scan(append([]interface{}{&service_id, &service_name, &service_human_name, &service_description, &service_categories, &service_image, &beta, &deprecated}, row.fields()...)...)
 		if err != nil {
+			glog.Errorf("Scan from query failed: %s\n", err.Error())
 			return nil, err
 		}
 
-		plans, err := b.GetPlans(service_id)
+		// rows are ordered by service, so a new service id starts a new entry in the catalog.
+		if len(services) == 0 || services[len(services)-1].ID != service_id {
+			services = append(services, osb.Service{
+				Name:                service_name,
+				ID:                  service_id,
+				Description:         service_description,
+				Bindable:            true,
+				BindingsRetrievable: true,
+				PlanUpdatable:       truePtr(),
+				Tags:                strings.Split(service_categories, ","),
+				Metadata: map[string]interface{}{
+					"name":  service_human_name,
+					"image": service_image,
+				},
+				Plans: make([]osb.Plan, 0),
+			})
+		}
+		if row.planId == "" {
+			continue
+		}
+		plan, err := row.plan()
 		if err != nil {
-			glog.Errorf("Unable to get RDS plans: %s\n", err.Error())
+			glog.Errorf("Unable to get plans: %s\n", err.Error())
 			return nil, InternalServerError()
 		}
-
-		osbPlans := make([]osb.Plan, 0)
-		for _, plan := range plans {
-			osbPlans = append(osbPlans, plan.basePlan)
-		}
-		services = append(services, osb.Service{
-			Name:                service_name,
-			ID:                  service_id,
-			Description:         plan_description,
-			Bindable:            true,
-			BindingsRetrievable: true,
-			PlanUpdatable:       truePtr(),
-			Tags:                strings.Split(plan_categories, ","),
-			Metadata: map[string]interface{}{
-				"name":  plan_human_name,
-				"image": plan_image,
-			},
-			Plans: osbPlans,
-		})
+		services[len(services)-1].Plans = append(services[len(services)-1].Plans, plan.basePlan)
 	}
-	return services, nil
+	return services, rows.Err()
 }
 
 func (b *PostgresStorage) GetPlanByID(planId string) (*ProviderPlan, error) {
@@ -403,13 +988,18 @@ func (b *PostgresStorage) GetPlanByID(planId string) (*ProviderPlan, error) {
 	return &plans[0], nil
 }
 
+// Ping checks the database can be reached, it's used by the readiness check.
+func (b *PostgresStorage) Ping() error {
+	return b.db.Ping()
+}
+
 func (b *PostgresStorage) GetPlans(serviceId string) ([]ProviderPlan, error) {
 	return b.getPlans(" and services.service::varchar(1024) = $1::varchar(1024) order by plans.name", serviceId)
 }
 
 func (b *PostgresStorage) IsUpgrading(dbId string) (bool, error) {
 	var count int64
-	err := b.db.QueryRow("select count(*) from tasks where ( status = 'started' or status = 'pending' ) and (action = 'change-providers' OR action = 'change-plans') and deleted = false and resource = $1", dbId).Scan(&count)
+	err := b.db.QueryRow("select count(*) from tasks where ( status = 'started' or status = 'pending' ) and (action = 'change-providers' OR action = 'change-plans' OR action = 'update-settings') and deleted = false and resource = $1", dbId).Scan(&count)
 	return count > 0, err
 }
 
@@ -419,113 +1009,1112 @@ func (b *PostgresStorage) IsRestoring(dbId string) (bool, error) {
 	return count > 0, err
 }
 
-func (b *PostgresStorage) GetUnclaimedInstance(PlanId string, InstanceId string) (*Entry, error) {
-	tx, err := b.db.Begin()
-	if err != nil {
+// Returns the most recent task of the action for the resource, including tasks marked deleted
+// (the tasks of a deleted resource are marked deleted with it).
+func (b *PostgresStorage) GetLastTask(dbId string, action TaskAction) (*Task, error) {
+	var task Task
+	err := b.db.QueryRow("select task, action, resource, status, retries, metadata, result, started, finished, request_id from tasks where resource = $1 and action = $2 order by created desc limit 1", dbId, string(action)).Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Started, &task.Finished, &task.RequestId)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, errors.New("Not found")
+	} else if err != nil {
 		return nil, err
 	}
-	var entry Entry
-	err = tx.QueryRow("select id, name, plan, claimed, status, username, password, endpoint from resources where claimed = false and status = 'available' and deleted = false and id != $1 and plan = $2 limit 1", InstanceId, PlanId).Scan(&entry.Id, &entry.Name, &entry.PlanId, &entry.Claimed, &entry.Status, &entry.Username, &entry.Password, &entry.Endpoint)
+	return &task, nil
+}
+
+// Returns the most recent task carrying out an operation of the platform on the resource (a resumed
+// provision, an update or a deprovision), including tasks marked deleted.
+func (b *PostgresStorage) GetLastOperationTask(dbId string) (*Task, error) {
+	var task Task
+	err := b.db.QueryRow("select task, action, resource, status, retries, metadata, result, started, finished, request_id from tasks where resource = $1 and action in ('resume-provision', 'change-providers', 'change-plans', 'update-settings', 'delete') order by created desc limit 1", dbId).Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Started, &task.Finished, &task.RequestId)
 	if err != nil && err.Error() == "sql: no rows in result set" {
-		tx.Rollback()
-		return nil, errors.New("Cannot find resource instance")
+		return nil, errors.New("Not found")
 	} else if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
+	return &task, nil
+}
 
-	if _, err = tx.Exec("insert into resources (id, name, plan, claimed, status, username, password, endpoint) values ($1, $2, $3, true, $4, $5, $6, $7)", InstanceId, entry.Name, entry.PlanId, entry.Status, entry.Username, entry.Password, entry.Endpoint); err != nil {
-		tx.Rollback()
+// Returns the most recent tasks of the resource (up to the limit), newest first.
+func (b *PostgresStorage) GetTasks(dbId string, limit int) ([]Task, error) {
+	rows, err := b.db.Query("select task, action, resource, status, retries, metadata, result, started, finished, request_id from tasks where resource = $1 and deleted = false order by created desc limit $2", dbId, limit)
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	tasks := make([]Task, 0)
+	for rows.Next() {
+		var task Task
+		if err := rows.Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Started, &task.Finished, &task.RequestId); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
 
-	if _, err = tx.Exec("update tasks set resource = $2 where resource = $1 and deleted = false", entry.Id, InstanceId); err != nil {
-		tx.Rollback()
+// Returns the most recently updated tasks (of any resource) with the status, newest first.
+func (b *PostgresStorage) GetTasksByStatus(status string, limit int) ([]Task, error) {
+	rows, err := b.db.Query("select task, action, resource, status, retries, metadata, result, started, finished, request_id from tasks where status = $1 and deleted = false order by updated desc limit $2", status, limit)
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	tasks := make([]Task, 0)
+	for rows.Next() {
+		var task Task
+		if err := rows.Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Started, &task.Finished, &task.RequestId); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
 
-	if _, err = tx.Exec("delete from resources where id = $1 and deleted = false and claimed = false", entry.Id); err != nil {
-		tx.Rollback()
+// The task with the plan and organization of the resource it's for, these are empty when the
+// resource no longer exists.
+type TaskContext struct {
+	Task
+	PlanId       string
+	Organization string
+}
+
+func (b *PostgresStorage) GetTaskContext(Id string) (*TaskContext, error) {
+	var task TaskContext
+	err := b.db.QueryRow("select tasks.task, tasks.action, tasks.resource, tasks.status, tasks.retries, tasks.metadata, tasks.result, tasks.started, tasks.finished, tasks.request_id, coalesce(resources.plan::text, ''), coalesce(resources.organization, '') from tasks left join resources on resources.id = tasks.resource where tasks.task = $1", Id).Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Started, &task.Finished, &task.RequestId, &task.PlanId, &task.Organization)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, errors.New("Not found")
+	} else if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// WorkerActivity is how many tasks are waiting for the worker and when it last started one.
+type WorkerActivity struct {
+	Pending     int
+	LastStarted *time.Time
+}
+
+func (b *PostgresStorage) GetWorkerActivity() (*WorkerActivity, error) {
+	var activity WorkerActivity
+	err := b.db.QueryRow("select ( select count(*) from tasks where status = 'pending' and deleted = false ), ( select max(started) from tasks )").Scan(&activity.Pending, &activity.LastStarted)
+	if err != nil {
 		return nil, err
 	}
+	return &activity, nil
+}
 
-	entry.Claimed = true
-	entry.Id = InstanceId
+// Returns a failed task to the queue with its retries reset, only failed tasks can be requeued.
+func (b *PostgresStorage) RequeueTask(Id string) error {
+	var task string
+	err := b.db.QueryRow("update tasks set status = 'pending', retries = 0, finished = null where task = $1 and status = 'failed' and deleted = false returning task", Id).Scan(&task)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return errors.New("Not found")
+	}
+	return err
+}
 
-	if err = tx.Commit(); err != nil {
+// Claims a preprovisioned resource by changing its id to the instance id in a single statement,
+// concurrent claims skip rows locked by each other rather than claiming the same resource. The
+// claim is recorded in the claims table.
+func (b *PostgresStorage) GetUnclaimedInstance(PlanId string, InstanceId string) (*Entry, error) {
+	var entry Entry
+	err := b.db.QueryRow(`
+        with candidate as (
+            select id from resources where claimed = false and status = 'available' and deleted = false and id != $1 and plan = $2 limit 1 for update skip locked
+        ), claim as (
+            update resources set id = $1, claimed = true from candidate
+            where resources.id = candidate.id and resources.claimed = false
+            returning candidate.id as pool_id, resources.id, resources.name, resources.plan, resources.claimed, resources.status, resources.username, resources.password, resources.endpoint, resources.region
+        ), recorded as (
+            insert into claims (pool_id, instance, name, plan) select pool_id, id, name, plan from claim
+        )
+        select id, name, plan, claimed, status, username, password, endpoint, region from claim
+    `, InstanceId, PlanId).Scan(&entry.Id, &entry.Name, &entry.PlanId, &entry.Claimed, &entry.Status, &entry.Username, &entry.Password, &entry.Endpoint, &entry.Region)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, errors.New("Cannot find resource instance")
+	} else if err != nil {
 		return nil, err
 	}
-	return &entry, err
+	return &entry, nil
 }
 
 func (b *PostgresStorage) ReturnClaimedInstance(Id string) error {
-	rows, err := b.db.Exec("update resources set claimed = false, id = uuid_generate_v4()::varchar(1024) where id = $1 and status = 'available' and deleted = false and claimed = true", Id)
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Exec("update resources set claimed = false, id = uuid_generate_v4()::varchar(1024) where id = $1 and status = 'available' and deleted = false and claimed = true", Id)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	count, err := rows.RowsAffected()
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	if count != 1 {
+		tx.Rollback()
 		return errors.New("invalid count returned after trying to return unclaimed db " + Id)
 	}
-	return nil
+	if _, err = tx.Exec("update claims set released = now() where instance = $1 and released is null", Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 func (b *PostgresStorage) AddInstance(Instance *Instance) error {
-	_, err := b.db.Exec("insert into resources (id, name, plan, claimed, status, username, password, endpoint) values ($1, $2, $3, true, $4, $5, $6, $7)", Instance.Id, Instance.Name, Instance.Plan.ID, Instance.Status, Instance.Username, Instance.Password, Instance.Endpoint)
+	_, err := b.db.Exec("insert into resources (id, name, plan, claimed, status, username, password, endpoint, region) values ($1, $2, $3, true, $4, $5, $6, $7, $8)", Instance.Id, Instance.Name, Instance.Plan.ID, Instance.Status, Instance.Username, Instance.Password, Instance.Endpoint, Instance.Region)
 	return err
 }
 
-func (b *PostgresStorage) NukeInstance(Id string) error {
-	_, err := b.db.Exec("delete from resources where id = $1", Id)
+// Records an instance for a bucket that exists but is not tracked, it fails if a (not deleted)
+// instance already has the bucket's name.
+func (b *PostgresStorage) AdoptInstance(Instance *Instance, Claimed bool, Organization string) error {
+	var count int64
+	if err := b.db.QueryRow("select count(*) from resources where name = $1 and deleted = false", Instance.Name).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("Already tracked")
+	}
+	_, err := b.db.Exec("insert into resources (id, name, plan, claimed, status, username, password, endpoint, region, organization) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)", Instance.Id, Instance.Name, Instance.Plan.ID, Claimed, Instance.Status, Instance.Username, Instance.Password, Instance.Endpoint, Instance.Region, Organization)
 	return err
 }
 
-func (b *PostgresStorage) DeleteInstance(Instance *Instance) error {
-	b.db.Exec("update tasks set deleted = true where resource = $1", Instance.Id)
-	_, err := b.db.Exec("update resources set deleted = true where id = $1", Instance.Id)
+// Returns the organization and space that own (or owned, if it was deprovisioned) the instance.
+func (b *PostgresStorage) GetInstanceOwner(Id string) (string, string, error) {
+	var organization, space string
+	err := b.db.QueryRow("select organization, space from resources where id = $1", Id).Scan(&organization, &space)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return "", "", errors.New("Cannot find resource instance")
+	}
+	return organization, space, err
+}
+
+func (b *PostgresStorage) SetInstanceOwner(Id string, Organization string, Space string) error {
+	_, err := b.db.Exec("update resources set organization = $2, space = $3 where id = $1", Id, Organization, Space)
 	return err
 }
 
-func (b *PostgresStorage) UpdateInstance(Instance *Instance, PlanId string) error {
-	_, err := b.db.Exec("update resources set plan = $1, endpoint = $2, status = $3, username = $4, password = $5, name = $6 where id = $7", PlanId, Instance.Endpoint, Instance.Status, Instance.Username, Instance.Password, Instance.Name, Instance.Id)
+func (b *PostgresStorage) SetDeletionProtection(Id string, Protected bool) error {
+	_, err := b.db.Exec("update resources set deletion_protection = $2 where id = $1", Id, Protected)
 	return err
 }
 
-func (b *PostgresStorage) UpdateCredentials(Instance *Instance, User *User) error {
-	_, err := b.db.Exec("update resources set username = $1, password=$2 where id = $3", User.AccessKeyId, User.SecretAccessKey, Instance.Id)
+func (b *PostgresStorage) SetFrozen(Id string, Frozen bool) error {
+	_, err := b.db.Exec("update resources set frozen = $2 where id = $1", Id, Frozen)
 	return err
 }
 
-func (b *PostgresStorage) ValidateInstanceID(id string) error {
-	var count int64
-	err := b.db.QueryRow("select count(*) from resources where id = $1", id).Scan(&count)
-	if err != nil {
-		return err
+func (b *PostgresStorage) IsFrozen(Id string) (bool, error) {
+	var frozen bool
+	err := b.db.QueryRow("select frozen from resources where id = $1 and deleted = false", Id).Scan(&frozen)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return false, errors.New("Cannot find resource instance")
 	}
-	if count != 0 {
-		return errors.New("The instance id is already in use (even if deleted)")
+	return frozen, err
+}
+
+func (b *PostgresStorage) SetInstanceAlias(Id string, Alias string) error {
+	_, err := b.db.Exec("update resources set alias = $2 where id = $1", Id, Alias)
+	return err
+}
+
+func (b *PostgresStorage) IsDeletionProtected(Id string) (bool, error) {
+	var protected bool
+	err := b.db.QueryRow("select deletion_protection from resources where id = $1 and deleted = false", Id).Scan(&protected)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return false, errors.New("Cannot find resource instance")
 	}
-	return nil
+	return protected, err
 }
 
-func (b *PostgresStorage) StartProvisioningTasks() ([]Entry, error) {
-	var sqlSelectToProvisionQuery = `
-        select 
-            plans.plan,
-            plans.preprovision - ( select count(*) from resources where resources.claimed = false and (resources.status = 'available' or resources.status = 'creating' or resources.status = 'provisioning' or resources.status = 'backing-up' or resources.status = 'starting') and resources.deleted = false and plan = plans.plan ) as needed
-        from 
+// GetExceededQuota returns the quota that would be exceeded by provisioning another instance of
+// the plan in the organization and space, or nil if there's room. Quotas specific to the
+// organization override the defaults (with an empty organization) of the same kind.
+func (b *PostgresStorage) GetExceededQuota(PlanId string, Organization string, Space string) (*Quota, error) {
+	var quota Quota
+	err := b.db.QueryRow(`
+        select quota, organization, space, plan, max_instances, instances from (
+            select
+                q.quota,
+                q.organization,
+                q.space,
+                coalesce(q.plan::text, '') as plan,
+                q.max_instances,
+                ( select count(*) from resources where resources.claimed = true and resources.deleted = false and resources.organization = $2 and (q.space = '' or resources.space = q.space) and (q.plan is null or resources.plan = q.plan) ) as instances
+            from (
+                select distinct on (space <> '', plan is null) quota, organization, space, plan, max_instances
+                from quotas
+                where deleted = false and organization in ('', $2) and space in ('', $3) and (plan is null or plan::varchar(1024) = $1::varchar(1024))
+                order by space <> '', plan is null, organization desc
+            ) q
+        ) applicable
+        where instances >= max_instances
+        limit 1`, PlanId, Organization, Space).Scan(&quota.Id, &quota.Organization, &quota.Space, &quota.PlanId, &quota.MaxInstances, &quota.Instances)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// Returns the claimed instances without usage recorded for the period starting at periodStart.
+func (b *PostgresStorage) GetUnmeteredInstanceIds(periodStart time.Time) ([]string, error) {
+	rows, err := b.db.Query("select id from resources where claimed = true and deleted = false and status = 'available' and not exists (select 1 from usage where usage.resource = resources.id and usage.period_start = $1)", periodStart)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Returns the ids of every available resource, claimed or in the preprovisioned pool.
+// Lists the instances with the status and plan, either may be empty to list every one, newest first.
+func (b *PostgresStorage) ListInstances(Status string, PlanId string) ([]InstanceSummary, error) {
+	rows, err := b.db.Query("select id, name, plan, status, claimed, region, alias, organization, frozen, created from resources where deleted = false and ($1 = '' or status = $1) and ($2 = '' or plan::varchar(1024) = $2) order by created desc", Status, PlanId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	instances := make([]InstanceSummary, 0)
+	for rows.Next() {
+		var instance InstanceSummary
+		if err := rows.Scan(&instance.Id, &instance.Name, &instance.PlanId, &instance.Status, &instance.Claimed, &instance.Region, &instance.Alias, &instance.Organization, &instance.Frozen, &instance.Created); err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, rows.Err()
+}
+
+func (b *PostgresStorage) GetAvailableInstanceIds() ([]string, error) {
+	rows, err := b.db.Query("select id from resources where deleted = false and status = 'available'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (b *PostgresStorage) AddAccessKeyAudit(Audit *AccessKeyAudit) error {
+	byteData, err := json.Marshal(Audit)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("insert into key_audits (report, created) values ($1, $2)", string(byteData), Audit.Created)
+	return err
+}
+
+func (b *PostgresStorage) GetLastAccessKeyAudit() (*AccessKeyAudit, error) {
+	var report string
+	err := b.db.QueryRow("select report from key_audits order by created desc limit 1").Scan(&report)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, errors.New("Not found")
+	} else if err != nil {
+		return nil, err
+	}
+	var audit AccessKeyAudit
+	if err = json.Unmarshal([]byte(report), &audit); err != nil {
+		return nil, err
+	}
+	return &audit, nil
+}
+
+// AddUsage records the usage unless it was already recorded for the period (e.g., by another
+// worker), the returned bool is true when it was added.
+func (b *PostgresStorage) AddUsage(usage *Usage) (bool, error) {
+	res, err := b.db.Exec("insert into usage (resource, period_start, period_end, bytes, objects, requests, request_metrics) values ($1, $2, $3, $4, $5, $6, $7) on conflict (resource, period_start) do nothing", usage.Resource, usage.Start, usage.End, usage.Bytes, usage.Objects, usage.Requests, usage.RequestMetrics)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count == 1, nil
+}
+
+func (b *PostgresStorage) GetUsage(Id string) ([]Usage, error) {
+	rows, err := b.db.Query("select resource, period_start, period_end, bytes, objects, requests, request_metrics from usage where resource = $1 order by period_start desc limit 100", Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usages := make([]Usage, 0)
+	for rows.Next() {
+		var usage Usage
+		if err := rows.Scan(&usage.Resource, &usage.Start, &usage.End, &usage.Bytes, &usage.Objects, &usage.Requests, &usage.RequestMetrics); err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	return usages, rows.Err()
+}
+
+func (b *PostgresStorage) AddRotation(Id string, OldKey string, NewKey string, Actor string, RequestId string) error {
+	_, err := b.db.Exec("insert into rotations (resource, old_key, new_key, actor, request_id) values ($1, $2, $3, $4, $5)", Id, OldKey, NewKey, Actor, RequestId)
+	return err
+}
+
+// Returns the most recent rotations of the resource, newest first.
+func (b *PostgresStorage) GetRotations(Id string) ([]Rotation, error) {
+	rows, err := b.db.Query("select old_key, new_key, actor, request_id, created from rotations where resource = $1 order by created desc limit 100", Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rotations := make([]Rotation, 0)
+	for rows.Next() {
+		var rotation Rotation
+		if err := rows.Scan(&rotation.OldAccessKeyId, &rotation.NewAccessKeyId, &rotation.Actor, &rotation.RequestId, &rotation.Created); err != nil {
+			return nil, err
+		}
+		rotations = append(rotations, rotation)
+	}
+	return rotations, rows.Err()
+}
+
+func (b *PostgresStorage) AddBinding(Binding *Binding) error {
+	_, err := b.db.Exec("insert into bindings (binding, resource, predecessor, access_key, secret_key, format, inherited) values ($1, $2, $3, $4, $5, $6, $7) on conflict (binding) do update set resource = excluded.resource, predecessor = excluded.predecessor, access_key = excluded.access_key, secret_key = excluded.secret_key, format = excluded.format, inherited = excluded.inherited, deleted = false", Binding.Id, Binding.InstanceId, Binding.Predecessor, Binding.AccessKeyId, Binding.SecretAccessKey, Binding.Format, Binding.Inherited)
+	return err
+}
+
+func (b *PostgresStorage) GetBinding(Id string) (*Binding, error) {
+	var binding Binding
+	err := b.db.QueryRow("select binding, resource, predecessor, access_key, secret_key, format, inherited, created from bindings where binding = $1 and deleted = false", Id).Scan(&binding.Id, &binding.InstanceId, &binding.Predecessor, &binding.AccessKeyId, &binding.SecretAccessKey, &binding.Format, &binding.Inherited, &binding.Created)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, errors.New("Not found")
+	} else if err != nil {
+		return nil, err
+	}
+	return &binding, nil
+}
+
+// Returns the recorded bindings of the resource, oldest first.
+func (b *PostgresStorage) GetBindings(Id string) ([]Binding, error) {
+	rows, err := b.db.Query("select binding, resource, predecessor, access_key, secret_key, format, inherited, created from bindings where resource = $1 and deleted = false order by created", Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bindings := make([]Binding, 0)
+	for rows.Next() {
+		var binding Binding
+		if err := rows.Scan(&binding.Id, &binding.InstanceId, &binding.Predecessor, &binding.AccessKeyId, &binding.SecretAccessKey, &binding.Format, &binding.Inherited, &binding.Created); err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings, rows.Err()
+}
+
+func (b *PostgresStorage) DeleteBinding(Id string) error {
+	_, err := b.db.Exec("update bindings set deleted = true where binding = $1", Id)
+	return err
+}
+
+// Returns whether any binding of the resource (other than the one given) uses the access key. Keys
+// inherited from bindings created before bindings were recorded are always bound, as the other
+// (unrecorded) bindings using them can't be known.
+func (b *PostgresStorage) IsAccessKeyBound(Id string, AccessKeyId string, ExceptBindingId string) (bool, error) {
+	var count int64
+	if err := b.db.QueryRow("select count(*) from bindings where resource = $1 and access_key = $2 and ((binding <> $3 and deleted = false) or inherited = true)", Id, AccessKeyId, ExceptBindingId).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Returns the ids of the bindings of the resource by the access key they use.
+func (b *PostgresStorage) GetAccessKeyBindings(Id string) (map[string][]string, error) {
+	rows, err := b.db.Query("select access_key, binding from bindings where resource = $1 and access_key <> '' and deleted = false order by created", Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bindings := make(map[string][]string)
+	for rows.Next() {
+		var accessKey, binding string
+		if err := rows.Scan(&accessKey, &binding); err != nil {
+			return nil, err
+		}
+		bindings[accessKey] = append(bindings[accessKey], binding)
+	}
+	return bindings, rows.Err()
+}
+
+// Returns the claimed instances created before the time that had no requests in any period starting
+// since. The periods must cover the whole time since (without gaps, up to the metering interval at
+// either end) and all have request metrics, otherwise missing usage would look like no requests.
+func (b *PostgresStorage) FindIdleInstanceIds(since time.Time, interval time.Duration) ([]string, error) {
+	rows, err := b.db.Query(`
+        select resources.id from resources join usage on usage.resource = resources.id
+        where resources.deleted = false and resources.claimed = true and resources.created < $1 and usage.period_start >= $1
+        group by resources.id
+        having sum(usage.requests) = 0 and bool_and(usage.request_metrics)
+            and min(usage.period_start) < $1 + make_interval(secs => $2)
+            and max(usage.period_end) > now() - make_interval(secs => $2 * 2)
+            and sum(extract(epoch from usage.period_end - usage.period_start)) >= extract(epoch from max(usage.period_end) - min(usage.period_start))`, since, interval.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (b *PostgresStorage) GetIdleInstances() ([]IdleInstance, error) {
+	rows, err := b.db.Query(`
+        select
+            resources.id, resources.name, resources.plan, resources.status, resources.claimed, resources.region, resources.alias, resources.organization, resources.frozen, resources.created,
+            idle_instances.detected, idle_instances.tagged,
+            ( select max(usage.period_end) from usage where usage.resource = resources.id and usage.requests > 0 ),
+            coalesce(( select usage.bytes from usage where usage.resource = resources.id order by usage.period_start desc limit 1 ), 0)
+        from idle_instances join resources on resources.id = idle_instances.resource
+        where resources.deleted = false
+        order by idle_instances.detected`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	instances := make([]IdleInstance, 0)
+	for rows.Next() {
+		var instance IdleInstance
+		if err := rows.Scan(&instance.Id, &instance.Name, &instance.PlanId, &instance.Status, &instance.Claimed, &instance.Region, &instance.Alias, &instance.Organization, &instance.Frozen, &instance.Created, &instance.Detected, &instance.Tagged, &instance.LastRequest, &instance.Bytes); err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, rows.Err()
+}
+
+func (b *PostgresStorage) AddIdleInstance(Id string) error {
+	_, err := b.db.Exec("insert into idle_instances (resource) values ($1) on conflict (resource) do nothing", Id)
+	return err
+}
+
+func (b *PostgresStorage) SetIdleInstanceTagged(Id string) error {
+	_, err := b.db.Exec("update idle_instances set tagged = true where resource = $1", Id)
+	return err
+}
+
+func (b *PostgresStorage) RemoveIdleInstance(Id string) error {
+	_, err := b.db.Exec("delete from idle_instances where resource = $1", Id)
+	return err
+}
+
+func (b *PostgresStorage) AddExpiration(expiration *Expiration) error {
+	_, err := b.db.Exec("insert into expirations (resource, expires, webhook, secret) values ($1, $2, $3, $4) on conflict (resource) do update set expires = excluded.expires, webhook = excluded.webhook, secret = excluded.secret, warned = null", expiration.InstanceId, expiration.Expires, expiration.Webhook, expiration.Secret)
+	return err
+}
+
+func (b *PostgresStorage) SetOwnerWebhook(Id string, Webhook string, Secret string) error {
+	_, err := b.db.Exec("insert into owner_webhooks (resource, webhook, secret) values ($1, $2, $3) on conflict (resource) do update set webhook = excluded.webhook, secret = excluded.secret", Id, Webhook, Secret)
+	return err
+}
+
+// Returns the webhook and secret of the instance's owner.
+func (b *PostgresStorage) GetOwnerWebhook(Id string) (string, string, error) {
+	var webhook, secret string
+	err := b.db.QueryRow("select webhook, secret from owner_webhooks where resource = $1", Id).Scan(&webhook, &secret)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return "", "", errors.New("Not found")
+	}
+	return webhook, secret, err
+}
+
+func (b *PostgresStorage) GetExpiration(Id string) (*Expiration, error) {
+	var expiration Expiration
+	err := b.db.QueryRow("select resource, expires, webhook, secret, warned from expirations where resource = $1", Id).Scan(&expiration.InstanceId, &expiration.Expires, &expiration.Webhook, &expiration.Secret, &expiration.Warned)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, errors.New("Not found")
+	} else if err != nil {
+		return nil, err
+	}
+	return &expiration, nil
+}
+
+// Returns the expirations of (not deleted) instances that expire before the time, soonest first.
+func (b *PostgresStorage) GetExpirations(before time.Time) ([]Expiration, error) {
+	rows, err := b.db.Query("select expirations.resource, expirations.expires, expirations.webhook, expirations.secret, expirations.warned from expirations join resources on resources.id = expirations.resource where resources.deleted = false and expirations.expires < $1 order by expirations.expires", before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	expirations := make([]Expiration, 0)
+	for rows.Next() {
+		var expiration Expiration
+		if err := rows.Scan(&expiration.InstanceId, &expiration.Expires, &expiration.Webhook, &expiration.Secret, &expiration.Warned); err != nil {
+			return nil, err
+		}
+		expirations = append(expirations, expiration)
+	}
+	return expirations, rows.Err()
+}
+
+func (b *PostgresStorage) SetExpirationWarned(Id string) error {
+	_, err := b.db.Exec("update expirations set warned = now() where resource = $1", Id)
+	return err
+}
+
+func (b *PostgresStorage) RemoveExpiration(Id string) error {
+	_, err := b.db.Exec("delete from expirations where resource = $1", Id)
+	return err
+}
+
+func (b *PostgresStorage) AddKeyReactivation(Id string, AccessKeyId string, Actor string) error {
+	_, err := b.db.Exec("insert into key_reactivations (access_key, resource, actor) values ($1, $2, $3) on conflict (access_key) do update set actor = excluded.actor, created = now()", AccessKeyId, Id, Actor)
+	return err
+}
+
+// Returns when each access key of the resource was last reactivated.
+func (b *PostgresStorage) GetKeyReactivations(Id string) (map[string]time.Time, error) {
+	rows, err := b.db.Query("select access_key, created from key_reactivations where resource = $1", Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reactivations := make(map[string]time.Time)
+	for rows.Next() {
+		var accessKey string
+		var created time.Time
+		if err := rows.Scan(&accessKey, &created); err != nil {
+			return nil, err
+		}
+		reactivations[accessKey] = created
+	}
+	return reactivations, rows.Err()
+}
+
+// Moves the bindings using an access key that has been rotated (and removed) to its replacement.
+func (b *PostgresStorage) ReplaceBindingKey(Id string, OldKey string, User *User) error {
+	_, err := b.db.Exec("update bindings set access_key = $1, secret_key = $2 where resource = $3 and access_key = $4 and deleted = false", User.AccessKeyId, User.SecretAccessKey, Id, OldKey)
+	return err
+}
+
+func (b *PostgresStorage) AddBackup(Backup *Backup) error {
+	_, err := b.db.Exec("insert into backups (backup, resource, name, kind, status) values ($1, $2, $3, $4, $5) on conflict (backup) do nothing", Backup.Id, Backup.InstanceId, Backup.Name, Backup.Kind, Backup.Status)
+	return err
+}
+
+// Records the backup as finished with a status of available or failed, and its size.
+func (b *PostgresStorage) FinishBackup(Id string, Status string, Objects int64, Bytes int64) error {
+	_, err := b.db.Exec("update backups set status = $2, objects = $3, bytes = $4, finished = now() where backup = $1", Id, Status, Objects, Bytes)
+	return err
+}
+
+func (b *PostgresStorage) GetBackup(Id string) (*Backup, error) {
+	var backup Backup
+	err := b.db.QueryRow("select backup, resource, name, kind, status, objects, bytes, created, finished from backups where backup = $1", Id).Scan(&backup.Id, &backup.InstanceId, &backup.Name, &backup.Kind, &backup.Status, &backup.Objects, &backup.Bytes, &backup.Created, &backup.Finished)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, errors.New("Not found")
+	} else if err != nil {
+		return nil, err
+	}
+	return &backup, nil
+}
+
+func (b *PostgresStorage) GetBackups(Id string) ([]Backup, error) {
+	rows, err := b.db.Query("select backup, resource, name, kind, status, objects, bytes, created, finished from backups where resource = $1 order by created desc", Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	backups := make([]Backup, 0)
+	for rows.Next() {
+		var backup Backup
+		if err := rows.Scan(&backup.Id, &backup.InstanceId, &backup.Name, &backup.Kind, &backup.Status, &backup.Objects, &backup.Bytes, &backup.Created, &backup.Finished); err != nil {
+			return nil, err
+		}
+		backups = append(backups, backup)
+	}
+	return backups, rows.Err()
+}
+
+func (b *PostgresStorage) GetStorageQuota(Id string) (*StorageQuota, error) {
+	var quota StorageQuota
+	err := b.db.QueryRow("select resource, quota_bytes, bytes, status, updated from storage_quotas where resource = $1", Id).Scan(&quota.InstanceId, &quota.QuotaBytes, &quota.Bytes, &quota.Status, &quota.Updated)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, errors.New("Not found")
+	} else if err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+func (b *PostgresStorage) SetStorageQuota(Quota *StorageQuota) error {
+	_, err := b.db.Exec("insert into storage_quotas (resource, quota_bytes, bytes, status) values ($1, $2, $3, $4) on conflict (resource) do update set quota_bytes = $2, bytes = $3, status = $4", Quota.InstanceId, Quota.QuotaBytes, Quota.Bytes, Quota.Status)
+	return err
+}
+
+func (b *PostgresStorage) AddAlert(Alert *Alert) (string, error) {
+	var id string
+	err := b.db.QueryRow("insert into alerts (resource, metric, threshold, webhook, secret) values ($1, $2, $3, $4, $5) returning alert", Alert.InstanceId, Alert.Metric, Alert.Threshold, Alert.Webhook, Alert.Secret).Scan(&id)
+	return id, err
+}
+
+func (b *PostgresStorage) GetAlerts(Id string) ([]Alert, error) {
+	rows, err := b.db.Query("select alert, resource, metric, threshold, webhook, secret, triggered, created from alerts where resource = $1 order by created", Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	alerts := make([]Alert, 0)
+	for rows.Next() {
+		var alert Alert
+		if err := rows.Scan(&alert.Id, &alert.InstanceId, &alert.Metric, &alert.Threshold, &alert.Webhook, &alert.Secret, &alert.Triggered, &alert.Created); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, rows.Err()
+}
+
+// Deletes an alert of the instance, the alert id must be a uuid.
+func (b *PostgresStorage) DeleteAlert(Id string, AlertId string) error {
+	res, err := b.db.Exec("delete from alerts where resource = $1 and alert::varchar = $2", Id, AlertId)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return errors.New("Not found")
+	}
+	return nil
+}
+
+func (b *PostgresStorage) SetAlertTriggered(AlertId string, Triggered bool) error {
+	if Triggered {
+		_, err := b.db.Exec("update alerts set triggered = now() where alert = $1", AlertId)
+		return err
+	}
+	_, err := b.db.Exec("update alerts set triggered = null where alert = $1", AlertId)
+	return err
+}
+
+func (b *PostgresStorage) AddPolicyVersion(Version *PolicyVersion) (string, error) {
+	var id string
+	err := b.db.QueryRow("insert into policy_versions (resource, policy, reason) values ($1, $2, $3) returning version", Version.InstanceId, Version.Policy, Version.Reason).Scan(&id)
+	return id, err
+}
+
+// The policy versions of the resource, newest first.
+func (b *PostgresStorage) GetPolicyVersions(Id string) ([]PolicyVersion, error) {
+	rows, err := b.db.Query("select version, resource, policy, reason, created from policy_versions where resource = $1 order by created desc", Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := make([]PolicyVersion, 0)
+	for rows.Next() {
+		var version PolicyVersion
+		if err := rows.Scan(&version.Id, &version.InstanceId, &version.Policy, &version.Reason, &version.Created); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+func (b *PostgresStorage) GetPolicyVersion(Id string, VersionId string) (*PolicyVersion, error) {
+	var version PolicyVersion
+	err := b.db.QueryRow("select version, resource, policy, reason, created from policy_versions where resource = $1 and version::text = $2", Id, VersionId).Scan(&version.Id, &version.InstanceId, &version.Policy, &version.Reason, &version.Created)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, errors.New("Not found")
+	} else if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+func (b *PostgresStorage) GetCustomerKey(Id string) (string, error) {
+	var encryptedKey string
+	err := b.db.QueryRow("select encrypted_key from customer_keys where resource = $1", Id).Scan(&encryptedKey)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return "", errors.New("Not found")
+	}
+	return encryptedKey, err
+}
+
+// Adds the key unless the resource already has one, the key the resource ends up with is returned
+// so bindings created at the same time agree on it.
+func (b *PostgresStorage) AddCustomerKey(Id string, EncryptedKey string) (string, error) {
+	if _, err := b.db.Exec("insert into customer_keys (resource, encrypted_key) values ($1, $2) on conflict (resource) do nothing", Id, EncryptedKey); err != nil {
+		return "", err
+	}
+	return b.GetCustomerKey(Id)
+}
+
+func (b *PostgresStorage) NukeInstance(Id string) error {
+	_, err := b.db.Exec("delete from resources where id = $1", Id)
+	return err
+}
+
+func (b *PostgresStorage) DeleteInstance(Instance *Instance) error {
+	b.db.Exec("update tasks set deleted = true where resource = $1", Instance.Id)
+	b.db.Exec("update claims set released = now() where instance = $1 and released is null", Instance.Id)
+	b.db.Exec("update bindings set deleted = true where resource = $1", Instance.Id)
+	b.db.Exec("delete from owner_webhooks where resource = $1", Instance.Id)
+	_, err := b.db.Exec("update resources set deleted = true where id = $1", Instance.Id)
+	return err
+}
+
+func (b *PostgresStorage) UpdateInstance(Instance *Instance, PlanId string) error {
+	_, err := b.db.Exec("update resources set plan = $1, endpoint = $2, status = $3, username = $4, password = $5, name = $6, region = $7 where id = $8", PlanId, Instance.Endpoint, Instance.Status, Instance.Username, Instance.Password, Instance.Name, Instance.Region, Instance.Id)
+	return err
+}
+
+func (b *PostgresStorage) UpdateCredentials(Instance *Instance, User *User) error {
+	_, err := b.db.Exec("update resources set username = $1, password=$2 where id = $3", User.AccessKeyId, User.SecretAccessKey, Instance.Id)
+	return err
+}
+
+func (b *PostgresStorage) ValidateInstanceID(id string) error {
+	var count int64
+	err := b.db.QueryRow("select count(*) from resources where id = $1", id).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		return errors.New("The instance id is already in use (even if deleted)")
+	}
+	return nil
+}
+
+// Provisions unfinished after this long are assumed to have died with the broker running them.
+const staleProvisionInterval = "15 minutes"
+
+// Registers a provision of the instance, false is returned when another provision of it is already
+// in flight (or has succeeded). Failed provisions and unfinished provisions older than
+// staleProvisionInterval are taken over.
+func (b *PostgresStorage) StartProvision(Id string, PlanId string, RequestId string) (bool, error) {
+	var instance string
+	err := b.db.QueryRow(`
+        insert into provisions (instance, plan, request_id) values ($1, $2, $3)
+        on conflict (instance) do update set plan = excluded.plan, request_id = excluded.request_id, started = now(), finished = null, available = null, error = ''
+            where (provisions.finished is null and provisions.started < now() - interval '`+staleProvisionInterval+`') or provisions.error <> ''
+        returning instance`, Id, PlanId, RequestId).Scan(&instance)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Marks the provision request finished, a request that failed is kept with its error (and can be
+// retried, see StartProvision).
+func (b *PostgresStorage) FinishProvision(Id string, Succeeded bool) error {
+	if Succeeded {
+		_, err := b.db.Exec("update provisions set finished = now() where instance = $1", Id)
+		return err
+	}
+	return b.FailProvision(Id, "The provision request failed.")
+}
+
+// Records when the provisioned bucket became available, only the first time.
+func (b *PostgresStorage) ProvisionAvailable(Id string) error {
+	_, err := b.db.Exec("update provisions set available = now() where instance = $1 and available is null and error = ''", Id)
+	return err
+}
+
+// Records that the provision failed (e.g., the worker gave up resuming it) unless its bucket was
+// already available.
+func (b *PostgresStorage) FailProvision(Id string, Error string) error {
+	_, err := b.db.Exec("update provisions set finished = coalesce(finished, now()), error = $2 where instance = $1 and available is null", Id, Error)
+	return err
+}
+
+func (b *PostgresStorage) IsProvisioning(Id string) (bool, error) {
+	var count int64
+	err := b.db.QueryRow("select count(*) from provisions where instance = $1 and finished is null and started > now() - interval '"+staleProvisionInterval+"'", Id).Scan(&count)
+	return count > 0, err
+}
+
+// GetPoolStatus returns the number of unclaimed (preprovisioned) instances for each plan. When
+// none are available the wait is estimated from how long the last week of preprovisioned
+// instances took to become available.
+func (b *PostgresStorage) GetPoolStatus() ([]PoolStatus, error) {
+	rows, err := b.db.Query(`
+        select
+            plans.plan,
+            plans.preprovision,
+            ( select count(*) from resources where resources.claimed = false and resources.status = 'available' and resources.deleted = false and resources.plan = plans.plan ) as available,
+            ( select count(*) from resources where resources.claimed = false and resources.status <> 'available' and resources.deleted = false and resources.plan = plans.plan ) as provisioning,
+            ( select coalesce(avg(extract(epoch from resources.updated - resources.created)), 0)::bigint from resources where resources.claimed = false and resources.status = 'available' and resources.plan = plans.plan and resources.created > now() - interval '7 days' ) as provision_seconds
+        from
+            plans join services on plans.service = services.service
+        where
+            plans.deleted = false and
+            plans.regions = '' and
+            services.deleted = false
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make([]PoolStatus, 0)
+	for rows.Next() {
+		var status PoolStatus
+		var provisionSeconds int64
+		if err := rows.Scan(&status.PlanId, &status.Target, &status.Available, &status.Provisioning, &provisionSeconds); err != nil {
+			return nil, err
+		}
+		if status.Available == 0 {
+			status.EstimatedWait = provisionSeconds
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, rows.Err()
+}
+
+// Failures are preprovisions recorded with AddPoolFailure and resumed preprovisions that gave up.
+func (b *PostgresStorage) GetPoolHealth() ([]PoolHealth, error) {
+	rows, err := b.db.Query(`
+        select
+            plans.plan,
+            plans.preprovision,
+            ( select count(*) from resources where resources.claimed = false and resources.status = 'available' and resources.deleted = false and resources.plan = plans.plan ) as available,
+            ( select count(*) from resources where resources.claimed = false and resources.status <> 'available' and resources.deleted = false and resources.plan = plans.plan ) as provisioning,
+            ( select count(*) from pool_failures where pool_failures.plan = plans.plan::varchar(1024) and pool_failures.created > now() - interval '1 day' ) +
+            ( select count(*) from tasks join resources on tasks.resource = resources.id where resources.claimed = false and resources.deleted = false and resources.plan = plans.plan and tasks.action = 'resume-provision' and tasks.status = 'failed' and tasks.finished > now() - interval '1 day' ) as failed,
+            coalesce(( select pool_failures.error from pool_failures where pool_failures.plan = plans.plan::varchar(1024) order by pool_failures.created desc limit 1 ), '') as last_failure,
+            ( select coalesce(extract(epoch from now() - min(resources.created)), 0)::bigint from resources where resources.claimed = false and resources.status = 'available' and resources.deleted = false and resources.plan = plans.plan ) as oldest_available_seconds,
+            coalesce(( select greatest(needed, 0) from (` + toProvisionQuery + `) to_provision where to_provision.plan = plans.plan ), 0) as to_provision
+        from
+            plans join services on plans.service = services.service
+        where
+            plans.deleted = false and
+            plans.regions = '' and
+            services.deleted = false
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pools := make([]PoolHealth, 0)
+	for rows.Next() {
+		var pool PoolHealth
+		if err := rows.Scan(&pool.PlanId, &pool.Target, &pool.Available, &pool.Provisioning, &pool.Failed, &pool.LastFailure, &pool.OldestAvailableSeconds, &pool.ToProvision); err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return pools, rows.Err()
+}
+
+func (b *PostgresStorage) GetTaskReports(since time.Time) ([]TaskReport, error) {
+	rows, err := b.db.Query(`
+        select
+            action,
+            count(*),
+            count(*) filter (where status = 'finished'),
+            count(*) filter (where status = 'failed'),
+            count(*) filter (where status = 'pending' or status = 'started'),
+            coalesce(avg(retries), 0)::float8,
+            coalesce(percentile_cont(0.5) within group (order by extract(epoch from finished - created)) filter (where status = 'finished'), 0)::float8,
+            coalesce(percentile_cont(0.95) within group (order by extract(epoch from finished - created)) filter (where status = 'finished'), 0)::float8
+        from tasks
+        where created > $1
+        group by action
+        order by action
+    `, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reports := make([]TaskReport, 0)
+	for rows.Next() {
+		var report TaskReport
+		if err := rows.Scan(&report.Action, &report.Total, &report.Finished, &report.Failed, &report.Pending, &report.AverageRetries, &report.P50Seconds, &report.P95Seconds); err != nil {
+			return nil, err
+		}
+		if report.Finished+report.Failed > 0 {
+			report.SuccessRate = float64(report.Finished) / float64(report.Finished+report.Failed)
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+func (b *PostgresStorage) GetProvisionReport(since time.Time, sloSeconds float64) (*ProvisionReport, error) {
+	report := ProvisionReport{SLOSeconds: sloSeconds}
+	var within int64
+	err := b.db.QueryRow(`
+        select
+            count(*),
+            count(*) filter (where available is not null),
+            count(*) filter (where error <> ''),
+            count(*) filter (where available is not null and extract(epoch from available - started) <= $2),
+            coalesce(percentile_cont(0.5) within group (order by extract(epoch from available - started)) filter (where available is not null), 0)::float8,
+            coalesce(percentile_cont(0.95) within group (order by extract(epoch from available - started)) filter (where available is not null), 0)::float8
+        from provisions
+        where started > $1
+    `, since, sloSeconds).Scan(&report.Total, &report.Finished, &report.Failed, &within, &report.P50Seconds, &report.P95Seconds)
+	if err != nil {
+		return nil, err
+	}
+	if sloSeconds > 0 && report.Finished > 0 {
+		report.WithinSLO = float64(within) / float64(report.Finished)
+	}
+	return &report, nil
+}
+
+func (b *PostgresStorage) AddPoolFailure(PlanId string, Error string) error {
+	_, err := b.db.Exec("insert into pool_failures (plan, error) values ($1, $2)", PlanId, Error)
+	return err
+}
+
+// Changes the number of instances preprovisioned for a plan, workers listening for changes
+// (see ListenForPreprovisionChanges) are notified so the pool is reconciled right away.
+func (b *PostgresStorage) SetPreprovision(PlanId string, Preprovision int) error {
+	res, err := b.db.Exec("update plans set preprovision = $2 where plan::varchar(1024) = $1::varchar(1024) and regions = '' and deleted = false", PlanId, Preprovision)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("Not found")
+	}
+	_, err = b.db.Exec("select pg_notify('preprovision', $1)", PlanId)
+	return err
+}
+
+// Returns the organizations allowed to use each restricted plan, by plan id.
+func (b *PostgresStorage) GetPlanOrganizations() (map[string][]string, error) {
+	rows, err := b.db.Query("select plan, organization from plan_organizations order by plan, organization")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	organizations := make(map[string][]string)
+	for rows.Next() {
+		var plan, organization string
+		if err := rows.Scan(&plan, &organization); err != nil {
+			return nil, err
+		}
+		organizations[plan] = append(organizations[plan], organization)
+	}
+	return organizations, rows.Err()
+}
+
+// Replaces the organizations allowed to use the plan, an empty list makes the plan available to everyone.
+func (b *PostgresStorage) SetPlanOrganizations(PlanId string, Organizations []string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	var count int64
+	if err = tx.QueryRow("select count(*) from plans where plan::varchar(1024) = $1::varchar(1024) and deleted = false", PlanId).Scan(&count); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count == 0 {
+		tx.Rollback()
+		return errors.New("Not found")
+	}
+	if _, err = tx.Exec("delete from plan_organizations where plan::varchar(1024) = $1::varchar(1024)", PlanId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, organization := range Organizations {
+		if _, err = tx.Exec("insert into plan_organizations (plan, organization) values ($1, $2) on conflict do nothing", PlanId, organization); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// The ids of plans whose preprovision count changed are sent on the returned channel until the
+// context is done, the listener reconnects on its own if the connection is lost.
+func (b *PostgresStorage) ListenForPreprovisionChanges(ctx context.Context) (<-chan string, error) {
+	listener := pq.NewListener(b.url, time.Second*10, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			glog.Errorf("Preprovision change listener error: %s\n", err.Error())
+		}
+	})
+	if err := listener.Listen("preprovision"); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	changes := make(chan string)
+	go (func() {
+		defer listener.Close()
+		defer close(changes)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case notification := <-listener.Notify:
+				// A nil notification means the connection was re-established, changes may have been missed.
+				planId := ""
+				if notification != nil {
+					planId = notification.Extra
+				}
+				select {
+				case changes <- planId:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	})()
+	return changes, nil
+}
+
+// The number of resources each plan needs to preprovision, this may be negative when the pool is
+// larger than the plan's preprovision count.
+const toProvisionQuery = `
+        select 
+            plans.plan,
+            plans.preprovision - ( select count(*) from resources where resources.claimed = false and (resources.status = 'available' or resources.status = 'creating' or resources.status = 'provisioning' or resources.status = 'backing-up' or resources.status = 'starting') and resources.deleted = false and plan = plans.plan ) as needed
+        from 
             plans join services on plans.service = services.service 
         where 
             plans.deprecated = false and 
             plans.deleted = false and 
+            plans.regions = '' and
             services.deleted = false and 
             services.deprecated = false
     `
 
-	rows, err := b.db.Query(sqlSelectToProvisionQuery)
+func (b *PostgresStorage) StartProvisioningTasks() ([]Entry, error) {
+	rows, err := b.db.Query(toProvisionQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -554,7 +2143,7 @@ func (b *PostgresStorage) StartProvisioningTasks() ([]Entry, error) {
 
 func (b *PostgresStorage) GetInstance(Id string) (*Entry, error) {
 	var entry Entry
-	err := b.db.QueryRow("select id, name, plan, claimed, status, username, password, endpoint, (select count(*) from tasks where tasks.resource=resources.id and tasks.status = 'started' and tasks.deleted = false) as tasks from resources where id = $1 and deleted = false", Id).Scan(&entry.Id, &entry.Name, &entry.PlanId, &entry.Claimed, &entry.Status, &entry.Username, &entry.Password, &entry.Endpoint, &entry.Tasks)
+	err := b.db.QueryRow("select id, name, plan, claimed, status, username, password, endpoint, region, alias, (select count(*) from tasks where tasks.resource=resources.id and tasks.status = 'started' and tasks.deleted = false) as tasks from resources where id = $1 and deleted = false", Id).Scan(&entry.Id, &entry.Name, &entry.PlanId, &entry.Claimed, &entry.Status, &entry.Username, &entry.Password, &entry.Endpoint, &entry.Region, &entry.Alias, &entry.Tasks)
 
 	if err != nil && err.Error() == "sql: no rows in result set" {
 		return nil, errors.New("Cannot find resource instance")
@@ -564,9 +2153,14 @@ func (b *PostgresStorage) GetInstance(Id string) (*Entry, error) {
 	return &entry, nil
 }
 
-func (b *PostgresStorage) AddTask(Id string, action TaskAction, metadata string) (string, error) {
+func (b *PostgresStorage) AddTask(Id string, action TaskAction, metadata string, requestId string) (string, error) {
 	var task_id string
-	return task_id, b.db.QueryRow("insert into tasks (task, resource, action, metadata) values (uuid_generate_v4(), $1, $2, $3) returning task", Id, action, metadata).Scan(&task_id)
+	return task_id, b.db.QueryRow("insert into tasks (task, resource, action, metadata, request_id) values (uuid_generate_v4(), $1, $2, $3, $4) returning task", Id, action, metadata, requestId).Scan(&task_id)
+}
+
+func (b *PostgresStorage) AddEvent(Id string, eventType string, description string, metadata string) error {
+	_, err := b.db.Exec("insert into events (event, resource, type, description, metadata) values (uuid_generate_v4(), $1, $2, $3, $4)", Id, eventType, description, metadata)
+	return err
 }
 
 func (b *PostgresStorage) UpdateTask(Id string, status *string, retries *int64, metadata *string, result *string, started *time.Time, finsihed *time.Time) error {
@@ -593,15 +2187,21 @@ func (b *PostgresStorage) PopPendingTask() (*Task, error) {
             status = 'started', 
             started = now() 
         where 
-            task in ( select task from tasks where status = 'pending' and deleted = false order by updated asc limit 1)
-        returning task, action, resource, status, retries, metadata, result, started, finished
-    `).Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Started, &task.Finished)
+            task in ( select task from tasks where status = 'pending' and deleted = false and (not_before is null or not_before <= now()) order by updated asc limit 1)
+        returning task, action, resource, status, retries, metadata, result, started, finished, request_id
+    `).Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Started, &task.Finished, &task.RequestId)
 	if err != nil {
 		return nil, err
 	}
 	return &task, nil
 }
 
+// Keeps the task from being popped until notBefore.
+func (b *PostgresStorage) DelayTask(Id string, notBefore time.Time) error {
+	_, err := b.db.Exec("update tasks set not_before = $2 where task = $1", Id, notBefore)
+	return err
+}
+
 func InitStorage(ctx context.Context, o Options) (*PostgresStorage, error) {
 	// Sanity checks
 	if o.DatabaseUrl == "" && os.Getenv("DATABASE_URL") != "" {
@@ -610,20 +2210,58 @@ func InitStorage(ctx context.Context, o Options) (*PostgresStorage, error) {
 	if o.DatabaseUrl == "" {
 		return nil, errors.New("Unable to connect to resource, none was specified in the environment via resource_URL or through the -resource cli option.")
 	}
+	if o.DatabaseMaxOpenConns == 0 && os.Getenv("DATABASE_MAX_OPEN_CONNS") != "" {
+		o.DatabaseMaxOpenConns, _ = strconv.Atoi(os.Getenv("DATABASE_MAX_OPEN_CONNS"))
+	}
+	if o.DatabaseMaxIdleConns == 0 && os.Getenv("DATABASE_MAX_IDLE_CONNS") != "" {
+		o.DatabaseMaxIdleConns, _ = strconv.Atoi(os.Getenv("DATABASE_MAX_IDLE_CONNS"))
+	}
+	if o.DatabaseConnMaxLifetime == 0 && os.Getenv("DATABASE_CONN_MAX_LIFETIME") != "" {
+		o.DatabaseConnMaxLifetime, _ = time.ParseDuration(os.Getenv("DATABASE_CONN_MAX_LIFETIME"))
+	}
 	db, err := sql.Open("postgres", o.DatabaseUrl)
 	if err != nil {
 		glog.Errorf("Unable to create resource schema: %s\n", err.Error())
 		return nil, errors.New("Unable to create resource schema: " + err.Error())
 	}
+	if o.DatabaseMaxOpenConns > 0 {
+		db.SetMaxOpenConns(o.DatabaseMaxOpenConns)
+	}
+	if o.DatabaseMaxIdleConns > 0 {
+		db.SetMaxIdleConns(o.DatabaseMaxIdleConns)
+	}
+	if o.DatabaseConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(o.DatabaseConnMaxLifetime)
+	}
 
-	_, err = db.Exec(sqlCreateScript)
-	if err != nil {
-		return nil, err
+	// The database may be briefly unavailable (e.g., during a failover or when both are started
+	// together), keep trying for a few minutes before giving up.
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		_, err = db.Exec(sqlCreateScript)
+		if err == nil {
+			break
+		}
+		if attempt >= 10 {
+			db.Close()
+			return nil, err
+		}
+		glog.Errorf("Unable to connect to the database (attempt %d), retrying in %s: %s\n", attempt, delay, err.Error())
+		select {
+		case <-ctx.Done():
+			db.Close()
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay < time.Second*30 {
+			delay = delay * 2
+		}
 	}
 
 	go cancelOnInterrupt(ctx, db)
 
 	return &PostgresStorage{
-		db: db,
+		db:  db,
+		url: o.DatabaseUrl,
 	}, nil
 }
@@ -5,12 +5,20 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -26,43 +34,155 @@ const (
 	ChangePlansTask						 TaskAction = "change-plans"
 	RestoreDbTask						 TaskAction = "restore-database"
 	PerformPostProvisionTask			 TaskAction = "perform-post-provision"
+	PurgeTask							 TaskAction = "purge"
+	BackupTask							 TaskAction = "backup"
+	PerformPostClaimTask				 TaskAction = "perform-post-claim"
+	UpdateSettingsTask					 TaskAction = "update-settings"
+	NotifyDeprovisionServiceWebhookTask	 TaskAction = "notify-deprovision-service-webhook"
+	NotifyUpdateServiceWebhookTask		 TaskAction = "notify-update-service-webhook"
+	ResumeProvisionTask					 TaskAction = "resume-provision"
+	RotateCredentialsTask				 TaskAction = "rotate-credentials"
+	TransferOwnershipTask				 TaskAction = "transfer-ownership"
+	NotifyAlertWebhookTask				 TaskAction = "notify-alert-webhook"
+	LegalHoldTask						 TaskAction = "legal-hold"
+	CreateFoldersTask					 TaskAction = "create-folders"
+	SeedTask							 TaskAction = "seed"
+	NotifyExpiryWebhookTask				 TaskAction = "notify-expiry-webhook"
+	NotifyOwnerWebhookTask				 TaskAction = "notify-owner-webhook"
 )
 
+// Task is a task for the worker, the metadata is never returned by the admin api as it may hold
+// secrets (e.g., of webhooks).
 type Task struct {
-	Id         string
-	Action     TaskAction
-	ResourceId string
-	Status     string
-	Retries    int64
-	Metadata   string
-	Result     string
-	Started    *time.Time
-	Finished   *time.Time
+	Id         string     `json:"id"`
+	Action     TaskAction `json:"action"`
+	ResourceId string     `json:"resource"`
+	Status     string     `json:"status"`
+	Retries    int64      `json:"retries"`
+	Metadata   string     `json:"-"`
+	Result     string     `json:"result"`
+	Started    *time.Time `json:"started,omitempty"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	RequestId  string     `json:"request_id,omitempty"`
 }
 
+// The retry policy of a webhook is set when it's scheduled, MaxAttempts defaults to 1 (no retries),
+// Backoff is the number of seconds before the first retry (60 by default) and Timeout is the
+// number of seconds each attempt may take (WEBHOOK_TIMEOUT by default).
 type WebhookTaskMetadata struct {
-	Url    string `json:"url"`
-	Secret string `json:"secret"`
+	Url         string     `json:"url"`
+	Secret      string     `json:"secret"`
+	MaxAttempts int        `json:"max_attempts,omitempty"`
+	Backoff     int64      `json:"backoff,omitempty"`
+	Timeout     int64      `json:"timeout,omitempty"`
+	Attempts    int        `json:"attempts,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	// Signature is how deliveries are signed, the broker's defaults are used when it's not set.
+	Signature *WebhookSignature `json:"signature,omitempty"`
+	// Description is sent by webhooks that aren't about an operation (such as alerts).
+	Description string `json:"description,omitempty"`
+	// Task is the task carrying out the operation (update or deprovision), the webhook reports how it
+	// ended once it has.
+	Task string `json:"task,omitempty"`
+	// State is sent by webhooks to the owner of an instance (see ScheduleOwnerWebhook).
+	State string `json:"state,omitempty"`
 }
 
+// ChangeProvidersTaskMetadata is the plan a bucket is moving to and how far the move got, Step is the
+// next step to run (see UpgradeAcrossProviders) and Source the bucket being moved from once the new
+// bucket has taken its place.
 type ChangeProvidersTaskMetadata struct {
-	Plan string `json:"plan"`
+	Plan   string                 `json:"plan"`
+	Step   string                 `json:"step,omitempty"`
+	Source *ChangeProvidersSource `json:"source,omitempty"`
+}
+
+// The bucket an instance is moving from, its credentials aren't kept (they're no longer needed).
+type ChangeProvidersSource struct {
+	Name       string `json:"name"`
+	Plan       string `json:"plan"`
+	Region     string `json:"region,omitempty"`
+	ProviderId string `json:"provider_id,omitempty"`
 }
 
+const (
+	ChangeProvidersStepCopy        = "copy"
+	ChangeProvidersStepDeprovision = "deprovision"
+)
+
 type ChangePlansTaskMetadata struct {
 	Plan string `json:"plan"`
 }
 
+// RestoreDbTaskMetadata is the backup to restore, SourceInstance and SourceName are the instance and
+// bucket the backup was taken of when it's restored into a new instance.
 type RestoreDbTaskMetadata struct {
+	Backup         string               `json:"backup"`
+	SourceInstance string               `json:"source_instance,omitempty"`
+	SourceName     string               `json:"source_name,omitempty"`
+	Verification   *RestoreVerification `json:"verification,omitempty"`
+	// Started is set once the restore-started event is recorded, so retries don't record it again.
+	Started bool `json:"started,omitempty"`
+}
+
+type BackupTaskMetadata struct {
 	Backup string `json:"backup"`
 }
 
+type PerformPostClaimTaskMetadata struct {
+	Owner string `json:"owner"`
+}
+
+// LegalHoldTaskMetadata is the prefix (empty for the whole bucket) a legal hold is placed on, or
+// removed from when On is false.
+type LegalHoldTaskMetadata struct {
+	Prefix string `json:"prefix"`
+	On     bool   `json:"on"`
+}
+
+// CreateFoldersTaskMetadata is the folders (see ParseFolders) to create once the bucket is available.
+type CreateFoldersTaskMetadata struct {
+	Folders []string `json:"folders"`
+}
+
+// Records the instance as creating and schedules the rest of its provisioning, the task's metadata
+// is the progress so far.
+func ScheduleResumeProvision(storage Storage, Id string, plan *ProviderPlan, progress *ProvisionProgress, requestId string) error {
+	Instance := progress.instance(Id, plan)
+	Instance.Status = "creating"
+	Instance.Ready = false
+	if err := storage.UpdateInstance(Instance, plan.ID); err != nil {
+		return err
+	}
+	byteData, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	_, err = storage.AddTask(Id, ResumeProvisionTask, string(byteData), requestId)
+	return err
+}
+
+// Removes what a provision that won't be finished created, if anything is left behind it's logged
+// and a notification is sent as it must be deleted by hand.
+func RollbackProvision(provider Provider, plan *ProviderPlan, progress *ProvisionProgress) error {
+	err := provider.RollbackProvision(plan, progress)
+	if err != nil {
+		glog.Errorf("Error: Unable to roll back the provision, WE HAVE AN ORPHAN! (%s): %s\n", progress.Name, err.Error())
+		SendNotification("orphan-"+progress.Name, "Orphaned bucket", "The bucket "+progress.Name+" was partially provisioned and could not be removed, it must be deleted by hand: "+err.Error())
+	}
+	return err
+}
+
 func FinishedTask(storage Storage, taskId string, retries int64, result string, status string) {
 	var t = time.Now()
 	err := storage.UpdateTask(taskId, &status, &retries, nil, &result, nil, &t)
 	if err != nil {
 		glog.Errorf("Unable to update task %s due to: %s (taskId: %s, retries: %d, result: [%s], status: [%s]\n", taskId, err.Error(), taskId, retries, result, status)
 	}
+	if status == "failed" {
+		SendNotification("task-"+taskId, "Task failed", "Task "+taskId+" failed: "+result)
+		datadogTaskFailed(storage, taskId, result)
+	}
 }
 
 func UpdateTaskStatus(storage Storage, taskId string, retries int64, result string, status string) {
@@ -70,9 +190,83 @@ func UpdateTaskStatus(storage Storage, taskId string, retries int64, result stri
 	if err != nil {
 		glog.Errorf("Unable to update task %s due to: %s (taskId: %s, retries: %d, result: [%s], status: [%s]\n", taskId, err.Error(), taskId, retries, result, status)
 	}
+	if status == "failed" {
+		SendNotification("task-"+taskId, "Task failed", "Task "+taskId+" failed: "+result)
+		datadogTaskFailed(storage, taskId, result)
+	}
+}
+
+// Tasks that change a bucket's objects fail once it's frozen (the freeze may be newer than the task)
+// rather than retrying until their limit, the broker isn't exempt from the freeze.
+func failIfFrozen(storage Storage, task *Task, Instance *Instance) bool {
+	frozen, err := storage.IsFrozen(Instance.Id)
+	if err != nil {
+		UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get frozen: "+err.Error(), "pending")
+		return true
+	}
+	if frozen {
+		FinishedTask(storage, task.Id, task.Retries, "The instance is frozen, unfreeze it and try again.", "failed")
+		return true
+	}
+	return false
+}
+
+// Puts back a task waiting for its instance's bucket to be created, the task fails with a queued
+// provision that failed. Waiting on a queued provision isn't a retry, otherwise it is (the bucket
+// should already be there).
+func waitForBucket(storage Storage, taskId string, retries int64, Instance *Instance) {
+	provision, err := storage.GetLastTask(Instance.Id, ResumeProvisionTask)
+	if err == nil && provision.Status == "failed" {
+		FinishedTask(storage, taskId, retries, "The bucket could not be provisioned ("+provision.Result+")", "failed")
+	} else if err == nil && (provision.Status == "pending" || provision.Status == "started") {
+		UpdateTaskStatus(storage, taskId, retries, "The bucket is not available yet ("+Instance.Status+")", "pending")
+	} else {
+		UpdateTaskStatus(storage, taskId, retries+1, "The bucket is not available yet ("+Instance.Status+")", "pending")
+	}
+}
+
+// With PROVISION_QUEUE set to true provisioning never calls AWS while the request waits, new buckets
+// are always created (and preprovisioned buckets claimed) by the worker.
+func GetProvisionQueue() bool {
+	return os.Getenv("PROVISION_QUEUE") == "true"
+}
+
+// Records the instance as provisioning and schedules the worker to provision it from the start.
+func QueueProvision(storage Storage, Id string, plan *ProviderPlan, progress *ProvisionProgress, requestId string) error {
+	Instance := progress.instance(Id, plan)
+	Instance.Status = "provisioning"
+	Instance.Ready = false
+	if err := storage.AddInstance(Instance); err != nil {
+		return err
+	}
+	byteData, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	_, err = storage.AddTask(Id, ResumeProvisionTask, string(byteData), requestId)
+	return err
+}
+
+// Removes the resource of a preprovision that failed and records the failure for the pool health.
+func FailedPreprovision(storage Storage, entry Entry, reason string) {
+	if err := storage.NukeInstance(entry.Id); err != nil {
+		glog.Errorf("Unable to remove failed preprovision %s: %s\n", entry.Id, err.Error())
+	}
+	if err := storage.AddPoolFailure(entry.PlanId, reason); err != nil {
+		glog.Errorf("Unable to record failed preprovision of plan %s: %s\n", entry.PlanId, err.Error())
+	}
 }
 
 func RunPreprovisionTasks(ctx context.Context, o Options, namePrefix string, storage Storage, wait int64) {
+	if statuses, err := storage.GetPoolStatus(); err != nil {
+		glog.Errorf("Unable to get the preprovisioned pool status: %s\n", err.Error())
+	} else {
+		for _, status := range statuses {
+			if status.Target > 0 && status.Available == 0 {
+				SendNotification("pool-"+status.PlanId, "Preprovision pool empty", "There are no preprovisioned buckets available for plan "+status.PlanId+", new buckets will be created on demand.")
+			}
+		}
+	}
 	t := time.NewTicker(time.Second * time.Duration(wait))
 	dbEntries, err := storage.StartProvisioningTasks()
 	if err != nil {
@@ -85,20 +279,29 @@ func RunPreprovisionTasks(ctx context.Context, o Options, namePrefix string, sto
 		plan, err := storage.GetPlanByID(entry.PlanId)
 		if err != nil {
 			glog.Errorf("Unable to provision, cannot find plan: %s, %s\n", entry.PlanId, err.Error())
-			storage.NukeInstance(entry.Id)
+			FailedPreprovision(storage, entry, "Cannot find plan: "+err.Error())
 			continue
 		}
 		provider, err := GetProviderByPlan(namePrefix, plan)
 		if err != nil {
 			glog.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
-			storage.NukeInstance(entry.Id)
+			FailedPreprovision(storage, entry, "Cannot find provider: "+err.Error())
 			continue
 		}
 
-		Instance, err := provider.Provision(entry.Id, plan, "preprovisioned")
-		if err != nil {
+		progress := &ProvisionProgress{Owner: "preprovisioned"}
+		Instance, err := provider.ResumeProvision(entry.Id, plan, progress)
+		if err != nil && progress.Name != "" {
+			glog.Errorf("Error provisioning database (%s), resuming from the %s step later: %s\n", plan.ID, progress.Step, err.Error())
+			if err = ScheduleResumeProvision(storage, entry.Id, plan, progress, ""); err != nil {
+				glog.Errorf("Error: Unable to schedule resuming the provision (%s), rolling it back: %s\n", progress.Name, err.Error())
+				RollbackProvision(provider, plan, progress)
+				FailedPreprovision(storage, entry, "Cannot resume provisioning: "+err.Error())
+			}
+			continue
+		} else if err != nil {
 			glog.Errorf("Error provisioning database (%s): %s\n", plan.ID, err.Error())
-			storage.NukeInstance(entry.Id)
+			FailedPreprovision(storage, entry, err.Error())
 			continue
 		}
 
@@ -107,14 +310,16 @@ func RunPreprovisionTasks(ctx context.Context, o Options, namePrefix string, sto
 
 			if err = provider.Deprovision(Instance, false); err != nil {
 				glog.Errorf("Error cleaning up (deprovision failed) after insert record failed but provision succeeded (Database Id:%s Name: %s) %s\n", Instance.Id, Instance.Name, err.Error())
-				if _, err = storage.AddTask(Instance.Id, DeleteTask, Instance.Name); err != nil {
+				if _, err = storage.AddTask(Instance.Id, DeleteTask, Instance.Name, ""); err != nil {
 					glog.Errorf("Error: Unable to add task to delete instance, WE HAVE AN ORPHAN! (%s): %s\n", Instance.Name, err.Error())
+					SendNotification("orphan-"+Instance.Name, "Orphaned bucket", "The bucket "+Instance.Name+" was preprovisioned but could not be recorded or removed, it must be deleted by hand.")
 				}
 			}
 			continue
 		}
+		RecordPolicyVersion(storage, provider, Instance, "provisioned")
 		if !IsAvailable(Instance.Status) {
-			if _, err = storage.AddTask(Instance.Id, ResyncFromProviderUntilAvailableTask, ""); err != nil {
+			if _, err = storage.AddTask(Instance.Id, ResyncFromProviderUntilAvailableTask, "", ""); err != nil {
 				glog.Errorf("Error: Unable to schedule resync from provider! (%s): %s\n", Instance.Name, err.Error())
 			}
 		}
@@ -125,9 +330,23 @@ func RunPreprovisionTasks(ctx context.Context, o Options, namePrefix string, sto
 
 func TickTocPreprovisionTasks(ctx context.Context, o Options, namePrefix string, storage Storage) {
 	next_check := time.NewTicker(time.Second * 60 * 5)
+	changes, err := storage.ListenForPreprovisionChanges(ctx)
+	if err != nil {
+		glog.Errorf("Unable to listen for preprovision changes, the pool will only be checked every 5 minutes: %s\n", err.Error())
+	}
 	for {
 		RunPreprovisionTasks(ctx, o, namePrefix, storage, 60)
-		<-next_check.C
+		select {
+		case <-ctx.Done():
+			return
+		case <-next_check.C:
+		case planId, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			glog.Infof("The preprovision count of plan %s changed, reconciling the pool.\n", planId)
+		}
 	}
 }
 
@@ -149,9 +368,6 @@ func UpgradeWithinProviders(storage Storage, fromDb *Instance, toPlanId string,
 
 	// This could take a very long time.
 	Instance, err := fromProvider.Modify(fromDb, toPlan)
-	if err != nil && err.Error() == "This feature is not available on this plan." {
-		return UpgradeAcrossProviders(storage, fromDb, toPlanId, namePrefix)
-	}
 	if err != nil {
 		return "", err
 	}
@@ -160,20 +376,434 @@ func UpgradeWithinProviders(storage Storage, fromDb *Instance, toPlanId string,
 		glog.Errorf("ERROR: Cannot update instance in database after upgrade change %s (to plan: %s) %s\n", Instance.Name, Instance.Plan.ID, err.Error())
 		return "", err
 	}
+	PublishEvent(PlanChangedEvent, Instance, "", "")
 
 	if !IsAvailable(Instance.Status) {
-		if _, err = storage.AddTask(Instance.Id, ResyncFromProviderTask, ""); err != nil {
+		if _, err = storage.AddTask(Instance.Id, ResyncFromProviderTask, "", ""); err != nil {
 			glog.Errorf("Error: Unable to schedule resync from provider! (%s): %s\n", Instance.Name, err.Error())
 		}
 	}
 	return "", err
 }
 
-func UpgradeAcrossProviders(storage Storage, fromDb *Instance, toPlanId string, namePrefix string) (string, error) {
-	return "", errors.New("Memcached and redis instances cannot be upgraded across providers.")
+// Moves the instance to a plan on another provider (if CanChangeProviders allows the pair) in steps:
+// a bucket is provisioned on the new provider and takes the instance's place, the objects are copied
+// to it from the previous bucket and the previous bucket is deprovisioned. The progress is kept in
+// the task's metadata after each step so a failed step is retried rather than starting over.
+// Bindings keep the previous bucket's credentials, they must be recreated once the move finishes.
+func UpgradeAcrossProviders(storage Storage, fromDb *Instance, taskId string, progress *ChangeProvidersTaskMetadata, namePrefix string) (string, error) {
+	save := func() {
+		if byteData, err := json.Marshal(progress); err == nil {
+			metadata := string(byteData)
+			if err = storage.UpdateTask(taskId, nil, nil, &metadata, nil, nil, nil); err != nil {
+				glog.Errorf("Unable to record the progress of changing providers (task %s): %s\n", taskId, err.Error())
+			}
+		}
+	}
+	toPlan, err := storage.GetPlanByID(progress.Plan)
+	if err != nil {
+		return "", err
+	}
+	toProvider, err := GetProviderByPlan(namePrefix, toPlan)
+	if err != nil {
+		return "", err
+	}
+
+	if progress.Source == nil {
+		if !CanChangeProviders(fromDb.Plan.Provider, toPlan.Provider) {
+			return "", errors.New("Provider change not allowed")
+		}
+		organization, _, err := storage.GetInstanceOwner(fromDb.Id)
+		if err != nil {
+			return "", err
+		}
+		region := ""
+		if PlanAllowsRegion(toPlan, fromDb.Region) {
+			region = fromDb.Region
+		}
+		Instance, err := toProvider.Provision(fromDb.Id, toPlan, organization, region)
+		if err != nil {
+			return "", err
+		}
+		if err = storage.UpdateInstance(Instance, toPlan.ID); err != nil {
+			glog.Errorf("Unable to record the new bucket %s of %s, removing it: %s\n", Instance.Name, fromDb.Id, err.Error())
+			if derr := toProvider.Deprovision(Instance, false); derr != nil {
+				glog.Errorf("Error: Unable to remove the new bucket, WE HAVE AN ORPHAN! (%s): %s\n", Instance.Name, derr.Error())
+			}
+			return "", err
+		}
+		progress.Source = &ChangeProvidersSource{Name: fromDb.Name, Plan: fromDb.Plan.ID, Region: fromDb.Region, ProviderId: fromDb.ProviderId}
+		progress.Step = ChangeProvidersStepCopy
+		save()
+		PublishEvent(PlanChangedEvent, Instance, "", "")
+		fromDb = Instance
+	}
+
+	fromPlan, err := storage.GetPlanByID(progress.Source.Plan)
+	if err != nil {
+		return "", err
+	}
+	fromProvider, err := GetProviderByPlan(namePrefix, fromPlan)
+	if err != nil {
+		return "", err
+	}
+	source := &Instance{Id: fromDb.Id, Name: progress.Source.Name, Plan: fromPlan, Region: progress.Source.Region, ProviderId: progress.Source.ProviderId}
+
+	if progress.Step == ChangeProvidersStepCopy {
+		copied := 0
+		err = fromProvider.ReadObjects(source, func(Key string, Body io.Reader) error {
+			copied++
+			return toProvider.WriteObject(fromDb, Key, Body)
+		})
+		if err != nil {
+			return "", err
+		}
+		glog.Infof("Copied %d objects from %s to %s.\n", copied, source.Name, fromDb.Name)
+		progress.Step = ChangeProvidersStepDeprovision
+		save()
+	}
+
+	if err = fromProvider.Deprovision(source, false); err != nil && !isMissing(err) {
+		return "", err
+	}
+	return "The bucket was moved from " + source.Name + " (" + string(fromPlan.Provider) + ") to " + fromDb.Name + " (" + string(toPlan.Provider) + ")", nil
+}
+
+// The worker processes one task at a time, so a webhook endpoint that never responds would stall
+// every other task. WEBHOOK_TIMEOUT (in seconds) bounds each delivery, WEBHOOK_PROXY optionally
+// sends deliveries through a proxy (otherwise HTTP_PROXY/HTTPS_PROXY are honored).
+func NewWebhookClient() (*http.Client, error) {
+	timeout, err := strconv.Atoi(os.Getenv("WEBHOOK_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		timeout = 30
+	}
+	proxy := http.ProxyFromEnvironment
+	if os.Getenv("WEBHOOK_PROXY") != "" {
+		proxyUrl, err := url.Parse(os.Getenv("WEBHOOK_PROXY"))
+		if err != nil {
+			return nil, errors.New("The WEBHOOK_PROXY is not a valid url: " + err.Error())
+		}
+		proxy = http.ProxyURL(proxyUrl)
+	}
+	return &http.Client{
+		Timeout: time.Second * time.Duration(timeout),
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          10,
+			MaxIdleConnsPerHost:   2,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Second * time.Duration(timeout),
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}, nil
+}
+
+// With WEBHOOK_VERIFY set to true the webhook given with a request is sent a signed challenge before
+// the request is accepted, so a mistyped url is rejected right away rather than after every attempt
+// to deliver to it fails.
+func GetWebhookVerify() bool {
+	return os.Getenv("WEBHOOK_VERIFY") == "true"
+}
+
+// WebhookSignature is how webhook bodies are signed: an hmac of the body with the secret using the
+// Algorithm (sha256 or sha512), encoded as hex or base64 in the Header. Timestamped signatures sign
+// "<timestamp>.<body>" and send the unix timestamp in the x-osb-timestamp header, so receivers can
+// reject old (replayed) deliveries.
+type WebhookSignature struct {
+	Algorithm   string `json:"algorithm,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Header      string `json:"header,omitempty"`
+	Timestamped bool   `json:"timestamped,omitempty"`
+}
+
+func (signature WebhookSignature) Validate() error {
+	if signature.Algorithm != "sha256" && signature.Algorithm != "sha512" {
+		return errors.New("The webhook signature algorithm must be sha256 or sha512.")
+	}
+	if signature.Encoding != "base64" && signature.Encoding != "hex" {
+		return errors.New("The webhook signature encoding must be base64 or hex.")
+	}
+	if signature.Header == "" || strings.ContainsAny(signature.Header, " :\r\n") {
+		return errors.New("The webhook signature header is not a valid header name.")
+	}
+	return nil
+}
+
+// The broker's default signature is a base64 hmac-sha256 in the x-osb-signature header, this can be
+// changed with WEBHOOK_SIGNATURE_ALGORITHM, WEBHOOK_SIGNATURE_ENCODING, WEBHOOK_SIGNATURE_HEADER and
+// WEBHOOK_SIGNATURE_TIMESTAMP (true to timestamp signatures). Invalid settings are ignored.
+func GetDefaultWebhookSignature() WebhookSignature {
+	signature := WebhookSignature{Algorithm: "sha256", Encoding: "base64", Header: "x-osb-signature", Timestamped: os.Getenv("WEBHOOK_SIGNATURE_TIMESTAMP") == "true"}
+	configured := signature
+	if os.Getenv("WEBHOOK_SIGNATURE_ALGORITHM") != "" {
+		configured.Algorithm = os.Getenv("WEBHOOK_SIGNATURE_ALGORITHM")
+	}
+	if os.Getenv("WEBHOOK_SIGNATURE_ENCODING") != "" {
+		configured.Encoding = os.Getenv("WEBHOOK_SIGNATURE_ENCODING")
+	}
+	if os.Getenv("WEBHOOK_SIGNATURE_HEADER") != "" {
+		configured.Header = os.Getenv("WEBHOOK_SIGNATURE_HEADER")
+	}
+	if err := configured.Validate(); err != nil {
+		glog.Errorf("The webhook signature settings are not valid, using the defaults: %s\n", err.Error())
+		return signature
+	}
+	return configured
+}
+
+// The signature a webhook given with a request is signed with, the webhook_signature_algorithm,
+// webhook_signature_encoding, webhook_signature_header and webhook_signature_timestamp query
+// parameters override the broker's defaults.
+func GetWebhookSignature(query url.Values) (WebhookSignature, error) {
+	signature := GetDefaultWebhookSignature()
+	if query.Get("webhook_signature_algorithm") != "" {
+		signature.Algorithm = query.Get("webhook_signature_algorithm")
+	}
+	if query.Get("webhook_signature_encoding") != "" {
+		signature.Encoding = query.Get("webhook_signature_encoding")
+	}
+	if query.Get("webhook_signature_header") != "" {
+		signature.Header = query.Get("webhook_signature_header")
+	}
+	if query.Get("webhook_signature_timestamp") != "" {
+		signature.Timestamped = query.Get("webhook_signature_timestamp") == "true"
+	}
+	return signature, signature.Validate()
+}
+
+// Adds the signature of the body (and its timestamp, if timestamped) to the request's headers.
+func (signature WebhookSignature) Sign(req *http.Request, secret string, body []byte) {
+	h := hmac.New(sha256.New, []byte(secret))
+	if signature.Algorithm == "sha512" {
+		h = hmac.New(sha512.New, []byte(secret))
+	}
+	if signature.Timestamped {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("x-osb-timestamp", timestamp)
+		h.Write([]byte(timestamp + "."))
+	}
+	h.Write(body)
+	header := signature.Header
+	if header == "" {
+		header = "x-osb-signature"
+	}
+	if signature.Encoding == "hex" {
+		req.Header.Set(header, hex.EncodeToString(h.Sum(nil)))
+	} else {
+		req.Header.Set(header, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	}
+}
+
+// Posts {"state":"verify","challenge":"..."} (signed like any delivery) to the webhook, which must
+// respond with a 2xx status and the challenge, either as the body or as the challenge of a json body.
+func VerifyWebhook(client *http.Client, webhook string, secret string, signature WebhookSignature, requestId string) error {
+	challenge := RandomString(32)
+	byteData, err := json.Marshal(map[string]interface{}{"state": "verify", "challenge": challenge})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", webhook, bytes.NewReader(byteData))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Header.Add("content-type", "application/json")
+	signature.Sign(req, secret, byteData)
+	if requestId != "" {
+		req.Header.Add("x-request-id", requestId)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("The webhook responded to the challenge with " + resp.Status)
+	}
+	var response struct {
+		Challenge string `json:"challenge"`
+	}
+	if string(bytes.TrimSpace(body)) == challenge || (json.Unmarshal(body, &response) == nil && response.Challenge == challenge) {
+		return nil
+	}
+	return errors.New("The webhook did not respond with the challenge")
+}
+
+// Schedules a webhook to the owner of the instance (the webhook given when it was provisioned) with
+// the state and description, instances provisioned without a webhook are skipped.
+func ScheduleOwnerWebhook(storage Storage, Instance *Instance, State string, Description string) error {
+	webhook, secret, err := storage.GetOwnerWebhook(Instance.Id)
+	if err != nil && err.Error() == "Not found" {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	metadata, err := json.Marshal(WebhookTaskMetadata{Url: webhook, Secret: secret, MaxAttempts: 5, State: State, Description: Description})
+	if err != nil {
+		return err
+	}
+	_, err = storage.AddTask(Instance.Id, NotifyOwnerWebhookTask, string(metadata), "")
+	return err
+}
+
+// Returns the state a webhook reports for the operation carried out by the task (succeeded with the
+// description or failed with the task's result), done is false until the task has finished.
+func operationOutcome(storage Storage, TaskId string, description string) (string, string, bool, error) {
+	operation, err := storage.GetTaskContext(TaskId)
+	if err != nil {
+		return "", "", false, err
+	}
+	switch operation.Status {
+	case "finished":
+		return "succeeded", description, true, nil
+	case "failed":
+		return "failed", operation.Result, true, nil
+	}
+	return "", "", false, nil
+}
+
+// Delivers a webhook about the operation carried out by the webhook task's operation task once it
+// has finished, webhooks scheduled without one are delivered as succeeded once ready says so.
+func deliverOperationWebhook(client *http.Client, storage Storage, task *Task, description string, ready func() (bool, error)) {
+	var taskMetaData WebhookTaskMetadata
+	if err := json.Unmarshal([]byte(task.Metadata), &taskMetaData); err != nil {
+		FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to callback: "+err.Error(), "failed")
+		return
+	}
+	if taskMetaData.Task == "" {
+		if done, err := ready(); err != nil {
+			UpdateTaskStatus(storage, task.Id, task.Retries+1, err.Error(), "pending")
+		} else if !done {
+			UpdateTaskStatus(storage, task.Id, task.Retries+1, "The operation has not finished yet", "pending")
+		} else {
+			DeliverWebhook(client, storage, task, "succeeded", description)
+		}
+		return
+	}
+	state, outcome, done, err := operationOutcome(storage, taskMetaData.Task, description)
+	if err != nil {
+		UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get the task "+taskMetaData.Task+": "+err.Error(), "pending")
+	} else if !done {
+		UpdateTaskStatus(storage, task.Id, task.Retries+1, "The operation has not finished yet", "pending")
+	} else {
+		DeliverWebhook(client, storage, task, state, outcome)
+	}
+}
+
+// Sends the (signed) state of an operation to the webhook in the task's metadata. Failed deliveries
+// are attempted up to the task's max attempts, waiting the backoff (doubled after each attempt, up to
+// an hour) in between. Once the last attempt fails the task fails and the delivery is recorded as a dead
+// letter in the instance's event history.
+func DeliverWebhook(client *http.Client, storage Storage, task *Task, state string, description string) {
+	var taskMetaData WebhookTaskMetadata
+	err := json.Unmarshal([]byte(task.Metadata), &taskMetaData)
+	if err != nil {
+		glog.Infof("Cannot unmarshal task metadata to callback: %s, %s\n", task.Id, err.Error())
+		FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to callback: "+err.Error(), "failed")
+		return
+	}
+	byteData, err := json.Marshal(map[string]interface{}{"state": state, "description": description})
+	if err != nil {
+		UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot marshal webhook to json: "+err.Error(), "pending")
+		return
+	}
+
+	signature := GetDefaultWebhookSignature()
+	if taskMetaData.Signature != nil {
+		signature = *taskMetaData.Signature
+	}
+
+	var result string
+	req, err := http.NewRequest("POST", taskMetaData.Url, bytes.NewReader(byteData))
+	if err != nil {
+		result = "Failed to create http post request: " + err.Error()
+	} else {
+		if taskMetaData.Timeout > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(taskMetaData.Timeout))
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		req.Header.Add("content-type", "application/json")
+		signature.Sign(req, taskMetaData.Secret, byteData)
+		if task.RequestId != "" {
+			req.Header.Add("x-request-id", task.RequestId)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			result = "Failed to send http post operation: " + err.Error()
+		} else {
+			io.Copy(ioutil.Discard, resp.Body) // ignore it, we dont want to hear it (but read it so the connection can be reused).
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode <= 399 {
+				FinishedTask(storage, task.Id, task.Retries, resp.Status, "finished")
+				return
+			}
+			result = "Got invalid http status code from hook: " + resp.Status
+		}
+	}
+
+	taskMetaData.Attempts++
+	maxAttempts := taskMetaData.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	if taskMetaData.Attempts >= maxAttempts {
+		deadLetter, err := json.Marshal(map[string]interface{}{"task": task.Id, "url": taskMetaData.Url, "body": string(byteData), "attempts": taskMetaData.Attempts, "error": result})
+		if err != nil {
+			glog.Errorf("Error: Unable to marshal dead letter for task %s: %s\n", task.Id, err.Error())
+		}
+		if err = storage.AddEvent(task.ResourceId, "webhook-dead-letter", "The webhook could not be delivered after "+strconv.Itoa(taskMetaData.Attempts)+" attempts.", string(deadLetter)); err != nil {
+			glog.Errorf("Error: Unable to record dead letter for task %s: %s\n", task.Id, err.Error())
+		}
+		FinishedTask(storage, task.Id, task.Retries, result, "failed")
+		return
+	}
+
+	// the backoff doubles after each attempt up to an hour, 20 attempts would otherwise wait months
+	// (or overflow).
+	backoff := taskMetaData.Backoff
+	if backoff <= 0 {
+		backoff = 60
+	}
+	for i := 1; i < taskMetaData.Attempts && backoff < 3600; i++ {
+		backoff = backoff * 2
+	}
+	if backoff > 3600 {
+		backoff = 3600
+	}
+	next := time.Now().Add(time.Second * time.Duration(backoff))
+	taskMetaData.NextAttempt = &next
+	metadata, err := json.Marshal(taskMetaData)
+	if err != nil {
+		UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot marshal task metadata: "+err.Error(), "pending")
+		return
+	}
+	status := "pending"
+	metadataString := string(metadata)
+	if err = storage.DelayTask(task.Id, next); err != nil {
+		glog.Errorf("Unable to delay task %s due to: %s\n", task.Id, err.Error())
+	}
+	if err = storage.UpdateTask(task.Id, &status, &task.Retries, &metadataString, &result, nil, nil); err != nil {
+		glog.Errorf("Unable to update task %s due to: %s\n", task.Id, err.Error())
+	}
 }
 
 func RunWorkerTasks(ctx context.Context, o Options, namePrefix string, storage Storage) error {
+	client, err := NewWebhookClient()
+	if err != nil {
+		return err
+	}
 
 	t := time.NewTicker(time.Second * 60)
 	for {
@@ -189,7 +819,7 @@ func RunWorkerTasks(ctx context.Context, o Options, namePrefix string, storage S
 			continue
 		}
 
-		glog.Infof("Started task: %s\n", task.Id)
+		glog.Infof("Started task: %s (request: %s)\n", task.Id, task.RequestId)
 
 		if task.Action == DeleteTask {
 			glog.Infof("Delete and deprovision database for task: %s\n", task.Id)
@@ -206,6 +836,21 @@ func RunWorkerTasks(ctx context.Context, o Options, namePrefix string, storage S
 				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
 				continue
 			}
+			// Deletion protection or freezing may have been turned on since the deprovision was scheduled.
+			protected, err := storage.IsDeletionProtected(Instance.Id)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get deletion protection: "+err.Error(), "pending")
+				continue
+			}
+			frozen, err := storage.IsFrozen(Instance.Id)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get frozen: "+err.Error(), "pending")
+				continue
+			}
+			if protected || frozen {
+				FinishedTask(storage, task.Id, task.Retries, "The instance is deletion protected or frozen, it was not deprovisioned.", "failed")
+				continue
+			}
 			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
 			if err != nil {
 				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
@@ -219,6 +864,7 @@ func RunWorkerTasks(ctx context.Context, o Options, namePrefix string, storage S
 				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to delete: "+err.Error(), "pending")
 				continue
 			}
+			PublishEvent(InstanceDeprovisionedEvent, Instance, "", task.RequestId)
 			FinishedTask(storage, task.Id, task.Retries, "", "finished")
 		} else if task.Action == ResyncFromProviderTask {
 			glog.Infof("Resyncing from provider for task: %s\n", task.Id)
@@ -313,6 +959,9 @@ func RunWorkerTasks(ctx context.Context, o Options, namePrefix string, storage S
 				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to update instance after post provision: "+err.Error(), "pending")
 				continue
 			}
+			if err = storage.ProvisionAvailable(newInstance.Id); err != nil {
+				glog.Errorf("Unable to record that %s is available: %s\n", newInstance.Id, err.Error())
+			}
 
 			FinishedTask(storage, task.Id, task.Retries, "", "finished")
 		} else if task.Action == NotifyCreateServiceWebhookTask {
@@ -333,54 +982,58 @@ func RunWorkerTasks(ctx context.Context, o Options, namePrefix string, storage S
 				continue
 			}
 
-			byteData, err := json.Marshal(map[string]interface{}{"state": "succeeded", "description": "available"})
-			// seems like this would be more useful, but whatevs: byteData, err := json.Marshal(Instance)
-
-			if err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot marshal Instance to json: "+err.Error(), "pending")
+			DeliverWebhook(client, storage, task, "succeeded", "available")
+		} else if task.Action == NotifyDeprovisionServiceWebhookTask {
+			if task.Retries >= 60 {
+				FinishedTask(storage, task.Id, task.Retries, "Unable to deliver webhook: "+task.Result, "failed")
 				continue
 			}
-
-			var taskMetaData WebhookTaskMetadata
-			err = json.Unmarshal([]byte(task.Metadata), &taskMetaData)
-			if err != nil {
-				glog.Infof("Cannot unmarshal task metadata to callback on create service: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to callback on create service: "+err.Error(), "pending")
+			// The instance is removed once it's deprovisioned (possibly by a delete task).
+			deliverOperationWebhook(client, storage, task, "deprovisioned", func() (bool, error) {
+				if _, err := GetInstanceById(namePrefix, storage, task.ResourceId); err == nil {
+					return false, nil
+				} else if err.Error() != "Cannot find resource instance" {
+					return false, errors.New("Cannot get Instance: " + err.Error())
+				}
+				return true, nil
+			})
+		} else if task.Action == NotifyUpdateServiceWebhookTask {
+			if task.Retries >= 60 {
+				FinishedTask(storage, task.Id, task.Retries, "Unable to deliver webhook: "+task.Result, "failed")
 				continue
 			}
-
-			h := hmac.New(sha256.New, []byte(taskMetaData.Secret))
-			h.Write(byteData)
-			sha := base64.StdEncoding.EncodeToString(h.Sum(nil))
-
-			client := &http.Client{}
-			req, err := http.NewRequest("POST", taskMetaData.Url, bytes.NewReader(byteData))
-			if err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to create http post request: "+err.Error(), "pending")
+			deliverOperationWebhook(client, storage, task, "updated", func() (bool, error) {
+				upgrading, err := storage.IsUpgrading(task.ResourceId)
+				if err != nil {
+					return false, errors.New("Cannot get upgrade status: " + err.Error())
+				}
+				Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
+				if err != nil {
+					return false, errors.New("Cannot get Instance: " + err.Error())
+				}
+				return !upgrading && IsAvailable(Instance.Status), nil
+			})
+		} else if task.Action == NotifyAlertWebhookTask {
+			var taskMetaData WebhookTaskMetadata
+			if err := json.Unmarshal([]byte(task.Metadata), &taskMetaData); err != nil {
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to callback: "+err.Error(), "failed")
 				continue
 			}
-			req.Header.Add("content-type", "application/json")
-			req.Header.Add("x-osb-signature", sha)
-			resp, err := client.Do(req)
-			if err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to send http post operation: "+err.Error(), "pending")
+			DeliverWebhook(client, storage, task, "alert", taskMetaData.Description)
+		} else if task.Action == NotifyExpiryWebhookTask {
+			var taskMetaData WebhookTaskMetadata
+			if err := json.Unmarshal([]byte(task.Metadata), &taskMetaData); err != nil {
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to callback: "+err.Error(), "failed")
 				continue
 			}
-			resp.Body.Close() // ignore it, we dont want to hear it.
-
-			if os.Getenv("RETRY_WEBHOOKS") != "" {
-				if resp.StatusCode < 200 || resp.StatusCode > 399 {
-					UpdateTaskStatus(storage, task.Id, task.Retries+1, "Got invalid http status code from hook: "+resp.Status, "pending")
-					continue
-				}
-				FinishedTask(storage, task.Id, task.Retries, resp.Status, "finished")
-			} else {
-				if resp.StatusCode < 200 || resp.StatusCode > 399 {
-					UpdateTaskStatus(storage, task.Id, task.Retries+1, "Got invalid http status code from hook: "+resp.Status, "failed")
-				} else {
-					FinishedTask(storage, task.Id, task.Retries, resp.Status, "finished")
-				}
+			DeliverWebhook(client, storage, task, "expiring", taskMetaData.Description)
+		} else if task.Action == NotifyOwnerWebhookTask {
+			var taskMetaData WebhookTaskMetadata
+			if err := json.Unmarshal([]byte(task.Metadata), &taskMetaData); err != nil {
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to callback: "+err.Error(), "failed")
+				continue
 			}
+			DeliverWebhook(client, storage, task, taskMetaData.State, taskMetaData.Description)
 		} else if task.Action == ChangePlansTask {
 			glog.Infof("Changing plans for database: %s\n", task.Id)
 			if task.Retries >= 60 {
@@ -413,36 +1066,536 @@ func RunWorkerTasks(ctx context.Context, o Options, namePrefix string, storage S
 			glog.Infof("Changing providers for database: %s\n", task.Id)
 			if task.Retries >= 60 {
 				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
-				FinishedTask(storage, task.Id, task.Retries, "Unable to resync information from provider for database "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
+				FinishedTask(storage, task.Id, task.Retries, "Unable to move bucket "+task.ResourceId+" across providers as it failed multiple times ("+task.Result+")", "failed")
 				continue
 			}
 			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
 			if err != nil {
 				glog.Infof("Failed to get provider instance for task: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot get Instance: " + err.Error(), "pending")
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
 				continue
 			}
 			var taskMetaData ChangeProvidersTaskMetadata
 			err = json.Unmarshal([]byte(task.Metadata), &taskMetaData)
 			if err != nil {
 				glog.Infof("Cannot unmarshal task metadata to change providers: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to change providers: "+err.Error(), "pending")
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to change providers: "+err.Error(), "failed")
 				continue
 			}
-			output, err := UpgradeAcrossProviders(storage, Instance, taskMetaData.Plan, namePrefix)
-			if err != nil {
+			// a move that has started is finished, stopping part way would leave the objects split across both buckets.
+			if taskMetaData.Source == nil && failIfFrozen(storage, task, Instance) {
+				continue
+			}
+			output, err := UpgradeAcrossProviders(storage, Instance, task.Id, &taskMetaData, namePrefix)
+			if err != nil && err.Error() == "Provider change not allowed" {
+				FinishedTask(storage, task.Id, task.Retries, "The bucket cannot be moved from the "+string(Instance.Plan.Provider)+" provider to the plan "+taskMetaData.Plan+".", "failed")
+				continue
+			} else if err != nil {
 				glog.Infof("Cannot switch providers: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot switch providers: "+err.Error(), "pending")
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot switch providers: "+err.Error(), "pending")
 				continue
 			}
 
 			FinishedTask(storage, task.Id, task.Retries, output, "finished")
-		}
-		// TODO: create binding NotifyCreateBindingWebhookTask
-
-		glog.Infof("Finished task: %s\n", task.Id)
-	}
-	return nil
+		} else if task.Action == PurgeTask {
+			glog.Infof("Purging contents of bucket for task: %s\n", task.Id)
+			if task.Retries >= 10 {
+				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+				FinishedTask(storage, task.Id, task.Retries, "Unable to purge bucket "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
+				continue
+			}
+			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
+				continue
+			}
+			if failIfFrozen(storage, task, Instance) {
+				continue
+			}
+			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
+				continue
+			}
+			if err = provider.Purge(Instance); err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to purge: "+err.Error(), "pending")
+				continue
+			}
+			FinishedTask(storage, task.Id, task.Retries, "", "finished")
+		} else if task.Action == BackupTask {
+			glog.Infof("Backing up bucket for task: %s\n", task.Id)
+			var taskMetaData BackupTaskMetadata
+			err = json.Unmarshal([]byte(task.Metadata), &taskMetaData)
+			if err != nil {
+				glog.Infof("Cannot unmarshal task metadata to backup: %s, %s\n", task.Id, err.Error())
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to backup: "+err.Error(), "failed")
+				continue
+			}
+			if task.Retries >= 10 {
+				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+				if err = storage.FinishBackup(taskMetaData.Backup, "failed", 0, 0); err != nil {
+					glog.Errorf("Unable to record the backup %s as failed: %s\n", taskMetaData.Backup, err.Error())
+				}
+				FinishedTask(storage, task.Id, task.Retries, "Unable to backup bucket "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
+				continue
+			}
+			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
+				continue
+			}
+			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
+				continue
+			}
+			// backups scheduled before the catalog existed are added to it.
+			if err = storage.AddBackup(&Backup{Id: taskMetaData.Backup, InstanceId: Instance.Id, Name: Instance.Name, Kind: BackupOnDemand, Status: "pending"}); err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to record the backup: "+err.Error(), "pending")
+				continue
+			}
+			backup, err := provider.Backup(Instance, taskMetaData.Backup)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to backup: "+err.Error(), "pending")
+				continue
+			}
+			if err = storage.FinishBackup(backup.Id, "available", backup.Objects, backup.Bytes); err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to record the backup: "+err.Error(), "pending")
+				continue
+			}
+			if err = storage.AddEvent(Instance.Id, "backup-finished", "The backup " + taskMetaData.Backup + " was created.", task.Metadata); err != nil {
+				glog.Errorf("Error: Unable to record backup %s for instance %s: %s\n", taskMetaData.Backup, Instance.Name, err.Error())
+			}
+			FinishedTask(storage, task.Id, task.Retries, taskMetaData.Backup, "finished")
+		} else if task.Action == PerformPostClaimTask {
+			glog.Infof("Performing post claim for task: %s\n", task.Id)
+			if task.Retries >= 10 {
+				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+				FinishedTask(storage, task.Id, task.Retries, "Unable to perform post claim for bucket "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
+				continue
+			}
+			var taskMetaData PerformPostClaimTaskMetadata
+			err = json.Unmarshal([]byte(task.Metadata), &taskMetaData)
+			if err != nil {
+				glog.Infof("Cannot unmarshal task metadata to perform post claim: %s, %s\n", task.Id, err.Error())
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to perform post claim: "+err.Error(), "failed")
+				continue
+			}
+			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
+				continue
+			}
+			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
+				continue
+			}
+			newInstance, err := provider.PerformPostClaim(Instance, taskMetaData.Owner)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to perform post claim: "+err.Error(), "pending")
+				continue
+			}
+			if err = storage.UpdateInstance(newInstance, newInstance.Plan.ID); err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to update instance: "+err.Error(), "pending")
+				continue
+			}
+			FinishedTask(storage, task.Id, task.Retries, "", "finished")
+		} else if task.Action == ResumeProvisionTask {
+			glog.Infof("Resuming provisioning for task: %s\n", task.Id)
+			var progress ProvisionProgress
+			if err = json.Unmarshal([]byte(task.Metadata), &progress); err != nil {
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to resume provisioning: "+err.Error(), "failed")
+				continue
+			}
+			// A provision that can't be finished is rolled back rather than left half created, the
+			// limit is checked first so a missing instance, plan or provider can't retry it forever.
+			if task.Retries >= 10 {
+				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+				result := "Unable to provision bucket " + task.ResourceId + " as it failed multiple times (" + task.Result + ")"
+				entry, err := storage.GetInstance(task.ResourceId)
+				if err != nil {
+					result = result + ", the partially provisioned bucket could not be removed as its instance could not be found: " + err.Error()
+				} else if plan, err := storage.GetPlanByID(entry.PlanId); err != nil {
+					result = result + ", the partially provisioned bucket could not be removed as its plan could not be found: " + err.Error()
+				} else if provider, err := GetProviderByPlan(namePrefix, plan); err != nil {
+					result = result + ", the partially provisioned bucket could not be removed as its provider could not be found: " + err.Error()
+				} else if err = RollbackProvision(provider, plan, &progress); err != nil {
+					result = result + ", the partially provisioned bucket could not be removed: " + err.Error()
+				} else {
+					result = result + ", the partially provisioned bucket was removed"
+				}
+				if entry != nil && progress.Owner == "preprovisioned" {
+					FailedPreprovision(storage, *entry, result)
+				} else if err = storage.FailProvision(task.ResourceId, result); err != nil {
+					glog.Errorf("Unable to record the failed provision of %s: %s\n", task.ResourceId, err.Error())
+				}
+				FinishedTask(storage, task.Id, task.Retries, result, "failed")
+				continue
+			}
+			entry, err := storage.GetInstance(task.ResourceId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
+				continue
+			}
+			plan, err := storage.GetPlanByID(entry.PlanId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get plan: "+err.Error(), "pending")
+				continue
+			}
+			provider, err := GetProviderByPlan(namePrefix, plan)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
+				continue
+			}
+			if progress.AccessKeyId != "" && progress.AccessKeyId == entry.Username {
+				progress.SecretAccessKey = entry.Password
+			}
+			Instance, err := provider.ResumeProvision(task.ResourceId, plan, &progress)
+			// a key created by this attempt is recorded with the instance before the progress, if it
+			// can't be the progress isn't kept either and the key step is repeated with a new key.
+			if progress.AccessKeyId != "" && progress.AccessKeyId != entry.Username {
+				user := &User{AccessKeyId: progress.AccessKeyId, SecretAccessKey: progress.SecretAccessKey}
+				if uerr := storage.UpdateCredentials(progress.instance(task.ResourceId, plan), user); uerr != nil {
+					UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to record the access key: "+uerr.Error(), "pending")
+					continue
+				}
+			}
+			// the progress is kept even if the step failed, the next attempt starts where this one stopped.
+			if byteData, merr := json.Marshal(progress); merr == nil {
+				metadata := string(byteData)
+				if uerr := storage.UpdateTask(task.Id, nil, nil, &metadata, nil, nil, nil); uerr != nil {
+					glog.Errorf("Unable to record the provisioning progress of task %s: %s\n", task.Id, uerr.Error())
+				}
+			}
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed at the "+progress.Step+" step: "+err.Error(), "pending")
+				continue
+			}
+			if err = storage.UpdateInstance(Instance, plan.ID); err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to update instance: "+err.Error(), "pending")
+				continue
+			}
+			RecordPolicyVersion(storage, provider, Instance, "provisioned")
+			if IsAvailable(Instance.Status) {
+				if err = storage.ProvisionAvailable(Instance.Id); err != nil {
+					glog.Errorf("Unable to record that %s is available: %s\n", Instance.Id, err.Error())
+				}
+			}
+			FinishedTask(storage, task.Id, task.Retries, "", "finished")
+		} else if task.Action == UpdateSettingsTask {
+			glog.Infof("Updating settings for task: %s\n", task.Id)
+			if task.Retries >= 10 {
+				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+				FinishedTask(storage, task.Id, task.Retries, "Unable to update settings for bucket "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
+				continue
+			}
+			var settings InstanceSettings
+			err = json.Unmarshal([]byte(task.Metadata), &settings)
+			if err != nil {
+				glog.Infof("Cannot unmarshal task metadata to update settings: %s, %s\n", task.Id, err.Error())
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to update settings: "+err.Error(), "failed")
+				continue
+			}
+			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
+				continue
+			}
+			if failIfFrozen(storage, task, Instance) {
+				continue
+			}
+			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
+				continue
+			}
+			if err = provider.UpdateInstanceSettings(Instance, &settings); err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to update settings: "+err.Error(), "pending")
+				continue
+			}
+			if settings.DeletionProtection != nil {
+				if err = storage.SetDeletionProtection(Instance.Id, *settings.DeletionProtection); err != nil {
+					UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to set deletion protection: "+err.Error(), "pending")
+					continue
+				}
+			}
+			if err = storage.AddEvent(Instance.Id, "settings-changed", "The settings were changed.", task.Metadata); err != nil {
+				glog.Errorf("Error: Unable to record settings change for instance %s: %s\n", Instance.Name, err.Error())
+			}
+			FinishedTask(storage, task.Id, task.Retries, "", "finished")
+		} else if task.Action == RestoreDbTask {
+			glog.Infof("Restoring bucket for task: %s\n", task.Id)
+			if task.Retries >= 10 {
+				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+				FinishedTask(storage, task.Id, task.Retries, "Unable to restore bucket "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
+				continue
+			}
+			var taskMetaData RestoreDbTaskMetadata
+			err = json.Unmarshal([]byte(task.Metadata), &taskMetaData)
+			if err != nil {
+				glog.Infof("Cannot unmarshal task metadata to restore: %s, %s\n", task.Id, err.Error())
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to restore: "+err.Error(), "failed")
+				continue
+			}
+			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
+				continue
+			}
+			if failIfFrozen(storage, task, Instance) {
+				continue
+			}
+			// New instances restored from another's backup wait until their bucket is created.
+			if taskMetaData.SourceName != "" && !IsAvailable(Instance.Status) {
+				waitForBucket(storage, task.Id, task.Retries, Instance)
+				continue
+			}
+			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
+				continue
+			}
+			if !taskMetaData.Started {
+				description := "The backup " + taskMetaData.Backup + " is being restored."
+				if taskMetaData.SourceName != "" {
+					description = "The backup " + taskMetaData.Backup + " of " + taskMetaData.SourceName + " is being restored."
+				}
+				if err = storage.AddEvent(Instance.Id, "restore-started", description, task.Metadata); err != nil {
+					glog.Errorf("Error: Unable to record restore of %s for instance %s: %s\n", taskMetaData.Backup, Instance.Name, err.Error())
+				}
+				taskMetaData.Started = true
+				if byteData, err := json.Marshal(taskMetaData); err == nil {
+					metadata := string(byteData)
+					if err = storage.UpdateTask(task.Id, nil, nil, &metadata, nil, nil, nil); err != nil {
+						glog.Errorf("Unable to record the start of the restore of task %s: %s\n", task.Id, err.Error())
+					}
+				}
+			}
+			if err = provider.Restore(Instance, taskMetaData.Backup, taskMetaData.SourceName); err != nil && err.Error() == "Backup not found" {
+				FinishedTask(storage, task.Id, task.Retries, "The backup "+taskMetaData.Backup+" was not found.", "failed")
+				continue
+			} else if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to restore: "+err.Error(), "pending")
+				continue
+			}
+			// The restored objects are compared with the backup, the verification is kept in the task's
+			// metadata. Copying is repeatable so a restore that's incomplete is run again.
+			verification, err := provider.VerifyRestore(Instance, taskMetaData.Backup, taskMetaData.SourceName)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to verify the restore: "+err.Error(), "pending")
+				continue
+			}
+			taskMetaData.Verification = verification
+			if byteData, err := json.Marshal(taskMetaData); err == nil {
+				metadata := string(byteData)
+				if err = storage.UpdateTask(task.Id, nil, nil, &metadata, nil, nil, nil); err != nil {
+					glog.Errorf("Unable to record the restore verification of task %s: %s\n", task.Id, err.Error())
+				}
+			}
+			if !verification.Verified && (verification.Missing > 0 || verification.Mismatched > 0) {
+				glog.Errorf("The restore of %s to %s is incomplete: %s\n", taskMetaData.Backup, Instance.Name, verification.Reason)
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "The restore is incomplete: "+verification.Reason, "pending")
+				continue
+			}
+			result := taskMetaData.Backup + " (verified " + strconv.FormatInt(verification.Objects, 10) + " objects, checksum " + verification.SourceChecksum + ")"
+			if !verification.Verified {
+				result = taskMetaData.Backup + " (not verified: " + verification.Reason + ")"
+			} else if err = storage.AddEvent(Instance.Id, "restore-verified", "The restore of "+taskMetaData.Backup+" was verified, "+strconv.FormatInt(verification.Objects, 10)+" objects match the backup.", ""); err != nil {
+				glog.Errorf("Error: Unable to record the restore verification of %s for instance %s: %s\n", taskMetaData.Backup, Instance.Name, err.Error())
+			}
+			FinishedTask(storage, task.Id, task.Retries, result, "finished")
+		} else if task.Action == RotateCredentialsTask {
+			glog.Infof("Rotating credentials for task: %s\n", task.Id)
+			if task.Retries >= 3 {
+				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+				FinishedTask(storage, task.Id, task.Retries, "Unable to rotate the credentials of "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
+				continue
+			}
+			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
+				continue
+			}
+			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
+				continue
+			}
+			user, err := RotateInstanceCredentials(storage, provider, Instance, "broker", task.RequestId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to rotate credentials: "+err.Error(), "pending")
+				continue
+			}
+			FinishedTask(storage, task.Id, task.Retries, user.AccessKeyId, "finished")
+		} else if task.Action == TransferOwnershipTask {
+			glog.Infof("Transferring the ownership of objects for task: %s\n", task.Id)
+			if task.Retries >= 3 {
+				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+				FinishedTask(storage, task.Id, task.Retries, "Unable to transfer the ownership of the objects in "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
+				continue
+			}
+			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
+				continue
+			}
+			if failIfFrozen(storage, task, Instance) {
+				continue
+			}
+			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
+				continue
+			}
+			job, err := provider.TransferOwnership(Instance)
+			if err != nil && err.Error() == "Batch operations are not configured" {
+				FinishedTask(storage, task.Id, task.Retries, "S3_BATCH_BUCKET and S3_BATCH_ROLE_ARN must be set to transfer the ownership of objects", "failed")
+				continue
+			} else if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to start the ownership transfer: "+err.Error(), "pending")
+				continue
+			}
+			if err = storage.AddEvent(Instance.Id, "ownership-transfer-started", "The ownership of "+strconv.FormatInt(job.Objects, 10)+" objects is being transferred by job "+job.JobId+".", ""); err != nil {
+				glog.Errorf("Error: Unable to record the ownership transfer of %s: %s\n", Instance.Name, err.Error())
+			}
+			FinishedTask(storage, task.Id, task.Retries, job.JobId, "finished")
+		} else if task.Action == CreateFoldersTask {
+			glog.Infof("Creating folders for task: %s\n", task.Id)
+			if task.Retries >= 60 {
+				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+				FinishedTask(storage, task.Id, task.Retries, "Unable to create the folders in "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
+				continue
+			}
+			var folders CreateFoldersTaskMetadata
+			if err = json.Unmarshal([]byte(task.Metadata), &folders); err != nil {
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to create folders: "+err.Error(), "failed")
+				continue
+			}
+			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
+				continue
+			}
+			if !IsAvailable(Instance.Status) {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "The bucket is not available yet ("+Instance.Status+")", "pending")
+				continue
+			}
+			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
+				continue
+			}
+			if err = provider.CreateFolders(Instance, folders.Folders); err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to create folders: "+err.Error(), "pending")
+				continue
+			}
+			FinishedTask(storage, task.Id, task.Retries, "Created "+strconv.Itoa(len(folders.Folders))+" folders", "finished")
+		} else if task.Action == SeedTask {
+			glog.Infof("Seeding the bucket for task: %s\n", task.Id)
+			if task.Retries >= 10 {
+				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+				FinishedTask(storage, task.Id, task.Retries, "Unable to seed "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
+				continue
+			}
+			var seed SeedTaskMetadata
+			if err = json.Unmarshal([]byte(task.Metadata), &seed); err != nil {
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to seed: "+err.Error(), "failed")
+				continue
+			}
+			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
+				continue
+			}
+			if failIfFrozen(storage, task, Instance) {
+				continue
+			}
+			if !IsAvailable(Instance.Status) {
+				waitForBucket(storage, task.Id, task.Retries, Instance)
+				continue
+			}
+			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
+				continue
+			}
+			// Large sources are copied over several passes, the progress is kept in the task's metadata.
+			progress, err := provider.Seed(Instance, seed.Source, seed.StartAfter, 5000)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to seed from "+seed.Source+": "+err.Error(), "pending")
+				continue
+			}
+			seed.StartAfter = progress.StartAfter
+			seed.Objects = seed.Objects + progress.Objects
+			seed.Bytes = seed.Bytes + progress.Bytes
+			result := "Copied " + strconv.FormatInt(seed.Objects, 10) + " objects (" + strconv.FormatInt(seed.Bytes, 10) + " bytes) from " + seed.Source
+			if progress.Done {
+				if err = storage.AddEvent(Instance.Id, "seeded", result+".", ""); err != nil {
+					glog.Errorf("Unable to record the seed of %s: %s\n", Instance.Name, err.Error())
+				}
+				FinishedTask(storage, task.Id, task.Retries, result, "finished")
+				continue
+			}
+			metadata, err := json.Marshal(seed)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot marshal task metadata: "+err.Error(), "pending")
+				continue
+			}
+			status := "pending"
+			metadataString := string(metadata)
+			result = result + " so far"
+			if err = storage.UpdateTask(task.Id, &status, &task.Retries, &metadataString, &result, nil, nil); err != nil {
+				glog.Errorf("Unable to update task %s due to: %s\n", task.Id, err.Error())
+			}
+		} else if task.Action == LegalHoldTask {
+			glog.Infof("Setting the legal hold of objects for task: %s\n", task.Id)
+			if task.Retries >= 3 {
+				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+				FinishedTask(storage, task.Id, task.Retries, "Unable to set the legal hold of the objects in "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
+				continue
+			}
+			var hold LegalHoldTaskMetadata
+			if err = json.Unmarshal([]byte(task.Metadata), &hold); err != nil {
+				FinishedTask(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to set the legal hold: "+err.Error(), "failed")
+				continue
+			}
+			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
+				continue
+			}
+			if failIfFrozen(storage, task, Instance) {
+				continue
+			}
+			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+			if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
+				continue
+			}
+			job, err := provider.SetLegalHold(Instance, hold.Prefix, hold.On)
+			if err != nil && err.Error() == "Batch operations are not configured" {
+				FinishedTask(storage, task.Id, task.Retries, "S3_BATCH_BUCKET and S3_BATCH_ROLE_ARN must be set to set legal holds", "failed")
+				continue
+			} else if err != nil {
+				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to start the legal hold job: "+err.Error(), "pending")
+				continue
+			}
+			event := "legal-hold-placed"
+			description := "A legal hold is being placed on " + strconv.FormatInt(job.Objects, 10) + " objects under '" + hold.Prefix + "' by job " + job.JobId + "."
+			if !hold.On {
+				event = "legal-hold-removed"
+				description = "The legal hold is being removed from " + strconv.FormatInt(job.Objects, 10) + " objects under '" + hold.Prefix + "' by job " + job.JobId + "."
+			}
+			if err = storage.AddEvent(Instance.Id, event, description, task.Metadata); err != nil {
+				glog.Errorf("Error: Unable to record the legal hold of %s: %s\n", Instance.Name, err.Error())
+			}
+			FinishedTask(storage, task.Id, task.Retries, job.JobId, "finished")
+		}
+		// TODO: create binding NotifyCreateBindingWebhookTask
+
+		glog.Infof("Finished task: %s\n", task.Id)
+	}
 }
 
 func RunBackgroundTasks(ctx context.Context, o Options) error {
@@ -452,5 +1605,9 @@ func RunBackgroundTasks(ctx context.Context, o Options) error {
 	}
 
 	go TickTocPreprovisionTasks(ctx, o, namePrefix, storage)
+	go TickTocMeteringTasks(ctx, namePrefix, storage)
+	go TickTocAccessKeyAudit(ctx, namePrefix, storage)
+	go TickTocExpirations(ctx, namePrefix, storage)
+	go TickTocIdleInstanceDetection(ctx, namePrefix, storage)
 	return RunWorkerTasks(ctx, o, namePrefix, storage)
 }
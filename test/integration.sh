@@ -0,0 +1,99 @@
+#!/bin/sh
+#
+# Provisions, binds, rotates the credentials of and deprovisions a bucket against a running broker.
+# This is intended to be run against a broker configured with AWS_ENDPOINT (and generally
+# AWS_S3_FORCE_PATH_STYLE=true) pointing at LocalStack or MinIO, see the Testing section of the
+# README. Requires curl and jq.
+#
+#   BROKER_URL - The url of the broker, defaults to http://localhost:8443
+#   PLAN_ID    - The plan to provision, defaults to the first plan in the catalog
+#   TIMEOUT    - How many seconds to wait for a provision or deprovision to finish, defaults to 300
+#
+set -e
+
+BROKER_URL=${BROKER_URL:-http://localhost:8443}
+TIMEOUT=${TIMEOUT:-300}
+INSTANCE_ID=$(cat /proc/sys/kernel/random/uuid 2>/dev/null || uuidgen | tr 'A-Z' 'a-z')
+BINDING_ID=$(cat /proc/sys/kernel/random/uuid 2>/dev/null || uuidgen | tr 'A-Z' 'a-z')
+ORGANIZATION_ID="integration-test"
+
+fail() {
+	echo "FAIL: $1"
+	exit 1
+}
+
+request() {
+	# request <method> <path> [body], prints the body and fails on anything but a 2xx status.
+	OUTPUT=$(mktemp)
+	STATUS=$(curl -s -o "$OUTPUT" -w '%{http_code}' -X "$1" -H 'X-Broker-API-Version: 2.13' -H 'Content-Type: application/json' ${3:+-d "$3"} "$BROKER_URL$2")
+	BODY=$(cat "$OUTPUT")
+	rm -f "$OUTPUT"
+	case $STATUS in
+		2*) echo "$BODY" ;;
+		*) fail "$1 $2 returned $STATUS: $BODY" ;;
+	esac
+}
+
+status() {
+	# status <path>, prints the http status of a GET.
+	curl -s -o /dev/null -w '%{http_code}' -H 'X-Broker-API-Version: 2.13' "$BROKER_URL$1"
+}
+
+wait_for_last_operation() {
+	# wait_for_last_operation <operation>, polls the last operation of the instance until it has
+	# succeeded, a deprovision has also finished once the instance is gone (410 or 404).
+	WAITED=0
+	while [ "$WAITED" -lt "$TIMEOUT" ]; do
+		OUTPUT=$(mktemp)
+		STATUS=$(curl -s -o "$OUTPUT" -w '%{http_code}' -H 'X-Broker-API-Version: 2.13' "$BROKER_URL/v2/service_instances/$INSTANCE_ID/last_operation?service_id=$SERVICE_ID&plan_id=$PLAN_ID")
+		BODY=$(cat "$OUTPUT")
+		rm -f "$OUTPUT"
+		case $STATUS in
+			2*) ;;
+			404|410) [ "$1" = "deprovision" ] && return 0 || fail "the last operation of $INSTANCE_ID returned $STATUS: $BODY" ;;
+			*) fail "the last operation of $INSTANCE_ID returned $STATUS: $BODY" ;;
+		esac
+		case $(echo "$BODY" | jq -r '.state') in
+			succeeded) return 0 ;;
+			failed) fail "the $1 of $INSTANCE_ID failed: $BODY" ;;
+		esac
+		sleep 5
+		WAITED=$((WAITED + 5))
+	done
+	fail "the $1 of $INSTANCE_ID did not finish within $TIMEOUT seconds"
+}
+
+CATALOG=$(request GET /v2/catalog)
+SERVICE_ID=$(echo "$CATALOG" | jq -r '.services[0].id')
+PLAN_ID=${PLAN_ID:-$(echo "$CATALOG" | jq -r '.services[0].plans[0].id')}
+[ "$SERVICE_ID" != "null" ] || fail "the catalog did not contain any services"
+[ "$PLAN_ID" != "null" ] || fail "the catalog did not contain any plans"
+echo "ok - catalog (service $SERVICE_ID, plan $PLAN_ID)"
+
+request PUT "/v2/service_instances/$INSTANCE_ID?accepts_incomplete=true" \
+	"{\"service_id\":\"$SERVICE_ID\",\"plan_id\":\"$PLAN_ID\",\"organization_guid\":\"$ORGANIZATION_ID\",\"space_guid\":\"$ORGANIZATION_ID\"}" > /dev/null
+wait_for_last_operation provision
+echo "ok - provision $INSTANCE_ID"
+
+BINDING=$(request PUT "/v2/service_instances/$INSTANCE_ID/service_bindings/$BINDING_ID" \
+	"{\"service_id\":\"$SERVICE_ID\",\"plan_id\":\"$PLAN_ID\"}")
+BUCKET=$(echo "$BINDING" | jq -r '.credentials.S3_BUCKET')
+ACCESS_KEY=$(echo "$BINDING" | jq -r '.credentials.S3_ACCESS_KEY')
+[ "$BUCKET" != "null" ] && [ "$BUCKET" != "" ] || fail "the binding did not contain S3_BUCKET: $BINDING"
+echo "ok - bind (bucket $BUCKET)"
+
+ROTATED=$(request PUT "/v2/service_instances/$INSTANCE_ID/actions/credentials")
+[ "$(echo "$ROTATED" | jq -r '.AccessKeyId')" != "$ACCESS_KEY" ] || fail "the access key was not rotated: $ROTATED"
+echo "ok - rotate credentials"
+
+request DELETE "/v2/service_instances/$INSTANCE_ID/service_bindings/$BINDING_ID?service_id=$SERVICE_ID&plan_id=$PLAN_ID" > /dev/null
+echo "ok - unbind"
+
+request DELETE "/v2/service_instances/$INSTANCE_ID?service_id=$SERVICE_ID&plan_id=$PLAN_ID&accepts_incomplete=true" > /dev/null
+wait_for_last_operation deprovision
+echo "ok - deprovision"
+
+case $(status "/v2/service_instances/$INSTANCE_ID") in
+	404|410) echo "ok - cleanup" ;;
+	*) fail "the instance $INSTANCE_ID still exists after it was deprovisioned" ;;
+esac